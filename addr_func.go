@@ -0,0 +1,106 @@
+package main
+
+/*
+本文件包含了服务器地址相关的函数：地址解析、连接服务器时选择能连上的地址
+*/
+
+/*
+地址格式：
+服务器地址统一使用host:port格式，host可以是IPv4、IPv6（需要加方括号，如“[2001:db8::1]:2333”）或主机名。
+每个服务器有一个主地址作为标识（成员表、数据库KeyServer里用的都是它），还可以用-addrs参数声明其它地址，
+比如同时有IPv4和IPv6地址，或者有一个主机名。连接服务器时依次尝试这些地址，记住能连上的那个，下次优先使用。
+*/
+
+import (
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+var dial_cache=map[string]string{} //服务器标识 -> 上次能连上的地址
+var dial_cache_lock sync.Mutex
+
+/*
+规范化地址：检查格式，主机名转小写，IPv6地址加方括号
+*/
+func normalizeAddr(addr string)(string,error){
+    host,port,err:=net.SplitHostPort(strings.TrimSpace(addr))
+    if err!=nil {return "",err}
+    if host=="" {
+        return "",errors.New("地址缺少主机："+addr)
+    }
+    port_num,err:=strconv.Atoi(port)
+    if err!=nil || port_num<=0 || port_num>65535 {
+        return "",errors.New("端口号不正确："+addr)
+    }
+    if ip:=net.ParseIP(host);ip!=nil {
+        host=ip.String()
+    }else{
+        host=strings.ToLower(host)
+    }
+    return net.JoinHostPort(host,port),nil
+}
+
+/*
+解析逗号分隔的地址列表
+*/
+func parseAddrList(list string)([]string,error){
+    var addrs []string
+    for _,addr:=range strings.Split(list,",") {
+        if strings.TrimSpace(addr)=="" {continue}
+        addr,err:=normalizeAddr(addr)
+        if err!=nil {return nil,err}
+        if !containsString(addrs,addr) {addrs=append(addrs,addr)}
+    }
+    return addrs,nil
+}
+
+/*
+取得连接的对方主机（不含端口）
+*/
+func remoteHost(conn net.Conn)string{
+    host,_,err:=net.SplitHostPort(conn.RemoteAddr().String())
+    if err!=nil {return conn.RemoteAddr().String()}
+    return host
+}
+
+/*
+服务器的所有地址：上次能连上的地址优先，然后是主地址，然后是成员表中声明的其它地址
+*/
+func serverAddrs(server string)[]string{
+    addrs:=[]string{}
+    dial_cache_lock.Lock()
+    if addr,exist:=dial_cache[server];exist {addrs=append(addrs,addr)}
+    dial_cache_lock.Unlock()
+    if !containsString(addrs,server) {addrs=append(addrs,server)}
+    global_members_lock.Lock()
+    if m,exist:=global_members[server];exist {
+        for _,addr:=range m.Addrs {
+            if !containsString(addrs,addr) {addrs=append(addrs,addr)}
+        }
+    }
+    global_members_lock.Unlock()
+    return addrs
+}
+
+/*
+连接服务器，依次尝试服务器的所有地址
+*/
+func dialServer(server string, timeout time.Duration)(net.Conn,error){
+    var last_err error
+    for _,addr:=range serverAddrs(server) {
+        conn, err := net.DialTimeout("tcp", addr, timeout)
+        if err!=nil {
+            last_err=err
+            continue
+        }
+        dial_cache_lock.Lock()
+        dial_cache[server]=addr
+        dial_cache_lock.Unlock()
+        return conn,nil
+    }
+    return nil,last_err
+}
@@ -0,0 +1,503 @@
+/*
+client包是分布式存储系统的客户端库，其它Go程序可以直接导入使用，例如：
+
+    c, err := client.New(client.Options{Servers: []string{"192.168.1.1:2333"}, User: "yumi"})
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    err = c.Put(ctx, "1.7z", f)
+
+和dss主程序的客户端使用相同的协议和数据库格式。Client没有全局状态，多个Client可以同时使用，
+一个Client也可以在多个goroutine中同时使用；所有方法都接受context，取消或超时后正在进行的网络操作会立即中断。
+出错时返回error，不会退出进程。
+*/
+package client
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "math/rand"
+    "crypto/sha1"
+    "database/sql"
+    "encoding/hex"
+    "unicode/utf8"
+)
+
+const DEFAULT_TIMEOUT=time.Millisecond*300 //连接服务器的超时时间
+const DEFAULT_REPLICAS=2 //每个文件块的副本数量
+const DEFAULT_PARALLEL=2 //同时下载的文件块数量
+const BLOCK_SIZE=1024*1024*32 //默认的文件分块大小，单位Byte，没有记录分块大小的文件都是这个大小
+const MIN_BLOCK_SIZE=1024*64 //文件分块大小的范围
+const MAX_BLOCK_SIZE=1024*1024*256
+const MAX_NAME_LENGTH=255 //用户名和文件名的最大长度（字节）
+
+var ErrNotFound=errors.New("文件或用户不存在")
+var ErrNoServer=errors.New("没有可用的服务器")
+var ErrSync=errors.New("数据库更新失败")
+
+type Options struct {//Client的参数
+    Servers []string //种子服务器地址（host:port），至少一个
+    User string //用户名，上传、删除、列出文件都针对这个用户
+    Dir string //存放数据库的文件夹，为空时使用临时文件夹，Close时删除
+    Timeout time.Duration //连接服务器的超时时间，默认DEFAULT_TIMEOUT
+    SyncTimeout time.Duration //发送数据后等待服务器确认的时间，默认BROADCAST_TIMEOUT
+    Replicas int //每个文件块的副本数量，默认DEFAULT_REPLICAS
+    Parallel int //同时下载的文件块数量，默认DEFAULT_PARALLEL
+    BlockSize int64 //上传时的文件分块大小，默认BLOCK_SIZE，每个文件记录自己的分块大小，修改后已有的文件不受影响
+    AdminKey string //管理员密钥，设置配额（SetQuota）时使用
+    Logger *slog.Logger //日志输出，为nil时不输出
+    Progress func(p Progress) //传输进度回调，每传输完一个文件块调用一次，为空时不调用
+}
+
+type Chunk struct {//文件块
+    Key string //sha1
+    Servers []string //存放的服务器
+    reused bool //数据库中已有这个文件块，没有重新上传
+}
+
+type FileInfo struct {//文件信息
+    User string
+    Name string
+    Size int64 //文件大小，旧版本上传的文件没有记录，为-1
+    ModTime time.Time //文件修改时间，旧版本上传的文件没有记录，为零值
+    BlockSize int64 //文件分块大小，为0时是BLOCK_SIZE
+    Chunks []Chunk
+}
+
+type Progress struct {//传输进度
+    Op string //upload或download
+    Name string //文件名
+    Chunk int //文件块序号
+    Key string
+    Servers []string
+    Done int //已完成的文件块数量
+    Total int //文件块总数，上传时不知道文件大小则为0
+    Err error //这个文件块传输失败的原因
+    RequestID string //这次传输的请求ID，和服务器日志中的request_id对应
+}
+
+type Client struct {
+    opts Options
+    dir string //存放数据库的文件夹
+    temp_dir bool //dir是否为临时文件夹
+    locker *Locker //集群锁
+    members []Member //成员表
+    dial_cache map[string]string //服务器标识 -> 上次能连上的地址
+    members_lock sync.Mutex
+    db_lock sync.Mutex //本地数据库文件的锁
+    stats map[string]*serverStat //服务器测量数据
+    stats_lock sync.Mutex
+}
+
+/*
+新建Client，不会连接服务器，第一次使用时才获取成员表
+*/
+func New(opts Options)(*Client,error){
+    if len(opts.Servers)==0 {return nil,errors.New("至少需要一个服务器地址")}
+    if err:=ValidUser(opts.User);err!=nil {return nil,err}
+    if opts.Timeout<=0 {opts.Timeout=DEFAULT_TIMEOUT}
+    if opts.SyncTimeout<=0 {opts.SyncTimeout=BROADCAST_TIMEOUT}
+    if opts.Replicas<=0 {opts.Replicas=DEFAULT_REPLICAS}
+    if opts.Parallel<=0 {opts.Parallel=DEFAULT_PARALLEL}
+    if opts.BlockSize<=0 {opts.BlockSize=BLOCK_SIZE}
+    if opts.BlockSize<MIN_BLOCK_SIZE || opts.BlockSize>MAX_BLOCK_SIZE {
+        return nil,fmt.Errorf("文件分块大小必须在%d和%d之间",MIN_BLOCK_SIZE,MAX_BLOCK_SIZE)
+    }
+    c:=&Client{opts:opts,dir:opts.Dir,dial_cache:map[string]string{},stats:map[string]*serverStat{}}
+    if c.dir=="" {
+        dir,err:=os.MkdirTemp("","dss-client-")
+        if err!=nil {return nil,err}
+        c.dir=dir
+        c.temp_dir=true
+    }else if err:=os.MkdirAll(c.dir,0755);err!=nil {
+        return nil,err
+    }
+    hostname,_:=os.Hostname()
+    c.locker=&Locker{
+        Owner:fmt.Sprintf("%s-%d-%08x",hostname,os.Getpid(),rand.Uint32()),
+        Members:c.memberList,
+        Request:c.request,
+        Logger:c.logger,
+        Timeout:c.opts.Timeout*10,
+    }
+    return c,nil
+}
+
+/*
+关闭Client，删除临时文件夹
+*/
+func (c *Client) Close()error{
+    if c.temp_dir {return os.RemoveAll(c.dir)}
+    return nil
+}
+
+/*
+当前用户名
+*/
+func (c *Client) User()string{
+    return c.opts.User
+}
+
+/*
+报告传输进度
+*/
+func (c *Client) progress(p Progress){
+    if c.opts.Progress!=nil {c.opts.Progress(p)}
+}
+
+/*
+更新成员表和数据库
+*/
+func (c *Client) Refresh(ctx context.Context)error{
+    err:=c.fetchMembers(ctx)
+    if err!=nil {return err}
+    return c.fetchDatabase(ctx)
+}
+
+/*
+集群成员
+*/
+func (c *Client) Members(ctx context.Context)([]Member,error){
+    err:=c.fetchMembers(ctx)
+    if err!=nil {return nil,err}
+    return c.memberList(ctx)
+}
+
+/*
+上传文件，修改时间记为当前时间
+*/
+func (c *Client) Put(ctx context.Context, name string, r io.Reader)error{
+    return c.PutWithModTime(ctx,name,r,time.Now())
+}
+
+/*
+上传文件并记录修改时间，同名文件会被替换：
+读取一个文件块就选择服务器上传一个，全部上传完成后持有集群锁写入数据库并同步
+*/
+func (c *Client) PutWithModTime(ctx context.Context, name string, r io.Reader, mtime time.Time)error{
+    ctx=ensureRequestID(ctx)//上传文件块和写入数据库使用同一个请求ID
+    info,err:=c.Upload(ctx,name,r,mtime)
+    if err!=nil {return err}
+    return c.Commit(ctx,[]FileInfo{info},nil)
+}
+
+/*
+只上传文件块，不写入数据库，返回的文件信息要用Commit写入后别人才能看到。
+上传很多文件时，可以全部Upload完再一次Commit，只需要同步一次数据库。
+本地数据库（List、Stat时获取）中已有的文件块不会重新上传。
+用户有配额时，每个文件块上传前按服务器的配额和本地数据库的用量检查，超出时返回ErrQuota
+*/
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, mtime time.Time)(FileInfo,error){
+    ctx=ensureRequestID(ctx)
+    info:=FileInfo{User:c.opts.User,Name:name,ModTime:mtime}
+    if err:=ValidName(name);err!=nil {return info,err}
+    members,err:=c.memberList(ctx)
+    if err!=nil {return info,err}
+    total:=0
+    if f,ok:=r.(interface{Stat()(os.FileInfo,error)});ok {
+        if stat,err:=f.Stat();err==nil && stat.Mode().IsRegular() {
+            total=int(stat.Size()/c.opts.BlockSize)+1
+        }
+    }
+    quota,err:=c.startQuotaCheck(ctx,name)
+    if err!=nil {return info,err}
+    info.BlockSize=c.opts.BlockSize
+    buf:=make([]byte,info.BlockSize)
+    for{
+        n,err:=io.ReadFull(r,buf)
+        if err==io.EOF && len(info.Chunks)>0 {break}
+        if err!=nil && err!=io.EOF && err!=io.ErrUnexpectedEOF {return info,err}
+        sum:=sha1.Sum(buf[:n])
+        key:=hex.EncodeToString(sum[:])
+        if err:=quota.add(key,int64(n));err!=nil {return info,err}
+        chunk:=Chunk{Key:key,Servers:c.chunkServers(key),reused:true}
+        if len(chunk.Servers)==0 {
+            chunk,err=c.uploadChunk(ctx,members,key,buf[:n])
+            if err!=nil {return info,err}
+        }
+        c.progress(Progress{Op:"upload",Name:name,Chunk:len(info.Chunks),Key:chunk.Key,Servers:chunk.Servers,Done:len(info.Chunks)+1,Total:total,RequestID:RequestID(ctx)})
+        info.Chunks=append(info.Chunks,chunk)
+        info.Size+=int64(n)
+        if n<len(buf) {break}
+    }
+    return info,nil
+}
+
+/*
+把Upload返回的文件信息写入数据库（同名文件会被替换），并删除removed中的文件，
+只持有一次集群锁、同步一次数据库。removed中的文件不存在时返回ErrNotFound，用量增加且超出配额时返回ErrQuota。
+同步成功后通知服务器删除不再被任何文件引用的文件块
+*/
+func (c *Client) Commit(ctx context.Context, files []FileInfo, removed []string)error{
+    if len(files)==0 && len(removed)==0 {return nil}
+    ctx=ensureRequestID(ctx)
+    key_servers:=map[string][]string{} //可以删除的文件块及其所在的服务器
+    var quota Quota
+    if len(files)>0 {
+        var err error
+        quota,err=c.fetchQuota(ctx)
+        if err!=nil {return err}
+    }
+    err:=c.updateDatabase(ctx,func(tx *sql.Tx)error{
+        before,err:=usageInTx(tx,c.opts.User,quota)
+        if err!=nil {return err}
+        var old_keys []string
+        for _,name:=range removed {
+            if err:=ValidName(name);err!=nil {return err}
+            keys,err:=removeFile(tx,name)
+            if err!=nil {return err}
+            if len(keys)==0 {return fmt.Errorf("%w：%s",ErrNotFound,name)}
+            old_keys=append(old_keys,keys...)
+        }
+        for _,file:=range files {
+            if err:=ValidName(file.Name);err!=nil {return err}
+            keys,err:=removeFile(tx,file.Name)
+            if err!=nil {return err}
+            old_keys=append(old_keys,keys...)
+            for _,chunk:=range file.Chunks {//没有重新上传的文件块，可能在上传期间被别人删除了
+                if !chunk.reused {continue}
+                servers,err:=keyServers(tx,chunk.Key)
+                if err!=nil {return err}
+                if len(servers)==0 {return fmt.Errorf("文件块已被删除，请重新上传：%s",file.Name)}
+            }
+            err=insertFile(tx,file)
+            if err!=nil {return err}
+        }
+        //找出不再被引用的文件块
+        for _,key:=range old_keys {
+            if _,exist:=key_servers[key];exist {continue}
+            in_use,err:=keyInUse(tx,key)
+            if err!=nil {return err}
+            if in_use {continue}//同一个用户的其它文件也有这个文件块
+            servers,err:=keyServers(tx,key)
+            if err!=nil {return err}
+            key_servers[key]=servers
+            _,err=tx.Exec(`DELETE FROM KeyServer WHERE key=$1`,key)
+            if err!=nil {return err}
+        }
+        return checkQuotaInTx(tx,c.opts.User,quota,before)
+    })
+    if err!=nil {return err}
+    for key,servers:=range key_servers {
+        if c.keyUsedByOthers(key) {continue}//其它用户上传了相同的文件块
+        for _,server:=range servers {
+            err:=c.deleteChunk(ctx,server,key)
+            if err!=nil {c.logger(ctx).Warn("通知服务器删除文件块失败","server",server,"key",key,"err",err)}
+        }
+    }
+    return nil
+}
+
+/*
+下载文件，按文件中的位置写入w，多个文件块并行下载
+*/
+func (c *Client) Get(ctx context.Context, name string, w io.WriterAt)error{
+    ctx=ensureRequestID(ctx)
+    info,err:=c.Stat(ctx,name)
+    if err!=nil {return err}
+    return c.Download(ctx,info,w)
+}
+
+/*
+按List或Stat返回的文件信息下载文件，不会重新获取数据库，下载很多文件时比Get快
+*/
+func (c *Client) Download(ctx context.Context, info FileInfo, w io.WriterAt)error{
+    return c.DownloadMissing(ctx,info,w,nil)
+}
+
+/*
+和Download一样，但have(i,key)返回true的文件块不下载（调用者已经写入了w，比如从本地旧版本的文件中复制），
+同步文件夹时没有变化的文件块不需要重新传输
+*/
+func (c *Client) DownloadMissing(ctx context.Context, info FileInfo, w io.WriterAt, have func(i int, key string)bool)error{
+    ctx,cancel:=context.WithCancel(ensureRequestID(ctx))
+    defer cancel()
+    var wg sync.WaitGroup
+    var first_err error
+    var err_lock sync.Mutex
+    var done int
+    slots:=make(chan struct{},c.opts.Parallel)
+    for i,chunk:=range info.Chunks {
+        if have!=nil && have(i,chunk.Key) {
+            err_lock.Lock()
+            done++
+            err_lock.Unlock()
+            continue
+        }
+        select{
+            case slots<-struct{}{}:
+            case <-ctx.Done():
+        }
+        if ctx.Err()!=nil {break}
+        wg.Add(1)
+        go func(i int, chunk Chunk){
+            defer wg.Done()
+            defer func(){<-slots}()
+            datas,err:=c.downloadChunk(ctx,chunk)
+            if err==nil {
+                _,err=w.WriteAt(datas,int64(i)*info.ChunkBytes())
+            }
+            err_lock.Lock()
+            if err==nil {done++}
+            p:=Progress{Op:"download",Name:info.Name,Chunk:i,Key:chunk.Key,Servers:chunk.Servers,Done:done,Total:len(info.Chunks),Err:err,RequestID:RequestID(ctx)}
+            if err!=nil && first_err==nil {
+                first_err=fmt.Errorf("第%d个文件块下载失败：%w",i,err)
+                cancel()
+            }
+            err_lock.Unlock()
+            c.progress(p)
+        }(i,chunk)
+    }
+    wg.Wait()
+    if first_err==nil && ctx.Err()!=nil {first_err=ctx.Err()}
+    return first_err
+}
+
+/*
+下载单个文件块（已经校验过sha1），按需读取文件的一部分时使用，比如挂载成文件系统后的随机读取
+*/
+func (c *Client) ReadChunk(ctx context.Context, chunk Chunk)([]byte,error){
+    ctx=ensureRequestID(ctx)
+    return c.downloadChunk(ctx,chunk)
+}
+
+/*
+按分块大小block_size计算文件块的key（不上传），可以和FileInfo.Chunks比较，判断本地文件和服务器上的文件是否相同，
+block_size要和服务器上的文件相同（FileInfo.ChunkBytes）
+*/
+func ChunkKeys(r io.Reader, block_size int64)([]string,error){
+    var keys []string
+    if block_size<=0 {block_size=BLOCK_SIZE}
+    buf:=make([]byte,block_size)
+    for{
+        n,err:=io.ReadFull(r,buf)
+        if err==io.EOF && len(keys)>0 {break}
+        if err!=nil && err!=io.EOF && err!=io.ErrUnexpectedEOF {return nil,err}
+        sum:=sha1.Sum(buf[:n])
+        keys=append(keys,hex.EncodeToString(sum[:]))
+        if n<len(buf) {break}
+    }
+    return keys,nil
+}
+
+/*
+文件分块大小，没有记录时（旧版本上传的文件）为BLOCK_SIZE
+*/
+func (info FileInfo) ChunkBytes()int64{
+    if info.BlockSize<=0 {return BLOCK_SIZE}
+    return info.BlockSize
+}
+
+/*
+判断文件块是否和keys相同
+*/
+func (info FileInfo) SameChunks(keys []string)bool{
+    if len(info.Chunks)!=len(keys) {return false}
+    for i,chunk:=range info.Chunks {
+        if chunk.Key!=keys[i] {return false}
+    }
+    return true
+}
+
+/*
+列出本用户的所有文件（先获取最新的数据库）
+*/
+func (c *Client) List(ctx context.Context)([]FileInfo,error){
+    err:=c.Refresh(ctx)
+    if err!=nil {return nil,err}
+    files,err:=c.queryFiles(c.opts.User,"")
+    if err==ErrNotFound {return nil,nil}//还没有上传过文件
+    return files,err
+}
+
+/*
+查询文件信息（先获取最新的数据库）
+*/
+func (c *Client) Stat(ctx context.Context, name string)(FileInfo,error){
+    err:=c.Refresh(ctx)
+    if err!=nil {return FileInfo{},err}
+    files,err:=c.queryFiles(c.opts.User,name)
+    if err!=nil {return FileInfo{},err}
+    if len(files)==0 {return FileInfo{},ErrNotFound}
+    return files[0],nil
+}
+
+/*
+删除文件：持有集群锁从数据库中删除并同步，然后通知存放文件块的服务器删除不再被任何文件引用的文件块
+*/
+func (c *Client) Delete(ctx context.Context, name string)error{
+    return c.Commit(ctx,nil,[]string{name})
+}
+
+/*
+检查文件块是否被其它用户的文件引用（使用本地的数据库，updateDatabase时刚获取过）
+*/
+func (c *Client) keyUsedByOthers(key string)bool{
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    entries,err:=os.ReadDir(c.dir)
+    if err!=nil {return true}//不确定时不删除
+    for _,entry:=range entries {
+        name:=entry.Name()
+        if !strings.HasSuffix(name,".db") || name==c.opts.User+".db" {continue}
+        db,err:=sql.Open(DB_TYPE,c.dbPath(name[:len(name)-3]))
+        if err!=nil {return true}
+        var num int
+        err=db.QueryRow(`SELECT count(*) FROM FileKey WHERE key=$1`,key).Scan(&num)
+        db.Close()
+        if err!=nil || num>0 {return true}
+    }
+    return false
+}
+
+/*
+检查用户名：不能为空、不能包含路径分隔符和控制字符，必须是合法的UTF-8
+*/
+func ValidUser(user string)error{
+    if user=="" || user=="." || user==".." || strings.HasPrefix(user,".") {return errors.New("用户名不正确："+user)}
+    if strings.ContainsAny(user,`/\`) {return errors.New("用户名不能包含路径分隔符："+user)}
+    return validText(user)
+}
+
+/*
+检查文件名：不能为空、不能包含控制字符，必须是合法的UTF-8，可以包含空格和路径分隔符
+*/
+func ValidName(name string)error{
+    if name=="" {return errors.New("文件名不能为空")}
+    return validText(name)
+}
+
+/*
+检查字符串是合法的UTF-8，没有控制字符，长度不超过MAX_NAME_LENGTH
+*/
+func validText(s string)error{
+    if len(s)>MAX_NAME_LENGTH {return errors.New("名字太长："+s)}
+    if !utf8.ValidString(s) {return errors.New("名字不是合法的UTF-8")}
+    for _,r:=range s {
+        if r<0x20 || r==0x7f {return fmt.Errorf("名字包含控制字符：%q",s)}
+    }
+    return nil
+}
+
+/*
+给错误加上ErrSync，调用者可以用errors.Is判断
+*/
+func syncError(err error)error{
+    return fmt.Errorf("%w：%v",ErrSync,err)
+}
+
+/*
+Unix时间戳转换为时间，0为零值
+*/
+func unixTime(t int64)time.Time{
+    if t==0 {return time.Time{}}
+    return time.Unix(t,0)
+}
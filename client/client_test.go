@@ -0,0 +1,66 @@
+package client
+
+/*
+文件分块大小的测试：按分块大小计算key、Client的分块大小参数
+*/
+
+import (
+    "bytes"
+    "testing"
+    "crypto/sha1"
+    "encoding/hex"
+)
+
+func TestChunkKeys(t *testing.T){
+    data:=make([]byte,3*MIN_BLOCK_SIZE+10)
+    for i:=range data {data[i]=byte(i*7)}
+    key:=func(b []byte)string{
+        sum:=sha1.Sum(b)
+        return hex.EncodeToString(sum[:])
+    }
+    tests:=[]struct{
+        name string
+        data []byte
+        block_size int64
+        expect []string
+    }{
+        {"最后一块不满",data,MIN_BLOCK_SIZE,[]string{key(data[:MIN_BLOCK_SIZE]),key(data[MIN_BLOCK_SIZE:2*MIN_BLOCK_SIZE]),key(data[2*MIN_BLOCK_SIZE:3*MIN_BLOCK_SIZE]),key(data[3*MIN_BLOCK_SIZE:])}},
+        {"刚好整块",data[:2*MIN_BLOCK_SIZE],MIN_BLOCK_SIZE,[]string{key(data[:MIN_BLOCK_SIZE]),key(data[MIN_BLOCK_SIZE:2*MIN_BLOCK_SIZE])}},//和Upload一样，不会多出一个空的文件块
+        {"默认分块大小",data,0,[]string{key(data)}},
+        {"空文件",nil,MIN_BLOCK_SIZE,[]string{key(nil)}},
+    }
+    for _,test:=range tests {
+        keys,err:=ChunkKeys(bytes.NewReader(test.data),test.block_size)
+        if err!=nil {t.Fatal(err)}
+        info:=FileInfo{}
+        for _,k:=range test.expect {info.Chunks=append(info.Chunks,Chunk{Key:k})}
+        if !info.SameChunks(keys) {t.Errorf("%s：计算出%d个key，期望%d个",test.name,len(keys),len(test.expect))}
+    }
+}
+
+func TestBlockSizeOption(t *testing.T){
+    tests:=[]struct{
+        block_size int64
+        expect int64 //0表示应该出错
+    }{
+        {0,BLOCK_SIZE},
+        {MIN_BLOCK_SIZE,MIN_BLOCK_SIZE},
+        {8<<20,8<<20},
+        {MIN_BLOCK_SIZE-1,0},
+        {MAX_BLOCK_SIZE+1,0},
+    }
+    for _,test:=range tests {
+        c,err:=New(Options{Servers:[]string{"127.0.0.1:1"},User:"yumi",BlockSize:test.block_size})
+        if test.expect==0 {
+            if err==nil {
+                c.Close()
+                t.Errorf("%d：应该出错",test.block_size)
+            }
+            continue
+        }
+        if err!=nil {t.Fatal(err)}
+        if c.opts.BlockSize!=test.expect {t.Errorf("%d：分块大小为%d",test.block_size,c.opts.BlockSize)}
+        c.Close()
+    }
+    if (FileInfo{}).ChunkBytes()!=BLOCK_SIZE {t.Error("没有记录分块大小的文件应该是BLOCK_SIZE")}
+}
@@ -0,0 +1,329 @@
+package client
+
+/*
+本文件包含了集群锁相关的函数，客户端和服务器（迁移文件块时修改用户数据库）共用这一份实现：
+向负责这个锁的服务器申请租约，超过半数同意才算得到锁，token取所有回复的最大值，再用续约告诉同意的服务器。
+持有锁期间定期续约，同步数据库时带上token，服务器会拒绝token过期的数据库。
+服务器不会把没有过期的租约再发给同一个持有者，所以每次申请使用不同的持有者标识；
+同一个进程中的申请者（比如网关的多个请求、服务器的下线和重新平衡）先按锁的名字在本进程内排队，再向服务器申请。
+*/
+
+import (
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "log/slog"
+    "math/rand"
+    "encoding/json"
+    "encoding/binary"
+)
+
+const LOCK_TTL=time.Second*30 //租约有效期
+const LOCK_WAIT=time.Second*60 //申请锁的最长等待时间（context没有期限时）
+
+type Lease struct {//租约，服务器回复的格式
+    Name string //锁的名字
+    Owner string //持有者
+    Token uint64 //fencing token
+    Expire time.Time //过期时间
+}
+
+type LockRequest struct {//LOCK_ACQUIRE、LOCK_RENEW、LOCK_RELEASE的请求
+    Name string
+    Owner string
+    Token uint64 //续约时为申请者确定的最终token
+    TTL time.Duration
+}
+
+/*
+集群锁的申请者：客户端用Client的连接和成员表，服务器用自己的连接和成员表
+*/
+type Locker struct {
+    Owner string //持有者标识的前缀，每次申请加上随机的后缀
+    Members func(ctx context.Context)([]Member,error) //成员表
+    Request func(ctx context.Context, server string, instruct byte, datas []byte)([]byte,error) //发送请求，返回ACK后的数据，ERR时返回错误
+    Logger func(ctx context.Context)*slog.Logger
+    Timeout time.Duration //释放锁时每个服务器的超时时间
+}
+
+type ClusterLock struct {//持有的集群锁
+    Name string
+    Token uint64
+    owner string //这次申请的持有者标识
+    candidates []string //负责这个锁的服务器
+    servers []string //同意了租约的服务器
+    quorum int //续约成功需要的服务器数量（负责这个锁的服务器的半数以上）
+    stop chan struct{}
+    lost bool //续约失败，锁可能已经被别人拿走
+    request_id string //申请锁时的请求ID，续约和释放也使用这个ID
+    lock sync.Mutex
+}
+
+var local_locks=map[string]chan struct{}{} //锁的名字 -> 本进程内的锁（容量为1的channel，可以随context取消等待）
+var local_locks_lock sync.Mutex
+
+/*
+本进程内按锁的名字排队，context取消时返回错误
+*/
+func lockLocal(ctx context.Context, name string)error{
+    local_locks_lock.Lock()
+    ch,exist:=local_locks[name]
+    if !exist {
+        ch=make(chan struct{},1)
+        local_locks[name]=ch
+    }
+    local_locks_lock.Unlock()
+    select{
+        case ch<-struct{}{}:
+            return nil
+        case <-ctx.Done():
+            return ctx.Err()
+    }
+}
+
+func unlockLocal(name string){
+    local_locks_lock.Lock()
+    ch:=local_locks[name]
+    local_locks_lock.Unlock()
+    <-ch
+}
+
+/*
+用户数据库的锁的名字
+*/
+func UserLockName(user string)string{
+    return "db/"+user
+}
+
+/*
+向服务器发送锁相关的请求
+*/
+func (l *Locker) send(ctx context.Context, server string, instruct byte, request LockRequest)(Lease,error){
+    var lease Lease
+    datas,_:=json.Marshal(request)
+    datas,err:=l.Request(ctx,server,instruct,datas)
+    if err!=nil {return lease,err}
+    err=json.Unmarshal(datas,&lease)
+    return lease,err
+}
+
+/*
+尝试申请一次集群锁，超过半数的服务器同意才算成功，否则释放已经拿到的租约
+*/
+func (l *Locker) try(ctx context.Context, name string)(*ClusterLock,error){
+    members,err:=l.Members(ctx)
+    if err!=nil {return nil,err}
+    servers:=LockServers(name,members)
+    if len(servers)==0 {return nil,ErrNoServer}
+    owner:=l.Owner+"-"+randomHex(4)
+    request:=LockRequest{Name:name,Owner:owner,TTL:LOCK_TTL}
+    type result struct {
+        server string
+        lease Lease
+        err error
+    }
+    results:=make(chan result,len(servers))
+    for _,server:=range servers {
+        go func(server string){
+            lease,err:=l.send(ctx,server,LOCK_ACQUIRE,request)
+            results<-result{server,lease,err}
+        }(server)
+    }
+    lock:=&ClusterLock{Name:name,owner:owner,candidates:servers,quorum:len(servers)/2+1,request_id:RequestID(ctx)}
+    var last_err error
+    for range servers {
+        r:=<-results
+        if r.err!=nil {
+            last_err=r.err
+            continue
+        }
+        if r.lease.Token>lock.Token {lock.Token=r.lease.Token}
+        if r.lease.Owner!=owner {
+            last_err=errors.New("锁已被"+r.lease.Owner+"持有")
+            continue
+        }
+        lock.servers=append(lock.servers,r.server)
+    }
+    if len(lock.servers)<lock.quorum {
+        l.release(lock)
+        if last_err==nil {last_err=errors.New("同意的服务器不足半数")}
+        return nil,last_err
+    }
+    //把最终的token告诉所有同意的服务器
+    if !l.renew(ctx,lock) {
+        l.release(lock)
+        return nil,errors.New("确认token失败")
+    }
+    return lock,nil
+}
+
+/*
+申请集群锁，锁被别人持有时等待，直到context取消或超过LOCK_WAIT
+*/
+func (l *Locker) Acquire(ctx context.Context, name string)(*ClusterLock,error){
+    if _,ok:=ctx.Deadline();!ok {
+        var cancel context.CancelFunc
+        ctx,cancel=context.WithTimeout(ctx,LOCK_WAIT)
+        defer cancel()
+    }
+    if err:=lockLocal(ctx,name);err!=nil {
+        return nil,errors.New("申请集群锁失败："+err.Error())
+    }
+    for{
+        lock,err:=l.try(ctx,name)
+        if err==nil {
+            l.Logger(ctx).Debug("得到集群锁","lock",name,"token",lock.Token)
+            lock.stop=make(chan struct{})
+            go l.keepAlive(lock)
+            return lock,nil
+        }
+        l.Logger(ctx).Info("集群锁申请失败，稍后重试","lock",name,"err",err)
+        select{
+            case <-ctx.Done():
+                unlockLocal(name)
+                return nil,errors.New("申请集群锁失败："+err.Error())
+            case <-time.After(time.Millisecond*time.Duration(200+rand.Intn(800))):
+        }
+    }
+}
+
+/*
+续约，超过半数的服务器同意才算成功
+*/
+func (l *Locker) renew(ctx context.Context, lock *ClusterLock)bool{
+    request:=LockRequest{Name:lock.Name,Owner:lock.owner,Token:lock.Token,TTL:LOCK_TTL}
+    renewed:=0
+    for _,server:=range lock.servers {
+        _,err:=l.send(ctx,server,LOCK_RENEW,request)
+        if err!=nil {
+            l.Logger(ctx).Debug("续约失败","lock",lock.Name,"server",server,"err",err)
+            continue
+        }
+        renewed++
+    }
+    return renewed>=lock.quorum
+}
+
+/*
+定期续约，直到释放锁
+*/
+func (l *Locker) keepAlive(lock *ClusterLock){
+    ticker:=time.NewTicker(LOCK_TTL/3)
+    defer ticker.Stop()
+    for{
+        select{
+            case <-lock.stop:
+                return
+            case <-ticker.C:
+                ctx,cancel:=context.WithTimeout(WithRequestID(context.Background(),lock.request_id),LOCK_TTL/3)
+                ok:=l.renew(ctx,lock)
+                cancel()
+                if !ok {
+                    l.Logger(ctx).Warn("集群锁续约失败，锁可能已经失效","lock",lock.Name)
+                    lock.lock.Lock()
+                    lock.lost=true
+                    lock.lock.Unlock()
+                }
+        }
+    }
+}
+
+/*
+锁是否可能已经失效
+*/
+func (lock *ClusterLock) Lost()bool{
+    lock.lock.Lock()
+    defer lock.lock.Unlock()
+    return lock.lost
+}
+
+/*
+负责这个锁的服务器，获取和同步数据库时以它们为准
+*/
+func (lock *ClusterLock) Servers()[]string{
+    return lock.candidates
+}
+
+/*
+servers中是否有超过半数负责这个锁的服务器
+*/
+func (lock *ClusterLock) Quorum(servers []string)bool{
+    num:=0
+    for _,server:=range servers {
+        for _,candidate:=range lock.candidates {
+            if server==candidate {
+                num++
+                break
+            }
+        }
+    }
+    return num>=lock.quorum
+}
+
+/*
+读取这个锁保护的数据的最新版本：向负责这个锁的服务器发送请求，服务器回复8字节token+内容。
+超过半数的服务器回复后取token最大的一份，token相同时取有内容的。
+修改后要有超过半数负责这个锁的服务器接收（见Quorum），两个半数至少有一个共同的服务器，所以一定能拿到上一个持有者的修改
+*/
+func (l *Locker) FetchLatest(ctx context.Context, lock *ClusterLock, instruct byte, datas []byte)(uint64,[]byte,error){
+    type result struct {
+        server string
+        datas []byte
+        err error
+    }
+    servers:=lock.Servers()
+    results:=make(chan result,len(servers))
+    for _,server:=range servers {
+        go func(server string){
+            datas,err:=l.Request(ctx,server,instruct,datas)
+            if err==nil && len(datas)<8 {err=errors.New("回复格式不正确")}
+            results<-result{server,datas,err}
+        }(server)
+    }
+    var token uint64
+    var content []byte
+    var replied []string
+    var last_err error
+    for range servers {
+        r:=<-results
+        if r.err!=nil {
+            l.Logger(ctx).Debug("读取失败","lock",lock.Name,"server",r.server,"err",r.err)
+            last_err=r.err
+            continue
+        }
+        replied=append(replied,r.server)
+        t:=binary.BigEndian.Uint64(r.datas)
+        if t>token || (t==token && len(content)==0) {
+            token,content=t,r.datas[8:]
+        }
+    }
+    if !lock.Quorum(replied) {
+        if last_err==nil {last_err=errors.New("回复的服务器不足半数")}
+        return 0,nil,last_err
+    }
+    return token,content,nil
+}
+
+/*
+向同意了租约的服务器释放锁（不使用调用者的context，取消后也要释放）
+*/
+func (l *Locker) release(lock *ClusterLock){
+    ctx,cancel:=context.WithTimeout(WithRequestID(context.Background(),lock.request_id),l.Timeout)
+    defer cancel()
+    request:=LockRequest{Name:lock.Name,Owner:lock.owner,Token:lock.Token}
+    for _,server:=range lock.servers {
+        _,err:=l.send(ctx,server,LOCK_RELEASE,request)
+        if err!=nil {l.Logger(ctx).Debug("释放集群锁失败","lock",lock.Name,"server",server,"err",err)}
+    }
+}
+
+/*
+释放集群锁
+*/
+func (l *Locker) Release(lock *ClusterLock){
+    close(lock.stop)
+    l.release(lock)
+    unlockLocal(lock.Name)
+    l.Logger(context.Background()).Debug("释放集群锁","lock",lock.Name)
+}
@@ -0,0 +1,215 @@
+package client
+
+/*
+本文件包含了成员表和文件块放置相关的函数，服务器（placement_func.go、lock_func.go）也使用这里的放置算法，
+保证客户端和服务器选出的服务器相同
+*/
+
+import (
+    "math"
+    "sort"
+    "context"
+    "crypto/sha1"
+    "encoding/json"
+    "encoding/binary"
+)
+
+const ( //成员状态
+    MEMBER_ALIVE uint8 = 0
+    MEMBER_SUSPECT uint8 = 1
+    MEMBER_DEAD uint8 = 2
+    MEMBER_LEFT uint8 = 3
+)
+
+const DEFAULT_CAPACITY=100 //服务器没有声明容量时的默认容量，单位GB
+const LOCK_SERVER_NUM=3 //负责一个锁的服务器数量
+
+type Member struct {//集群成员，和服务器的成员表格式相同
+    Addr string //服务器地址（标识）
+    Addrs []string //服务器的其它地址
+    State uint8 //成员状态
+    Incarnation uint64 //化身号
+    Draining bool //正在下线，不再接收新的文件块
+    Zone string //故障域
+    Capacity float64 //容量（GB）
+}
+
+/*
+从服务器获取成员表，依次尝试已知的成员和种子服务器
+*/
+func (c *Client) fetchMembers(ctx context.Context)error{
+    var last_err error=ErrNoServer
+    for _,server:=range c.knownServers() {
+        datas,err:=c.requestMembers(ctx,server)
+        if err!=nil {
+            last_err=err
+            continue
+        }
+        var members []Member
+        err=json.Unmarshal(datas,&members)
+        if err!=nil {
+            last_err=err
+            continue
+        }
+        c.members_lock.Lock()
+        c.members=members
+        c.members_lock.Unlock()
+        return nil
+    }
+    return last_err
+}
+
+/*
+GET_MEMBERS没有请求数据，回复直接是成员表
+*/
+func (c *Client) requestMembers(ctx context.Context, server string)([]byte,error){
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return nil,err}
+    defer conn.Close()
+    setReadDeadline(ctx,conn,c.opts.Timeout*10)
+    err=writeAll(conn,[]byte{GET_MEMBERS})
+    if err!=nil {return nil,err}
+    return readData(conn)
+}
+
+/*
+已知的服务器：成员表中存活和可疑的成员，然后是种子服务器
+*/
+func (c *Client) knownServers()[]string{
+    c.members_lock.Lock()
+    defer c.members_lock.Unlock()
+    var servers []string
+    for _,m:=range c.members {
+        if m.State==MEMBER_ALIVE || m.State==MEMBER_SUSPECT {servers=append(servers,m.Addr)}
+    }
+    for _,server:=range c.opts.Servers {
+        if !containsString(servers,server) {servers=append(servers,server)}
+    }
+    return servers
+}
+
+/*
+成员表的副本，成员表为空时先获取
+*/
+func (c *Client) memberList(ctx context.Context)([]Member,error){
+    c.members_lock.Lock()
+    members:=append([]Member{},c.members...)
+    c.members_lock.Unlock()
+    if len(members)>0 {return members,nil}
+    err:=c.fetchMembers(ctx)
+    if err!=nil {return nil,err}
+    c.members_lock.Lock()
+    defer c.members_lock.Unlock()
+    return append([]Member{},c.members...),nil
+}
+
+/*
+服务器的所有地址：上次能连上的地址优先，然后是主地址，然后是成员表中声明的其它地址
+*/
+func (c *Client) serverAddrs(server string)[]string{
+    c.members_lock.Lock()
+    defer c.members_lock.Unlock()
+    var addrs []string
+    if addr,exist:=c.dial_cache[server];exist {addrs=append(addrs,addr)}
+    if !containsString(addrs,server) {addrs=append(addrs,server)}
+    for _,m:=range c.members {
+        if m.Addr!=server {continue}
+        for _,addr:=range m.Addrs {
+            if !containsString(addrs,addr) {addrs=append(addrs,addr)}
+        }
+    }
+    return addrs
+}
+
+/*
+服务器的权重，即容量
+*/
+func MemberWeight(m Member)float64{
+    if m.Capacity<=0 {return DEFAULT_CAPACITY}
+    return m.Capacity
+}
+
+/*
+服务器的故障域，没有声明的服务器各自算一个
+*/
+func MemberZone(m Member)string{
+    if m.Zone=="" {return "@"+m.Addr}
+    return m.Zone
+}
+
+/*
+带权重的rendezvous哈希得分，越高越优先
+*/
+func PlacementScore(key string, m Member)float64{
+    h:=sha1.Sum([]byte(key+"/"+m.Addr))
+    u:=(float64(binary.BigEndian.Uint64(h[:8])>>11)+0.5)/float64(uint64(1)<<53)//0到1之间，不含0和1
+    return -MemberWeight(m)/math.Log(u)
+}
+
+/*
+按得分从高到低排列可以存放文件块的服务器
+*/
+func RankPlacement(key string, members []Member)[]Member{
+    var ranked []Member
+    for _,m:=range members {
+        if m.Draining || m.State==MEMBER_DEAD || m.State==MEMBER_LEFT {continue}
+        ranked=append(ranked,m)
+    }
+    score:=map[string]float64{}
+    for _,m:=range ranked {score[m.Addr]=PlacementScore(key,m)}
+    sort.Slice(ranked, func(i, j int)bool{
+        if score[ranked[i].Addr]!=score[ranked[j].Addr] {return score[ranked[i].Addr]>score[ranked[j].Addr]}
+        return ranked[i].Addr<ranked[j].Addr
+    })
+    return ranked
+}
+
+/*
+为文件块选择最多n个服务器，不会有两个服务器在同一个故障域。
+used_zones为已经有副本的故障域，usable不为空时用来过滤服务器（比如连不上的）
+*/
+func PlaceChunk(key string, n int, members []Member, used_zones []string, usable func(addr string)bool)[]string{
+    var servers []string
+    zones:=append([]string{},used_zones...)
+    for _,m:=range RankPlacement(key,members) {
+        if len(servers)>=n {break}
+        if containsString(zones,MemberZone(m)) {continue}
+        if usable!=nil && !usable(m.Addr) {continue}
+        servers=append(servers,m.Addr)
+        zones=append(zones,MemberZone(m))
+    }
+    return servers
+}
+
+/*
+负责某个锁的服务器：按rendezvous哈希选出LOCK_SERVER_NUM个存活的成员（下线中的服务器也可以），不按容量加权
+*/
+func LockServers(name string, members []Member)[]string{
+    var alive []Member
+    for _,m:=range members {
+        if m.State==MEMBER_DEAD || m.State==MEMBER_LEFT {continue}
+        alive=append(alive,m)
+    }
+    score:=map[string]float64{}
+    for _,m:=range alive {score[m.Addr]=PlacementScore(name,Member{Addr:m.Addr})}
+    var servers []string
+    for len(servers)<LOCK_SERVER_NUM && len(servers)<len(alive) {
+        best:=""
+        for _,m:=range alive {
+            if containsString(servers,m.Addr) {continue}
+            if best=="" || score[m.Addr]>score[best] || (score[m.Addr]==score[best] && m.Addr<best) {best=m.Addr}
+        }
+        servers=append(servers,best)
+    }
+    return servers
+}
+
+/*
+判断字符串数组是否包含某个字符串
+*/
+func containsString(list []string, s string)bool{
+    for _,item:=range list {
+        if item==s {return true}
+    }
+    return false
+}
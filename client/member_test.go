@@ -0,0 +1,164 @@
+package client
+
+/*
+放置算法的测试：按容量加权的分布、故障域分散、结果确定、锁服务器的选择
+*/
+
+import (
+    "fmt"
+    "math"
+    "testing"
+)
+
+/*
+生成测试用的成员，zones[i]为第i个服务器的故障域（空字符串表示没有声明）
+*/
+func testMembers(capacities []float64, zones []string)[]Member{
+    members:=make([]Member,len(capacities))
+    for i,capacity:=range capacities {
+        members[i]=Member{Addr:fmt.Sprintf("10.0.0.%d:2333",i+1),Capacity:capacity}
+        if i<len(zones) {members[i].Zone=zones[i]}
+    }
+    return members
+}
+
+func TestPlacementWeight(t *testing.T){
+    tests:=[]struct{
+        name string
+        capacities []float64
+    }{
+        {"相同容量",[]float64{100,100,100,100}},
+        {"容量不同",[]float64{100,200,300,400}},
+        {"默认容量",[]float64{0,100,200}},//没有声明容量按DEFAULT_CAPACITY计算
+    }
+    const n=20000
+    for _,test:=range tests {
+        t.Run(test.name, func(t *testing.T){
+            members:=testMembers(test.capacities,nil)
+            counts:=map[string]int{}
+            for i:=0;i<n;i++ {
+                servers:=PlaceChunk(fmt.Sprintf("chunk-%d",i),1,members,nil,nil)
+                if len(servers)!=1 {t.Fatalf("选出了%d个服务器",len(servers))}
+                counts[servers[0]]++
+            }
+            total:=0.0
+            for _,m:=range members {total+=MemberWeight(m)}
+            for _,m:=range members {
+                expect:=n*MemberWeight(m)/total
+                if math.Abs(float64(counts[m.Addr])-expect)>expect*0.1 {
+                    t.Errorf("%s：%d个文件块，期望约%.0f个",m.Addr,counts[m.Addr],expect)
+                }
+            }
+        })
+    }
+}
+
+func TestPlacementZones(t *testing.T){
+    tests:=[]struct{
+        name string
+        zones []string
+        used_zones []string
+        n int
+        expect int //选出的服务器数量
+    }{
+        {"没有声明故障域",nil,nil,3,3},
+        {"两个故障域",[]string{"a","a","a","b","b","b"},nil,3,2},
+        {"三个故障域",[]string{"a","a","b","b","c","c"},nil,3,3},
+        {"已有副本的故障域",[]string{"a","a","b","b","c","c"},[]string{"a"},3,2},
+        {"部分声明",[]string{"a","a"},nil,3,3},//没有声明的服务器各自算一个故障域
+    }
+    for _,test:=range tests {
+        t.Run(test.name, func(t *testing.T){
+            members:=testMembers([]float64{100,100,100,100,100,100},test.zones)
+            zone_of:=map[string]string{}
+            for _,m:=range members {zone_of[m.Addr]=MemberZone(m)}
+            for i:=0;i<1000;i++ {
+                key:=fmt.Sprintf("chunk-%d",i)
+                servers:=PlaceChunk(key,test.n,members,test.used_zones,nil)
+                if len(servers)!=test.expect {t.Fatalf("%s：选出了%d个服务器，期望%d个",key,len(servers),test.expect)}
+                zones:=append([]string{},test.used_zones...)
+                for _,server:=range servers {
+                    if containsString(zones,zone_of[server]) {t.Fatalf("%s：%v中有两个副本在故障域%s",key,servers,zone_of[server])}
+                    zones=append(zones,zone_of[server])
+                }
+            }
+        })
+    }
+}
+
+func TestPlacementStable(t *testing.T){
+    members:=testMembers([]float64{100,200,300,400,500},nil)
+    reversed:=make([]Member,len(members))
+    for i,m:=range members {reversed[len(members)-1-i]=m}
+    added_members:=append(append([]Member{},members...),Member{Addr:"10.0.0.99:2333",Capacity:300})
+    moved:=0
+    for i:=0;i<1000;i++ {
+        key:=fmt.Sprintf("chunk-%d",i)
+        servers:=PlaceChunk(key,3,members,nil,nil)
+        if fmt.Sprint(servers)!=fmt.Sprint(PlaceChunk(key,3,reversed,nil,nil)) {
+            t.Fatalf("%s：成员顺序不同时选出的服务器不同",key)
+        }
+        //加入一个服务器后，原来的服务器之间的先后顺序不变
+        added:=PlaceChunk(key,3,added_members,nil,nil)
+        if added[0]!=servers[0] {moved++}
+        var kept []string
+        for _,server:=range added {
+            if server!="10.0.0.99:2333" {kept=append(kept,server)}
+        }
+        for j,server:=range kept {
+            if server!=servers[j] {t.Fatalf("%s：加入服务器后原来的顺序改变了：%v -> %v",key,servers,added)}
+        }
+    }
+    //只有约 新服务器的容量/总容量（1/6）的文件块的第一个服务器改变
+    if moved<100 || moved>250 {t.Errorf("加入一个服务器后%d个文件块的第一个服务器改变了",moved)}
+}
+
+func TestPlacementSkip(t *testing.T){
+    members:=testMembers([]float64{100,100,100,100},nil)
+    members[0].Draining=true
+    members[1].State=MEMBER_DEAD
+    members[2].State=MEMBER_LEFT
+    for i:=0;i<100;i++ {
+        servers:=PlaceChunk(fmt.Sprintf("chunk-%d",i),3,members,nil,nil)
+        if fmt.Sprint(servers)!="["+members[3].Addr+"]" {t.Fatalf("选出了%v，期望只有%s",servers,members[3].Addr)}
+    }
+    servers:=PlaceChunk("chunk",3,testMembers([]float64{100,100,100},nil),nil, func(addr string)bool{return addr!="10.0.0.1:2333"})
+    if len(servers)!=2 || containsString(servers,"10.0.0.1:2333") {t.Errorf("usable没有过滤服务器：%v",servers)}
+}
+
+func TestLockServers(t *testing.T){
+    members:=testMembers([]float64{100,500,100,100,100},nil)
+    tests:=[]struct{
+        name string
+        members []Member
+        expect int
+    }{
+        {"五个服务器",members,LOCK_SERVER_NUM},
+        {"两个服务器",members[:2],2},
+        {"没有服务器",nil,0},
+    }
+    for _,test:=range tests {
+        t.Run(test.name, func(t *testing.T){
+            for i:=0;i<100;i++ {
+                name:=fmt.Sprintf("user-%d",i)
+                servers:=LockServers(name,test.members)
+                if len(servers)!=test.expect {t.Fatalf("%s：选出了%d个服务器，期望%d个",name,len(servers),test.expect)}
+                seen:=map[string]bool{}
+                for _,server:=range servers {
+                    if seen[server] {t.Fatalf("%s：服务器%s重复",name,server)}
+                    seen[server]=true
+                }
+            }
+        })
+    }
+    //不按容量加权，下线中的服务器也可以，死亡的服务器不行
+    weighted:=testMembers([]float64{100,100,100,100},nil)
+    equal:=testMembers([]float64{1,1,1,1},nil)
+    weighted[0].Draining=true
+    weighted[3].State=MEMBER_DEAD
+    for i:=0;i<100;i++ {
+        name:=fmt.Sprintf("user-%d",i)
+        servers:=LockServers(name,weighted)
+        if fmt.Sprint(servers)!=fmt.Sprint(LockServers(name,equal[:3])) {t.Fatalf("%s：%v",name,servers)}
+    }
+}
@@ -0,0 +1,463 @@
+package client
+
+/*
+本文件包含了用户数据库（文件元数据）相关的函数，数据库格式和服务器一致：
+每个用户一个ql数据库（用户名.db），有KeyServer、FileKey、FileInfo三个表。
+客户端从服务器获取所有数据库（SEND_DB，zip压缩），修改后只上传自己用户的数据库（SYNC_DB）。
+修改前持有集群锁，从负责这个锁的服务器获取本用户最新的数据库（SEND_USER_DB），
+同步时要有超过半数负责这个锁的服务器接收，下一个持有者就一定能拿到这次修改。
+服务器检查同步过来的数据库是否超出配额，拒绝时回复的原因以ErrQuota开头。
+*/
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "bytes"
+    "errors"
+    "strings"
+    "context"
+    "io/ioutil"
+    "archive/zip"
+    "path/filepath"
+    "database/sql"
+    "encoding/binary"
+    _ "modernc.org/ql/driver"
+)
+
+const DB_TYPE="ql2" //数据库类型
+
+/*
+用户数据库的路径
+*/
+func (c *Client) dbPath(user string)string{
+    return filepath.Join(c.dir,user+".db")
+}
+
+/*
+从服务器获取最新的数据库，解压到数据库文件夹
+*/
+func (c *Client) fetchDatabase(ctx context.Context)error{
+    var last_err error=ErrNoServer
+    for _,server:=range c.knownServers() {
+        datas,err:=c.downloadDatabase(ctx,server)
+        if err==nil {err=c.extractDatabase(datas)}
+        if err==nil {return nil}
+        last_err=err
+        if ctx.Err()!=nil {break}
+    }
+    return last_err
+}
+
+/*
+从一个服务器下载所有数据库：发送SEND_DB，服务器返回8字节文件大小+zip
+*/
+func (c *Client) downloadDatabase(ctx context.Context, server string)([]byte,error){
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return nil,err}
+    defer conn.Close()
+    err=writeAll(conn,[]byte{SEND_DB})
+    if err!=nil {return nil,err}
+    setReadDeadline(ctx,conn,c.opts.SyncTimeout)
+    header:=make([]byte,8)
+    _,err=io.ReadFull(conn,header)
+    if err!=nil {return nil,err}
+    size:=binary.BigEndian.Uint64(header)
+    if size>MAX_DATA_SIZE {return nil,errors.New("数据库太大")}
+    datas:=make([]byte,size)
+    _,err=io.ReadFull(conn,datas)
+    return datas,err
+}
+
+/*
+解压数据库到数据库文件夹，只接受“用户名.db”形式的文件名
+*/
+func (c *Client) extractDatabase(datas []byte)error{
+    reader,err:=zip.NewReader(bytes.NewReader(datas),int64(len(datas)))
+    if err!=nil {return err}
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    for _,file:=range reader.File {
+        name:=filepath.Base(file.Name)
+        if filepath.Ext(name)!=".db" || ValidUser(name[:len(name)-3])!=nil {continue}
+        rc,err:=file.Open()
+        if err!=nil {return err}
+        content,err:=ioutil.ReadAll(rc)
+        rc.Close()
+        if err!=nil {return err}
+        //先写临时文件再改名，不会留下写了一半的数据库
+        tmp:=filepath.Join(c.dir,"."+name+".tmp")
+        err=ioutil.WriteFile(tmp,content,0644)
+        if err==nil {err=os.Rename(tmp,filepath.Join(c.dir,name))}
+        if err!=nil {return err}
+    }
+    return nil
+}
+
+/*
+获取用户数据库的最新版本：向负责这个锁的服务器发送SEND_USER_DB（用户名），服务器返回ACK+8字节token+数据库内容。
+content为空表示这些服务器上都没有这个用户的数据库
+*/
+func (l *Locker) FetchDatabase(ctx context.Context, lock *ClusterLock, user string)(uint64,[]byte,error){
+    token,content,err:=l.FetchLatest(ctx,lock,SEND_USER_DB,[]byte(user))
+    if err!=nil {return 0,nil,errors.New("获取数据库失败："+err.Error())}
+    return token,content,nil
+}
+
+/*
+拿到本用户的集群锁之后，用负责这个锁的服务器上最新的数据库替换本地的数据库
+*/
+func (c *Client) fetchUserDatabase(ctx context.Context, lock *ClusterLock)error{
+    _,content,err:=c.locker.FetchDatabase(ctx,lock,c.opts.User)
+    if err!=nil {return err}
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    if len(content)==0 {//还没有数据库，修改时新建
+        err=os.Remove(c.dbPath(c.opts.User))
+        if os.IsNotExist(err) {err=nil}
+        return err
+    }
+    tmp:=filepath.Join(c.dir,"."+c.opts.User+".db.tmp")
+    err=ioutil.WriteFile(tmp,content,0644)
+    if err==nil {err=os.Rename(tmp,c.dbPath(c.opts.User))}
+    return err
+}
+
+/*
+把本用户的数据库带上fencing token同步到所有服务器。
+有服务器拒绝（token过期），或者负责这个锁的服务器接收的不足半数时返回错误
+*/
+func (c *Client) uploadDatabase(ctx context.Context, lock *ClusterLock)error{
+    c.db_lock.Lock()
+    content,err:=ioutil.ReadFile(c.dbPath(c.opts.User))
+    c.db_lock.Unlock()
+    if err!=nil {return err}
+    //压缩，文件名格式和服务器的压缩函数一致（“/用户名.db”）
+    var zip_buf bytes.Buffer
+    w:=zip.NewWriter(&zip_buf)
+    f,err:=w.Create("/"+c.opts.User+".db")
+    if err==nil {_,err=f.Write(content)}
+    if err==nil {err=w.Close()}
+    if err!=nil {return err}
+    var packet bytes.Buffer
+    packet.WriteByte(SYNC_DB)
+    binary.Write(&packet,binary.BigEndian,lock.Token)
+    binary.Write(&packet,binary.BigEndian,uint64(len(c.opts.User)))
+    packet.WriteString(c.opts.User)
+    binary.Write(&packet,binary.BigEndian,uint64(zip_buf.Len()))
+    packet.Write(zip_buf.Bytes())
+    members,err:=c.memberList(ctx)
+    if err!=nil {return err}
+    var acked []string
+    rejected:=0
+    var quota_err error
+    for _,m:=range members {
+        if m.State==MEMBER_DEAD || m.State==MEMBER_LEFT {continue}
+        conn,err:=c.dial(ctx,m.Addr)
+        if err!=nil {
+            c.logger(ctx).Warn("服务器连接失败","server",m.Addr,"err",err)
+            continue
+        }
+        err=writeAll(conn,packet.Bytes())
+        if err==nil {
+            setReadDeadline(ctx,conn,c.opts.SyncTimeout)
+            switch readInstruct(conn) {
+                case ACK:
+                    acked=append(acked,m.Addr)
+                case ERR:
+                    message,_:=readData(conn)
+                    c.logger(ctx).Warn("服务器拒绝了数据库","server",m.Addr,"reason",string(message))
+                    if strings.HasPrefix(string(message),ErrQuota.Error()) {quota_err=fmt.Errorf("%w（服务器%s）",ErrQuota,m.Addr)}
+                    rejected++
+            }
+        }
+        conn.Close()
+    }
+    if quota_err!=nil {return quota_err}
+    if rejected>0 {
+        return errors.New("有服务器拒绝了数据库，集群锁可能已经失效")
+    }
+    if !lock.Quorum(acked) {
+        return errors.New("负责集群锁的服务器接收数据库的不足半数")
+    }
+    return nil
+}
+
+/*
+打开用户数据库，不存在时新建（调用前需持有db_lock）
+*/
+func (c *Client) openDatabase(user string, create bool)(*sql.DB,error){
+    exist:=true
+    if _,err:=os.Stat(c.dbPath(user));err!=nil {exist=false}
+    if !exist && !create {return nil,ErrNotFound}
+    db,err:=sql.Open(DB_TYPE,c.dbPath(user))
+    if err!=nil {return nil,err}
+    if exist {return db,nil}
+    tx,err:=db.Begin()
+    if err==nil {
+        _,err=tx.Exec(`CREATE TABLE KeyServer (
+        key string,
+        server string,
+        );`)
+    }
+    if err==nil {
+        _,err=tx.Exec(`CREATE TABLE FileKey (
+        filename string,
+        num int,
+        key string,
+        );`)
+    }
+    if err==nil {err=tx.Commit()}
+    if err!=nil {
+        db.Close()
+        return nil,err
+    }
+    return db,nil
+}
+
+/*
+新建FileInfo表（如果不存在），旧版本的数据库没有这个表
+*/
+func ensureFileInfoTable(tx *sql.Tx)error{
+    _,err:=tx.Exec(`CREATE TABLE IF NOT EXISTS FileInfo (
+    filename string,
+    size int64,
+    mtime int64,
+    );`)
+    return err
+}
+
+/*
+新建FileBlock表（如果不存在），记录分块大小不是BLOCK_SIZE的文件，
+分块大小是BLOCK_SIZE的文件不记录，旧版本的客户端也能正确读取
+*/
+func ensureFileBlockTable(tx *sql.Tx)error{
+    _,err:=tx.Exec(`CREATE TABLE IF NOT EXISTS FileBlock (
+    filename string,
+    block_size int64,
+    );`)
+    return err
+}
+
+/*
+查询用户的文件列表，name不为空时只查询这个文件
+*/
+func (c *Client) queryFiles(user string, name string)([]FileInfo,error){
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    db,err:=c.openDatabase(user,false)
+    if err!=nil {return nil,err}
+    defer db.Close()
+    return ReadFiles(db,user,name)
+}
+
+type querier interface {//*sql.DB或*sql.Tx
+    Query(query string, args ...interface{})(*sql.Rows,error)
+    QueryRow(query string, args ...interface{})*sql.Row
+}
+
+/*
+从数据库或事务中读取文件列表，name不为空时只读取这个文件（服务器检查同步过来的数据库的配额时也使用）
+*/
+func ReadFiles(db querier, user string, name string)([]FileInfo,error){
+    var files []FileInfo
+    index:=map[string]int{}
+    rows,err:=db.Query(`SELECT filename,num,key FROM FileKey WHERE $1=="" || filename==$1 ORDER BY filename,num`,name)
+    if err!=nil {return nil,err}
+    for rows.Next() {
+        var filename,key string
+        var num int
+        if err=rows.Scan(&filename,&num,&key);err!=nil {
+            rows.Close()
+            return nil,err
+        }
+        i,exist:=index[filename]
+        if !exist {
+            i=len(files)
+            index[filename]=i
+            files=append(files,FileInfo{User:user,Name:filename,Size:-1,BlockSize:BLOCK_SIZE})
+        }
+        files[i].Chunks=append(files[i].Chunks,Chunk{Key:key})
+    }
+    //文件块所在的服务器
+    servers:=map[string][]string{}
+    rows,err=db.Query(`SELECT key,server FROM KeyServer ORDER BY server`)
+    if err!=nil {return nil,err}
+    for rows.Next() {
+        var key,server string
+        if err=rows.Scan(&key,&server);err!=nil {
+            rows.Close()
+            return nil,err
+        }
+        servers[key]=append(servers[key],server)
+    }
+    for i:=range files {
+        for j:=range files[i].Chunks {
+            files[i].Chunks[j].Servers=servers[files[i].Chunks[j].Key]
+        }
+    }
+    //文件大小和修改时间，旧版本的数据库没有FileInfo表
+    rows,err=db.Query(`SELECT filename,size,mtime FROM FileInfo`)
+    if err==nil {
+        for rows.Next() {
+            var filename string
+            var size,mtime int64
+            if err=rows.Scan(&filename,&size,&mtime);err!=nil {
+                rows.Close()
+                break
+            }
+            if i,exist:=index[filename];exist {
+                files[i].Size=size
+                files[i].ModTime=unixTime(mtime)
+            }
+        }
+    }
+    //分块大小，没有FileBlock表或没有记录的文件为BLOCK_SIZE
+    rows,err=db.Query(`SELECT filename,block_size FROM FileBlock`)
+    if err==nil {
+        for rows.Next() {
+            var filename string
+            var block_size int64
+            if err=rows.Scan(&filename,&block_size);err!=nil {
+                rows.Close()
+                break
+            }
+            if i,exist:=index[filename];exist && block_size>0 {files[i].BlockSize=block_size}
+        }
+    }
+    return files,nil
+}
+
+/*
+在事务中删除文件的记录，返回文件原来的文件块
+*/
+func removeFile(tx *sql.Tx, name string)([]string,error){
+    var keys []string
+    rows,err:=tx.Query(`SELECT key FROM FileKey WHERE filename=$1`,name)
+    if err!=nil {return nil,err}
+    for rows.Next() {
+        var key string
+        if err=rows.Scan(&key);err!=nil {
+            rows.Close()
+            return nil,err
+        }
+        keys=append(keys,key)
+    }
+    _,err=tx.Exec(`DELETE FROM FileKey WHERE filename=$1`,name)
+    if err==nil {err=ensureFileInfoTable(tx)}
+    if err==nil {_,err=tx.Exec(`DELETE FROM FileInfo WHERE filename=$1`,name)}
+    if err==nil {err=ensureFileBlockTable(tx)}
+    if err==nil {_,err=tx.Exec(`DELETE FROM FileBlock WHERE filename=$1`,name)}
+    return keys,err
+}
+
+/*
+在事务中插入文件的记录
+*/
+func insertFile(tx *sql.Tx, file FileInfo)error{
+    _,err:=tx.Exec(`INSERT INTO FileInfo VALUES ($1,$2,$3);`,file.Name,file.Size,file.ModTime.Unix())
+    if err!=nil {return err}
+    if file.ChunkBytes()!=BLOCK_SIZE {
+        _,err=tx.Exec(`INSERT INTO FileBlock VALUES ($1,$2);`,file.Name,file.ChunkBytes())
+        if err!=nil {return err}
+    }
+    for i,chunk:=range file.Chunks {
+        _,err=tx.Exec(`INSERT INTO FileKey VALUES ($1,$2,$3);`,file.Name,i,chunk.Key)
+        if err!=nil {return err}
+        for _,server:=range chunk.Servers {
+            var num int
+            err=tx.QueryRow(`SELECT count(*) FROM KeyServer WHERE key=$1 AND server=$2`,chunk.Key,server).Scan(&num)
+            if err==nil && num==0 {
+                _,err=tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,chunk.Key,server)
+            }
+            if err!=nil {return err}
+        }
+    }
+    return nil
+}
+
+/*
+在事务中查询文件块所在的服务器
+*/
+func keyServers(tx *sql.Tx, key string)([]string,error){
+    var servers []string
+    rows,err:=tx.Query(`SELECT server FROM KeyServer WHERE key=$1`,key)
+    if err!=nil {return nil,err}
+    for rows.Next() {
+        var server string
+        if err=rows.Scan(&server);err!=nil {
+            rows.Close()
+            return nil,err
+        }
+        servers=append(servers,server)
+    }
+    return servers,nil
+}
+
+/*
+本地数据库中文件块所在的服务器，没有记录时为空
+*/
+func (c *Client) chunkServers(key string)[]string{
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    db,err:=c.openDatabase(c.opts.User,false)
+    if err!=nil {return nil}
+    defer db.Close()
+    var servers []string
+    rows,err:=db.Query(`SELECT server FROM KeyServer WHERE key=$1 ORDER BY server`,key)
+    if err!=nil {return nil}
+    for rows.Next() {
+        var server string
+        if rows.Scan(&server)!=nil {
+            rows.Close()
+            return nil
+        }
+        servers=append(servers,server)
+    }
+    return servers
+}
+
+/*
+查询文件块是否还被其它文件引用
+*/
+func keyInUse(tx *sql.Tx, key string)(bool,error){
+    var num int
+    err:=tx.QueryRow(`SELECT count(*) FROM FileKey WHERE key=$1`,key).Scan(&num)
+    return num>0,err
+}
+
+/*
+持有本用户的集群锁，从负责这个锁的服务器获取最新的数据库，在事务中修改，然后带token同步到所有服务器
+*/
+func (c *Client) updateDatabase(ctx context.Context, f func(tx *sql.Tx)error)error{
+    lock,err:=c.locker.Acquire(ctx,UserLockName(c.opts.User))
+    if err!=nil {return syncError(err)}
+    defer c.locker.Release(lock)
+    err=c.fetchUserDatabase(ctx,lock)//拿到锁之后要先获取最新的数据库再修改
+    if err!=nil {return err}
+    c.db_lock.Lock()
+    db,err:=c.openDatabase(c.opts.User,true)
+    if err!=nil {
+        c.db_lock.Unlock()
+        return err
+    }
+    tx,err:=db.Begin()
+    if err==nil {
+        err=f(tx)
+        if err==nil {
+            err=tx.Commit()
+        }else{
+            tx.Rollback()
+        }
+    }
+    db.Close()
+    c.db_lock.Unlock()
+    if err!=nil {return err}
+    if lock.Lost() {
+        return syncError(errors.New("集群锁已失效，数据库没有同步"))
+    }
+    err=c.uploadDatabase(ctx,lock)
+    if errors.Is(err,ErrQuota) {return err}
+    if err!=nil {return syncError(err)}
+    return nil
+}
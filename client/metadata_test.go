@@ -0,0 +1,73 @@
+package client
+
+/*
+数据库文件的测试：两个用户的Client同时获取数据库和提交修改
+*/
+
+import (
+    "fmt"
+    "sync"
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "archive/zip"
+    "path/filepath"
+)
+
+/*
+生成服务器SEND_DB回复格式的zip，files为文件名 -> 内容
+*/
+func testDatabaseZip(t *testing.T, files map[string]string)[]byte{
+    var buf bytes.Buffer
+    w:=zip.NewWriter(&buf)
+    for name,content:=range files {
+        f,err:=w.Create("/"+name)
+        if err!=nil {t.Fatal(err)}
+        f.Write([]byte(content))
+    }
+    if err:=w.Close();err!=nil {t.Fatal(err)}
+    return buf.Bytes()
+}
+
+/*
+alice的Client不断获取数据库（其中bob的数据库是旧的），同时bob的Client提交修改后读取数据库准备同步：
+bob读到的必须是自己刚提交的内容，否则同步的是旧数据库，修改就丢了
+*/
+func TestConcurrentUsers(t *testing.T){
+    dir:=t.TempDir()
+    alice,err:=New(Options{Servers:[]string{"127.0.0.1:1"},User:"alice",Dir:filepath.Join(dir,"alice")})
+    if err!=nil {t.Fatal(err)}
+    bob,err:=New(Options{Servers:[]string{"127.0.0.1:1"},User:"bob",Dir:filepath.Join(dir,"bob")})
+    if err!=nil {t.Fatal(err)}
+    stale:=testDatabaseZip(t,map[string]string{"alice.db":"alice","bob.db":"stale"})
+    done:=make(chan bool)
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func(){
+        defer wg.Done()
+        for{
+            select {
+                case <-done:
+                    return
+                default:
+            }
+            if err:=alice.extractDatabase(stale);err!=nil {t.Error(err);return}
+        }
+    }()
+    for i:=0;i<200;i++ {
+        content:=fmt.Sprint("commit-",i)
+        bob.db_lock.Lock()//提交事务
+        err=ioutil.WriteFile(bob.dbPath("bob"),[]byte(content),0644)
+        bob.db_lock.Unlock()
+        if err!=nil {t.Fatal(err)}
+        bob.db_lock.Lock()//uploadDatabase读取数据库
+        datas,err:=ioutil.ReadFile(bob.dbPath("bob"))
+        bob.db_lock.Unlock()
+        if err!=nil {t.Fatal(err)}
+        if string(datas)!=content {
+            t.Fatalf("bob提交了%s，同步的却是%s",content,datas)
+        }
+    }
+    close(done)
+    wg.Wait()
+}
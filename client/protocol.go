@@ -0,0 +1,155 @@
+package client
+
+/*
+本文件包含了和服务器通信的协议：指令码、连接服务器、数据的发送和读取。
+指令码和数据格式必须和服务器（dss主程序main.go）一致。
+*/
+
+import (
+    "io"
+    "net"
+    "time"
+    "errors"
+    "context"
+    "encoding/binary"
+)
+
+const ( //指令码，数据包第一个字节为指令码
+    SEND_DB byte = 2 //请求服务器发送所有数据库
+    ACK byte = 8
+    SYNC_DB byte = 9 //同步数据库，后面跟fencing token、用户名、文件大小和数据库内容
+    UPLOAD_FILE byte = 10 //上传文件块
+    DELETE_FILE byte = 11 //删除文件块
+    SERVER_LOAD byte = 16 //查询服务器负载
+    DOWNLOAD_RANGE byte = 17 //下载文件块的一段
+    FILE_SIZE byte = 18 //查询文件块大小
+    GET_MEMBERS byte = 21 //获取成员表
+    LOCK_ACQUIRE byte = 27 //申请集群锁的租约
+    LOCK_RENEW byte = 28 //集群锁续约
+    LOCK_RELEASE byte = 29 //释放集群锁
+    REQUEST_ID byte = 30 //请求ID，后面跟REQUEST_ID_LEN个字符，服务器在这个连接上的日志都带上这个ID
+    SEND_USER_DB byte = 31 //请求服务器发送一个用户的数据库和它的token
+    GET_QUOTAS byte = 32 //请求服务器发送配额表
+    SET_QUOTA byte = 33 //设置用户的配额（需要管理员密钥）
+    ERR byte = 255
+)
+
+const MAX_DATA_SIZE=1024*1024*64 //sendData/readData一次最多传输的数据大小
+const BROADCAST_TIMEOUT=time.Second*30 //发送数据后等待ACK的时间，对方可能需要解压数据库
+
+/*
+带context的连接：context取消时中断正在进行的读写
+*/
+type ctxConn struct {
+    net.Conn
+    stop func()bool
+}
+
+func (c *ctxConn) Close()error{
+    c.stop()
+    return c.Conn.Close()
+}
+
+/*
+连接服务器，依次尝试服务器的所有地址（主地址和成员表中声明的其它地址），记住能连上的那个。
+context中有请求ID时，连接后先发送请求ID
+*/
+func (c *Client) dial(ctx context.Context, server string)(net.Conn,error){
+    var last_err error=ErrNoServer
+    dialer:=net.Dialer{Timeout:c.opts.Timeout}
+    for _,addr:=range c.serverAddrs(server) {
+        conn,err:=dialer.DialContext(ctx,"tcp",addr)
+        if err!=nil {
+            last_err=err
+            continue
+        }
+        c.members_lock.Lock()
+        c.dial_cache[server]=addr
+        c.members_lock.Unlock()
+        if deadline,ok:=ctx.Deadline();ok {conn.SetDeadline(deadline)}
+        stop:=context.AfterFunc(ctx,func(){conn.SetDeadline(time.Now())})//取消时让读写立即返回
+        if id:=RequestID(ctx);id!="" {
+            if err:=writeAll(conn,append([]byte{REQUEST_ID},id...));err!=nil {
+                stop()
+                conn.Close()
+                return nil,err
+            }
+        }
+        return &ctxConn{conn,stop},nil
+    }
+    return nil,last_err
+}
+
+/*
+设置读取期限，不会超过context的期限
+*/
+func setReadDeadline(ctx context.Context, conn net.Conn, timeout time.Duration){
+    deadline:=time.Now().Add(timeout)
+    if ctx_deadline,ok:=ctx.Deadline();ok && ctx_deadline.Before(deadline) {deadline=ctx_deadline}
+    conn.SetReadDeadline(deadline)
+}
+
+/*
+写入全部字节
+*/
+func writeAll(conn net.Conn, b []byte)error{
+    for len(b)>0 {
+        n,err:=conn.Write(b)
+        if err!=nil {return err}
+        b=b[n:]
+    }
+    return nil
+}
+
+/*
+读取指令码
+*/
+func readInstruct(conn net.Conn)byte{
+    data:=make([]byte,1)
+    _,err:=io.ReadFull(conn,data)
+    if err!=nil {return ERR}
+    return data[0]
+}
+
+/*
+发送一段数据：8字节长度（uint64）+数据
+*/
+func sendData(datas []byte, conn net.Conn)error{
+    header:=make([]byte,8)
+    binary.BigEndian.PutUint64(header,uint64(len(datas)))
+    return writeAll(conn,append(header,datas...))
+}
+
+/*
+读取一段数据：8字节长度（uint64）+数据
+*/
+func readData(conn net.Conn)([]byte,error){
+    header:=make([]byte,8)
+    _,err:=io.ReadFull(conn,header)
+    if err!=nil {return nil,err}
+    size:=binary.BigEndian.Uint64(header)
+    if size>MAX_DATA_SIZE {
+        return nil,errors.New("数据太大")
+    }
+    datas:=make([]byte,size)
+    _,err=io.ReadFull(conn,datas)
+    return datas,err
+}
+
+/*
+发送一个请求，读取回复：ACK+数据返回数据，ERR+原因返回错误
+*/
+func (c *Client) request(ctx context.Context, server string, instruct byte, datas []byte)([]byte,error){
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return nil,err}
+    defer conn.Close()
+    setReadDeadline(ctx,conn,c.opts.Timeout*10)
+    err=writeAll(conn,[]byte{instruct})
+    if err==nil {err=sendData(datas,conn)}
+    if err!=nil {return nil,err}
+    if readInstruct(conn)!=ACK {
+        message,_:=readData(conn)
+        return nil,errors.New(string(message))
+    }
+    return readData(conn)
+}
@@ -0,0 +1,250 @@
+package client
+
+/*
+本文件包含了用户配额相关的函数：配额保存在服务器的配额表中（和用户的数据库分开，用户同步数据库不能修改配额），
+由管理员用服务器配置的管理员密钥（-admin_key）设置，服务器持有集群锁QUOTA_LOCK修改配额表并同步到所有服务器。
+服务器接收SYNC_DB时检查配额，客户端在上传文件块前和写入数据库时也检查，尽早停止上传。
+用量从数据库中的文件记录计算：
+不去重时为所有文件大小之和；去重时相同的文件块只计算一次（同一个用户的多个文件有相同内容时只占用一份空间）。
+旧版本上传的文件没有记录大小，每个文件块按分块大小计算。
+*/
+
+import (
+    "errors"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "encoding/binary"
+)
+
+var ErrQuota=errors.New("超出用户的存储配额")
+
+const QUOTA_LOCK="quota" //配额表的集群锁的名字
+
+type Quota struct {//用户配额
+    MaxBytes int64 //最多占用的空间（Byte），0表示不限
+    MaxFiles int64 //最多文件数量，0表示不限
+    Dedup bool //计算用量时相同的文件块是否只计算一次
+}
+
+type Usage struct {//用户的用量
+    Files int64
+    Bytes int64 //按配额的计算方式（是否去重）计算
+}
+
+type QuotaRequest struct {//SET_QUOTA和SYNC_QUOTAS（服务器之间同步配额表）的请求
+    AdminKey string //管理员密钥
+    User string //SET_QUOTA：要设置的用户
+    Quota Quota //SET_QUOTA：新的配额，MaxBytes和MaxFiles都为0时取消配额
+    Token uint64 //SYNC_QUOTAS：持有QUOTA_LOCK的fencing token
+    Quotas map[string]Quota //SYNC_QUOTAS：完整的配额表
+}
+
+/*
+是否设置了配额
+*/
+func (q Quota) Limited()bool{
+    return q.MaxBytes>0 || q.MaxFiles>0
+}
+
+/*
+用量是否超出配额
+*/
+func (q Quota) Exceeded(u Usage)bool{
+    return (q.MaxBytes>0 && u.Bytes>q.MaxBytes) || (q.MaxFiles>0 && u.Files>q.MaxFiles)
+}
+
+/*
+是否允许用量从before变为after：超出配额且用量增加时不允许，用量没有增加的修改（删除、重命名）总是允许
+*/
+func (q Quota) Allows(before Usage, after Usage)bool{
+    return !q.Exceeded(after) || (after.Bytes<=before.Bytes && after.Files<=before.Files)
+}
+
+/*
+文件第i个文件块的大小
+*/
+func chunkSize(file FileInfo, i int)int64{
+    if file.Size<0 || i<len(file.Chunks)-1 {return file.ChunkBytes()}
+    return file.Size-int64(i)*file.ChunkBytes()
+}
+
+/*
+计算文件列表的用量，dedup为true时相同的文件块只计算一次
+*/
+func ComputeUsage(files []FileInfo, dedup bool)Usage{
+    usage,_:=computeUsage(files,dedup)
+    return usage
+}
+
+/*
+计算用量，同时返回所有文件块的key
+*/
+func computeUsage(files []FileInfo, dedup bool)(Usage,map[string]bool){
+    usage:=Usage{Files:int64(len(files))}
+    keys:=map[string]bool{}
+    for _,file:=range files {
+        for i,chunk:=range file.Chunks {
+            if dedup && keys[chunk.Key] {continue}
+            keys[chunk.Key]=true
+            usage.Bytes+=chunkSize(file,i)
+        }
+    }
+    return usage,keys
+}
+
+/*
+编码GET_QUOTAS的回复：8字节token+配额表（JSON）
+*/
+func EncodeQuotas(token uint64, quotas map[string]Quota)[]byte{
+    datas:=make([]byte,8)
+    binary.BigEndian.PutUint64(datas,token)
+    content,_:=json.Marshal(quotas)
+    return append(datas,content...)
+}
+
+/*
+解析GET_QUOTAS的回复中token之后的配额表，为空时没有配额
+*/
+func DecodeQuotas(content []byte)(map[string]Quota,error){
+    quotas:=map[string]Quota{}
+    if len(content)==0 {return quotas,nil}
+    err:=json.Unmarshal(content,&quotas)
+    return quotas,err
+}
+
+/*
+从服务器获取配额表（GET_QUOTAS）
+*/
+func (c *Client) Quotas(ctx context.Context)(map[string]Quota,error){
+    var last_err error=ErrNoServer
+    for _,server:=range c.knownServers() {
+        datas,err:=c.request(ctx,server,GET_QUOTAS,nil)
+        if err==nil && len(datas)<8 {err=errors.New("回复格式不正确")}
+        if err==nil {
+            var quotas map[string]Quota
+            quotas,err=DecodeQuotas(datas[8:])
+            if err==nil {return quotas,nil}
+        }
+        last_err=err
+        if ctx.Err()!=nil {break}
+    }
+    return nil,last_err
+}
+
+/*
+从服务器获取本用户的配额
+*/
+func (c *Client) fetchQuota(ctx context.Context)(Quota,error){
+    quotas,err:=c.Quotas(ctx)
+    if err!=nil {return Quota{},err}
+    return quotas[c.opts.User],nil
+}
+
+/*
+设置本用户的配额（需要Options.AdminKey和服务器的管理员密钥相同），MaxBytes和MaxFiles都为0时取消配额。
+收到请求的服务器持有集群锁修改配额表，同步到所有服务器后才返回
+*/
+func (c *Client) SetQuota(ctx context.Context, q Quota)error{
+    ctx=ensureRequestID(ctx)
+    if q.MaxBytes<0 || q.MaxFiles<0 {return errors.New("配额不能是负数")}
+    datas,_:=json.Marshal(QuotaRequest{AdminKey:c.opts.AdminKey,User:c.opts.User,Quota:q})
+    var last_err error=ErrNoServer
+    for _,server:=range c.knownServers() {
+        _,err:=c.request(ctx,server,SET_QUOTA,datas)
+        if err==nil {return nil}
+        last_err=err
+        if ctx.Err()!=nil {break}
+    }
+    return syncError(last_err)
+}
+
+/*
+获取最新的数据库和配额，返回本用户的配额和用量
+*/
+func (c *Client) Quota(ctx context.Context)(Quota,Usage,error){
+    err:=c.Refresh(ctx)
+    if err!=nil {return Quota{},Usage{},err}
+    q,err:=c.fetchQuota(ctx)
+    if err!=nil {return Quota{},Usage{},err}
+    usage,err:=c.CachedUsage(q.Dedup)
+    return q,usage,err
+}
+
+/*
+使用本地的数据库（不获取最新的）计算本用户的用量，用户还没有数据库时返回ErrNotFound
+*/
+func (c *Client) CachedUsage(dedup bool)(Usage,error){
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    db,err:=c.openDatabase(c.opts.User,false)
+    if err!=nil {return Usage{},err}
+    defer db.Close()
+    files,err:=ReadFiles(db,c.opts.User,"")
+    if err!=nil {return Usage{},err}
+    return ComputeUsage(files,dedup),nil
+}
+
+type quotaCheck struct {//上传一个文件时检查配额
+    quota Quota
+    usage Usage //不包括正在上传的文件（同名文件会被替换，不计算）
+    keys map[string]bool //已有的文件块，去重时不再计算
+}
+
+/*
+开始上传文件name前获取配额，检查文件数量（用量使用本地的数据库），返回nil表示没有配额
+*/
+func (c *Client) startQuotaCheck(ctx context.Context, name string)(*quotaCheck,error){
+    q,err:=c.fetchQuota(ctx)
+    if err!=nil {return nil,err}
+    if !q.Limited() {return nil,nil}
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    var others []FileInfo
+    db,err:=c.openDatabase(c.opts.User,false)
+    if err==nil {//还没有数据库的用户用量为0
+        files,err:=ReadFiles(db,c.opts.User,"")
+        db.Close()
+        if err!=nil {return nil,err}
+        for _,file:=range files {
+            if file.Name!=name {others=append(others,file)}
+        }
+    }
+    usage,keys:=computeUsage(others,q.Dedup)
+    usage.Files++
+    if q.Exceeded(usage) {return nil,ErrQuota}
+    return &quotaCheck{quota:q,usage:usage,keys:keys},nil
+}
+
+/*
+上传一个文件块前检查：加上这个文件块后不能超出配额
+*/
+func (check *quotaCheck) add(key string, size int64)error{
+    if check==nil {return nil}
+    if check.quota.Dedup && check.keys[key] {return nil}
+    check.keys[key]=true
+    check.usage.Bytes+=size
+    if check.quota.Exceeded(check.usage) {return ErrQuota}
+    return nil
+}
+
+/*
+写入数据库时（持有集群锁，使用最新的数据库）再检查一次，同时上传的多个客户端不会一起超出配额
+*/
+func checkQuotaInTx(tx *sql.Tx, user string, q Quota, before Usage)error{
+    if !q.Limited() {return nil}
+    files,err:=ReadFiles(tx,user,"")
+    if err!=nil {return err}
+    if !q.Allows(before,ComputeUsage(files,q.Dedup)) {return ErrQuota}
+    return nil
+}
+
+/*
+事务开始时的用量（没有配额时不需要计算）
+*/
+func usageInTx(tx *sql.Tx, user string, q Quota)(Usage,error){
+    if !q.Limited() {return Usage{},nil}
+    files,err:=ReadFiles(tx,user,"")
+    if err!=nil {return Usage{},err}
+    return ComputeUsage(files,q.Dedup),nil
+}
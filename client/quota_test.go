@@ -0,0 +1,105 @@
+package client
+
+/*
+配额的测试：用量计算（是否去重、没有记录大小的旧文件）和是否允许修改
+*/
+
+import (
+    "testing"
+)
+
+func TestComputeUsage(t *testing.T){
+    chunks:=func(keys ...string)[]Chunk{
+        var list []Chunk
+        for _,key:=range keys {list=append(list,Chunk{Key:key})}
+        return list
+    }
+    files:=[]FileInfo{
+        {Name:"a",Size:BLOCK_SIZE+100,Chunks:chunks("k1","k2")},
+        {Name:"b",Size:BLOCK_SIZE+100,Chunks:chunks("k1","k2")},//和a内容相同
+        {Name:"c",Size:10,Chunks:chunks("k3")},
+        {Name:"old",Size:-1,Chunks:chunks("k4","k5")},//旧版本上传的文件，每个文件块按BLOCK_SIZE计算
+        {Name:"empty",Size:0},
+        {Name:"small",Size:3*MIN_BLOCK_SIZE,BlockSize:MIN_BLOCK_SIZE,Chunks:chunks("k6","k6","k7")},//分块大小不是BLOCK_SIZE
+    }
+    tests:=[]struct{
+        name string
+        files []FileInfo
+        dedup bool
+        expect Usage
+    }{
+        {"没有文件",nil,false,Usage{}},
+        {"空文件",files[4:5],false,Usage{Files:1}},
+        {"最后一个文件块",files[:1],false,Usage{Files:1,Bytes:BLOCK_SIZE+100}},
+        {"不去重",files[:5],false,Usage{Files:5,Bytes:2*(BLOCK_SIZE+100)+10+2*BLOCK_SIZE}},
+        {"去重",files[:5],true,Usage{Files:5,Bytes:(BLOCK_SIZE+100)+10+2*BLOCK_SIZE}},
+        {"旧文件",files[3:4],true,Usage{Files:1,Bytes:2*BLOCK_SIZE}},
+        {"按文件的分块大小计算",files[5:],true,Usage{Files:1,Bytes:2*MIN_BLOCK_SIZE}},
+    }
+    for _,test:=range tests {
+        if usage:=ComputeUsage(test.files,test.dedup);usage!=test.expect {
+            t.Errorf("%s：用量为%+v，期望%+v",test.name,usage,test.expect)
+        }
+    }
+}
+
+func TestQuotaAllows(t *testing.T){
+    q:=Quota{MaxBytes:1000,MaxFiles:10}
+    tests:=[]struct{
+        name string
+        quota Quota
+        before Usage
+        after Usage
+        exceeded bool
+        allows bool
+    }{
+        {"没有配额",Quota{},Usage{},Usage{Files:1e6,Bytes:1e12},false,true},
+        {"没有超出",q,Usage{Files:1,Bytes:100},Usage{Files:2,Bytes:200},false,true},
+        {"刚好用完",q,Usage{},Usage{Files:10,Bytes:1000},false,true},
+        {"超出空间",q,Usage{},Usage{Files:1,Bytes:1001},true,false},
+        {"超出文件数量",q,Usage{},Usage{Files:11},true,false},
+        {"超出后删除",q,Usage{Files:20,Bytes:2000},Usage{Files:19,Bytes:1900},true,true},
+        {"超出后重命名",q,Usage{Files:20,Bytes:2000},Usage{Files:20,Bytes:2000},true,true},
+        {"超出后替换成更大的文件",q,Usage{Files:20,Bytes:2000},Usage{Files:20,Bytes:2001},true,false},
+        {"只限制文件数量",Quota{MaxFiles:1},Usage{},Usage{Files:1,Bytes:1e12},false,true},
+    }
+    for _,test:=range tests {
+        if exceeded:=test.quota.Exceeded(test.after);exceeded!=test.exceeded {
+            t.Errorf("%s：Exceeded返回%v",test.name,exceeded)
+        }
+        if allows:=test.quota.Allows(test.before,test.after);allows!=test.allows {
+            t.Errorf("%s：Allows返回%v",test.name,allows)
+        }
+    }
+}
+
+func TestQuotaCheck(t *testing.T){
+    check:=&quotaCheck{quota:Quota{MaxBytes:100,Dedup:true},keys:map[string]bool{"old":true}}
+    steps:=[]struct{
+        key string
+        size int64
+        ok bool
+    }{
+        {"old",60,true},//已有的文件块，去重时不计算
+        {"a",60,true},
+        {"a",60,true},
+        {"b",40,true},
+        {"c",1,false},
+    }
+    for i,step:=range steps {
+        if err:=check.add(step.key,step.size);(err==nil)!=step.ok {t.Fatalf("第%d步：%v",i,err)}
+    }
+    var none *quotaCheck //没有配额
+    if err:=none.add("x",1<<40);err!=nil {t.Errorf("没有配额时返回了%v",err)}
+}
+
+func TestEncodeQuotas(t *testing.T){
+    quotas:=map[string]Quota{"yumi":{MaxBytes:1<<30,Dedup:true},"test":{MaxFiles:10}}
+    datas:=EncodeQuotas(7,quotas)
+    if len(datas)<8 || datas[7]!=7 {t.Fatalf("token编码错误：%v",datas)}
+    decoded,err:=DecodeQuotas(datas[8:])
+    if err!=nil {t.Fatal(err)}
+    if len(decoded)!=2 || decoded["yumi"]!=quotas["yumi"] || decoded["test"]!=quotas["test"] {t.Errorf("解析结果为%v",decoded)}
+    decoded,err=DecodeQuotas(nil)
+    if err!=nil || len(decoded)!=0 {t.Errorf("空的配额表解析为%v，%v",decoded,err)}
+}
@@ -0,0 +1,80 @@
+package client
+
+/*
+本文件包含了按需读取文件的Reader：Read时才下载读到的文件块，可以Seek，
+用于HTTP的Range请求、流式下载等只需要文件一部分的场合
+*/
+
+import (
+    "io"
+    "errors"
+    "context"
+)
+
+type Reader struct {//按需读取的文件，不能在多个goroutine中同时使用
+    c *Client
+    ctx context.Context
+    info FileInfo
+    offset int64 //当前位置
+    index int //最近下载的文件块序号，-1表示没有
+    datas []byte //最近下载的文件块，顺序读取时不需要重新下载
+}
+
+/*
+按List或Stat返回的文件信息打开文件，ctx取消后Read返回错误
+*/
+func (c *Client) NewReader(ctx context.Context, info FileInfo)*Reader{
+    return &Reader{c:c,ctx:ensureRequestID(ctx),info:info,index:-1}
+}
+
+func (r *Reader) Read(p []byte)(int,error){
+    block_size:=r.info.ChunkBytes()
+    i:=int(r.offset/block_size)
+    if i>=len(r.info.Chunks) {return 0,io.EOF}
+    if i!=r.index {
+        datas,err:=r.c.downloadChunk(r.ctx,r.info.Chunks[i])
+        if err!=nil {return 0,err}
+        r.index,r.datas=i,datas
+    }
+    pos:=int(r.offset-int64(i)*block_size)
+    if pos>=len(r.datas) {return 0,io.EOF}//最后一个文件块不满一块
+    n:=copy(p,r.datas[pos:])
+    r.offset+=int64(n)
+    return n,nil
+}
+
+/*
+移动读取位置，旧版本上传的文件没有记录大小，从末尾Seek时先下载最后一个文件块计算大小
+*/
+func (r *Reader) Seek(offset int64, whence int)(int64,error){
+    switch whence {
+        case io.SeekStart:
+        case io.SeekCurrent:
+            offset+=r.offset
+        case io.SeekEnd:
+            size,err:=r.size()
+            if err!=nil {return r.offset,err}
+            offset+=size
+        default:
+            return r.offset,errors.New("whence不正确")
+    }
+    if offset<0 {return r.offset,errors.New("位置不能是负数")}
+    r.offset=offset
+    return offset,nil
+}
+
+/*
+文件大小：没有记录时为前面的文件块数量乘以分块大小加上最后一个文件块的大小
+*/
+func (r *Reader) size()(int64,error){
+    if r.info.Size>=0 {return r.info.Size,nil}
+    last:=len(r.info.Chunks)-1
+    if last<0 {return 0,nil}
+    if r.index!=last {
+        datas,err:=r.c.downloadChunk(r.ctx,r.info.Chunks[last])
+        if err!=nil {return 0,err}
+        r.index,r.datas=last,datas
+    }
+    r.info.Size=int64(last)*r.info.ChunkBytes()+int64(len(r.datas))
+    return r.info.Size,nil
+}
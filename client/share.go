@@ -0,0 +1,232 @@
+package client
+
+/*
+本文件包含了分享链接相关的函数：文件的所有者创建分享（随机令牌），其他人不需要客户端就能通过网关下载。
+分享保存在所有者的数据库的Share表中，和文件记录一样同步到所有服务器，任何一个网关都能验证。
+最多下载次数按发送的字节数计算：每次下载（包括断点续传和分段下载）都记录发送的字节数（ShareBytes表），
+总数不能超过文件大小乘以最多下载次数，已下载次数为总字节数除以文件大小。
+*/
+
+import (
+    "time"
+    "errors"
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "golang.org/x/crypto/bcrypt"
+)
+
+var ErrShareExpired=errors.New("分享链接已过期或下载次数已用完")
+var ErrSharePassword=errors.New("分享链接的密码错误")
+
+type Share struct {//分享链接
+    Token string //随机令牌
+    User string
+    Name string //分享的文件名
+    Expire time.Time //过期时间，零值表示不过期
+    MaxDownloads int64 //最多下载次数，0表示不限
+    Downloads int64 //已经下载的次数
+    Created time.Time
+    password string //密码的bcrypt哈希，没有密码时为空
+}
+
+/*
+分享是否设置了密码
+*/
+func (s Share) HasPassword()bool{
+    return s.password!=""
+}
+
+/*
+检查分享是否还能下载
+*/
+func (s Share) check(password string)error{
+    if !s.Expire.IsZero() && time.Now().After(s.Expire) {return ErrShareExpired}
+    if s.MaxDownloads>0 && s.Downloads>=s.MaxDownloads {return ErrShareExpired}
+    if s.password=="" {return nil}
+    if bcrypt.CompareHashAndPassword([]byte(s.password),[]byte(password))!=nil {return ErrSharePassword}
+    return nil
+}
+
+func randomHex(n int)string{
+    buf:=make([]byte,n)
+    _,err:=rand.Read(buf)
+    if err!=nil {panic(err)}
+    return hex.EncodeToString(buf)
+}
+
+/*
+分享密码的哈希：bcrypt（自带盐，计算慢，数据库泄露后难以暴力破解）
+*/
+func hashSharePassword(password string)(string,error){
+    hash,err:=bcrypt.GenerateFromPassword([]byte(password),bcrypt.DefaultCost)
+    if err!=nil {return "",errors.New("分享密码不能使用："+err.Error())}
+    return string(hash),nil
+}
+
+/*
+新建Share表和ShareBytes表（如果不存在）
+*/
+func ensureShareTable(tx *sql.Tx)error{
+    _,err:=tx.Exec(`CREATE TABLE IF NOT EXISTS Share (
+    token string,
+    filename string,
+    password string,
+    expire int64,
+    max_downloads int64,
+    downloads int64,
+    created int64,
+    );`)
+    if err!=nil {return err}
+    _,err=tx.Exec(`CREATE TABLE IF NOT EXISTS ShareBytes (
+    token string,
+    served int64,
+    );`)
+    return err
+}
+
+/*
+查询分享，没有时返回ErrNotFound
+*/
+func queryShare(db querier, user string, token string)(Share,error){
+    s:=Share{Token:token,User:user}
+    var expire,created int64
+    err:=db.QueryRow(`SELECT filename,password,expire,max_downloads,downloads,created FROM Share WHERE token==$1`,token).Scan(&s.Name,&s.password,&expire,&s.MaxDownloads,&s.Downloads,&created)
+    if err==sql.ErrNoRows {return s,ErrNotFound}
+    s.Expire,s.Created=unixTime(expire),unixTime(created)
+    return s,err
+}
+
+/*
+分享文件：password为空时不需要密码，expire为零值时不过期，max_downloads为0时不限下载次数
+*/
+func (c *Client) CreateShare(ctx context.Context, name string, password string, expire time.Time, max_downloads int64)(Share,error){
+    if err:=ValidName(name);err!=nil {return Share{},err}
+    s:=Share{Token:randomHex(16),User:c.opts.User,Name:name,Expire:expire,MaxDownloads:max_downloads,Created:time.Now()}
+    if password!="" {
+        var err error
+        s.password,err=hashSharePassword(password)
+        if err!=nil {return Share{},err}
+    }
+    var expire_unix int64
+    if !expire.IsZero() {expire_unix=expire.Unix()}
+    err:=c.updateDatabase(ctx,func(tx *sql.Tx)error{
+        var num int
+        err:=tx.QueryRow(`SELECT count(*) FROM FileKey WHERE filename==$1`,name).Scan(&num)
+        if err!=nil {return err}
+        if num==0 {return ErrNotFound}
+        err=ensureShareTable(tx)
+        if err!=nil {return err}
+        _,err=tx.Exec(`INSERT INTO Share VALUES ($1,$2,$3,$4,$5,$6,$7);`,s.Token,s.Name,s.password,expire_unix,s.MaxDownloads,int64(0),s.Created.Unix())
+        return err
+    })
+    if err!=nil {return Share{},err}
+    return s,nil
+}
+
+/*
+列出本用户的所有分享（包括已经过期的）
+*/
+func (c *Client) Shares(ctx context.Context)([]Share,error){
+    err:=c.Refresh(ctx)
+    if err!=nil {return nil,err}
+    c.db_lock.Lock()
+    defer c.db_lock.Unlock()
+    db,err:=c.openDatabase(c.opts.User,false)
+    if err!=nil {return nil,err}
+    defer db.Close()
+    rows,err:=db.Query(`SELECT token,filename,password,expire,max_downloads,downloads,created FROM Share ORDER BY created`)
+    if err!=nil {return nil,nil}//旧版本的数据库没有Share表
+    defer rows.Close()
+    var shares []Share
+    for rows.Next() {
+        s:=Share{User:c.opts.User}
+        var expire,created int64
+        err=rows.Scan(&s.Token,&s.Name,&s.password,&expire,&s.MaxDownloads,&s.Downloads,&created)
+        if err!=nil {return nil,err}
+        s.Expire,s.Created=unixTime(expire),unixTime(created)
+        shares=append(shares,s)
+    }
+    return shares,rows.Err()
+}
+
+/*
+取消分享，分享不存在时返回ErrNotFound
+*/
+func (c *Client) RevokeShare(ctx context.Context, token string)error{
+    return c.updateDatabase(ctx,func(tx *sql.Tx)error{
+        err:=ensureShareTable(tx)
+        if err!=nil {return err}
+        result,err:=tx.Exec(`DELETE FROM Share WHERE token==$1`,token)
+        if err!=nil {return err}
+        if n,err:=result.RowsAffected();err==nil && n==0 {return ErrNotFound}
+        _,err=tx.Exec(`DELETE FROM ShareBytes WHERE token==$1`,token)
+        return err
+    })
+}
+
+/*
+按分享下载前检查并记录这次要发送的字节数（持有集群锁修改），返回分享和文件信息。
+发送后总字节数超过文件大小乘以最多下载次数时返回ErrShareExpired，过期时也返回ErrShareExpired，密码错误时返回ErrSharePassword。
+空文件按请求次数计算
+*/
+func (c *Client) UseShare(ctx context.Context, token string, password string, bytes int64)(Share,FileInfo,error){
+    var s Share
+    var file FileInfo
+    err:=c.updateDatabase(ctx,func(tx *sql.Tx)error{
+        err:=ensureShareTable(tx)
+        if err!=nil {return err}
+        s,err=queryShare(tx,c.opts.User,token)
+        if err!=nil {return err}
+        err=s.check(password)
+        if err!=nil {return err}
+        files,err:=ReadFiles(tx,c.opts.User,s.Name)
+        if err!=nil {return err}
+        if len(files)==0 {return ErrNotFound}//文件已经被删除
+        file=files[0]
+        size:=ComputeUsage(files,false).Bytes
+        if size==0 {
+            s.Downloads++
+        }else{
+            var served int64
+            err=tx.QueryRow(`SELECT served FROM ShareBytes WHERE token==$1`,token).Scan(&served)
+            if err!=nil && err!=sql.ErrNoRows {return err}
+            if s.MaxDownloads>0 && served+bytes>s.MaxDownloads*size {return ErrShareExpired}
+            if err==sql.ErrNoRows {
+                _,err=tx.Exec(`INSERT INTO ShareBytes VALUES ($1,$2);`,token,served+bytes)
+            }else{
+                _,err=tx.Exec(`UPDATE ShareBytes served=$1 WHERE token==$2`,served+bytes,token)
+            }
+            if err!=nil {return err}
+            s.Downloads=(served+bytes)/size
+        }
+        _,err=tx.Exec(`UPDATE Share downloads=$1 WHERE token==$2`,s.Downloads,token)
+        return err
+    })
+    if err!=nil {return Share{},FileInfo{},err}
+    return s,file,nil
+}
+
+/*
+只检查分享，不记录下载（用于HEAD和计算要发送的字节数）
+*/
+func (c *Client) StatShare(ctx context.Context, token string, password string)(Share,FileInfo,error){
+    err:=c.Refresh(ctx)
+    if err!=nil {return Share{},FileInfo{},err}
+    var s Share
+    c.db_lock.Lock()
+    db,err:=c.openDatabase(c.opts.User,false)
+    if err==nil {
+        s,err=queryShare(db,c.opts.User,token)
+        db.Close()
+    }
+    c.db_lock.Unlock()
+    if err!=nil {return Share{},FileInfo{},ErrNotFound}//用户不存在，或者旧版本的数据库没有Share表
+    err=s.check(password)
+    if err!=nil {return Share{},FileInfo{},err}
+    files,err:=c.queryFiles(c.opts.User,s.Name)
+    if err!=nil {return Share{},FileInfo{},err}
+    if len(files)==0 {return Share{},FileInfo{},ErrNotFound}
+    return s,files[0],nil
+}
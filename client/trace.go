@@ -0,0 +1,73 @@
+package client
+
+/*
+本文件包含了请求ID和日志相关的函数：
+每次传输（上传、下载、删除）使用一个请求ID，连接服务器时先发送REQUEST_ID+请求ID，
+服务器在这个连接上的日志都带上这个ID，用同一个ID就能在所有服务器的日志中找到一次put的全过程。
+调用者可以用WithRequestID指定ID（比如网关使用HTTP请求的ID），没有指定时每次操作生成一个新的。
+*/
+
+import (
+    "io"
+    "context"
+    "log/slog"
+)
+
+const REQUEST_ID_LEN=16 //请求ID的长度，十六进制小写字母和数字
+
+type requestIDKey struct{}
+
+var discard_logger=slog.New(slog.NewTextHandler(io.Discard,nil))
+
+/*
+生成一个新的请求ID
+*/
+func NewRequestID()string{
+    return randomHex(REQUEST_ID_LEN/2)
+}
+
+/*
+检查请求ID的格式：十六进制小写字母和数字都不是指令码，旧版本的服务器会逐字节忽略
+*/
+func ValidRequestID(id string)bool{
+    if len(id)!=REQUEST_ID_LEN {return false}
+    for _,c:=range id {
+        if (c<'0' || c>'9') && (c<'a' || c>'f') {return false}
+    }
+    return true
+}
+
+/*
+返回带有请求ID的context，格式不正确的ID会被忽略
+*/
+func WithRequestID(ctx context.Context, id string)context.Context{
+    if !ValidRequestID(id) {return ctx}
+    return context.WithValue(ctx,requestIDKey{},id)
+}
+
+/*
+context中的请求ID，没有时返回空字符串
+*/
+func RequestID(ctx context.Context)string{
+    id,_:=ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+/*
+context中没有请求ID时生成一个新的，每个公开的传输操作开始时调用
+*/
+func ensureRequestID(ctx context.Context)context.Context{
+    if RequestID(ctx)!="" {return ctx}
+    return context.WithValue(ctx,requestIDKey{},NewRequestID())
+}
+
+/*
+日志，带上用户和请求ID
+*/
+func (c *Client) logger(ctx context.Context)*slog.Logger{
+    logger:=c.opts.Logger
+    if logger==nil {return discard_logger}
+    logger=logger.With("user",c.opts.User)
+    if id:=RequestID(ctx);id!="" {logger=logger.With("request_id",id)}
+    return logger
+}
@@ -0,0 +1,390 @@
+package client
+
+/*
+本文件包含了文件块的上传、下载和删除。下载算法：
+每个服务器记录延迟和吞吐量（指数加权平均），下载文件块时切成若干段，
+每个拥有副本的服务器开一个下载协程从同一个队列里取段下载，卡住或出错的段放回队列由其它服务器接手。
+*/
+
+import (
+    "io"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "context"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/binary"
+)
+
+const DOWNLOAD_RANGE_SIZE=1024*1024*4 //并行下载时每段的大小，单位Byte
+const DOWNLOAD_STALL_TIMEOUT=time.Second*10 //超过这个时间没收到数据就认为服务器卡住了
+const DOWNLOAD_MAX_FAILURES=2 //一个服务器在同一个文件块上失败这么多次后不再使用
+const DOWNLOAD_SLOW_FACTOR=4 //预计耗时超过最快服务器这么多倍的服务器只作为后备
+const DEFAULT_THROUGHPUT=1024*1024*10 //没有测量数据时假设的吞吐量，单位Byte/s
+const STAT_EWMA_ALPHA=0.3 //指数加权平均的系数，越大越看重最近的测量
+const READ_SIZE=4096 //每次从连接读取的大小
+
+type serverStat struct {//服务器的测量数据
+    throughput float64 //吞吐量，单位Byte/s，0表示还没有测量过
+    latency time.Duration //延迟
+    load uint8 //最近一次查询到的负载
+    failures int //连续失败次数
+}
+
+/*
+取得服务器的测量数据（调用前需持有stats_lock）
+*/
+func (c *Client) serverStat(server string)*serverStat{
+    stat,exist:=c.stats[server]
+    if !exist {
+        stat=&serverStat{}
+        c.stats[server]=stat
+    }
+    return stat
+}
+
+/*
+指数加权平均
+*/
+func ewma(old float64, sample float64)float64{
+    if old==0 {return sample}
+    return old*(1-STAT_EWMA_ALPHA)+sample*STAT_EWMA_ALPHA
+}
+
+/*
+记录一次传输测量
+*/
+func (c *Client) recordTransfer(server string, size uint64, duration time.Duration){
+    if duration<=0 || size==0 {return}
+    c.stats_lock.Lock()
+    defer c.stats_lock.Unlock()
+    stat:=c.serverStat(server)
+    stat.throughput=ewma(stat.throughput,float64(size)/duration.Seconds())
+    stat.failures=0
+}
+
+/*
+记录一次失败
+*/
+func (c *Client) recordFailure(server string){
+    c.stats_lock.Lock()
+    defer c.stats_lock.Unlock()
+    c.serverStat(server).failures++
+}
+
+/*
+估计从服务器下载一段数据需要的时间（秒），越小越好
+*/
+func (c *Client) serverCost(server string)float64{
+    c.stats_lock.Lock()
+    defer c.stats_lock.Unlock()
+    stat:=c.serverStat(server)
+    throughput:=stat.throughput
+    if throughput==0 {throughput=DEFAULT_THROUGHPUT}
+    cost:=stat.latency.Seconds()+DOWNLOAD_RANGE_SIZE/throughput
+    cost*=1+float64(stat.load)/8 //负载高的服务器带宽要分给其它人
+    cost*=float64(1+stat.failures)
+    return cost
+}
+
+/*
+按预计耗时从小到大排列服务器
+*/
+func (c *Client) rankServers(servers []string)[]string{
+    ranked:=append([]string{},servers...)
+    cost:=map[string]float64{}
+    for _,server:=range ranked {cost[server]=c.serverCost(server)}
+    sort.SliceStable(ranked, func(i, j int)bool{return cost[ranked[i]]<cost[ranked[j]]})
+    return ranked
+}
+
+/*
+查询服务器负载，顺便测量延迟
+*/
+func (c *Client) serverLoad(ctx context.Context, server string)(uint8,error){
+    time_start:=time.Now()
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return 0,err}
+    defer conn.Close()
+    err=writeAll(conn,[]byte{SERVER_LOAD})
+    if err!=nil {return 0,err}
+    setReadDeadline(ctx,conn,c.opts.Timeout)
+    load:=make([]byte,1)
+    _,err=io.ReadFull(conn,load)
+    if err!=nil {return 0,err}
+    c.stats_lock.Lock()
+    stat:=c.serverStat(server)
+    stat.latency=time.Duration(ewma(float64(stat.latency),float64(time.Since(time_start))))
+    stat.load=load[0]
+    c.stats_lock.Unlock()
+    return load[0],nil
+}
+
+/*
+并行探测服务器，返回在线的服务器（同时更新延迟和负载）
+*/
+func (c *Client) probeServers(ctx context.Context, servers []string)map[string]bool{
+    online:=map[string]bool{}
+    var lock sync.Mutex
+    var wg sync.WaitGroup
+    for _,server:=range servers {
+        wg.Add(1)
+        go func(server string){
+            defer wg.Done()
+            if _,err:=c.serverLoad(ctx,server);err!=nil {return}
+            lock.Lock()
+            online[server]=true
+            lock.Unlock()
+        }(server)
+    }
+    wg.Wait()
+    return online
+}
+
+/*
+上传一个文件块：用rendezvous哈希选择服务器（跳过连不上的），多个副本同时上传，至少一个成功才算成功
+*/
+func (c *Client) uploadChunk(ctx context.Context, members []Member, key string, datas []byte)(Chunk,error){
+    chunk:=Chunk{Key:key}
+    var addrs []string
+    for _,m:=range members {addrs=append(addrs,m.Addr)}
+    online:=c.probeServers(ctx,addrs)
+    servers:=PlaceChunk(chunk.Key,c.opts.Replicas,members,nil,func(addr string)bool{return online[addr]})
+    if len(servers)==0 {return chunk,ErrNoServer}
+    var wg sync.WaitGroup
+    var lock sync.Mutex
+    var last_err error
+    for _,server:=range servers {
+        wg.Add(1)
+        go func(server string){
+            defer wg.Done()
+            err:=c.sendChunk(ctx,server,chunk.Key,datas)
+            lock.Lock()
+            defer lock.Unlock()
+            if err!=nil {
+                c.logger(ctx).Warn("上传失败","key",chunk.Key,"server",server,"err",err)
+                last_err=err
+                return
+            }
+            chunk.Servers=append(chunk.Servers,server)
+        }(server)
+    }
+    wg.Wait()
+    if len(chunk.Servers)==0 {
+        if ctx.Err()!=nil {return chunk,ctx.Err()}
+        return chunk,errors.Join(ErrNoServer,last_err)
+    }
+    if len(chunk.Servers)<c.opts.Replicas {
+        c.logger(ctx).Warn("可用的服务器或故障域不足，文件块的副本不够","key",chunk.Key,"replicas",len(chunk.Servers),"want",c.opts.Replicas)
+    }
+    sort.Strings(chunk.Servers)
+    return chunk,nil
+}
+
+/*
+把文件块发送到服务器：UPLOAD_FILE+key+文件大小+文件内容，服务器接收完返回ACK
+*/
+func (c *Client) sendChunk(ctx context.Context, server string, key string, datas []byte)error{
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return err}
+    defer conn.Close()
+    var packet bytes.Buffer
+    packet.WriteByte(UPLOAD_FILE)
+    packet.WriteString(key)
+    binary.Write(&packet,binary.BigEndian,uint64(len(datas)))
+    err=writeAll(conn,packet.Bytes())
+    if err==nil {err=writeAll(conn,datas)}
+    if err!=nil {return err}
+    setReadDeadline(ctx,conn,c.opts.SyncTimeout)
+    if readInstruct(conn)!=ACK {
+        return errors.New("服务器没有回复ACK")
+    }
+    return nil
+}
+
+/*
+通知服务器删除文件块：DELETE_FILE+key，服务器返回ACK
+*/
+func (c *Client) deleteChunk(ctx context.Context, server string, key string)error{
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return err}
+    defer conn.Close()
+    err=writeAll(conn,append([]byte{DELETE_FILE},key...))
+    if err!=nil {return err}
+    setReadDeadline(ctx,conn,c.opts.Timeout*10)
+    if readInstruct(conn)!=ACK {
+        return errors.New("服务器没有回复ACK")
+    }
+    return nil
+}
+
+/*
+查询服务器上文件块的大小
+*/
+func (c *Client) chunkSize(ctx context.Context, server string, key string)(uint64,error){
+    conn,err:=c.dial(ctx,server)
+    if err!=nil {return 0,err}
+    defer conn.Close()
+    err=writeAll(conn,append([]byte{FILE_SIZE},key...))
+    if err!=nil {return 0,err}
+    setReadDeadline(ctx,conn,DOWNLOAD_STALL_TIMEOUT)
+    if readInstruct(conn)!=ACK {
+        return 0,errors.New("服务器上没有这个文件块")
+    }
+    data:=make([]byte,8)
+    _,err=io.ReadFull(conn,data)
+    if err!=nil {return 0,err}
+    return binary.BigEndian.Uint64(data),nil
+}
+
+type rangeTask struct {//下载任务中的一段
+    offset uint64
+    length uint64
+}
+
+/*
+从服务器下载文件块的一段，写到buf的对应位置
+*/
+func (c *Client) fetchRange(ctx context.Context, conn net.Conn, server string, key string, task rangeTask, buf []byte)error{
+    time_start:=time.Now()
+    var packet bytes.Buffer
+    packet.WriteByte(DOWNLOAD_RANGE)
+    packet.WriteString(key)
+    binary.Write(&packet,binary.BigEndian,task.offset)
+    binary.Write(&packet,binary.BigEndian,task.length)
+    err:=writeAll(conn,packet.Bytes())
+    if err!=nil {return err}
+    setReadDeadline(ctx,conn,DOWNLOAD_STALL_TIMEOUT)
+    data:=make([]byte,8)
+    _,err=io.ReadFull(conn,data)
+    if err!=nil {return err}
+    if binary.BigEndian.Uint64(data)!=task.length {
+        return errors.New("服务器返回的长度不对")
+    }
+    part:=buf[task.offset:task.offset+task.length]
+    for done:=0;done<len(part); {
+        setReadDeadline(ctx,conn,DOWNLOAD_STALL_TIMEOUT)//每次收到数据都延长期限，超时说明卡住了
+        end:=done+READ_SIZE
+        if end>len(part) {end=len(part)}
+        n,err:=conn.Read(part[done:end])
+        done+=n
+        if err!=nil && done<len(part) {return err}
+    }
+    c.recordTransfer(server,task.length,time.Since(time_start))
+    return nil
+}
+
+/*
+从多个服务器并行下载文件块，校验sha1后返回内容
+*/
+func (c *Client) downloadChunk(ctx context.Context, chunk Chunk)([]byte,error){
+    c.probeServers(ctx,chunk.Servers)//更新延迟和负载
+    servers:=c.rankServers(chunk.Servers)
+    if len(servers)==0 {return nil,ErrNoServer}
+    //查询文件块大小
+    var size uint64
+    var err error
+    for _,server:=range servers {
+        size,err=c.chunkSize(ctx,server,chunk.Key)
+        if err==nil {break}
+        c.recordFailure(server)
+    }
+    if err!=nil {return nil,errors.New("无法取得文件块大小："+err.Error())}
+    if size>MAX_BLOCK_SIZE {return nil,errors.New("文件块太大")}
+    buf:=make([]byte,size)
+    //切分任务
+    var tasks []rangeTask
+    for offset:=uint64(0);offset<size;offset+=DOWNLOAD_RANGE_SIZE {
+        length:=uint64(DOWNLOAD_RANGE_SIZE)
+        if size-offset<length {length=size-offset}
+        tasks=append(tasks,rangeTask{offset,length})
+    }
+    //选择服务器：预计耗时在最快服务器几倍以内的一起下载，其它的作为后备
+    var active,backup []string
+    best_cost:=c.serverCost(servers[0])
+    for _,server:=range servers {
+        if len(active)<len(tasks) && c.serverCost(server)<=best_cost*DOWNLOAD_SLOW_FACTOR {
+            active=append(active,server)
+        }else{
+            backup=append(backup,server)
+        }
+    }
+    //开始下载
+    pending:=make(chan rangeTask,len(tasks))
+    for _,task:=range tasks {pending<-task}
+    completed:=make(chan struct{},len(tasks))
+    done:=make(chan struct{})
+    worker_exit:=make(chan string,len(servers))
+    worker:=func(server string){
+        failures:=0
+        var conn net.Conn
+        defer func(){
+            if conn!=nil {conn.Close()}
+            worker_exit<-server
+        }()
+        for{
+            var task rangeTask
+            select{
+                case <-done:
+                    return
+                case task=<-pending:
+            }
+            var err error
+            if conn==nil {
+                conn,err=c.dial(ctx,server)
+                if err!=nil {conn=nil}
+            }
+            if conn!=nil {
+                err=c.fetchRange(ctx,conn,server,chunk.Key,task,buf)
+            }
+            if err!=nil {
+                pending<-task//放回队列，由其它服务器接手
+                if ctx.Err()!=nil {return}
+                c.logger(ctx).Info("下载文件块的一段失败，重新分配","server",server,"key",chunk.Key,"offset",task.offset,"err",err)
+                c.recordFailure(server)
+                if conn!=nil {
+                    conn.Close()
+                    conn=nil
+                }
+                failures++
+                if failures>=DOWNLOAD_MAX_FAILURES {return}
+                continue
+            }
+            completed<-struct{}{}
+        }
+    }
+    for _,server:=range active {go worker(server)}
+    alive:=len(active)
+    finished:=0
+    for finished<len(tasks) && err==nil {
+        select{
+            case <-completed:
+                finished++
+            case <-worker_exit:
+                alive--
+                if ctx.Err()!=nil {
+                    err=ctx.Err()
+                }else if alive==0 && len(backup)==0 {
+                    err=errors.New("所有服务器都下载失败")
+                }else if alive==0 {
+                    c.logger(ctx).Info("启用后备服务器","server",backup[0],"key",chunk.Key)
+                    go worker(backup[0])
+                    backup=backup[1:]
+                    alive++
+                }
+        }
+    }
+    //等所有下载协程退出后再校验
+    close(done)
+    for ;alive>0;alive-- {<-worker_exit}
+    if err!=nil {return nil,err}
+    sum:=sha1.Sum(buf)
+    if hex.EncodeToString(sum[:])!=chunk.Key {
+        return nil,errors.New("文件块校验失败")
+    }
+    return buf,nil
+}
@@ -8,177 +8,212 @@ import (
     "fmt"
     "os"
     "net"
-    "errors"
     "time"
     "bytes"
     "io"
     "io/ioutil"
+    "errors"
     "strings"
+    "log/slog"
+    "sync/atomic"
     "encoding/binary"
+    "dss/client"
 )
 
 /*
-客户端下载文件
-*/
-func downloadFile(filename string, tcpAddrString string)error{
-    //连接服务器
-    conn, err := net.DialTimeout("tcp", tcpAddrString, NET_TIMEOUT)
-    if err != nil {
-        fmt.Println("服务器连接失败")
-        return errors.New("服务器连接失败")
-    }
-    defer conn.Close()
-    //发送下载请求
-    sendInstruct(DOWNLOAD_FILE,conn)
-    sendString(filename,conn)
-    //下载文件
-    err=reciveFile("tmp/"+filename,conn)
-    if err!=nil {
-        fmt.Println("[ERROR]下载文件失败")
-        os.Exit(1)
-    }
-    //完成任务
-    download_mission.Done()
-    return nil
-}
-
-/*
-向所有服务器发送相同的数据（相当于广播）
+向所有服务器发送相同的数据（相当于广播），返回回复ACK的服务器和回复ERR的服务器数量
 */
-func sendDatasToAllServers(datas []byte){
-    for _, server := range global_server_list{
+func sendDatasToAllServers(datas []byte)([]string,int){
+    var acked []string
+    rejected:=0
+    for _, server := range serverList(){
         if server == self_server_addr {continue}
-        conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
+        conn, err := dialServer(server, *net_timeout)
         if err != nil {
-            fmt.Println("服务器连接失败：",server)
+            slog.Warn("服务器连接失败","server",server,"err",err)
             continue
         }
-        //log("向"+server+"发送指令：",datas)
-        log("向",server,"发送了",len(datas),"字节的数据")
-        conn.Write(datas)
-        instruct := make([]byte, 1)
-        conn.Read(instruct)
-        var i byte
-        binary.Read(bytes.NewBuffer(instruct), binary.BigEndian, &i)
-        for{
-            if i==ACK {
-                log("收到"+server+"回复：ACK")
-                break
-            }
-            time.Sleep(time.Millisecond*10)
+        slog.Debug("发送数据","server",server,"bytes",len(datas))
+        writeAll(conn,datas)
+        conn.SetReadDeadline(time.Now().Add(*sync_timeout))
+        switch readInstruct(conn) {
+            case ACK:
+                slog.Debug("收到ACK","server",server)
+                acked=append(acked,server)
+            case ERR:
+                message,_:=readData(conn)
+                slog.Warn("服务器拒绝","server",server,"reason",string(message))
+                rejected++
+            default:
+                slog.Warn("服务器没有回复ACK","server",server)
         }
         conn.Close()
     }
+    return acked,rejected
 }
 
 /*
-客户端上传数据库给服务器
+上传用户数据库给服务器（服务器迁移文件块后调用），带上持有的集群锁的fencing token。
+本机的数据库已经修改，本机也算接收了；负责这个锁的服务器接收的不足半数时返回错误
 */
-func uploadDatabase(){
-    log("向其它服务器发送数据库……",username)
-    compressUserDatabase()
+func uploadDatabase(user string, lock *client.ClusterLock)error{
+    token:=lock.Token
+    slog.Debug("向其它服务器发送数据库……","user",user,"token",token)
+    acquireGlobalLock()//DB_ZIP是共用的，压缩和读取期间需要加锁
+    compressUserDatabase(user)
     bytes_buf := bytes.NewBuffer(make([]byte, 0))
     binary.Write(bytes_buf, binary.BigEndian, SYNC_DB)
-    binary.Write(bytes_buf, binary.BigEndian, getFileSize(DB_PATH))
-    file_datas, err := ioutil.ReadFile(DB_PATH);checkErr(err)
+    binary.Write(bytes_buf, binary.BigEndian, token)
+    binary.Write(bytes_buf, binary.BigEndian, uint64(len(user)))
+    bytes_buf.WriteString(user)
+    binary.Write(bytes_buf, binary.BigEndian, getFileSize(tmpPath(DB_ZIP)))
+    file_datas, err := ioutil.ReadFile(tmpPath(DB_ZIP));checkErr(err)
+    releaseGlobalLock()
     binary.Write(bytes_buf, binary.BigEndian, file_datas)
-    sendDatasToAllServers(bytes_buf.Bytes())
-    log("数据库同步成功。")
-}
-
-/*
-服务器之间同步服务器列表
-*/
-func syncServerList(){
-    log("向其它服务器发送服务器列表……")
-    bytes_buf := bytes.NewBuffer(make([]byte, 0))
-    binary.Write(bytes_buf, binary.BigEndian, SYNC_SERVER_LIST)
-    binary.Write(bytes_buf, binary.BigEndian, getFileSize("server_list.txt"))
-    file_datas, err := ioutil.ReadFile("server_list.txt");checkErr(err)
-    binary.Write(bytes_buf, binary.BigEndian, file_datas)
-    sendDatasToAllServers(bytes_buf.Bytes())
-    log("服务器列表同步成功。")
+    acked,rejected:=sendDatasToAllServers(bytes_buf.Bytes())
+    if rejected>0 {
+        return fmt.Errorf("%d个服务器拒绝了数据库，集群锁可能已经失效",rejected)
+    }
+    if !lock.Quorum(append(acked,self_server_addr)) {
+        return errors.New("负责集群锁的服务器接收数据库的不足半数")
+    }
+    slog.Debug("数据库同步成功","user",user,"acked",len(acked))
+    return nil
 }
 
 /*
-读取服务器列表文件server_list.txt到变量global_server_list中
+读取服务器列表文件（-server_list）到服务器列表中，再加上-seeds指定的种子服务器
 */
-func refreshServerList(){
+func refreshServerList()error{
     //读取服务器列表
-    log("读取服务器列表")
-    b, err := ioutil.ReadFile("server_list.txt");checkErr(err)
+    slog.Debug("读取服务器列表")
+    b, err := ioutil.ReadFile(*server_list_file)
+    if err!=nil && !(os.IsNotExist(err) && len(seed_servers)>0) {return err}//有种子服务器时可以没有列表文件
     //将文件内容转为字符串，去除首尾的空白字符，按换行切割（如果换行是linux，只要\n），结果为服务器IP数组
-    global_server_list = strings.Split(strings.TrimSpace(string(b)), "\r\n")
-    for i,server:= range global_server_list {
-        fmt.Printf("服务器%d：%s\n", i,server)
+    var servers []string
+    for _,line:=range strings.Split(strings.TrimSpace(string(b)), "\r\n") {
+        if line=="" {continue}
+        server,err:=normalizeAddr(line)
+        if err!=nil {
+            slog.Warn("服务器地址格式不正确","addr",line,"err",err)
+            continue
+        }
+        servers=append(servers,server)
     }
+    for _,server:=range seed_servers {
+        if !containsString(servers,server) {servers=append(servers,server)}
+    }
+    if len(servers)==0 {
+        return errors.New("服务器列表为空，请检查"+*server_list_file+"或-seeds参数")
+    }
+    setServerList(servers)
+    slog.Debug("服务器列表","servers",servers)
+    return nil
 }
 
 /*
-接收文件
+接收文件（8字节文件大小+内容），完成后输出一条日志（大小和速度）。
+出错时返回错误，不退出程序；调用者需要给连接设置超时时间
 */
 func reciveFile(file_path string, conn net.Conn)error{
     time_start:=time.Now()
-    //time.Sleep(time.Millisecond * 200)//以防接不到数据
     data := make([]byte, 8)
-    conn.Read(data)
-    var file_size uint64
-    binary.Read(bytes.NewBuffer(data), binary.BigEndian, &file_size)
-    log("文件大小：",file_size)
-    var download_size uint64 = 0
-    f, err := os.Create(file_path);checkErr(err)
+    _,err:=io.ReadFull(conn,data)
+    if err!=nil {return err}
+    file_size:=binary.BigEndian.Uint64(data)
+    f, err := os.Create(file_path)
+    if err!=nil {return err}
     defer f.Close()
-    for{
-        data := make([]byte, FILE_READ_SIZE)
-        n, err := conn.Read(data);
-        if err != nil {
-            fmt.Println("[WARN]文件下载出错",err)
-            return err
-        }
-        f.Write(data[:n])
-        download_size+=uint64(n)
-        fmt.Printf("进度：%.2f\n",float32(download_size)*100/float32(file_size))//TODO:减缓输出速度
-        if download_size==file_size{
-            break
-        }
+    download_size,err:=io.CopyBuffer(f,io.LimitReader(conn,int64(file_size)),make([]byte,file_read_size))
+    if err==nil && uint64(download_size)<file_size {err=io.ErrUnexpectedEOF}
+    if err != nil {
+        connLogger(conn).Warn("文件接收出错","file",file_path,"received",download_size,"size",file_size,"err",err)
+        return err
     }
-    fmt.Println("文件下载完毕")
-    time_end:=time.Now()
-    fmt.Printf("下载速度：%.3f MB/s\n",float64(float64(file_size)/1024/1024/time_end.Sub(time_start).Seconds()))
+    connLogger(conn).Debug("文件接收完毕","file",file_path,"size",file_size,"duration",time.Since(time_start),"mb_per_s",speedMBps(file_size,time.Since(time_start)))
     return nil
 }
 
+/*
+传输速度（MB/s）
+*/
+func speedMBps(size uint64, duration time.Duration)float64{
+    if duration<=0 {return 0}
+    return float64(size)/1024/1024/duration.Seconds()
+}
+
 /*
 发送文件
 */
 func sendFile(file_path string, conn net.Conn){
     time_start:=time.Now()
     bytes_buf := bytes.NewBuffer(make([]byte, 0))
-    file_size:=getFileSize(file_path)
+    var file_size uint64 = 0 //文件不存在时发送0
+    f,err:=os.Open(file_path)
+    if err==nil {
+        defer f.Close()
+        info,err:=f.Stat()
+        if err==nil {file_size=uint64(info.Size())}
+    }
     binary.Write(bytes_buf, binary.BigEndian, file_size)//8字节文件大小（uint64）
     conn.Write(bytes_buf.Bytes())
+    if file_size==0 {return}
     //发送文件
-    var upload_size uint64 = 0
-    log("开始发送文件……")
-    f,err:=os.Open(file_path);checkErr(err)
-    defer f.Close()
-    buf := make([]byte, FILE_READ_SIZE)
+    buf := make([]byte, file_read_size)
     for {
         n, err := f.Read(buf)
         if err != nil && err != io.EOF {
-            fmt.Println("[WARN]文件发送出错",err)
+            connLogger(conn).Warn("文件发送出错","file",file_path,"err",err)
             return
         }
         if 0 == n {
             break
         }
         writeAll(conn,buf[:n])
-        upload_size+=uint64(n)
-        fmt.Printf("进度：%.2f\n",float32(upload_size)*100/float32(file_size))
     }
-    log("文件发送完毕！")//客户端接收完成后会关闭连接，服务器会自动关闭
-    time_end:=time.Now()
-    fmt.Printf("上传速度：%.3f MB/s\n",float64(float64(file_size)/1024/1024/time_end.Sub(time_start).Seconds()))
+    //客户端接收完成后会关闭连接，服务器会自动关闭
+    connLogger(conn).Debug("文件发送完毕","file",file_path,"size",file_size,"duration",time.Since(time_start),"mb_per_s",speedMBps(file_size,time.Since(time_start)))
+}
+
+/*
+发送文件的一段，超出文件范围的部分不发送
+*/
+func sendFileRange(file_path string, offset uint64, length uint64, conn net.Conn){
+    var file_size uint64 = 0
+    f,err:=os.Open(file_path)
+    if err==nil {
+        defer f.Close()
+        info,err:=f.Stat()
+        if err==nil {file_size=uint64(info.Size())}
+    }
+    if offset>file_size {offset=file_size}
+    if length>file_size-offset {length=file_size-offset}
+    bytes_buf := bytes.NewBuffer(make([]byte, 0))
+    binary.Write(bytes_buf, binary.BigEndian, length)//8字节实际长度（uint64）
+    conn.Write(bytes_buf.Bytes())
+    if length==0 {return}
+    _,err=io.Copy(conn,io.NewSectionReader(f,int64(offset),int64(length)))
+    if err!=nil {
+        connLogger(conn).Warn("文件发送出错","file",file_path,"offset",offset,"length",length,"err",err)
+    }
+}
+
+/*
+开始一次文件传输，服务器负载加一；返回的函数在传输完成后调用，负载减一
+*/
+func beginTransfer()func(){
+    atomic.AddInt32(&global_server_load,1)
+    return func(){atomic.AddInt32(&global_server_load,-1)}
+}
+
+/*
+服务器负载（SERVER_LOAD指令返回的一个字节），最大253
+*/
+func serverLoad()uint8{
+    load:=atomic.LoadInt32(&global_server_load)
+    if load>253 {load=253}
+    if load<0 {load=0}
+    return uint8(load)
 }
 
 /*
@@ -191,7 +226,7 @@ func readInstruct(conn net.Conn)byte{
         return ERR
     }
     if err!=nil {
-        fmt.Println("[ERROR]读取指令出错：",err)
+        slog.Warn("读取指令出错","remote",conn.RemoteAddr().String(),"err",err)
         return ERR
     }
     return instruct[0]
@@ -212,46 +247,15 @@ func sendString(strings string,conn net.Conn){
 }
 
 /*
-读取Key
+读取Key，格式不正确时返回错误：key会拼接成本地文件的路径，不能是其它字符
 */
-func readKey(conn net.Conn)string{
+func readKey(conn net.Conn)(string,error){
     data := make([]byte, 40)//key长度40
-    n, _ :=conn.Read(data)//读取key
+    n, err :=io.ReadFull(conn,data)//读取key
     key:=string(data[0:n])//将key转成字符串
-    return key
-}
-
-/*
-客户端获取服务器负载
-*/
-func getServerLoad(server string)uint8{//获取服务器负载
-    conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
-    if err != nil {
-        fmt.Println("服务器连接失败：",server)
-        return ERR
-    }
-    conn.Write([]byte{SERVER_LOAD})
-    server_load := make([]byte, 1)
-    conn.Read(server_load)
-    conn.Close()
-    return uint8(server_load[0])
-}
-
-/*
-客户端上传文件
-*/
-func uploadFile(key string,conn net.Conn){
-    sendInstruct(UPLOAD_FILE,conn)
-    sendString(key,conn)
-    sendFile("tmp/"+key,conn)
-    instruct:=readInstruct(conn)//等待服务端回应ACK
-    if instruct==ACK {
-        fmt.Println("上传成功：",key)
-    }else{
-        fmt.Println("[ERROR]上传失败：",key)//TODO:处理失败情形
-    }
-    conn.Close()
-    upload_mission.Done()
+    if err!=nil {return key,err}
+    if !isKey(key) {return key,errors.New("文件key格式不正确")}
+    return key,nil
 }
 
 /*
@@ -274,49 +278,41 @@ func writeAll(c net.Conn, b []byte)error{
 /*
 客户端获取最新到数据库
 */
-func getGlobalDatabase(){
-    log("获取最新数据库……")
-    for _,server:= range global_server_list {
-        conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
+func getGlobalDatabase()error{
+    slog.Debug("获取最新数据库……")
+    for _,server:= range serverList() {
+        conn, err := dialServer(server, *net_timeout)
         if err!=nil {continue}
-        fmt.Println("服务器连接成功：",server)
+        slog.Debug("服务器连接成功","server",server)
         sendInstruct(SEND_DB,conn)
-        err=reciveFile(DB_PATH,conn)//下载文件
+        conn.SetReadDeadline(time.Now().Add(*sync_timeout))
+        err=reciveFile(tmpPath(DB_ZIP),conn)//下载文件
+        if err==nil {err=decompressDatabase(tmpPath(DB_ZIP))}
         if err!=nil {
-            fmt.Println("[ERROR]数据库下载失败")
+            slog.Warn("数据库下载失败","server",server,"err",err)
             conn.Close()
             continue
         }
-        decompressDatabase()
         //关闭连接并退出循环
         conn.Close()
-        return
+        return nil
     }
-    fmt.Println("[ERROR]数据库下载失败：没有可用的服务器。")
-    os.Exit(1)
+    return errors.New("数据库下载失败：没有可用的服务器")
 }
 
 /*
-客户端获取最新的服务器列表（服务器在加入集群之后也会调用一次）
+客户端获取最新的成员表和服务器列表（服务器在加入集群之后也会调用一次）
 */
-func updateServerList(){
-    log("获取最新服务器列表……")
-    for _,server:= range global_server_list {
-        conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
-        if err!=nil {continue}
-        fmt.Println("服务器连接成功：",server)
-        sendInstruct(GET_SERVER_LIST,conn)
-        err=reciveFile("server_list.txt",conn)
+func updateServerList()error{
+    slog.Debug("获取最新服务器列表……")
+    for _,server:= range serverList() {
+        err:=fetchMembers(server,!*enable_server)//客户端直接使用服务器的成员表，服务器则合并
         if err!=nil {
-            fmt.Println("[ERROR]服务器列表下载失败：",err)
-            conn.Close()
+            slog.Debug("成员表获取失败","server",server,"err",err)
             continue
         }
-        //关闭连接并退出循环
-        conn.Close()
-        refreshServerList()//刷新服务器列表
-        return
+        slog.Debug("服务器列表","from",server,"servers",serverList())
+        return nil
     }
-    fmt.Println("[ERROR]服务器列表下载失败：没有可用的服务器。")
-    os.Exit(1)
+    return errors.New("服务器列表下载失败：没有可用的服务器")
 }
@@ -0,0 +1,52 @@
+package main
+
+/*
+服务器读取文件key和发送文件的测试：不正确的key返回错误，不存在的文件发送大小0，都不能让服务器退出
+*/
+
+import (
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/binary"
+)
+
+func TestReadKey(t *testing.T){
+    tests:=[]struct{
+        name string
+        data string
+        ok bool
+    }{
+        {"正确的key","0123456789abcdef0123456789abcdef01234567",true},
+        {"大写字母","0123456789ABCDEF0123456789ABCDEF01234567",false},
+        {"跳出文件夹","../../../../../../../../../../etc/passwd",false},
+        {"含有斜杠","0123456789abcdef0123456789abcdef0123/567",false},
+        {"不够40个字符","0123456789abcdef",false},
+        {"没有key","",false},
+    }
+    for _,test:=range tests {
+        client_conn,server_conn:=net.Pipe()
+        go func(){
+            io.WriteString(client_conn,test.data)
+            client_conn.Close()
+        }()
+        key,err:=readKey(server_conn)
+        server_conn.Close()
+        if (err==nil)!=test.ok {t.Errorf("%s：读取到%q，%v",test.name,key,err)}
+    }
+}
+
+func TestSendFileNotExist(t *testing.T){
+    path:=filepath.Join(t.TempDir(),strings.Repeat("0",40))
+    client_conn,server_conn:=net.Pipe()
+    go func(){
+        sendFile(path,server_conn)
+        server_conn.Close()
+    }()
+    data,err:=ioutil.ReadAll(client_conn)
+    if err!=nil {t.Fatal(err)}
+    if len(data)!=8 || binary.BigEndian.Uint64(data)!=0 {t.Errorf("文件不存在时返回了%v",data)}
+}
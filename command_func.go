@@ -0,0 +1,570 @@
+package main
+
+/*
+本文件包含了客户端命令相关的函数：子命令（dss put、dss get……）和交互式命令行共用的操作
+*/
+
+/*
+客户端命令：
+dss [全局参数] <子命令> [子命令参数] [参数]
+子命令执行完就退出，退出码表示失败的原因，方便在脚本、cron、Makefile中使用；
+没有子命令或子命令为shell时进入交互式命令行。
+每个操作都返回error，不会直接退出进程，交互式命令行只打印错误。
+*/
+
+import (
+    "fmt"
+    "os"
+    "flag"
+    "sync"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "io/fs"
+    "path/filepath"
+    "database/sql"
+    "dss/client"
+)
+
+const ( //退出码
+    EXIT_OK = 0 //成功
+    EXIT_ERROR = 1 //其它错误
+    EXIT_USAGE = 2 //命令或参数错误
+    EXIT_NETWORK = 3 //连接不上服务器，或上传下载失败
+    EXIT_NOT_FOUND = 4 //文件或用户数据库不存在
+    EXIT_SYNC = 5 //数据库更新失败（申请集群锁失败或同步被拒绝）
+    EXIT_IO = 6 //本地文件读写失败
+    EXIT_QUOTA = 7 //超出用户的存储配额
+)
+
+const CLIENT_USAGE_MSG= //客户端子命令帮助信息
+    `用法：dss [全局参数] <命令> [参数]
+命令：
+    put -u 用户名 [-r] 文件...   上传文件，-r递归上传文件夹
+    get [-o 输出路径] [-r] 用户名 文件名  下载文件，默认保存到download文件夹，-r递归下载文件夹
+    ls [-l] [用户名]              查看可下载的文件列表，-l查看文件块和所在的服务器
+    rm -u 用户名 文件名...        删除文件
+    sync -u 用户名 [-n] [-delete 策略] 本地文件夹 服务器文件夹
+                                  双向同步文件夹，-n只显示要做的操作，删除策略为none（默认）、local、remote或both
+    watch -u 用户名 本地文件夹 [服务器文件夹]
+                                  监视文件夹，自动上传新建和修改的文件，Ctrl+C退出
+    mount 挂载点                  把集群挂载成文件系统（FUSE，只支持Linux），Ctrl+C卸载
+    share -u 用户名 [-password 密码] [-expire 72h] [-max 次数] [文件名]
+                                  分享文件，生成网关上的下载链接；没有文件名时列出已有的分享
+    unshare -u 用户名 令牌...      取消分享
+    quota [用户名]                查看用户的配额和用量
+    quota -u 用户名 [-bytes 10G] [-files 数量] [-dedup]
+                                  设置用户的配额（管理员使用，需要全局参数-admin_key），不设置的项不限，都不设置时取消配额，-dedup表示相同的文件块只计算一次
+    gateway [-addr :8080] [-s3 :9000] [-webdav :8081] [-cert 证书 -key 私钥]
+                                  启动HTTP网关（REST接口）、S3兼容网关和WebDAV网关，认证令牌保存在-gateway_tokens指定的文件中
+    status                        服务器状态和用户的用量
+    update                        更新服务器列表和数据库
+    shell                         交互式命令行（没有命令时默认进入）
+退出码：0成功，1其它错误，2命令或参数错误，3网络错误，4文件不存在，5数据库更新失败，6本地文件读写失败，7超出存储配额
+全局参数（-json：标准输出只输出JSON记录，每行一条）：`
+
+type CommandError struct {//带退出码的错误
+    Code int
+    Err error
+}
+
+func (e *CommandError) Error()string{
+    return e.Err.Error()
+}
+
+/*
+给错误加上退出码
+*/
+func commandError(code int, err error)error{
+    if err==nil {return nil}
+    return &CommandError{code,err}
+}
+
+/*
+取得错误对应的退出码
+*/
+func exitCode(err error)int{
+    if err==nil {return EXIT_OK}
+    var command_err *CommandError
+    if errors.As(err,&command_err) {return command_err.Code}
+    return EXIT_ERROR
+}
+
+/*
+客户端初始化：读取服务器列表，获取成员表和数据库
+*/
+func clientInit()error{
+    err:=refreshServerList()
+    if err!=nil {return commandError(EXIT_USAGE,errors.New("读取服务器列表失败："+err.Error()))}
+    return updateDatabase()
+}
+
+/*
+更新服务器列表和数据库（update命令）
+*/
+func updateDatabase()error{
+    err:=updateServerList()
+    if err!=nil {return commandError(EXIT_NETWORK,err)}
+    err=getGlobalDatabase()
+    return commandError(EXIT_NETWORK,err)
+}
+
+/*
+执行子命令，返回退出码
+*/
+func runCommand(args []string)int{
+    if len(args)==0 {args=[]string{"shell"}}
+    command,args:=args[0],args[1:]
+    flags:=flag.NewFlagSet(command,flag.ContinueOnError)
+    user:=flags.String("u","","User name.用户名。")
+    output:=flags.String("o","","Output path.输出路径。")
+    long:=flags.Bool("l",false,"Show chunks and servers.显示文件块和所在的服务器。")
+    recursive:=flags.Bool("r",false,"Upload or download directories recursively.递归上传、下载文件夹。")
+    dry_run:=flags.Bool("n",false,"Dry run, only show what sync would do.只显示同步要做的操作，不实际执行。")
+    delete_policy:=flags.String("delete","none","Which side sync may delete files from: none, local, remote or both.同步时允许删除哪一边的文件。")
+    addr:=flags.String("addr",":8080","HTTP gateway listen address.HTTP网关的监听地址。")
+    s3_addr:=flags.String("s3","","S3 gateway listen address, empty to disable.S3网关的监听地址，为空时不启动。")
+    webdav_addr:=flags.String("webdav","","WebDAV gateway listen address, empty to disable.WebDAV网关的监听地址，为空时不启动。")
+    password:=flags.String("password","","Password of the share link, empty for none.分享链接的密码，为空时不需要密码。")
+    expire:=flags.Duration("expire",0,"Share link expires after this duration, 0 for never.分享链接的有效期，0表示不过期。")
+    max_downloads:=flags.Int64("max",0,"Maximum downloads of the share link, 0 for unlimited.分享链接最多下载次数，0表示不限。")
+    max_bytes:=flags.String("bytes","0","Quota of used space, such as 10G, 0 for unlimited.配额：最多占用的空间，如10G，0表示不限。")
+    max_files:=flags.Int64("files",0,"Quota of file count, 0 for unlimited.配额：最多文件数量，0表示不限。")
+    dedup:=flags.Bool("dedup",false,"Count identical chunks only once in the quota.计算配额用量时相同的文件块只计算一次。")
+    cert:=flags.String("cert","","HTTPS certificate file of the gateway.HTTP网关的证书文件，为空时使用HTTP。")
+    key:=flags.String("key","","HTTPS private key file of the gateway.HTTP网关的私钥文件。")
+    switch command {
+        case "put","get","ls","rm","sync","watch","mount","share","unshare","quota","gateway","status","update","shell":
+        case "help","-h","--help":
+            printUsage()
+            return EXIT_OK
+        default:
+            fmt.Fprintln(os.Stderr,"未知命令：",command)
+            printUsage()
+            return EXIT_USAGE
+    }
+    if flags.Parse(args)!=nil {return EXIT_USAGE}
+    args=flags.Args()
+    //检查参数
+    usage_err:=""
+    switch command {
+        case "put":
+            if *user=="" || len(args)==0 {usage_err="用法：dss put -u 用户名 [-r] 文件..."}
+        case "get":
+            if len(args)!=2 {usage_err="用法：dss get [-o 输出路径] [-r] 用户名 文件名"}
+        case "rm":
+            if *user=="" || len(args)==0 {usage_err="用法：dss rm -u 用户名 文件名..."}
+        case "ls":
+            if len(args)>1 {usage_err="用法：dss ls [-l] [用户名]"}
+        case "sync":
+            if *user=="" || len(args)!=2 {usage_err="用法：dss sync -u 用户名 [-n] [-delete none|local|remote|both] 本地文件夹 服务器文件夹"}
+        case "watch":
+            if *user=="" || len(args)==0 || len(args)>2 {usage_err="用法：dss watch -u 用户名 本地文件夹 [服务器文件夹]"}
+        case "mount":
+            if len(args)!=1 {usage_err="用法：dss mount 挂载点"}
+        case "share":
+            if *user=="" || len(args)>1 {usage_err="用法：dss share -u 用户名 [-password 密码] [-expire 72h] [-max 次数] [文件名]"}
+        case "unshare":
+            if *user=="" || len(args)==0 {usage_err="用法：dss unshare -u 用户名 令牌..."}
+        case "quota":
+            if len(args)>1 || (*user!="" && len(args)!=0) {usage_err="用法：dss quota [用户名] 或 dss quota -u 用户名 [-bytes 10G] [-files 数量] [-dedup]"}
+        case "gateway":
+            if len(args)!=0 || (*cert=="")!=(*key=="") {usage_err="用法：dss gateway [-addr :8080] [-s3 :9000] [-webdav :8081] [-cert 证书 -key 私钥]"}
+    }
+    if usage_err!="" {
+        fmt.Fprintln(os.Stderr,usage_err)
+        return EXIT_USAGE
+    }
+    err:=clientInit()
+    if err!=nil {
+        fmt.Fprintln(os.Stderr,"[ERROR]",err)
+        if *json_output {emitJSON(ErrorRecord{"error",exitCode(err),err.Error()})}
+        return exitCode(err)
+    }
+    switch command {
+        case "put":
+            for _,file_path:=range args {
+                if *recursive {
+                    err=putTree(*user,file_path)
+                }else{
+                    err=putFile(*user,file_path)
+                }
+                if err!=nil {break}
+            }
+        case "get":
+            if *recursive {
+                err=getTree(args[0],args[1],*output)
+            }else{
+                err=getFile(args[0],args[1],*output)
+            }
+        case "ls":
+            filter:=""
+            if len(args)==1 {filter=args[0]}
+            err=listFiles(*long,filter)
+        case "rm":
+            for _,filename:=range args {
+                err=deleteFile(*user,filename)
+                if err!=nil {break}
+            }
+        case "sync":
+            err=syncTree(*user,args[0],args[1],*delete_policy,*dry_run)
+        case "watch":
+            remote:=""
+            if len(args)==2 {remote=args[1]}
+            err=watchFolder(*user,args[0],remote)
+        case "mount":
+            err=mountCluster(args[0])
+        case "share":
+            if len(args)==0 {
+                err=listShares(*user)
+            }else{
+                err=shareFile(*user,args[0],*password,*expire,*max_downloads)
+            }
+        case "unshare":
+            for _,token:=range args {
+                err=revokeShare(*user,token)
+                if err!=nil {break}
+            }
+        case "quota":
+            if *user!="" {
+                err=setQuota(*user,*max_bytes,*max_files,*dedup)
+            }else{
+                filter:=""
+                if len(args)==1 {filter=args[0]}
+                err=showQuota(filter)
+            }
+        case "gateway":
+            err=runGateway(*addr,*s3_addr,*webdav_addr,*cert,*key)
+        case "status":
+            err=printStatus()
+        case "update":
+            //clientInit已经更新过了
+        case "shell":
+            clientShell()
+    }
+    if err!=nil {
+        fmt.Fprintln(os.Stderr,"[ERROR]",err)
+        if *json_output {emitJSON(ErrorRecord{"error",exitCode(err),err.Error()})}
+    }
+    return exitCode(err)
+}
+
+/*
+打印子命令帮助
+*/
+func printUsage(){
+    fmt.Fprintln(os.Stderr,CLIENT_USAGE_MSG)
+    flag.PrintDefaults()
+}
+
+/*
+新建客户端库的Client：使用服务器列表和database文件夹，日志和进度的输出方式和命令行一致
+*/
+func newClient(user string)(*client.Client,error){
+    return newClientIn(user,*database_dir)
+}
+
+/*
+新建Client，数据库放在dir中
+*/
+func newClientIn(user string, dir string)(*client.Client,error){
+    c,err:=client.New(client.Options{
+        Servers:serverList(),
+        User:user,
+        Dir:dir,
+        Timeout:*net_timeout,
+        SyncTimeout:*sync_timeout,
+        AdminKey:*admin_key,
+        Parallel:*parallel,
+        BlockSize:block_size,
+        Replicas:REPLICA_NUM,
+        Logger:slog.Default(),
+        Progress:func(p client.Progress){
+            record:=ProgressRecord{Op:p.Op,User:user,Name:p.Name,Chunk:p.Chunk,Key:p.Key,Servers:p.Servers,Done:p.Done,Total:p.Total,RequestID:p.RequestID}
+            if p.Err!=nil {
+                record.Error=p.Err.Error()
+                slog.Warn("文件块传输失败","op",p.Op,"name",p.Name,"chunk",p.Chunk,"key",p.Key,"request_id",p.RequestID,"err",p.Err)
+            }else{
+                slog.Info("文件块传输完成","op",p.Op,"name",p.Name,"chunk",p.Chunk,"key",p.Key,"servers",p.Servers,"request_id",p.RequestID)
+            }
+            emitProgress(record)
+        },
+    })
+    return c,commandError(EXIT_USAGE,err)
+}
+
+/*
+每个用户一个Client，同时为多个用户服务时使用（挂载、网关）。
+每个Client的数据库放在自己的文件夹（CLIENT_POOL_DIR/用户名）中：
+Client获取数据库时会替换文件夹中所有用户的数据库，共用文件夹时一个用户的List可能在另一个用户提交修改和同步数据库之间
+把它的数据库换成旧的，修改就丢了；fetchUsers解压全局数据库也不会影响它们
+*/
+type clientPool struct {
+    clients map[string]*client.Client
+    lock sync.Mutex
+}
+
+const CLIENT_POOL_DIR=".clients" //数据库文件夹中存放每个用户的Client的数据库的文件夹，以“.”开头，压缩数据库和listUsers时会跳过
+
+func newClientPool()*clientPool{
+    return &clientPool{clients:map[string]*client.Client{}}
+}
+
+/*
+取得用户的Client，没有时新建
+*/
+func (p *clientPool) get(user string)(*client.Client,error){
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if c,exist:=p.clients[user];exist {return c,nil}
+    if err:=client.ValidUser(user);err!=nil {return nil,commandError(EXIT_USAGE,err)}
+    c,err:=newClientIn(user,filepath.Join(*database_dir,CLIENT_POOL_DIR,user))
+    if err!=nil {return nil,err}
+    p.clients[user]=c
+    return c,nil
+}
+
+/*
+关闭所有Client
+*/
+func (p *clientPool) close(){
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    for _,c:=range p.clients {c.Close()}
+    p.clients=map[string]*client.Client{}
+}
+
+/*
+从服务器获取最新的数据库，返回所有用户
+*/
+func fetchUsers()([]string,error){
+    acquireGlobalLock()
+    err:=getGlobalDatabase()
+    releaseGlobalLock()
+    if err!=nil {return nil,commandError(EXIT_NETWORK,err)}
+    return listUsers(),nil
+}
+
+/*
+给客户端库返回的错误加上退出码，无法判断原因的错误使用code
+*/
+func clientError(err error, code int)error{
+    var path_err *fs.PathError
+    switch {
+        case err==nil:
+            return nil
+        case errors.Is(err,client.ErrNotFound):
+            code=EXIT_NOT_FOUND
+        case errors.Is(err,client.ErrSync):
+            code=EXIT_SYNC
+        case errors.Is(err,client.ErrNoServer):
+            code=EXIT_NETWORK
+        case errors.Is(err,client.ErrQuota):
+            code=EXIT_QUOTA
+        case errors.As(err,&path_err):
+            code=EXIT_IO
+    }
+    return commandError(code,err)
+}
+
+/*
+下载文件：
+由客户端库查询文件的文件块和所在的服务器，每个文件块从所有在线的副本并行分段下载，
+校验后直接写到输出文件的对应位置。output为空时保存到download文件夹
+*/
+func getFile(user string, filename string, output string)error{
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    ctx:=context.Background()
+    info,err:=c.Stat(ctx,filename)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    if output=="" {
+        output,err=downloadPath(filename)
+        if err!=nil {return commandError(EXIT_USAGE,err)}
+        err=os.MkdirAll(filepath.Dir(output),0755)
+        if err!=nil {return commandError(EXIT_IO,err)}
+    }
+    f,err:=os.Create(output)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    fmt.Println("开始下载，文件块数量：",len(info.Chunks))
+    err=c.Get(ctx,filename,f)
+    if cerr:=f.Close();err==nil {err=cerr}
+    if err!=nil {
+        os.Remove(output)//不留下不完整的文件
+        return clientError(err,EXIT_NETWORK)
+    }
+    fmt.Println("文件下载成功：",output)
+    return nil
+}
+
+/*
+没有指定输出路径时，文件下载到下载文件夹（-download_dir）中，文件名中的“/”为子文件夹，不能跳出下载文件夹
+*/
+func downloadPath(filename string)(string,error){
+    rel:=filepath.FromSlash(filename)
+    if !filepath.IsLocal(rel) {return "",errors.New("文件名不安全，请用-o指定输出路径："+filename)}
+    return filepath.Join(*download_dir,rel),nil
+}
+
+/*
+上传文件：
+由客户端库把文件切成文件块，为每个文件块选择服务器并上传，
+然后持有该用户的集群锁写入数据库并同步到服务器（同名文件会被替换）
+*/
+func putFile(user string, file_path string)error{
+    if user=="" || user=="Anonymous" {
+        return commandError(EXIT_USAGE,errors.New("请先登录"))
+    }
+    fmt.Println("文件路径：",file_path)
+    f,err:=os.Open(file_path)
+    if err!=nil {return commandError(EXIT_NOT_FOUND,err)}
+    defer f.Close()
+    info,err:=f.Stat()
+    if err!=nil {return commandError(EXIT_IO,err)}
+    if info.IsDir() {return commandError(EXIT_USAGE,errors.New("不能上传文件夹："+file_path))}
+    filename:=filepath.Base(file_path)
+    fmt.Println("文件名：",filename)
+    fmt.Println("文件大小：",info.Size())
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    err=c.PutWithModTime(context.Background(),filename,f,info.ModTime())
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    fmt.Println("文件上传完毕！")
+    return nil
+}
+
+/*
+删除文件：
+由客户端库持有该用户的集群锁，从数据库中删除文件并同步到服务器，
+然后通知存放文件块的服务器删除不再被引用的文件块
+*/
+func deleteFile(user string, filename string)error{
+    if user=="" || user=="Anonymous" {
+        return commandError(EXIT_USAGE,errors.New("请先登录"))
+    }
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    err=c.Delete(context.Background(),filename)
+    if err!=nil {return clientError(err,EXIT_ERROR)}
+    fmt.Println("文件删除完毕！")
+    return nil
+}
+
+/*
+查看可下载的文件列表，long为true时显示文件块和所在的服务器，user不为空时只显示该用户的文件
+*/
+func listFiles(long bool, user string)error{
+    users:=listUsers()
+    if user!="" {
+        if !containsString(users,user) {
+            return commandError(EXIT_NOT_FOUND,errors.New("用户数据库不存在："+user))
+        }
+        users=[]string{user}
+    }
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    for _,user:=range users {
+        if long {
+            err:=listChunks(user)
+            if err!=nil {return err}
+            continue
+        }
+        files,err:=queryFiles(user)
+        if err!=nil {return err}
+        if *json_output {
+            for _,file:=range files {
+                emitJSON(FileRecord{"file",user,file.Name,file.Size,file.Mtime,file.Chunks})
+            }
+            continue
+        }
+        fmt.Println(user+".db :")
+        for _,file:=range files {
+            fmt.Println("    ",file.Name)
+        }
+        fmt.Println("")
+    }
+    return nil
+}
+
+/*
+查看用户的文件及其分块、分块所在的服务器
+*/
+func listChunks(user string)error{
+    db, err := sql.Open(DB_TYPE, dbPath(user))
+    if err!=nil {return err}
+    defer db.Close()
+    rows, err := db.Query(`SELECT FileKey.filename,FileKey.num,FileKey.key,KeyServer.server FROM FileKey,KeyServer WHERE FileKey.key=KeyServer.key ORDER BY FileKey.filename,FileKey.num`)
+    if err!=nil {return err}
+    var records []ChunkRecord
+    for rows.Next() {
+        var filename,key,server string
+        var num int
+        if err = rows.Scan(&filename,&num,&key,&server); err != nil {
+            rows.Close()
+            return err
+        }
+        if !*json_output {
+            fmt.Println(user,filename,num,key,server)
+            continue
+        }
+        //同一个文件块的服务器合并成一条记录
+        if n:=len(records);n>0 && records[n-1].Name==filename && records[n-1].Num==num {
+            records[n-1].Servers=append(records[n-1].Servers,server)
+            continue
+        }
+        records=append(records,ChunkRecord{"chunk",user,filename,num,key,[]string{server}})
+    }
+    for _,record:=range records {emitJSON(record)}
+    return nil
+}
+
+/*
+获取最新的成员表，并发连接每个服务器检查是否在线
+*/
+func serverStatus()([]ServerRecord,error){
+    err:=updateServerList()
+    if err!=nil {return nil,commandError(EXIT_NETWORK,err)}
+    members:=memberList()
+    records:=make([]ServerRecord,len(members))
+    parallelDo(len(members),len(members),func(i int)error{
+        member:=members[i]
+        online:=false
+        if conn,err:=dialServer(member.Addr,*net_timeout);err==nil {
+            online=true
+            conn.Close()
+        }
+        records[i]=ServerRecord{"server",member.Addr,online,memberStateName(member.State),member.Incarnation,member.Zone,client.MemberWeight(clientMember(member)),member.Addrs,member.Draining}
+        return nil
+    })
+    return records,nil
+}
+
+/*
+打印服务器状态和每个用户的用量，有服务器连不上时返回错误
+*/
+func printStatus()error{
+    records,err:=serverStatus()
+    if err!=nil {return err}
+    var offline []string
+    for _,record:=range records {
+        if !record.Online && record.State==memberStateName(MEMBER_ALIVE) {offline=append(offline,record.Addr)}
+        if *json_output {
+            emitJSON(record)
+            continue
+        }
+        online:="在线"
+        if !record.Online {online="无法连接"}
+        fmt.Println(record.Addr,online,"集群状态：",record.State,"化身号：",record.Incarnation,"故障域：",record.Zone,"容量：",record.Capacity,"其它地址：",record.Addrs)
+    }
+    if !*json_output {fmt.Println("")}
+    err=printQuotas(listUsers())
+    if err!=nil {return err}
+    if len(offline)>0 {
+        return commandError(EXIT_NETWORK,errors.New("部分服务器无法连接："+strings.Join(offline,",")))
+    }
+    return nil
+}
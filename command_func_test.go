@@ -0,0 +1,61 @@
+package main
+
+/*
+命令行客户端的测试
+*/
+
+import (
+    "testing"
+    "path/filepath"
+)
+
+/*
+网关和挂载为每个用户建立的Client使用各自的数据库文件夹，不和全局数据库（fetchUsers）共用
+*/
+func TestClientPoolDirs(t *testing.T){
+    saved_dir,saved_servers:=*database_dir,serverList()
+    *database_dir=t.TempDir()
+    setServerList([]string{"127.0.0.1:1"})
+    defer func(){
+        *database_dir=saved_dir
+        setServerList(saved_servers)
+    }()
+    pool:=newClientPool()
+    defer pool.close()
+    dirs:=map[string]bool{}
+    for _,user:=range []string{"alice","bob"} {
+        c,err:=pool.get(user)
+        if err!=nil {t.Fatal(err)}
+        if again,_:=pool.get(user);again!=c {t.Errorf("%s：再次获取时新建了Client",user)}
+        dir:=filepath.Join(*database_dir,CLIENT_POOL_DIR,user)
+        if matches,_:=filepath.Glob(dir);len(matches)!=1 {t.Errorf("%s：没有建立文件夹%s",user,dir)}
+        dirs[dir]=true
+    }
+    if len(dirs)!=2 {t.Error("两个用户共用了数据库文件夹")}
+    for _,user:=range []string{"",".clients","../x","a/b"} {
+        if _,err:=pool.get(user);err==nil {t.Errorf("%q：用户名不正确，应该出错",user)}
+    }
+}
+
+func TestDownloadPath(t *testing.T){
+    tests:=[]struct{
+        filename string
+        expect string //空字符串表示应该出错
+    }{
+        {"a.jpg",filepath.Join("download","a.jpg")},
+        {"photos/a.jpg",filepath.Join("download","photos","a.jpg")},
+        {"photos/2024/a.jpg",filepath.Join("download","photos","2024","a.jpg")},
+        {"../a.jpg",""},
+        {"photos/../../a.jpg",""},
+        {"/etc/passwd",""},
+        {"",""},
+    }
+    for _,test:=range tests {
+        path,err:=downloadPath(test.filename)
+        if test.expect=="" {
+            if err==nil {t.Errorf("%q：应该出错，返回了%s",test.filename,path)}
+            continue
+        }
+        if err!=nil || path!=test.expect {t.Errorf("%q：返回%s，%v，期望%s",test.filename,path,err,test.expect)}
+    }
+}
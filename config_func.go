@@ -0,0 +1,182 @@
+package main
+
+/*
+本文件包含了配置文件相关的函数：-config参数指定一个TOML文件，服务端和客户端都可以使用
+*/
+
+/*
+配置文件的每一项就是一个命令行参数，键为参数名（不带“-”），比如：
+    enable_server = true
+    listen = "192.168.1.10:2333"
+    advertise = "202.38.1.2:40000"
+    storage_dir = "/data/dss/storage"
+    seeds = ["192.168.1.1:2333", "192.168.1.2:2333"]
+    timeout = "500ms"
+    max_connections = 200
+    auto_rebalance = false
+    block_size = "8M"
+命令行参数优先：命令行上指定了的参数不使用配置文件中的值。未知的参数名和格式不正确的值都会在启动时报错。
+文件块大小（-block_size）只影响新上传的文件：每个文件在数据库中记录自己的分块大小，读取时按文件的分块大小计算偏移。
+*/
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "crypto/subtle"
+    "path/filepath"
+    "dss/client"
+    "github.com/BurntSushi/toml"
+)
+
+var config_file = flag.String("config", "", "TOML config file, keys are flag names; flags on the command line override it.配置文件（TOML），键为命令行参数名，命令行上的参数优先。")
+var storage_dir = flag.String("storage_dir", "storage", "Directory of the chunks stored on this server.服务器存放文件块的文件夹。")
+var database_dir = flag.String("database_dir", "database", "Directory of the user databases.用户数据库的文件夹。")
+var tmp_dir = flag.String("tmp_dir", "tmp", "Directory of temporary files.临时文件的文件夹。")
+var server_list_file = flag.String("server_list", "server_list.txt", "Server list file, updated from the membership table.服务器列表文件，由成员表自动更新。")
+var seeds = flag.String("seeds", "", "Seed servers (host:port, comma separated) used together with the server list file.种子服务器（host:port，逗号分隔），和服务器列表文件一起使用。")
+var net_timeout = flag.Duration("timeout", time.Millisecond*300, "Timeout of connecting to a server.连接服务器的超时时间。")
+var sync_timeout = flag.Duration("sync_timeout", time.Second*30, "Time to wait for a server to acknowledge a synced database.发送数据库后等待对方确认的时间，对方需要解压数据库。")
+var read_buffer = flag.String("read_buffer", "2M", "Buffer size of sending and receiving files on servers, such as 2M.服务器收发文件的缓存大小，如2M。")
+var block_size_flag = flag.String("block_size", "32M", "Chunk size of newly uploaded files, such as 8M; every file records its own chunk size.客户端新上传的文件的分块大小，如8M，每个文件记录自己的分块大小，修改后已有的文件不受影响。")
+var download_dir = flag.String("download_dir", "download", "Directory of downloaded files when no output path is given.没有指定输出路径时下载文件保存的文件夹。")
+var gateway_token_file = flag.String("gateway_tokens", "gateway_tokens.txt", "Token file of the gateways, one \"token user\" per line.网关的认证令牌文件，每行“令牌 用户名”。")
+var history_file = flag.String("history_file", ".dss_history", "Command history file of the shell, empty for not saving history.交互式命令行的历史文件，为空时不保存历史。")
+var parallel = flag.Int("parallel", client.DEFAULT_PARALLEL, "Chunks downloaded at the same time by the client.客户端同时下载的文件块数量。")
+var max_connections = flag.Int("max_connections", 0, "Connections a server handles at the same time, including other servers, 0 for unlimited.服务器同时处理的连接数量（包括其它服务器的连接），0表示不限制。")
+var auto_rebalance = flag.Bool("auto_rebalance", true, "Rebalance chunks automatically when a server joins.有服务器加入时自动重新平衡文件块。")
+var admin_key = flag.String("admin_key", "", "Admin key, the same on all servers; needed to set quotas and decommission servers. Empty on a server disables these.管理员密钥，所有服务器要相同，设置配额和服务器下线时需要；服务器上为空时不能执行这些操作。")
+var rebalance_delay = flag.Duration("rebalance_delay", time.Second*30, "Wait this long after a server joins before rebalancing.服务器加入后等待多久开始重新平衡。")
+
+var file_read_size int //收发文件的缓存大小，由-read_buffer得到
+var block_size int64 = client.BLOCK_SIZE //新上传的文件的分块大小，由-block_size得到
+var seed_servers []string //种子服务器，由-seeds得到
+
+/*
+读取配置文件，把命令行上没有指定的参数设置为配置文件中的值，然后检查所有参数
+*/
+func loadConfig()error{
+    if *config_file!="" {
+        err:=applyConfigFile(*config_file)
+        if err!=nil {return err}
+    }
+    return validateConfig()
+}
+
+/*
+读取TOML配置文件并设置参数
+*/
+func applyConfigFile(path string)error{
+    values:=map[string]interface{}{}
+    _,err:=toml.DecodeFile(path,&values)
+    if err!=nil {return errors.New("配置文件读取失败："+err.Error())}
+    set_on_command_line:=map[string]bool{}
+    flag.Visit(func(f *flag.Flag){set_on_command_line[f.Name]=true})
+    for name,value:=range values {
+        if name=="config" || flag.Lookup(name)==nil {
+            return errors.New("配置文件中有未知的参数："+name)
+        }
+        if set_on_command_line[name] {continue}
+        text,err:=configValue(value)
+        if err==nil {err=flag.Set(name,text)}
+        if err!=nil {return fmt.Errorf("配置文件中的参数%s不正确：%v",name,err)}
+    }
+    return nil
+}
+
+/*
+把TOML的值转换成命令行参数的格式，数组转换成逗号分隔的字符串
+*/
+func configValue(value interface{})(string,error){
+    switch v:=value.(type) {
+        case string:
+            return v,nil
+        case bool:
+            return strconv.FormatBool(v),nil
+        case int64:
+            return strconv.FormatInt(v,10),nil
+        case float64:
+            return strconv.FormatFloat(v,'g',-1,64),nil
+        case []interface{}:
+            var items []string
+            for _,item:=range v {
+                text,err:=configValue(item)
+                if err!=nil {return "",err}
+                items=append(items,text)
+            }
+            return strings.Join(items,","),nil
+    }
+    return "",fmt.Errorf("不支持的类型%T",value)
+}
+
+/*
+检查参数，并计算由参数得到的全局变量
+*/
+func validateConfig()error{
+    port_num,err:=strconv.Atoi(*port)
+    if err!=nil || port_num<=0 || port_num>65535 {return errors.New("-port参数不正确："+*port)}
+    self_server_addrs,err=parseAddrList(*addrs)
+    if err!=nil {return errors.New("-addrs参数不正确："+err.Error())}
+    if *advertise!="" {
+        *advertise,err=normalizeAddr(*advertise)
+        if err!=nil {return errors.New("-advertise参数不正确："+err.Error())}
+    }
+    seed_servers,err=parseAddrList(*seeds)
+    if err!=nil {return errors.New("-seeds参数不正确："+err.Error())}
+    for name,value:=range map[string]string{"storage_dir":*storage_dir,"database_dir":*database_dir,"tmp_dir":*tmp_dir,"server_list":*server_list_file,"download_dir":*download_dir,"gateway_tokens":*gateway_token_file} {
+        if value=="" {return errors.New("-"+name+"参数不能为空")}
+    }
+    if *capacity<=0 {return errors.New("-capacity参数必须大于0")}
+    if *rebalance_threshold<0 || *rebalance_bandwidth<0 {return errors.New("-rebalance_threshold和-rebalance_bandwidth参数不能小于0")}
+    if *net_timeout<=0 || *sync_timeout<=0 {return errors.New("-timeout和-sync_timeout参数必须大于0")}
+    if *rebalance_delay<0 {return errors.New("-rebalance_delay参数不能小于0")}
+    size,err:=parseSize(*read_buffer)
+    if err!=nil {return errors.New("-read_buffer参数不正确："+err.Error())}
+    if size<4096 || size>client.BLOCK_SIZE {return errors.New("-read_buffer参数必须在4K和文件块大小之间："+*read_buffer)}
+    file_read_size=int(size)
+    block_size,err=parseSize(*block_size_flag)
+    if err!=nil {return errors.New("-block_size参数不正确："+err.Error())}
+    if block_size<client.MIN_BLOCK_SIZE || block_size>client.MAX_BLOCK_SIZE {return errors.New("-block_size参数必须在64K和256M之间："+*block_size_flag)}
+    if *parallel<1 {return errors.New("-parallel参数必须大于0")}
+    if *max_connections<0 {return errors.New("-max_connections参数不能小于0")}
+    return nil
+}
+
+/*
+检查管理员密钥（设置配额、服务器下线等管理操作需要），服务器没有设置管理员密钥时不能执行管理操作
+*/
+func checkAdminKey(key string)error{
+    if *admin_key=="" {return errors.New("服务器没有设置管理员密钥（-admin_key），不能执行管理操作")}
+    if subtle.ConstantTimeCompare([]byte(key),[]byte(*admin_key))!=1 {return errors.New("管理员密钥不正确")}
+    return nil
+}
+
+/*
+本地文件的路径
+*/
+func storagePath(key string)string{
+    return filepath.Join(*storage_dir,key)
+}
+
+func databasePath(name string)string{
+    return filepath.Join(*database_dir,name)
+}
+
+func tmpPath(name string)string{
+    return filepath.Join(*tmp_dir,name)
+}
+
+/*
+创建需要的文件夹
+*/
+func createDirs()error{
+    for _,dir:=range []string{*tmp_dir,*storage_dir,*database_dir,*download_dir} {
+        err:=os.MkdirAll(dir,os.ModePerm)
+        if err!=nil {return err}
+    }
+    return nil
+}
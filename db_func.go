@@ -15,60 +15,72 @@ TABEL file_key(
     num int(4),//文件分块号，从0开始
     key char(40),//key，即文件分块名，sha1字符串形式，共40字节
 )
+TABEL file_info(//旧版本的数据库没有这个表，修改数据库时自动新建
+    filename varchar(255),//文件名
+    size int(8),//文件大小
+    mtime int(8),//文件修改时间（Unix时间戳）
+)
 */
 
 import (
     "os"
+    "errors"
+    "log/slog"
     "io/ioutil"
-    "time"
+    "archive/zip"
+    "database/sql"
+    "dss/client"
 )
 
+type FileInfo struct {//文件信息
+    User string
+    Name string
+    Size int64 //旧版本上传的文件没有记录，为-1
+    Mtime int64
+    Chunks int
+}
+
 
 /*
-申请数据库锁
+申请数据库锁（本进程内），读写本地数据库文件和DB_ZIP时使用。
+集群范围内修改用户数据库使用集群锁，见lock_func.go
 */
 func acquireGlobalLock(){
-    log("等待数据库锁……")
-    for{
-        if global_db_lock_status==FREE {
-            log("得到数据库锁。")
-            global_db_lock_status=USING
-            return
-        }
-        time.Sleep(time.Millisecond*10)//避免CPU占用100%
-    }
+    slog.Debug("等待数据库锁……")
+    global_db_lock.Lock()
+    slog.Debug("得到数据库锁")
 }
 
 /*
 释放数据库锁
 */
 func releaseGlobalLock(){
-    log("释放数据库锁。")
-    global_db_lock_status=FREE
+    slog.Debug("释放数据库锁")
+    global_db_lock.Unlock()
 }
 
 /*
 根据用户名取得数据库路径
 */
 func dbPath(user string)string{
-    return "database/"+user+".db"
+    return databasePath(user+".db")
 }
 
 
 /*
-压缩用户数据库，客户端上传或删除文件后，更新数据库到集群时会用到
+压缩用户数据库，客户端上传或删除文件后、服务器迁移文件块后，更新数据库到集群时会用到
 */
-func compressUserDatabase(){
-    f1, err := os.Open(dbPath(username))//username为全局变量，当前登录用户名
+func compressUserDatabase(user string){
+    f1, err := os.Open(dbPath(user))
 	if err != nil {
-		log(err)
+		slog.Error("压缩数据库失败","err",err)
         os.Exit(1)
 	}
 	defer f1.Close()
     var files = []*os.File{f1}
-    err = Compress(files, DB_PATH)
+    err = Compress(files, tmpPath(DB_ZIP))
 	if err != nil {
-		log(err)
+		slog.Error("压缩数据库失败","err",err)
         os.Exit(1)
 	}
 }
@@ -78,31 +90,169 @@ func compressUserDatabase(){
 */
 func compressDatabase(){
     var files = []*os.File{}
-    dir, err := ioutil.ReadDir("database");checkErr(err)
+    dir, err := ioutil.ReadDir(*database_dir);checkErr(err)
     for _,f := range dir {
         if(subString(f.Name(),0,1)=="."){continue}
-        f1, err := os.Open("database/"+f.Name())
+        f1, err := os.Open(databasePath(f.Name()))
         if err != nil {
-    		log(err)
+    		slog.Error("压缩数据库失败","err",err)
             os.Exit(1)
     	}
         files=append(files,f1)
         defer f1.Close()
     }
-    err = Compress(files, DB_PATH)
+    err = Compress(files, tmpPath(DB_ZIP))
 	if err != nil {
-		log(err)
+		slog.Error("压缩数据库失败","err",err)
         os.Exit(1)
 	}
 }
 
 /*
-解压缩数据库，客户端或服务端接受数据库时会用到
+解压缩数据库到数据库文件夹，客户端或服务端接受数据库时会用到
 */
-func decompressDatabase(){
-    err := DeCompress(DB_PATH, "database")
-	if err != nil {
-		log(err)
-        os.Exit(1)
-	}
+func decompressDatabase(zip_path string)error{
+    err := DeCompress(zip_path, *database_dir)
+    if err != nil {return errors.New("解压数据库失败："+err.Error())}
+    return nil
+}
+
+/*
+新建FileInfo表（如果不存在）
+*/
+func ensureFileInfoTable(tx *sql.Tx)error{
+    _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS FileInfo (
+    filename string,
+    size int64,
+    mtime int64,
+    );`)
+    return err
+}
+
+/*
+查询用户的所有文件，读取数据库时需要持有数据库锁
+*/
+func queryFiles(user string)([]FileInfo,error){
+    db, err := sql.Open(DB_TYPE, dbPath(user))
+    if err!=nil {return nil,err}
+    defer db.Close()
+    var files []FileInfo
+    rows, err := db.Query(`SELECT filename,count(key) FROM FileKey GROUP BY filename`)
+    if err!=nil {return nil,err}
+    for rows.Next() {
+        file:=FileInfo{User:user,Size:-1}
+        if err = rows.Scan(&file.Name,&file.Chunks); err != nil {
+            rows.Close()
+            return nil,err
+        }
+        files=append(files,file)
+    }
+    //文件大小和修改时间，旧版本的数据库没有FileInfo表
+    info:=map[string][2]int64{}
+    rows, err = db.Query(`SELECT filename,size,mtime FROM FileInfo`)
+    if err==nil {
+        for rows.Next() {
+            var filename string
+            var size,mtime int64
+            if err = rows.Scan(&filename,&size,&mtime); err != nil {
+                rows.Close()
+                break
+            }
+            info[filename]=[2]int64{size,mtime}
+        }
+    }
+    for i:=range files {
+        if v,exist:=info[files[i].Name];exist {
+            files[i].Size,files[i].Mtime=v[0],v[1]
+        }
+    }
+    return files,nil
+}
+
+/*
+检查同步过来的数据库压缩包：只能包含这个用户自己的数据库，
+用户名、文件名必须是合法的UTF-8且没有控制字符，key必须是sha1字符串，用量增加后不能超出配额
+*/
+func checkSyncDatabase(user string, zip_path string)error{
+    err:=client.ValidUser(user)
+    if err!=nil {return err}
+    reader, err := zip.OpenReader(zip_path)
+    if err!=nil {return err}
+    defer reader.Close()
+    if len(reader.File)!=1 || reader.File[0].Name!="/"+user+".db" {
+        return errors.New("数据库压缩包只能包含该用户的数据库")
+    }
+    //解压到临时文件检查内容
+    rc, err := reader.File[0].Open()
+    if err!=nil {return err}
+    content, err := ioutil.ReadAll(rc)
+    rc.Close()
+    if err!=nil {return err}
+    tmp_file, err := ioutil.TempFile(*tmp_dir, "sync-check-*.db")
+    if err!=nil {return err}
+    tmp_path:=tmp_file.Name()
+    defer os.Remove(tmp_path)
+    _, err = tmp_file.Write(content)
+    tmp_file.Close()
+    if err!=nil {return err}
+    db, err := sql.Open(DB_TYPE, tmp_path)
+    if err!=nil {return err}
+    defer db.Close()
+    rows, err := db.Query(`SELECT filename,key FROM FileKey`)
+    if err!=nil {return err}
+    for rows.Next() {
+        var filename,key string
+        if err = rows.Scan(&filename,&key); err != nil {
+            rows.Close()
+            return err
+        }
+        if err = client.ValidName(filename); err != nil {
+            rows.Close()
+            return err
+        }
+        if !isKey(key) {
+            rows.Close()
+            return errors.New("文件块的key不正确："+key)
+        }
+    }
+    rows, err = db.Query(`SELECT key FROM KeyServer`)
+    if err!=nil {return err}
+    for rows.Next() {
+        var key string
+        if err = rows.Scan(&key); err != nil {
+            rows.Close()
+            return err
+        }
+        if !isKey(key) {
+            rows.Close()
+            return errors.New("文件块的key不正确："+key)
+        }
+    }
+    //分块大小，旧版本的数据库没有FileBlock表
+    rows, err = db.Query(`SELECT block_size FROM FileBlock`)
+    if err==nil {
+        for rows.Next() {
+            var size int64
+            if err = rows.Scan(&size); err != nil {
+                rows.Close()
+                return err
+            }
+            if size<client.MIN_BLOCK_SIZE || size>client.MAX_BLOCK_SIZE {
+                rows.Close()
+                return errors.New("文件分块大小不正确")
+            }
+        }
+    }
+    return checkSyncQuota(db,user)
+}
+
+/*
+判断字符串是不是sha1字符串（40个小写十六进制字符）
+*/
+func isKey(key string)bool{
+    if len(key)!=40 {return false}
+    for _,c:=range key {
+        if !(c>='0' && c<='9') && !(c>='a' && c<='f') {return false}
+    }
+    return true
 }
@@ -0,0 +1,291 @@
+package main
+
+/*
+本文件包含了服务器下线（退出集群）相关的函数
+*/
+
+/*
+下线流程：
+管理员在客户端执行decommission命令，客户端向要下线的服务器发送DECOMMISSION指令和管理员密钥（-admin_key）
+服务器把自己标记为下线中（Draining），通过gossip传播，客户端上传时不再选择它
+服务器扫描所有用户数据库，找出存放在本机的文件块，复制到其它服务器，直到副本数量满足REPLICA_NUM
+每复制完一批文件块，就修改KeyServer并同步数据库到集群
+处理完后重新扫描，成员表还没有更新的客户端可能又上传了文件块到本机，直到一轮扫描没有找到新的文件块
+全部完成后，服务器把自己标记为已退出（MEMBER_LEFT），其它服务器会把它从服务器列表中删除
+下线过程中可以用DRAIN_STATUS查询进度，用DRAIN_CANCEL取消
+*/
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "log/slog"
+    "encoding/json"
+)
+
+const DRAIN_SYNC_BATCH=32 //每迁移这么多个文件块同步一次数据库
+
+type DrainStatus struct {//下线进度
+    Running bool //是否正在下线
+    Finished bool //是否已完成（已退出集群）
+    Canceled bool //是否被取消
+    Total int //需要处理的文件块数量
+    Done int //已处理的文件块数量
+    Failed int //迁移失败的文件块数量
+    Current string //正在处理的文件块
+    Message string //最后一条消息
+}
+
+var drain_status DrainStatus
+var drain_status_lock sync.Mutex
+var drain_cancel chan struct{}
+
+/*
+取得下线进度的副本
+*/
+func getDrainStatus()DrainStatus{
+    drain_status_lock.Lock()
+    defer drain_status_lock.Unlock()
+    return drain_status
+}
+
+/*
+修改下线进度
+*/
+func updateDrainStatus(f func(status *DrainStatus)){
+    drain_status_lock.Lock()
+    defer drain_status_lock.Unlock()
+    f(&drain_status)
+}
+
+/*
+开始下线，如果已经在下线中则返回错误
+*/
+func startDrain()error{
+    drain_status_lock.Lock()
+    defer drain_status_lock.Unlock()
+    if drain_status.Running {
+        return errors.New("已经在下线中")
+    }
+    if drain_status.Finished {
+        return errors.New("已经退出集群")
+    }
+    placeable:=0
+    for _,server:=range serverList() {
+        if server!=self_server_addr && isPlaceable(server) {placeable++}
+    }
+    if placeable==0 {
+        return errors.New("集群中没有其它可以存放文件块的服务器")
+    }
+    drain_status=DrainStatus{Running:true,Message:"开始下线"}
+    drain_cancel=make(chan struct{})
+    go drainServer(drain_cancel)
+    return nil
+}
+
+/*
+取消下线
+*/
+func cancelDrain()error{
+    drain_status_lock.Lock()
+    defer drain_status_lock.Unlock()
+    if !drain_status.Running {
+        return errors.New("没有在下线")
+    }
+    if drain_status.Canceled {
+        return errors.New("正在取消")
+    }
+    close(drain_cancel)//正在迁移的文件块完成后，下线协程才会退出
+    drain_status.Canceled=true
+    drain_status.Message="正在取消……"
+    return nil
+}
+
+/*
+下线协程，把本机的文件块全部迁移到其它服务器
+*/
+func drainServer(cancel chan struct{}){
+    slog.Info("开始下线，迁移本机的文件块……")
+    updateSelfMember(MEMBER_ALIVE,true)//标记为下线中，不再接收新的文件块
+    canceled:=func()bool{
+        select{
+            case <-cancel:
+                return true
+            default:
+                return false
+        }
+    }
+    var pending []ChunkMove //已经发送、还没有写入数据库的迁移
+    var key_users map[string][]string
+    flush:=func(){
+        failed:=applyChunkMoves(pending,key_users,true,true)
+        updateDrainStatus(func(status *DrainStatus){
+            status.Done-=len(failed)
+            status.Failed+=len(failed)
+        })
+        pending=nil
+    }
+    //成员表还没有传播到的客户端可能在扫描之后继续上传到本机，所以反复扫描，直到一轮扫描没有找到新的文件块才退出集群
+    handled:=map[string]bool{} //已经处理过（包括失败）的文件块
+    for !canceled() {
+        key_servers,users,err:=scanKeyServers()
+        if err!=nil {
+            updateDrainStatus(func(status *DrainStatus){
+                status.Running=false
+                status.Message="读取数据库失败："+err.Error()
+            })
+            updateSelfMember(MEMBER_ALIVE,false)
+            return
+        }
+        key_users=users
+        var keys []string
+        for key,servers:=range key_servers {
+            if containsString(servers,self_server_addr) && !handled[key] {keys=append(keys,key)}
+        }
+        if len(keys)==0 {break}
+        updateDrainStatus(func(status *DrainStatus){status.Total+=len(keys)})
+        for i,key:=range keys {
+            if canceled() {break}
+            handled[key]=true
+            updateDrainStatus(func(status *DrainStatus){status.Current=key})
+            //计算还需要多少个副本：其它可以存放文件块的服务器上的副本不用动
+            var keep []string
+            for _,server:=range key_servers[key] {
+                if server!=self_server_addr && isPlaceable(server) {keep=append(keep,server)}
+            }
+            need:=REPLICA_NUM-len(keep)
+            var targets []string
+            if need>0 {
+                var used_zones []string
+                for _,server:=range keep {used_zones=append(used_zones,serverZone(server))}
+                targets=placeChunk(key,need,used_zones,func(server string)bool{
+                    if containsString(key_servers[key],server) {return false}
+                    conn, err := dialServer(server, *net_timeout)
+                    if err!=nil {return false}
+                    conn.Close()
+                    return true
+                })
+                if len(targets)==0 {
+                    slog.Warn("没有可用的目标服务器，文件块迁移失败","key",key)
+                    updateDrainStatus(func(status *DrainStatus){status.Failed++})
+                    continue
+                }
+            }
+            err:=migrateChunk(key,targets)
+            if err!=nil {
+                slog.Warn("文件块迁移失败","key",key,"err",err)
+                updateDrainStatus(func(status *DrainStatus){status.Failed++})
+                continue
+            }
+            if len(targets)==0 {
+                pending=append(pending,ChunkMove{key,self_server_addr,""})//副本已经足够，只删除本机
+            }
+            for _,target:=range targets {
+                pending=append(pending,ChunkMove{key,self_server_addr,target})
+            }
+            updateDrainStatus(func(status *DrainStatus){status.Done++})
+            if (i+1)%DRAIN_SYNC_BATCH==0 {
+                flush()
+            }
+            printMigrateProgress("下线",i+1,len(keys))
+        }
+        flush()
+    }
+    status:=getDrainStatus()
+    if status.Canceled {
+        slog.Info("下线已取消")
+        updateSelfMember(MEMBER_ALIVE,false)
+        updateDrainStatus(func(status *DrainStatus){
+            status.Running=false
+            status.Current=""
+            status.Message="下线已取消"
+        })
+        return
+    }
+    if status.Failed>0 {
+        updateDrainStatus(func(status *DrainStatus){
+            status.Running=false
+            status.Message=fmt.Sprint("有",status.Failed,"个文件块迁移失败，本机仍处于下线中，可以再次执行下线命令重试")
+        })
+        slog.Warn("下线未完成，有文件块迁移失败","failed",status.Failed)
+        return
+    }
+    //全部完成，退出集群
+    updateSelfMember(MEMBER_LEFT,false)
+    for _,member:=range memberList() {//主动通知所有成员，不用等gossip慢慢传播
+        if member.Addr!=self_server_addr && member.State!=MEMBER_DEAD {pingMember(member.Addr)}
+    }
+    updateDrainStatus(func(status *DrainStatus){
+        status.Running=false
+        status.Finished=true
+        status.Current=""
+        status.Message="下线完成，已退出集群，可以关闭本服务器"
+    })
+    slog.Info("下线完成，已退出集群，可以关闭本服务器")
+}
+
+/*
+客户端发送下线相关的指令（DECOMMISSION、DRAIN_STATUS、DRAIN_CANCEL），返回服务器的下线进度
+*/
+func sendDrainCommand(server string, instruct byte)(DrainStatus,error){
+    var status DrainStatus
+    conn, err := dialServer(server, *net_timeout)
+    if err != nil {return status,err}
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(*net_timeout*10))
+    sendInstruct(instruct,conn)
+    if instruct!=DRAIN_STATUS {//开始和取消下线需要管理员密钥
+        sendData([]byte(*admin_key),conn)
+    }
+    if readInstruct(conn)!=ACK {
+        message,_:=readData(conn)
+        return status,errors.New(string(message))
+    }
+    datas,err:=readData(conn)
+    if err!=nil {return status,err}
+    err=json.Unmarshal(datas,&status)
+    return status,err
+}
+
+/*
+服务器处理下线相关的指令
+*/
+func handleDrainCommand(instruct byte, conn net.Conn){
+    var err error
+    if instruct!=DRAIN_STATUS {
+        var key []byte
+        key,err=readData(conn)
+        if err==nil {err=checkAdminKey(string(key))}
+    }
+    if err==nil {
+        switch instruct {
+            case DECOMMISSION:
+                err=startDrain()
+            case DRAIN_CANCEL:
+                err=cancelDrain()
+        }
+    }
+    if err!=nil {
+        sendInstruct(ERR,conn)
+        sendData([]byte(err.Error()),conn)
+        return
+    }
+    datas,_:=json.Marshal(getDrainStatus())
+    sendInstruct(ACK,conn)
+    sendData(datas,conn)
+}
+
+/*
+打印下线进度
+*/
+func printDrainStatus(server string, status DrainStatus){
+    fmt.Println("服务器：",server)
+    fmt.Println("    正在下线：",status.Running,"已完成：",status.Finished,"已取消：",status.Canceled)
+    fmt.Printf("    进度：%d/%d，失败：%d\n",status.Done,status.Total,status.Failed)
+    if status.Current!="" {
+        fmt.Println("    正在迁移：",status.Current)
+    }
+    fmt.Println("    ",status.Message)
+}
@@ -0,0 +1,44 @@
+package main
+
+/*
+下线指令的测试：开始和取消下线需要管理员密钥，查询进度不需要
+*/
+
+import (
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestDrainCommandAdminKey(t *testing.T){
+    saved_key:=*admin_key
+    defer func(){*admin_key=saved_key}()
+    tests:=[]struct{
+        name string
+        server_key string //服务器的管理员密钥
+        instruct byte
+        key string //客户端发送的密钥
+        reply byte
+        message string //返回ERR时的错误信息
+    }{
+        {"服务器没有设置密钥","",DECOMMISSION,"secret",ERR,"没有设置管理员密钥"},
+        {"密钥不正确","secret",DECOMMISSION,"wrong",ERR,"密钥不正确"},
+        {"取消时密钥不正确","secret",DRAIN_CANCEL,"",ERR,"密钥不正确"},
+        {"密钥正确","secret",DRAIN_CANCEL,"secret",ERR,"没有在下线"},//通过检查，没有在下线所以取消失败
+        {"查询进度","secret",DRAIN_STATUS,"",ACK,""},
+    }
+    for _,test:=range tests {
+        *admin_key=test.server_key
+        client_conn,server_conn:=net.Pipe()
+        go func(){
+            handleDrainCommand(test.instruct,server_conn)
+            server_conn.Close()
+        }()
+        if test.instruct!=DRAIN_STATUS {sendData([]byte(test.key),client_conn)}
+        reply:=readInstruct(client_conn)
+        message,_:=readData(client_conn)
+        client_conn.Close()
+        if reply!=test.reply {t.Errorf("%s：返回%d（%s），期望%d",test.name,reply,message,test.reply);continue}
+        if reply==ERR && !strings.Contains(string(message),test.message) {t.Errorf("%s：错误信息为%s",test.name,message)}
+    }
+}
@@ -0,0 +1,365 @@
+package main
+
+/*
+本文件包含了HTTP网关相关的函数（gateway命令）：浏览器和其它语言的程序通过HTTP使用存储系统
+*/
+
+/*
+HTTP接口（除了分享链接，所有请求都需要认证）：
+    GET    /api/users                    用户列表
+    GET    /api/files/用户名/[文件夹/]    文件列表（JSON，和-json输出的file记录相同），只列出该文件夹下的文件
+    GET    /api/files/用户名/文件名       下载文件，支持Range、If-Modified-Since和HEAD，边下载文件块边输出
+    PUT    /api/files/用户名/文件名       上传文件，请求体就是文件内容，由网关切块上传；Last-Modified请求头可以指定修改时间
+    POST   /api/files/用户名/[文件夹/]    multipart/form-data上传多个文件到该文件夹，全部上传完后一次性写入数据库
+    DELETE /api/files/用户名/文件名       删除文件
+/share/和/api/shares是分享链接（见share_func.go），其它路径是网页界面（见webui_func.go）。
+文件名中的“/”表示文件夹，文件名要URL编码。出错时返回 {"error":"原因"} 和对应的HTTP状态码。
+认证：令牌文件（-gateway_tokens，默认gateway_tokens.txt）中每行一个“令牌 用户名”，请求时用 Authorization: Bearer 令牌，
+或者HTTP Basic认证（用户名+令牌作为密码，浏览器会弹出登录框）。
+所有用户都可以读取所有用户的文件（和命令行一样），只能修改自己的文件。
+*/
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "errors"
+    "context"
+    "strings"
+    "syscall"
+    "net/http"
+    "os/signal"
+    "encoding/json"
+    "dss/client"
+)
+
+const GATEWAY_SHUTDOWN_TIMEOUT=30*time.Second //退出时等待正在进行的请求的时间
+
+type gateway struct {
+    tokens map[string]string //令牌 -> 用户名
+    clients *clientPool
+}
+
+/*
+读取认证令牌文件，空行和#开头的行忽略
+*/
+func loadGatewayTokens(path string)(map[string]string,error){
+    f,err:=os.Open(path)
+    if err!=nil {return nil,err}
+    defer f.Close()
+    tokens:=map[string]string{}
+    scanner:=bufio.NewScanner(f)
+    for line:=1;scanner.Scan();line++ {
+        text:=strings.TrimSpace(scanner.Text())
+        if text=="" || strings.HasPrefix(text,"#") {continue}
+        fields:=strings.Fields(text)
+        if len(fields)!=2 || client.ValidUser(fields[1])!=nil {
+            return nil,fmt.Errorf("%s第%d行格式不正确，应为“令牌 用户名”",path,line)
+        }
+        tokens[fields[0]]=fields[1]
+    }
+    if err:=scanner.Err();err!=nil {return nil,err}
+    if len(tokens)==0 {return nil,errors.New(path+"中没有令牌")}
+    return tokens,nil
+}
+
+/*
+认证请求，返回令牌对应的用户名
+*/
+func (g *gateway) authenticate(r *http.Request)(string,bool){
+    if name,token,ok:=r.BasicAuth();ok {
+        user,exist:=g.tokens[token]
+        return user,exist && (name=="" || name==user)
+    }
+    if header:=r.Header.Get("Authorization");strings.HasPrefix(header,"Bearer ") {
+        user,exist:=g.tokens[strings.TrimSpace(header[len("Bearer "):])]
+        return user,exist
+    }
+    return "",false
+}
+
+/*
+输出JSON
+*/
+func writeJSON(w http.ResponseWriter, status int, v interface{}){
+    w.Header().Set("Content-Type","application/json; charset=utf-8")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+/*
+输出错误，status为0时按错误的退出码选择HTTP状态码
+*/
+func writeHTTPError(w http.ResponseWriter, status int, err error){
+    if status==0 {
+        switch exitCode(clientError(err,EXIT_ERROR)) {
+            case EXIT_USAGE:
+                status=http.StatusBadRequest
+            case EXIT_NOT_FOUND:
+                status=http.StatusNotFound
+            case EXIT_NETWORK:
+                status=http.StatusBadGateway
+            case EXIT_SYNC:
+                status=http.StatusConflict
+            case EXIT_QUOTA:
+                status=http.StatusInsufficientStorage
+            default:
+                status=http.StatusInternalServerError
+        }
+    }
+    writeJSON(w,status,map[string]string{"error":err.Error()})
+}
+
+/*
+把客户端库的文件信息转换成file记录
+*/
+func fileRecord(file client.FileInfo)FileRecord{
+    var mtime int64
+    if !file.ModTime.IsZero() {mtime=file.ModTime.Unix()}
+    return FileRecord{"file",file.User,file.Name,file.Size,mtime,len(file.Chunks)}
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request){
+    r=withHTTPRequestID(w,r)
+    if strings.HasPrefix(r.URL.Path,"/share/") {//分享链接不需要认证
+        g.serveShare(w,r)
+        return
+    }
+    start:=time.Now()
+    user,ok:=g.authenticate(r)
+    if !ok {
+        w.Header().Set("WWW-Authenticate",`Basic realm="dss"`)
+        writeHTTPError(w,http.StatusUnauthorized,errors.New("需要认证"))
+        httpLogger("http",r).Warn("认证失败")
+        return
+    }
+    switch {
+        case r.URL.Path=="/api/users":
+            g.serveUsers(w,r)
+        case strings.HasPrefix(r.URL.Path,"/api/files/"):
+            g.serveFiles(w,r,user)
+        case r.URL.Path=="/api/me":
+            g.serveMe(w,r,user)
+        case r.URL.Path=="/api/status":
+            g.serveStatus(w,r)
+        case strings.HasPrefix(r.URL.Path,"/api/chunks/"):
+            g.serveChunks(w,r)
+        case r.URL.Path=="/api/shares" || strings.HasPrefix(r.URL.Path,"/api/shares/"):
+            g.serveShares(w,r,user)
+        case !strings.HasPrefix(r.URL.Path,"/api/"):
+            g.serveUI(w,r)
+        default:
+            writeHTTPError(w,http.StatusNotFound,errors.New("接口不存在："+r.URL.Path))
+    }
+    httpLogger("http",r).Info("请求完成","user",user,"duration",time.Since(start))
+}
+
+/*
+用户列表
+*/
+func (g *gateway) serveUsers(w http.ResponseWriter, r *http.Request){
+    if r.Method!=http.MethodGet {
+        writeHTTPError(w,http.StatusMethodNotAllowed,errors.New("只支持GET"))
+        return
+    }
+    users,err:=fetchUsers()
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    if users==nil {users=[]string{}}
+    writeJSON(w,http.StatusOK,users)
+}
+
+/*
+/api/files/用户名/文件名：文件名为空或以“/”结尾时表示文件夹
+*/
+func (g *gateway) serveFiles(w http.ResponseWriter, r *http.Request, auth_user string){
+    path:=strings.TrimPrefix(r.URL.Path,"/api/files/")
+    user,name:=path,""
+    if i:=strings.Index(path,"/");i>=0 {user,name=path[:i],path[i+1:]}
+    if err:=client.ValidUser(user);err!=nil {
+        writeHTTPError(w,http.StatusBadRequest,err)
+        return
+    }
+    is_dir:=name=="" || strings.HasSuffix(name,"/")
+    if !is_dir {
+        if err:=client.ValidName(name);err!=nil {
+            writeHTTPError(w,http.StatusBadRequest,err)
+            return
+        }
+    }
+    if r.Method!=http.MethodGet && r.Method!=http.MethodHead && user!=auth_user {
+        writeHTTPError(w,http.StatusForbidden,errors.New("只能修改自己的文件"))
+        return
+    }
+    c,err:=g.clients.get(user)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    switch {
+        case is_dir && r.Method==http.MethodGet:
+            g.listFiles(w,r,c,name)
+        case is_dir && r.Method==http.MethodPost:
+            g.uploadFiles(w,r,c,name)
+        case !is_dir && (r.Method==http.MethodGet || r.Method==http.MethodHead):
+            g.downloadFile(w,r,c,name)
+        case !is_dir && r.Method==http.MethodPut:
+            g.putFile(w,r,c,name)
+        case !is_dir && r.Method==http.MethodDelete:
+            err=c.Delete(r.Context(),name)
+            if err!=nil {
+                writeHTTPError(w,0,err)
+                return
+            }
+            w.WriteHeader(http.StatusNoContent)
+        default:
+            writeHTTPError(w,http.StatusMethodNotAllowed,errors.New("不支持的请求方法："+r.Method))
+    }
+}
+
+/*
+文件夹下的文件列表（包括子文件夹中的文件）
+*/
+func (g *gateway) listFiles(w http.ResponseWriter, r *http.Request, c *client.Client, prefix string){
+    files,err:=c.List(r.Context())
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    records:=[]FileRecord{}
+    for _,file:=range files {
+        if strings.HasPrefix(file.Name,prefix) {records=append(records,fileRecord(file))}
+    }
+    writeJSON(w,http.StatusOK,records)
+}
+
+/*
+下载文件：边下载文件块边输出，Range请求只下载需要的文件块
+*/
+func (g *gateway) downloadFile(w http.ResponseWriter, r *http.Request, c *client.Client, name string){
+    info,err:=c.Stat(r.Context(),name)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    g.serveReader(w,r,c,info)
+}
+
+/*
+输出文件内容（下载文件和分享链接共用）
+*/
+func (g *gateway) serveReader(w http.ResponseWriter, r *http.Request, c *client.Client, info client.FileInfo){
+    reader:=c.NewReader(r.Context(),info)
+    if info.Size<0 {//旧版本上传的文件没有记录大小，不支持Range
+        w.Header().Set("Content-Type","application/octet-stream")
+        if r.Method==http.MethodGet {io.Copy(w,reader)}
+        return
+    }
+    http.ServeContent(w,r,info.Name,info.ModTime,reader)
+}
+
+/*
+上传文件：请求体就是文件内容
+*/
+func (g *gateway) putFile(w http.ResponseWriter, r *http.Request, c *client.Client, name string){
+    mtime:=time.Now()
+    if t,err:=http.ParseTime(r.Header.Get("Last-Modified"));err==nil {mtime=t}
+    file,err:=c.Upload(r.Context(),name,r.Body,mtime)
+    if err==nil {err=c.Commit(r.Context(),[]client.FileInfo{file},nil)}
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    writeJSON(w,http.StatusCreated,fileRecord(file))
+}
+
+/*
+multipart上传：每个文件上传到“文件夹/文件名”，最后一次性写入数据库
+*/
+func (g *gateway) uploadFiles(w http.ResponseWriter, r *http.Request, c *client.Client, dir string){
+    reader,err:=r.MultipartReader()
+    if err!=nil {
+        writeHTTPError(w,http.StatusBadRequest,err)
+        return
+    }
+    var uploaded []client.FileInfo
+    for{
+        part,err:=reader.NextPart()
+        if err==io.EOF {break}
+        if err!=nil {
+            writeHTTPError(w,http.StatusBadRequest,err)
+            return
+        }
+        if part.FileName()=="" {continue}//不是文件的表单字段
+        name:=dir+part.FileName()
+        if err:=client.ValidName(name);err!=nil {
+            writeHTTPError(w,http.StatusBadRequest,err)
+            return
+        }
+        file,err:=c.Upload(r.Context(),name,part,time.Now())
+        if err!=nil {
+            writeHTTPError(w,0,err)
+            return
+        }
+        uploaded=append(uploaded,file)
+    }
+    if len(uploaded)==0 {
+        writeHTTPError(w,http.StatusBadRequest,errors.New("没有上传文件"))
+        return
+    }
+    err=c.Commit(r.Context(),uploaded,nil)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    records:=[]FileRecord{}
+    for _,file:=range uploaded {records=append(records,fileRecord(file))}
+    writeJSON(w,http.StatusCreated,records)
+}
+
+/*
+启动HTTP网关（addr）、S3网关（s3_addr）和WebDAV网关（webdav_addr），地址为空的不启动，直到收到SIGINT或SIGTERM。cert和key不为空时使用HTTPS
+*/
+func runGateway(addr string, s3_addr string, webdav_addr string, cert string, key string)error{
+    tokens,err:=loadGatewayTokens(*gateway_token_file)
+    if err!=nil {return commandError(EXIT_USAGE,errors.New("读取认证令牌失败："+err.Error()))}
+    clients:=newClientPool()
+    defer clients.close()
+    g:=&gateway{tokens:tokens,clients:clients}
+    var servers []*http.Server
+    if addr!="" {servers=append(servers,&http.Server{Addr:addr,Handler:g})}
+    if s3_addr!="" {servers=append(servers,&http.Server{Addr:s3_addr,Handler:newS3Gateway(tokens,clients)})}
+    if webdav_addr!="" {servers=append(servers,&http.Server{Addr:webdav_addr,Handler:newDavGateway(g)})}
+    if len(servers)==0 {return commandError(EXIT_USAGE,errors.New("没有要启动的网关"))}
+    ctx,stop:=signal.NotifyContext(context.Background(),os.Interrupt,syscall.SIGTERM)
+    defer stop()
+    errs:=make(chan error,len(servers))
+    for _,server:=range servers {
+        go func(server *http.Server){
+            if cert!="" {
+                errs<-server.ListenAndServeTLS(cert,key)
+            }else{
+                errs<-server.ListenAndServe()
+            }
+        }(server)
+    }
+    if addr!="" {fmt.Println("HTTP网关已启动：",addr)}
+    if s3_addr!="" {fmt.Println("S3网关已启动：",s3_addr)}
+    if webdav_addr!="" {fmt.Println("WebDAV网关已启动：",webdav_addr)}
+    //收到信号或者有网关启动失败时，停止所有网关，等待正在进行的请求结束
+    select {
+        case <-ctx.Done():
+            err=nil
+        case err=<-errs:
+    }
+    shutdown_ctx,cancel:=context.WithTimeout(context.Background(),GATEWAY_SHUTDOWN_TIMEOUT)
+    defer cancel()
+    for _,server:=range servers {server.Shutdown(shutdown_ctx)}
+    if err!=nil {return commandError(EXIT_NETWORK,err)}
+    fmt.Println("网关已停止")
+    return nil
+}
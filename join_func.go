@@ -0,0 +1,205 @@
+package main
+
+/*
+本文件包含了服务器加入集群相关的函数
+*/
+
+/*
+加入集群原理：
+服务器先开始监听，然后连接服务器列表中的一个服务器，发送JOIN_CLUSTER。
+服务器在NAT（比如宿舍路由器）后面时，对方看到的地址不一定能连上，端口映射的外部端口也可能和监听端口不同，
+所以可以用-advertise参数声明对外的地址（host:port），用-listen参数指定监听的地址，两者的端口可以不同。
+没有声明-advertise时，使用对方看到的IP加上本机端口。
+收到JOIN_CLUSTER的服务器除了自己测试连接对外地址，还会请JOIN_VERIFY_NUM个其它成员帮忙测试（VERIFY_ADDR），
+超过半数能连上才允许加入，这样只在局域网内能连上的地址不会被加入集群。
+*/
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "log/slog"
+    "math/rand"
+    "encoding/binary"
+)
+
+const JOIN_VERIFY_NUM=2 //加入集群时请其它成员帮忙测试连接的数量
+
+/*
+服务器的监听地址，默认为所有地址的-port端口
+*/
+func listenAddr()string{
+    if *listen!="" {return *listen}
+    return ":"+*port
+}
+
+/*
+服务器对外声明的端口：声明了-advertise时用它的端口，否则用监听端口
+*/
+func advertisePort()uint16{
+    port_string:=*port
+    if *advertise!="" {
+        _,port_string,_=net.SplitHostPort(*advertise)
+    }else if *listen!="" {
+        _,port_string,_=net.SplitHostPort(*listen)
+    }
+    server_port, err := strconv.ParseUint(port_string, 10, 16);checkErr(err)
+    return uint16(server_port)
+}
+
+/*
+开始监听，加入集群前就要开始，其它服务器需要连接本机进行测试
+*/
+func listenServer()(*net.TCPListener,error){
+    tcpAddr, err := net.ResolveTCPAddr("tcp",listenAddr())
+    if err != nil {return nil,errors.New("监听地址不正确："+listenAddr()+"："+err.Error())}
+    tcpListener, err := net.ListenTCP("tcp",tcpAddr)
+    if err != nil {return nil,errors.New("监听失败："+err.Error())}
+    slog.Info("开始监听","addr",listenAddr())
+    return tcpListener,nil
+}
+
+/*
+加入集群，成功后设置self_server_addr
+*/
+func joinCluster()error{
+    for _,server:= range serverList() {
+        conn, err := dialServer(server, *net_timeout)
+        if err!=nil {continue}
+        slog.Info("加入服务器集群……","server",server)
+        bytes_buf := bytes.NewBuffer(make([]byte, 0))
+        binary.Write(bytes_buf, binary.BigEndian, JOIN_CLUSTER)//1字节指令码
+        binary.Write(bytes_buf, binary.BigEndian, advertisePort())//2字节端口号（uint16）
+        conn.Write(bytes_buf.Bytes())
+        sendData([]byte(strings.Join(self_server_addrs,",")),conn)//其它地址
+        sendData([]byte(*advertise),conn)//对外地址，没有声明则为空
+        conn.SetReadDeadline(time.Now().Add(*net_timeout*(JOIN_VERIFY_NUM+2)*3))
+        instruct := readInstruct(conn)
+        if instruct!=ACK {
+            message,_:=readData(conn)
+            conn.Close()
+            return errors.New("服务器集群加入失败，请检查端口映射或-advertise参数："+server+"："+string(message))
+        }
+        slog.Info("服务器集群加入成功","server",server)
+        //得到本机地址，更新数据库要用
+        data,err:=readData(conn)
+        conn.Close()
+        if err!=nil {return errors.New("读取本机地址失败："+err.Error())}
+        self_server_addr=string(data)
+        slog.Info("本机地址","addr",self_server_addr)
+        return nil
+    }
+    return errors.New("准备加入集群时发现没有可以连接上的服务器")
+}
+
+/*
+测试能否连上某个地址
+*/
+func verifyAddr(addr string)bool{
+    conn, err := net.DialTimeout("tcp", addr, *net_timeout*3)
+    if err != nil {return false}
+    conn.Close()
+    return true
+}
+
+/*
+请其它成员测试能否连上某个地址
+*/
+func requestVerifyAddr(helper string, addr string)bool{
+    conn, err := dialServer(helper, *net_timeout)
+    if err != nil {return false}
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(*net_timeout*6))
+    sendInstruct(VERIFY_ADDR,conn)
+    sendData([]byte(addr),conn)
+    return readInstruct(conn)==ACK
+}
+
+/*
+拒绝加入集群
+*/
+func rejectJoin(conn net.Conn, message string){
+    connLogger(conn).Warn("拒绝加入集群","reason",message)
+    sendInstruct(ERR,conn)
+    sendData([]byte(message),conn)
+}
+
+/*
+处理JOIN_CLUSTER指令
+*/
+func handleJoinCluster(conn net.Conn){
+    //读取服务器端口、其它地址和对外地址
+    data := make([]byte, 2)
+    _,err:=io.ReadFull(conn,data)
+    if err!=nil {return}
+    server_port:=binary.BigEndian.Uint16(data)
+    datas,err:=readData(conn)
+    if err!=nil {return}
+    addrs,err:=parseAddrList(string(datas))
+    if err!=nil {
+        rejectJoin(conn,"声明的其它地址不正确："+err.Error())
+        return
+    }
+    datas,err=readData(conn)
+    if err!=nil {return}
+    var server string
+    if len(datas)>0 {
+        server,err=normalizeAddr(string(datas))
+        if err!=nil {
+            rejectJoin(conn,"声明的对外地址不正确："+err.Error())
+            return
+        }
+    }else{
+        server,_=normalizeAddr(net.JoinHostPort(remoteHost(conn),strconv.Itoa(int(server_port))))
+    }
+    connLogger(conn).Debug("申请加入集群","server",server,"addrs",addrs)
+    //本机和其它成员一起测试连接，超过半数能连上才允许加入
+    var helpers []string
+    for _,m:=range memberList() {
+        if m.Addr==server || m.Addr==self_server_addr || m.State!=MEMBER_ALIVE {continue}
+        helpers=append(helpers,m.Addr)
+    }
+    rand.Shuffle(len(helpers), func(i, j int){helpers[i],helpers[j]=helpers[j],helpers[i]})
+    if len(helpers)>JOIN_VERIFY_NUM {helpers=helpers[:JOIN_VERIFY_NUM]}
+    result:=make(chan bool,len(helpers)+1)
+    go func(){result<-verifyAddr(server)}()
+    for _,helper:=range helpers {
+        go func(helper string){
+            ok:=requestVerifyAddr(helper,server)
+            if !ok {slog.Info("成员无法连接申请加入的服务器","helper",helper,"server",server)}
+            result<-ok
+        }(helper)
+    }
+    succeeded:=0
+    for i:=0;i<len(helpers)+1;i++ {
+        if <-result {succeeded++}
+    }
+    if succeeded*2<=len(helpers)+1 {
+        rejectJoin(conn,fmt.Sprint("测试连接失败，",len(helpers)+1,"个成员中只有",succeeded,"个能连上",server))
+        return
+    }
+    connLogger(conn).Info("测试连接成功","server",server)
+    //加入成员表，之后由gossip协议传播给其它服务器
+    joinMember(server,addrs)
+    sendInstruct(ACK,conn)//返回ACK
+    sendData([]byte(server),conn)
+}
+
+/*
+处理VERIFY_ADDR指令
+*/
+func handleVerifyAddr(conn net.Conn){
+    datas,err:=readData(conn)
+    if err!=nil {return}
+    addr,err:=normalizeAddr(string(datas))
+    if err!=nil || !verifyAddr(addr) {
+        sendInstruct(ERR,conn)
+        return
+    }
+    sendInstruct(ACK,conn)
+}
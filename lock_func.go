@@ -0,0 +1,290 @@
+package main
+
+/*
+本文件包含了集群锁（分布式锁）相关的函数，用来串行化对同一个用户数据库的修改
+*/
+
+/*
+集群锁原理（租约+fencing token）：
+每个锁有一个名字（用户数据库的锁为“db/用户名”），按rendezvous哈希选出client.LOCK_SERVER_NUM个服务器负责这个锁，
+申请者向它们申请租约，超过半数同意才算得到锁。每个服务器为每个锁记录发出过的最大token，
+申请成功后申请者取所有回复的服务器的token的最大值，再用LOCK_RENEW把这个token告诉它们，这样token在集群中单调递增。
+租约有效期为LOCK_TTL，持有者每LOCK_TTL/3续约一次；持有者崩溃后租约过期，其它人就能申请到锁。
+修改用户数据库后，SYNC_DB会带上token，服务器只接受不小于自己见过的最大token的数据库，
+所以即使旧的持有者因为卡顿没有发现租约已经过期，它的数据库也会被拒绝，不会覆盖新持有者的修改。
+每个服务器还为每个用户数据库记录它的token（接受SYNC_DB时的token），同步数据库时要有超过半数负责这个锁的服务器接收，
+下一个持有者拿到锁之后向负责这个锁的服务器获取数据库（SEND_USER_DB），超过半数回复后取token最大的一份，
+两个半数至少有一个共同的服务器，所以一定能拿到上一个持有者的修改。
+修改用户数据库的流程：申请锁 -> 获取最新数据库 -> 修改 -> 带token同步数据库 -> 释放锁。
+*/
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "log/slog"
+    "io/ioutil"
+    "math/rand"
+    "encoding/json"
+    "encoding/binary"
+    "dss/client"
+)
+
+var lock_leases=map[string]*client.Lease{} //锁的名字 -> 当前租约
+var lock_tokens=map[string]uint64{} //锁的名字 -> 发出过或见过的最大token
+var lock_table_lock sync.Mutex
+var db_tokens=map[string]uint64{} //用户名 -> 本地数据库的token，修改时需持有数据库锁
+
+const DB_TOKENS_FILE=".db_tokens.json" //数据库文件夹中保存db_tokens的文件，以“.”开头，压缩数据库时会跳过
+
+/*
+本服务器申请集群锁（迁移文件块时修改用户数据库），申请的过程在客户端库中（client/lock.go），和客户端共用
+*/
+var cluster_locker=&client.Locker{
+    Owner:fmt.Sprintf("%s-%d-%08x",hostName(),os.Getpid(),rand.Uint32()),
+    Members:func(ctx context.Context)([]client.Member,error){return clientMembers(memberList()),nil},
+    Request:serverRequest,
+    Logger:func(ctx context.Context)*slog.Logger{return slog.Default()},
+    Timeout:client.LOCK_TTL/3,
+}
+
+/*
+主机名，用于锁持有者的标识
+*/
+func hostName()string{
+    name,err:=os.Hostname()
+    if err!=nil {return "unknown"}
+    return name
+}
+
+/*
+向服务器发送一个请求（指令+8字节长度+数据），返回ACK后的数据，服务器返回ERR时返回它的原因
+*/
+func serverRequest(ctx context.Context, server string, instruct byte, datas []byte)([]byte,error){
+    conn, err := dialServer(server, *net_timeout)
+    if err != nil {return nil,err}
+    defer conn.Close()
+    deadline:=time.Now().Add(*net_timeout*10)
+    if d,ok:=ctx.Deadline();ok && d.Before(deadline) {deadline=d}
+    conn.SetDeadline(deadline)
+    sendInstruct(instruct,conn)
+    err=sendData(datas,conn)
+    if err!=nil {return nil,err}
+    if readInstruct(conn)!=ACK {
+        message,_:=readData(conn)
+        return nil,errors.New(string(message))
+    }
+    return readData(conn)
+}
+
+/*
+服务器持有用户数据库的集群锁，从负责这个锁的服务器获取最新的数据库，执行修改，然后带token同步数据库到所有服务器
+*/
+func updateUserDatabase(user string, f func()error)error{
+    lock,err:=cluster_locker.Acquire(context.Background(),client.UserLockName(user))
+    if err!=nil {return err}
+    defer cluster_locker.Release(lock)
+    err=fetchUserDatabase(user,lock)
+    if err!=nil {return err}
+    err=f()
+    if err!=nil {return err}
+    if lock.Lost() {
+        return errors.New("集群锁已失效，数据库没有同步")
+    }
+    acquireGlobalLock()
+    err=setDatabaseToken(user,lock.Token)
+    releaseGlobalLock()
+    if err!=nil {return err}
+    return uploadDatabase(user,lock)
+}
+
+/*
+拿到集群锁之后，用负责这个锁的服务器上最新的数据库替换本地的数据库
+*/
+func fetchUserDatabase(user string, lock *client.ClusterLock)error{
+    ctx,cancel:=context.WithTimeout(context.Background(),*sync_timeout)
+    defer cancel()
+    token,content,err:=cluster_locker.FetchDatabase(ctx,lock,user)
+    if err!=nil {return err}
+    if len(content)==0 {
+        return errors.New("负责集群锁的服务器上没有这个用户的数据库："+user)
+    }
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    tmp_path:=databasePath("."+user+".db.tmp")
+    err=ioutil.WriteFile(tmp_path,content,0644)
+    if err==nil {err=os.Rename(tmp_path,dbPath(user))}
+    if err!=nil {return err}
+    return setDatabaseToken(user,token)
+}
+
+/*
+服务器处理SEND_USER_DB：返回本地数据库的token（8字节）和内容，没有这个用户的数据库时内容为空
+*/
+func handleSendUserDatabase(conn net.Conn){
+    user,err:=readData(conn)
+    if err!=nil {return}
+    err=client.ValidUser(string(user))
+    if err!=nil {
+        sendInstruct(ERR,conn)
+        sendData([]byte(err.Error()),conn)
+        return
+    }
+    acquireGlobalLock()
+    content,err:=ioutil.ReadFile(dbPath(string(user)))
+    token:=db_tokens[string(user)]
+    releaseGlobalLock()
+    if err!=nil && !os.IsNotExist(err) {
+        sendInstruct(ERR,conn)
+        sendData([]byte("读取数据库失败"),conn)
+        return
+    }
+    datas:=make([]byte,8,8+len(content))
+    binary.BigEndian.PutUint64(datas,token)
+    sendInstruct(ACK,conn)
+    sendData(append(datas,content...),conn)
+}
+
+/*
+读取保存的数据库token，启动时调用
+*/
+func loadDatabaseTokens()error{
+    datas,err:=ioutil.ReadFile(databasePath(DB_TOKENS_FILE))
+    if os.IsNotExist(err) {return nil}
+    if err!=nil {return err}
+    return json.Unmarshal(datas,&db_tokens)
+}
+
+/*
+用保存的数据库token和配额表的token设置每个锁见过的最大token，启动时在loadDatabaseTokens和loadQuotas之后调用。
+lock_tokens只在内存中，重启后从0开始的话，新发放的token会小于已经写入的数据的token：
+旧的持有者的写入会被接受，新的持有者反而被拒绝
+*/
+func seedLockTokens(){
+    acquireGlobalLock()
+    seeds:=map[string]uint64{}
+    for user,token:=range db_tokens {seeds[client.UserLockName(user)]=token}
+    releaseGlobalLock()
+    quota_lock.Lock()
+    seeds[client.QUOTA_LOCK]=quota_table.Token
+    quota_lock.Unlock()
+    lock_table_lock.Lock()
+    defer lock_table_lock.Unlock()
+    for name,token:=range seeds {
+        if token>lock_tokens[name] {lock_tokens[name]=token}
+    }
+}
+
+/*
+记录本地数据库的token并保存到文件，调用前需持有数据库锁
+*/
+func setDatabaseToken(user string, token uint64)error{
+    db_tokens[user]=token
+    datas,_:=json.Marshal(db_tokens)
+    tmp_path:=databasePath(DB_TOKENS_FILE+".tmp")
+    err:=ioutil.WriteFile(tmp_path,datas,0644)
+    if err==nil {err=os.Rename(tmp_path,databasePath(DB_TOKENS_FILE))}
+    return err
+}
+
+/*
+服务器处理锁相关的指令（LOCK_ACQUIRE、LOCK_RENEW、LOCK_RELEASE）
+*/
+func handleLockCommand(instruct byte, conn net.Conn){
+    datas,err:=readData(conn)
+    if err!=nil {return}
+    var request client.LockRequest
+    err=json.Unmarshal(datas,&request)
+    if err!=nil || request.Name=="" || request.Owner=="" {
+        sendInstruct(ERR,conn)
+        sendData([]byte("请求格式不正确"),conn)
+        return
+    }
+    if request.TTL<=0 || request.TTL>client.LOCK_TTL*4 {request.TTL=client.LOCK_TTL}
+    var lease client.Lease
+    switch instruct {
+        case LOCK_ACQUIRE:
+            lease,err=acquireLease(request)
+        case LOCK_RENEW:
+            lease,err=renewLease(request)
+        case LOCK_RELEASE:
+            err=releaseLease(request)
+    }
+    logger:=connLogger(conn).With("instruction",instruction_names[instruct],"lock",request.Name,"owner",request.Owner)
+    if err!=nil {
+        logger.Debug("拒绝集群锁请求","err",err)
+        sendInstruct(ERR,conn)
+        sendData([]byte(err.Error()),conn)
+        return
+    }
+    logger.Debug("集群锁请求完成","holder",lease.Owner,"token",lease.Token)
+    datas,_=json.Marshal(lease)
+    sendInstruct(ACK,conn)
+    sendData(datas,conn)
+}
+
+/*
+发放租约：锁空闲或租约已过期时发给申请者，token加一。
+租约没有过期时（即使是同一个持有者）返回当前的租约，其中的token为见过的最大token，申请者确定最终token时要考虑它；
+持有者延长租约要用续约（LOCK_RENEW）
+*/
+func acquireLease(request client.LockRequest)(client.Lease,error){
+    lock_table_lock.Lock()
+    defer lock_table_lock.Unlock()
+    if lease,exist:=lock_leases[request.Name];exist && time.Now().Before(lease.Expire) {
+        return client.Lease{Name:lease.Name,Owner:lease.Owner,Token:lock_tokens[request.Name],Expire:lease.Expire},nil//返回当前的持有者和最大token
+    }
+    lock_tokens[request.Name]++
+    lease:=&client.Lease{Name:request.Name,Owner:request.Owner,Token:lock_tokens[request.Name],Expire:time.Now().Add(request.TTL)}
+    lock_leases[request.Name]=lease
+    return *lease,nil
+}
+
+/*
+续约：只有持有者可以续约，同时把租约的token更新为申请者确定的最终token
+*/
+func renewLease(request client.LockRequest)(client.Lease,error){
+    lock_table_lock.Lock()
+    defer lock_table_lock.Unlock()
+    lease,exist:=lock_leases[request.Name]
+    if !exist || lease.Owner!=request.Owner || time.Now().After(lease.Expire) {
+        return client.Lease{},errors.New("没有持有这个锁或租约已过期")
+    }
+    if request.Token<lease.Token {
+        return client.Lease{},errors.New("token已过期")
+    }
+    lease.Token=request.Token
+    if request.Token>lock_tokens[request.Name] {lock_tokens[request.Name]=request.Token}
+    lease.Expire=time.Now().Add(request.TTL)
+    return *lease,nil
+}
+
+/*
+释放租约
+*/
+func releaseLease(request client.LockRequest)error{
+    lock_table_lock.Lock()
+    defer lock_table_lock.Unlock()
+    lease,exist:=lock_leases[request.Name]
+    if !exist || lease.Owner!=request.Owner {return nil}//已经过期被别人拿走了，不用处理
+    delete(lock_leases,request.Name)
+    return nil
+}
+
+/*
+检查fencing token：不小于见过的最大token才接受，并记录下来。
+没有使用过锁的用户数据库token为0，可以直接接受
+*/
+func checkFencingToken(name string, token uint64)error{
+    lock_table_lock.Lock()
+    defer lock_table_lock.Unlock()
+    if token<lock_tokens[name] {
+        return fmt.Errorf("token已过期：%d<%d",token,lock_tokens[name])
+    }
+    lock_tokens[name]=token
+    return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+/*
+集群锁租约的测试：发放、续约、释放、fencing token
+*/
+
+import (
+    "time"
+    "testing"
+    "dss/client"
+)
+
+/*
+清空租约表，测试结束后恢复
+*/
+func resetLeases(t *testing.T){
+    lock_table_lock.Lock()
+    saved_leases,saved_tokens:=lock_leases,lock_tokens
+    lock_leases=map[string]*client.Lease{}
+    lock_tokens=map[string]uint64{}
+    lock_table_lock.Unlock()
+    t.Cleanup(func(){
+        lock_table_lock.Lock()
+        lock_leases,lock_tokens=saved_leases,saved_tokens
+        lock_table_lock.Unlock()
+    })
+}
+
+func TestLease(t *testing.T){
+    const ttl=time.Minute
+    type step struct {
+        op string //acquire、renew、release、fence、expire（让当前租约过期）
+        owner string
+        token uint64 //renew和fence的token
+        ok bool
+        expect_owner string //acquire和renew返回的持有者
+        expect_token uint64 //acquire和renew返回的token
+    }
+    tests:=[]struct{
+        name string
+        steps []step
+    }{
+        {"申请和释放",[]step{
+            {"acquire","a",0,true,"a",1},
+            {"acquire","b",0,true,"a",1},//租约没有过期，返回当前的持有者
+            {"release","b",0,true,"",0},//不是持有者，不影响
+            {"acquire","b",0,true,"a",1},
+            {"release","a",0,true,"",0},
+            {"acquire","b",0,true,"b",2},
+        }},
+        {"同一个持有者再次申请",[]step{
+            {"acquire","a",0,true,"a",1},
+            {"acquire","a",0,true,"a",1},//不会发新的token，持有者要用续约延长租约
+            {"renew","a",1,true,"a",1},
+        }},
+        {"续约",[]step{
+            {"acquire","a",0,true,"a",1},
+            {"renew","a",5,true,"a",5},//申请者确定的最终token更大（从其它服务器得到）
+            {"renew","a",4,false,"",0},//token不能变小
+            {"renew","b",5,false,"",0},//不是持有者
+            {"release","a",0,true,"",0},
+            {"renew","a",5,false,"",0},//已经释放
+            {"acquire","b",0,true,"b",6},
+        }},
+        {"过期",[]step{
+            {"acquire","a",0,true,"a",1},
+            {"expire","",0,true,"",0},
+            {"renew","a",1,false,"",0},
+            {"acquire","b",0,true,"b",2},
+            {"release","a",0,true,"",0},//过期后被别人拿走，释放不影响
+            {"acquire","c",0,true,"b",2},
+        }},
+        {"fencing token",[]step{
+            {"fence","",0,true,"",0},//没有使用过锁
+            {"acquire","a",0,true,"a",1},
+            {"fence","",1,true,"",0},
+            {"fence","",0,false,"",0},
+            {"fence","",3,true,"",0},//见过更大的token
+            {"fence","",2,false,"",0},
+            {"expire","",0,true,"",0},
+            {"acquire","b",0,true,"b",4},//新的token大于见过的所有token
+            {"renew","a",3,false,"",0},
+        }},
+    }
+    for _,test:=range tests {
+        t.Run(test.name, func(t *testing.T){
+            resetLeases(t)
+            const name="yumi"
+            for i,s:=range test.steps {
+                var lease client.Lease
+                var err error
+                request:=client.LockRequest{Name:name,Owner:s.owner,Token:s.token,TTL:ttl}
+                switch s.op {
+                    case "acquire":
+                        lease,err=acquireLease(request)
+                    case "renew":
+                        lease,err=renewLease(request)
+                    case "release":
+                        err=releaseLease(request)
+                    case "fence":
+                        err=checkFencingToken(name,s.token)
+                    case "expire":
+                        lock_table_lock.Lock()
+                        lock_leases[name].Expire=time.Now().Add(-time.Second)
+                        lock_table_lock.Unlock()
+                }
+                if (err==nil)!=s.ok {t.Fatalf("第%d步%s：错误为%v",i,s.op,err)}
+                if err!=nil || (s.op!="acquire" && s.op!="renew") {continue}
+                if lease.Owner!=s.expect_owner || lease.Token!=s.expect_token {
+                    t.Fatalf("第%d步%s：租约为%s/%d，期望%s/%d",i,s.op,lease.Owner,lease.Token,s.expect_owner,s.expect_token)
+                }
+            }
+        })
+    }
+}
+
+/*
+重启后（内存中的租约和token都没有了）发放的token不能小于已经写入的用户数据库和配额表的token
+*/
+func TestLockTokensAfterRestart(t *testing.T){
+    resetLeases(t)
+    saved_dir,saved_db_tokens,saved_quotas:=*database_dir,db_tokens,quota_table
+    *database_dir=t.TempDir()
+    db_tokens=map[string]uint64{}
+    defer func(){*database_dir,db_tokens,quota_table=saved_dir,saved_db_tokens,saved_quotas}()
+    //重启前：yumi的数据库以token 7写入，配额表以token 3写入
+    if err:=setDatabaseToken("yumi",7);err!=nil {t.Fatal(err)}
+    if err:=storeQuotas(3,map[string]client.Quota{"yumi":{MaxFiles:10}});err!=nil {t.Fatal(err)}
+    //重启
+    lock_leases=map[string]*client.Lease{}
+    lock_tokens=map[string]uint64{}
+    db_tokens=map[string]uint64{}
+    quota_table=quotaTable{}
+    if err:=loadDatabaseTokens();err!=nil {t.Fatal(err)}
+    if err:=loadQuotas();err!=nil {t.Fatal(err)}
+    seedLockTokens()
+    tests:=[]struct{
+        name string
+        written uint64 //重启前写入的token
+    }{
+        {client.UserLockName("yumi"),7},
+        {client.QUOTA_LOCK,3},
+        {client.UserLockName("new"),0},
+    }
+    for _,test:=range tests {
+        if test.written>0 && checkFencingToken(test.name,test.written-1)==nil {
+            t.Errorf("%s：接受了旧的持有者的token %d",test.name,test.written-1)
+        }
+        lease,err:=acquireLease(client.LockRequest{Name:test.name,Owner:"a",TTL:time.Minute})
+        if err!=nil {t.Fatal(err)}
+        if lease.Token!=test.written+1 {t.Errorf("%s：重启后发放的token为%d，期望%d",test.name,lease.Token,test.written+1)}
+        if err:=checkFencingToken(test.name,lease.Token);err!=nil {t.Errorf("%s：新的持有者被拒绝：%v",test.name,err)}
+    }
+}
@@ -0,0 +1,95 @@
+package main
+
+/*
+本文件包含了日志相关的函数
+*/
+
+/*
+日志使用log/slog，每条日志有级别（debug、info、warn、error）、消息和键值对，输出格式为text（key=value）或json（每行一个JSON对象）。
+-log_file指定日志文件后，日志写入文件而不是标准输出，文件超过-log_max_size（MB）时自动轮转，
+旧文件保留-log_max_backups个、最多-log_max_age天。
+客户端每次传输（上传、下载、删除）生成一个请求ID，连接服务器时先发送REQUEST_ID指令，
+服务器处理这个连接的指令时，日志都带上request_id，用它可以在所有服务器的日志中找到同一次put。
+*/
+
+import (
+    "io"
+    "os"
+    "net"
+    "flag"
+    "errors"
+    "log/slog"
+    "net/http"
+    "dss/client"
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+var log_level = flag.String("log_level", "info", "Log level: debug, info, warn or error.日志级别：debug、info、warn或error。")
+var log_format = flag.String("log_format", "text", "Log format: text or json.日志格式：text或json。")
+var log_file = flag.String("log_file", "", "Write logs to this file with rotation instead of stdout.日志文件，为空时输出到标准输出。")
+var log_max_size = flag.Int("log_max_size", 100, "Rotate the log file when it exceeds this size in MB.日志文件超过多少MB时轮转。")
+var log_max_backups = flag.Int("log_max_backups", 5, "Number of rotated log files to keep.保留多少个轮转后的旧日志文件。")
+var log_max_age = flag.Int("log_max_age", 30, "Days to keep rotated log files, 0 means forever.旧日志文件保留多少天，0表示不删除。")
+
+/*
+按命令行参数初始化日志，-v=false时只输出警告和错误
+*/
+func initLogger()error{
+    var level slog.Level
+    if level.UnmarshalText([]byte(*log_level))!=nil {
+        return errors.New("日志级别只能是debug、info、warn或error："+*log_level)
+    }
+    if !*verbose && level<slog.LevelWarn {level=slog.LevelWarn}
+    var out io.Writer=os.Stdout //JSON输出模式下os.Stdout已经换成了标准错误
+    if *log_file!="" {
+        out=&lumberjack.Logger{Filename:*log_file,MaxSize:*log_max_size,MaxBackups:*log_max_backups,MaxAge:*log_max_age}
+    }
+    options:=&slog.HandlerOptions{Level:level}
+    switch *log_format {
+        case "text":
+            slog.SetDefault(slog.New(slog.NewTextHandler(out,options)))
+        case "json":
+            slog.SetDefault(slog.New(slog.NewJSONHandler(out,options)))
+        default:
+            return errors.New("日志格式只能是text或json："+*log_format)
+    }
+    return nil
+}
+
+/*
+服务端处理连接时使用的日志：带上对方地址和客户端发来的请求ID
+*/
+func connLogger(conn net.Conn)*slog.Logger{
+    logger:=slog.With("remote",conn.RemoteAddr().String())
+    if c,ok:=conn.(*serverConn);ok && c.request_id!="" {logger=logger.With("request_id",c.request_id)}
+    return logger
+}
+
+/*
+HTTP请求（网关、S3、WebDAV）使用的请求ID：请求头X-Request-ID格式正确时使用它，否则生成一个新的，
+放进请求的context传给客户端库，并在响应头X-Request-ID中返回
+*/
+func withHTTPRequestID(w http.ResponseWriter, r *http.Request)*http.Request{
+    id:=r.Header.Get("X-Request-ID")
+    if !client.ValidRequestID(id) {id=client.NewRequestID()}
+    w.Header().Set("X-Request-ID",id)
+    return r.WithContext(client.WithRequestID(r.Context(),id))
+}
+
+/*
+HTTP请求使用的日志：带上对方地址、方法、路径和请求ID
+*/
+func httpLogger(name string, r *http.Request)*slog.Logger{
+    return slog.With("gateway",name,"remote",r.RemoteAddr,"method",r.Method,"path",r.URL.Path,
+        "request_id",client.RequestID(r.Context()))
+}
+
+/*
+读取REQUEST_ID指令后面的请求ID，格式不正确时忽略
+*/
+func (c *serverConn) readRequestID(){
+    data:=make([]byte,client.REQUEST_ID_LEN)
+    _,err:=io.ReadFull(c,data)
+    if err==nil && client.ValidRequestID(string(data)) {c.request_id=string(data)}
+    c.bytes_in,c.failed=0,false
+}
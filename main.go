@@ -4,52 +4,65 @@
 
 //TODO：磁盘空间 https://blog.csdn.net/webxscan/article/details/72857292
 //TODO：双击运行，可选部署服务器或者客户端
-//TODO：退出集群、数据库冗余项的清理、服务器列表废弃服务器的清理
+//TODO：数据库冗余项的清理
 //TODO：文件块下载完成进行校验，断点续传，迁移等功能，相同hash的分块不需要上传/重复删除等，美化输出
 
 package main
 
 import (
     "fmt"
+    "io"
     "io/ioutil"
     "net"
     "time"
-    "strings"
     "os"
     "bytes"
+    "errors"
     "encoding/binary"
-    "encoding/hex"
     "flag"
     "sync"
-    "path/filepath"
-    "database/sql"
     _ "modernc.org/ql/driver"
-    "strconv"
     "sort"
-    "github.com/remeh/sizedwaitgroup"
+    "log/slog"
+    "dss/client"
+    "github.com/peterh/liner"
 )
 
 const ( //定义指令码，数据包第一个字节为指令码
     DOWNLOAD_FILE byte = 1 //下载文件，后面跟文件的key
     SEND_DB byte = 2 //发送数据库指令
     ACK byte = 8 //表示收到信息
-    SYNC_DB byte = 9 //同步（接受）数据库指令，后面跟文件大小（uint64）和数据库内容
+    SYNC_DB byte = 9 //同步（接受）数据库指令，后面跟fencing token（uint64）、用户名、文件大小（uint64）和数据库内容
     UPLOAD_FILE byte = 10 //上传文件指令，后面跟文件的key+文件大小+文件内容
     DELETE_FILE byte = 11 //删除文件指令，后面跟文件的key
     JOIN_CLUSTER byte = 13 //加入集群指令，后面跟服务器端口（uint16）
     GET_SERVER_LIST byte = 14 //下载服务器列表
-    SYNC_SERVER_LIST byte = 15 //同步服务器列表
+    SYNC_SERVER_LIST byte = 15 //同步服务器列表（已废弃，由gossip协议取代）
     SERVER_LOAD byte = 16 //服务器负载
+    DOWNLOAD_RANGE byte = 17 //下载文件的一段，后面跟文件的key+偏移量（uint64）+长度（uint64）
+    FILE_SIZE byte = 18 //查询文件大小，后面跟文件的key
+    GOSSIP_PING byte = 19 //gossip探测，后面跟附带的成员变化
+    GOSSIP_PING_REQ byte = 20 //请求间接探测，后面跟目标地址和附带的成员变化
+    GET_MEMBERS byte = 21 //获取成员表
+    DECOMMISSION byte = 22 //服务器下线（退出集群），迁移本机所有文件块
+    DRAIN_STATUS byte = 23 //查询下线进度
+    DRAIN_CANCEL byte = 24 //取消下线
+    REBALANCE byte = 25 //重新平衡，把文件块从文件块多的服务器迁移到少的服务器
+    VERIFY_ADDR byte = 26 //测试能否连上某个地址，后面跟地址
+    LOCK_ACQUIRE byte = 27 //申请集群锁的租约
+    LOCK_RENEW byte = 28 //集群锁续约
+    LOCK_RELEASE byte = 29 //释放集群锁
+    REQUEST_ID byte = 30 //请求ID，后面跟16个字符（十六进制小写字母和数字，都不是指令码，旧版本服务器会逐字节忽略），之后这个连接上的日志都带上这个ID
+    SEND_USER_DB byte = 31 //发送一个用户的数据库和它的token，后面跟用户名
+    GET_QUOTAS byte = 32 //发送配额表和它的token
+    SET_QUOTA byte = 33 //设置用户的配额，后面跟请求（JSON，带管理员密钥）
+    SYNC_QUOTAS byte = 34 //同步配额表（服务器之间），后面跟请求（JSON，带管理员密钥和token）
     ERR byte = 255 //错误
 )
 
 const (
     DB_TYPE="ql2" //数据库类型
-    DB_PATH="tmp/db.zip" //数据库压缩文件路径
-)
-const ( //定义数据库锁状态
-    FREE = 0
-    USING = 1 //本节点在读取数据库
+    DB_ZIP="db.zip" //数据库压缩文件名（在tmp文件夹中）
 )
 
 const CLIENT_SHELL_HELP_MSG= //客户端命令行帮助信息
@@ -57,12 +70,21 @@ const CLIENT_SHELL_HELP_MSG= //客户端命令行帮助信息
     help：查看帮助
     ls：查看可下载的文件列表
         使用-l参数可以查看可下载的文件及其分块、分块所在的服务器
-    login [username]：登录，使用get命令和del命令时需要
+    login [username]：登录，使用put命令和del命令时需要
     get [username] [filename]：下载文件
-    put [filename]：上传文件
-    del [filename]：删除文件
+        get -r [username] [dir]：递归下载文件夹
+    put [filename]...：上传文件
+        put -r [dir]...：递归上传文件夹，没有变化的文件会跳过
+    del [filename]...：删除文件
+    sync [-n] [-delete policy] [local dir] [remote dir]：双向同步本地文件夹和服务器上的文件夹
+        -n只显示要做的操作；-delete删除策略：none不删除（默认），local允许删除本地文件，remote允许删除服务器上的文件，both都允许
+    （参数包含空格时用引号括起来，如get yumi "my file.7z"）
     update：更新数据库（客户端启动时也会自动更新）
     status：服务器状态
+    decommission [server]：服务器下线，把服务器上的文件块迁移到其它服务器后退出集群（需要全局参数-admin_key）
+        decommission status [server]：查看下线进度
+        decommission cancel [server]：取消下线
+    rebalance：重新平衡，把文件块从文件块多的服务器迁移到少的服务器（新服务器加入时会自动执行）
     exit：退出
     `
 
@@ -73,158 +95,180 @@ const CLIENT_SHELL_WELCOME_MSG= //客户端命令行欢迎信息
     1. 上传或删除文件前请先使用login命令登录，用户名请每人固定下来，不要冲突，如果不确定名字有没有人用，可用ls命令查看。登录命令例子：login yumi。同一个用户请不要同时上传多个文件，否则会造成数据库损坏。
     2. 不同用户上传的文件名可以相同，但请不要上传同样的文件（文件块hash相同），否则删除时会一并删除文件块。（这个问题会在后续版本修复）
     3. 当前用户名可在命令行前缀查看，默认为Anonymous。下载文件不需要登录。
-    4. 用户名和文件名请不要包含空格。
+    4. 用户名和文件名可以包含空格和中文，包含空格时请用引号括起来或用\转义，例如：put "my file.txt"。按Tab键可以补全命令、用户名和文件名，按上下键可以查看历史命令。
     **************************************************
     启用客户端命令行，欢迎使用GDUT-DistributeStorageSystem！
     输入help获取帮助。
     `
 
-const FILE_BLOCK_SIZE=1024*1024*32 //文件分块大小，单位Byte
-const FILE_READ_SIZE=1024*1024*2 //读取缓存大小
-const NET_TIMEOUT=time.Millisecond*300
-
-type KeyServerPair struct {//Key-服务器对
-    Key string
-    Server []string
-}
+const REPLICA_NUM=2 //每个文件块的副本数量
 
-var download_mission=sizedwaitgroup.New(2) //最大同时下载任务为2
-var upload_mission sync.WaitGroup //上传任务的WaitGroup
-var global_server_list [] string //服务器列表，格式如“127.0.0.1::2333”
-var global_db_lock_status int = FREE //数据库锁
-var global_server_load uint8 = 0 //服务器负载
-var self_server_addr string
+var global_server_list [] string //服务器列表，格式如“127.0.0.1:2333”、“[::1]:2333”，用serverList和setServerList读写
+var global_server_list_lock sync.RWMutex
+var global_db_lock sync.Mutex //数据库锁
+var global_server_load int32 = 0 //服务器负载：正在进行的文件传输数量，用atomic读写
+var self_server_addr string //本机地址（服务器标识）
+var self_server_addrs []string //本机的其它地址
 var username string = "Anonymous"
 
 var enable_server = flag.Bool("enable_server", false, "Enable server.启用服务器。")
 var port = flag.String("port", "2333", "Listening port.监听端口（启用服务器才有效）。")
 var first_server = flag.Bool("first_server", false, "First server, disable server scan.集群首台服务器，不进行服务器列表扫描。")
-var verbose = flag.Bool("v", true, "Verbose output.输出详细信息。")
+var verbose = flag.Bool("v", true, "Verbose output, false only logs warnings and errors.输出详细信息，为false时只输出警告和错误。")
+var json_output = flag.Bool("json", false, "Client commands print JSON records (one per line) to stdout, other messages go to stderr.客户端命令在标准输出输出JSON记录（每行一条），其它信息输出到标准错误。")
+var listen = flag.String("listen", "", "Listening address (host:port), defaults to all addresses on -port.监听地址（host:port），默认为所有地址的-port端口。")
+var advertise = flag.String("advertise", "", "Address (host:port) other nodes and clients use to reach this server, e.g. the router's public address and mapped port behind NAT.对外地址（host:port），在NAT后面时填路由器的外部地址和映射的端口，可以和监听端口不同。")
+var addrs = flag.String("addrs", "", "Other addresses (host:port, comma separated) this server can be reached at, e.g. an IPv6 address or a hostname.服务器的其它地址（host:port，逗号分隔），比如IPv6地址或主机名，客户端会选择能连上的地址。")
+var zone = flag.String("zone", "", "Failure zone label of this server, e.g. building or dorm. Replicas never share a zone.服务器所在的故障域（比如楼栋、宿舍），同一个文件块的副本不会放在同一个故障域。")
+var capacity = flag.Float64("capacity", client.DEFAULT_CAPACITY, "Storage capacity of this server in GB, used as placement weight.服务器的存储容量（GB），容量大的服务器存放更多文件块。")
+var rebalance_threshold = flag.Float64("rebalance_threshold", 0.1, "Rebalance when a server's block count per capacity is off the mean by more than this fraction.服务器按容量计算的负载（文件块数量/容量）偏离平均值超过这个比例时重新平衡。")
+var rebalance_bandwidth = flag.Float64("rebalance_bandwidth", 10, "Bandwidth cap for rebalancing in MB/s, 0 means unlimited.重新平衡时的带宽上限（MB/s），0表示不限速。")
+var metrics_addr = flag.String("metrics", "", "HTTP listen address (host:port) of the Prometheus /metrics endpoint, empty to disable.监控指标接口/metrics（Prometheus格式）的HTTP监听地址，为空时不启动。")
 
 func main() {
 
+    flag.Usage=printUsage
     flag.Parse()//读取命令行参数
-    log("命令行参数：")
-    log("enable_server",*enable_server)
-    log("first_server",*first_server)
-    log("port",*port)
-    log("verbose",*verbose)
+    err:=loadConfig()//读取配置文件（命令行参数优先）并检查参数
+    if err!=nil {
+        fmt.Fprintln(os.Stderr,"[ERROR]",err)
+        os.Exit(EXIT_USAGE)
+    }
+    if *json_output && !*enable_server {
+        enableJSONOutput()//之后的信息都输出到标准错误
+    }
+    err=initLogger()
+    if err!=nil {
+        fmt.Fprintln(os.Stderr,"[ERROR]",err)
+        os.Exit(EXIT_USAGE)
+    }
+    var params []interface{}
+    flag.VisitAll(func(f *flag.Flag){params=append(params,f.Name,f.Value.String())})
+    slog.Debug("参数",params...)
 
     //创建文件夹
-    if(!isPathExists("tmp")){os.Mkdir("tmp", os.ModePerm)}
-    if(!isPathExists("storage")){os.Mkdir("storage", os.ModePerm)}
-    if(!isPathExists("download")){os.Mkdir("download", os.ModePerm)}
-    if(!isPathExists("database")){os.Mkdir("database", os.ModePerm)}
+    err=createDirs()
+    if err!=nil {
+        slog.Error("创建文件夹失败","err",err)
+        os.Exit(EXIT_IO)
+    }
+
+    //客户端：执行子命令（没有子命令时进入交互式命令行），执行完退出
+    if !*enable_server {
+        os.Exit(runCommand(flag.Args()))
+    }
+
+    //服务端：启动失败时按错误的类型退出，启动完成后不再返回
+    err=runServer()
+    slog.Error("服务器启动失败","err",err)
+    os.Exit(exitCode(err))
+}
 
-    //根据参数判断是否作为服务端启动
+/*
+启动服务端：读取本地数据、开始监听、加入集群，启动完成后不再返回；
+启动失败时返回带退出码的错误（EXIT_IO读取本地数据失败，EXIT_USAGE服务器列表不正确，EXIT_NETWORK监听或加入集群失败）
+*/
+func runServer()error{
+    err:=loadDatabaseTokens()
+    if err==nil {err=loadQuotas()}
+    if err==nil {err=loadPendingDeletes()}
+    if err!=nil {return commandError(EXIT_IO,errors.New("读取数据库token、配额表或等待删除的文件块失败："+err.Error()))}
+    seedLockTokens()//重启后发放的token不能小于已经写入的数据
+
+    //服务端：先开始监听，加入集群时其它服务器需要连接本机进行测试
+    listener,err:=listenServer()
+    if err!=nil {return commandError(EXIT_NETWORK,err)}
+    go tcpServer(listener)//启动服务器，接收客户端和其它服务器的消息
+    startMetrics(*metrics_addr)
+
+    //根据参数判断是否作为首节点启动
     if !*first_server {
-        fmt.Println("[INFO]读取服务器列表……")
-        refreshServerList()
-        fmt.Println("[INFO]更新服务器列表……")
-        updateServerList()
-
-        if !*enable_server {//如果是客户端
-            fmt.Println("[INFO]更新共享文件数据……")
-            getGlobalDatabase()
-        }else{//如果是服务器
-            fmt.Println("[INFO]系统启动……")
-            fmt.Println("[INFO]连接服务器……准备加入集群")
-            var connected_server string
-            for _,server:= range global_server_list {
-                conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
-                if err!=nil {continue}
-                fmt.Println("服务器连接成功：",server)
-                connected_server=server
-                //加入服务器集群
-                go testConn()//加入集群需启动一个测试连接服务端
-                fmt.Println("[INFO]加入服务器集群……")
-                bytes_buf := bytes.NewBuffer(make([]byte, 0))
-                binary.Write(bytes_buf, binary.BigEndian, JOIN_CLUSTER)//1字节指令码
-                server_port, err := strconv.ParseInt(*port, 10, 32);checkErr(err)
-                binary.Write(bytes_buf, binary.BigEndian, uint16(server_port))//2字节端口号（uint16）
-                conn.Write(bytes_buf.Bytes())
-                instruct := readInstruct(conn)
-                if instruct==ACK {
-                    fmt.Println("[INFO]服务器集群加入成功")
-                    //得到本机ip，更新数据库要用
-                    data := make([]byte, 21)//地址长度最大21：xxx.xxx.xxx.xxx:xxxxx
-                    n, _ :=conn.Read(data)//读取本机地址
-                    self_server_addr=string(data[0:n])
-                    fmt.Println("本机地址：",self_server_addr)
+        slog.Info("读取服务器列表……")
+        err=refreshServerList()
+        if err!=nil {return commandError(EXIT_USAGE,errors.New("读取服务器列表失败："+err.Error()))}
+        slog.Info("更新服务器列表……")
+        err=updateServerList()
+        if err!=nil {return commandError(EXIT_NETWORK,errors.New("更新服务器列表失败："+err.Error()))}
+
+        slog.Info("连接服务器……准备加入集群")
+        err=joinCluster()
+        if err!=nil {return commandError(EXIT_NETWORK,err)}
+        slog.Info("更新服务器列表……")//加入集群后再次更新
+        err=updateServerList()
+        if err!=nil {slog.Warn("更新服务器列表失败","err",err)}
+
+        //TODO:查询本地的块，结合数据库，进行删除或添加
+        //fmt.Println("[INFO]更新数据库文件……")
+        //获取所有数据库的key
+        /*key_list:=make(map[string]string)
+        dir, err := ioutil.ReadDir(*database_dir);checkErr(err)
+        for _,f := range dir {
+            if(subString(f.Name(),0,1)=="."){continue}
+            db, err := sql.Open(DB_TYPE, databasePath(f.Name()));checkErr(err)
+            rows, err := db.Query(`SELECT key FROM FileKey`);checkErr(err)
+            for rows.Next() {
+                var key string
+                if err = rows.Scan(&key); err != nil {
+                    rows.Close()
+                    break
+                }
+                key_list[key]=""
+            }
+            err = db.Close();checkErr(err)
+        }*/
+        //删除本地冗余文件
+        /*fmt.Println("[INFO]检查冗余文件……")
+        dir, err = ioutil.ReadDir(*storage_dir);checkErr(err)
+        for _,f := range dir {
+            if(subString(f.Name(),0,1)=="."){continue}
+            if _,exist := key_list[f.Name()];!exist {
+                log("发现废弃数据块。")
+                err := os.Remove(storagePath(f.Name()))
+                if err==nil {
+                    log("数据块删除成功：",f.Name())
                 }else{
-                    fmt.Println("[ERROR]服务器集群加入失败，请检查端口映射")
-                    os.Exit(1)
+                    log("数据块删除失败：",f.Name(),err)
                 }
-                //关闭连接并退出循环
-                conn.Close()
-                break
             }
-            if connected_server=="" {
-                fmt.Println("[ERROR]准备加入集群时发现没有可以连接上的服务器。")
-                os.Exit(1)
+        }*/
+        //TODO:添加已有的块
+        /*dir, err = ioutil.ReadDir(*storage_dir);checkErr(err)
+        for _,f := range dir {
+            if(subString(f.Name(),0,1)=="."){continue}
+            var key string
+            db, err := sql.Open(DB_TYPE, databasePath(f.Name()));checkErr(err)
+            db.QueryRow(`SELECT key FROM KeyServer WHERE server = $1 and key = $2`,self_server_addr,f.Name()).Scan(&key);
+            if key=="" {//如果文件里有，但数据库KeyServer没有这个服务器条目，就新增数据条目
+                log("新增数据块：",f.Name())
+                tx, err := db.Begin();checkErr(err)
+                _, err = tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,f.Name(),self_server_addr);checkErr(err)
+                err = tx.Commit();checkErr(err)
             }
-            fmt.Println("[INFO]更新服务器列表……")//加入集群后再次更新
-            time.Sleep(NET_TIMEOUT)//需要sleep，否则会卡住
-            updateServerList()
-
-            //TODO:查询本地的块，结合数据库，进行删除或添加
-            //fmt.Println("[INFO]更新数据库文件……")
-            //获取所有数据库的key
-            /*key_list:=make(map[string]string)
-            dir, err := ioutil.ReadDir("database");checkErr(err)
-            for _,f := range dir {
-                if(subString(f.Name(),0,1)=="."){continue}
-                db, err := sql.Open(DB_TYPE, "database/"+f.Name());checkErr(err)
-                rows, err := db.Query(`SELECT key FROM FileKey`);checkErr(err)
-                for rows.Next() {
-                    var key string
-                    if err = rows.Scan(&key); err != nil {
-                        rows.Close()
-                        break
-                    }
-                    key_list[key]=""
-                }
-                err = db.Close();checkErr(err)
-            }*/
-            //删除本地冗余文件
-            /*fmt.Println("[INFO]检查冗余文件……")
-            dir, err = ioutil.ReadDir("storage");checkErr(err)
-            for _,f := range dir {
-                if(subString(f.Name(),0,1)=="."){continue}
-                if _,exist := key_list[f.Name()];!exist {
-                    log("发现废弃数据块。")
-                    err := os.Remove("storage/"+f.Name())
-                    if err==nil {
-                        log("数据块删除成功：",f.Name())
-                    }else{
-                        log("数据块删除失败：",f.Name(),err)
-                    }
-                }
-            }*/
-            //TODO:添加已有的块
-            /*dir, err = ioutil.ReadDir("storage");checkErr(err)
-            for _,f := range dir {
-                if(subString(f.Name(),0,1)=="."){continue}
-                var key string
-                db, err := sql.Open(DB_TYPE, "database/"+f.Name());checkErr(err)
-                db.QueryRow(`SELECT key FROM KeyServer WHERE server = $1 and key = $2`,self_server_addr,f.Name()).Scan(&key);
-                if key=="" {//如果文件里有，但数据库KeyServer没有这个服务器条目，就新增数据条目
-                    log("新增数据块：",f.Name())
-                    tx, err := db.Begin();checkErr(err)
-                    _, err = tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,f.Name(),self_server_addr);checkErr(err)
-                    err = tx.Commit();checkErr(err)
-                }
-                err = db.Close();checkErr(err)
-            }*/
-        }
+            err = db.Close();checkErr(err)
+        }*/
     }
 
-    if *enable_server {
-        go tcpServer(*port)//启动服务器，接收客户端和其它服务器的消息
-        fmt.Println("[INFO]服务器启动完成。")
-    }else{
-        go clientShell()//启用客户端命令行
+    if *first_server && *advertise!="" {
+        self_server_addr=*advertise
+        slog.Info("本机地址","addr",self_server_addr)
+    }else if *first_server {//首节点的地址就是服务器列表文件里端口相同的那一个
+        err=refreshServerList()
+        if err!=nil {return commandError(EXIT_USAGE,errors.New("读取服务器列表失败："+err.Error()))}
+        servers:=serverList()
+        self_server_addr=servers[0]
+        for _,server:=range servers {
+            _,server_port,err:=net.SplitHostPort(server)
+            if err==nil && server_port==*port {
+                self_server_addr=server
+                break
+            }
+        }
+        slog.Info("本机地址","addr",self_server_addr)
     }
+    initSelfMember()
+    go gossipLoop()//启动gossip协议，进行故障检测和成员信息传播
+    schedulePendingDeletes()//继续重启前没有完成的删除
+    slog.Info("服务器启动完成")
 
     for{
         time.Sleep(time.Hour)//死循环，任务交由其它goroutine执行
@@ -232,44 +276,62 @@ func main() {
 }
 
 
-func tcpServer(port string){//服务器goroutine，接收客户端和其它服务器的消息
-    //启动服务器
-    tcpAddr, err := net.ResolveTCPAddr("tcp",":"+port)
-    tcpListener, err := net.ListenTCP("tcp",tcpAddr)
-    if err != nil {
-        fmt.Println("[ERROR]服务器启动错误：",err)
-        panic("服务器启动错误")
-    }
+func tcpServer(tcpListener *net.TCPListener){//服务器goroutine，接收客户端和其它服务器的消息
     //处理客户端传入连接
     ConnMap := make(map[string]*net.TCPConn)//使用Map来存储连接
+    var slots chan struct{} //-max_connections限制同时处理的连接数量，满了之后等有连接断开再接受新的连接
+    if *max_connections>0 {slots=make(chan struct{},*max_connections)}
     for{
+        if slots!=nil {slots<-struct{}{}}
         tcpConn, _ := tcpListener.AcceptTCP()
         defer tcpConn.Close()
         ConnMap[tcpConn.RemoteAddr().String()] = tcpConn
-        fmt.Println("新的连接：",tcpConn.RemoteAddr().String())
-        go clientHandle(tcpConn) //新建一个goroutine来处理客户端连接
+        slog.Debug("新的连接","remote",tcpConn.RemoteAddr().String())
+        metric_connections_total.Inc()
+        go func(){//新建一个goroutine来处理客户端连接
+            clientHandle(tcpConn)
+            if slots!=nil {<-slots}
+        }()
     }
 }
 
 
-func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客户端消息
+func clientHandle(tcp_conn net.Conn) {//客户端连接处理goroutine，处理客户端消息
+    conn:=&serverConn{Conn:tcp_conn} //统计每条指令的字节数和错误，记录请求ID
+    metric_connections.Inc()
+    defer metric_connections.Dec()
     defer conn.Close() //函数结束前关闭连接
-    defer fmt.Println("连接断开：",conn.RemoteAddr().String()) //函数结束前输出提示
+    defer slog.Debug("连接断开","remote",conn.RemoteAddr().String()) //函数结束前输出提示
     //循环的处理客户的请求
     for {
         //TODO:处理超时的连接
         //读取数据
         instruct := readInstruct(conn)
         if instruct==ERR {break}
+        if instruct==REQUEST_ID {//之后这个连接上的日志都带上请求ID，不计入指标
+            conn.readRequestID()
+            continue
+        }
+        start:=time.Now()
+        logger:=connLogger(conn)
+        var key string
+        switch instruct {
+            case DOWNLOAD_FILE, UPLOAD_FILE, DELETE_FILE, DOWNLOAD_RANGE, FILE_SIZE://这些指令后面跟着文件key
+                var err error
+                key,err=readKey(conn)
+                if err!=nil {//key不正确时后面的数据无法解析，返回ERR并关闭连接
+                    logger.Warn("文件key不正确","instruction",instruction_names[instruct],"key",key,"err",err)
+                    sendInstruct(ERR,conn)
+                    conn.done(instruct,start)
+                    return
+                }
+        }
         switch instruct {//根据指令码做出选择
             case DOWNLOAD_FILE://下载文件
-                if global_server_load<253 {
-                    global_server_load++
-                    defer func(){global_server_load--}()
-                }
-                key:=readKey(conn)//读取文件key
-                log("[接收到指令]客户端下载文件：",key)
-                sendFile("storage/"+key,conn)//发送文件
+                logger.Debug("客户端下载文件","key",key)
+                done:=beginTransfer()
+                sendFile(storagePath(key),conn)//发送文件
+                done()
                 /*
                 文件下载交互流程：
                 客户端连接服务端
@@ -280,41 +342,108 @@ func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客
                 服务端关闭连接
                 */
             case SYNC_DB://同步数据库
-                log("[接收到指令]开始同步数据库")
-                err:=reciveFile(DB_PATH,conn)
+                logger.Debug("开始同步数据库")
+                sync_start:=time.Now()
+                data:=make([]byte,8)
+                _,err:=io.ReadFull(conn,data)
+                if err!=nil {break}
+                token:=binary.BigEndian.Uint64(data)
+                user,err:=readData(conn)
+                if err!=nil {break}
+                //每个连接接收到自己的临时文件，接收时不持有数据库锁，慢的连接不会卡住其它请求
+                tmp_file,err:=ioutil.TempFile(*tmp_dir,"sync-*.zip")
+                if err!=nil {
+                    logger.Error("创建临时文件失败","err",err)
+                    break
+                }
+                zip_path:=tmp_file.Name()
+                tmp_file.Close()
+                conn.SetReadDeadline(time.Now().Add(*sync_timeout))
+                err=reciveFile(zip_path,conn)
+                conn.SetReadDeadline(time.Time{})
+                if err!=nil {
+                    os.Remove(zip_path)
+                    logger.Error("数据库同步出错","err",err)
+                    conn.Close()//数据没有读完，连接上后面的数据不能再当作指令读取
+                    break
+                }
+                err=checkSyncDatabase(string(user),zip_path)//先检查内容，不合法的数据库不能推高token
                 if err!=nil {
-                    fmt.Println("[ERROR]数据库同步出错")
+                    os.Remove(zip_path)
+                    logger.Warn("拒绝同步数据库","user",string(user),"token",token,"err",err)
+                    sendInstruct(ERR,conn)
+                    sendData([]byte(err.Error()),conn)
                     break
                 }
                 acquireGlobalLock()
-                decompressDatabase()
+                err=checkFencingToken(client.UserLockName(string(user)),token)
+                if err==nil {err=decompressDatabase(zip_path)}
+                if err==nil {err=setDatabaseToken(string(user),token)}
                 releaseGlobalLock()
-                sendInstruct(ACK,conn)
-                fmt.Println("数据库同步完毕")
-            case SYNC_SERVER_LIST://同步服务器列表
-                log("[接收到指令]同步服务器列表")
-                err:=reciveFile("server_list.txt",conn)
+                os.Remove(zip_path)
                 if err!=nil {
-                    fmt.Println("[ERROR]服务器列表同步出错")
+                    logger.Warn("拒绝同步数据库","user",string(user),"token",token,"err",err)
+                    sendInstruct(ERR,conn)
+                    sendData([]byte(err.Error()),conn)
                     break
                 }
                 sendInstruct(ACK,conn)
-                refreshServerList()
-                fmt.Println("服务器列表同步完毕")
+                metric_db_sync.Observe(time.Since(sync_start).Seconds())
+                logger.Info("数据库同步完毕","user",string(user),"token",token,"duration",time.Since(sync_start))
+                /*
+                同步数据库交互流程：
+                客户端（或迁移文件块的服务器）持有该用户的集群锁，连接服务端
+                客户端发送指令SYNC_DB+fencing token（8字节）+用户名（8字节长度+用户名）+文件大小（8字节）+数据库
+                服务端接收数据库，检查内容（只能包含该用户的数据库，用户名和文件名合法）和token（不小于见过的最大token），
+                通过则解压并返回ACK，否则返回ERR+原因（8字节长度+字符串）
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case LOCK_ACQUIRE, LOCK_RENEW, LOCK_RELEASE:
+                handleLockCommand(instruct,conn)
+                /*
+                集群锁交互流程：
+                客户端连接服务端
+                客户端发送指令LOCK_ACQUIRE/LOCK_RENEW/LOCK_RELEASE+请求（8字节长度+JSON：锁名、持有者、token、有效期）
+                服务端返回ACK+租约（8字节长度+JSON），锁被别人持有时返回的租约是别人的；请求不合法时返回ERR+原因
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case SEND_USER_DB:
+                logger.Debug("发送用户数据库")
+                handleSendUserDatabase(conn)
+                /*
+                发送用户数据库交互流程：
+                持有该用户集群锁的客户端（或服务器）连接负责这个锁的服务端
+                客户端发送指令SEND_USER_DB+用户名（8字节长度+用户名）
+                服务端返回ACK+数据（8字节长度+8字节token+数据库内容，没有这个用户的数据库时内容为空），或ERR+原因
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case GET_QUOTAS, SET_QUOTA, SYNC_QUOTAS:
+                handleQuotaCommand(instruct,conn)
+                /*
+                配额交互流程：
+                客户端（或服务器）连接服务端
+                客户端发送指令GET_QUOTAS/SET_QUOTA/SYNC_QUOTAS+请求（8字节长度+数据，GET_QUOTAS为空，其它为JSON）
+                GET_QUOTAS：服务端返回ACK+数据（8字节长度+8字节token+配额表JSON）
+                SET_QUOTA：服务端检查管理员密钥，持有集群锁修改配额表并同步到所有服务器，返回ACK+空数据
+                SYNC_QUOTAS：服务端检查管理员密钥和token（不小于见过的最大token），保存配额表，返回ACK+空数据
+                出错时返回ERR+原因（8字节长度+字符串）
+                客户端关闭连接
+                服务端关闭连接
+                */
             case UPLOAD_FILE:
-                if global_server_load<253 {
-                    global_server_load++
-                    defer func(){global_server_load--}()
-                }
-                key := readKey(conn)//读取文件key
-                log("[接收到指令]客户端上传文件：",key)
-                err:=reciveFile("storage/"+key,conn)
+                logger.Debug("客户端上传文件","key",key)
+                done:=beginTransfer()
+                err:=reciveFile(storagePath(key),conn)
+                done()
                 if err!=nil {
-                    fmt.Println("[ERROR]客户端文件上传出错")
+                    logger.Error("客户端文件上传出错","key",key,"err",err)
                     break
                 }
                 sendInstruct(ACK,conn)
-                fmt.Println("客户端文件上传完毕")
+                logger.Info("客户端文件上传完毕","key",key,"duration",time.Since(start))
                 /*
                 文件上传交互流程：
                 客户端连接服务端
@@ -324,9 +453,8 @@ func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客
                 服务端关闭连接
                 */
             case DELETE_FILE:
-                key := readKey(conn)
-                log("[接收到指令]客户端删除文件：",key)
-                os.Remove("storage/"+key)
+                logger.Info("客户端删除文件","key",key)
+                os.Remove(storagePath(key))
                 sendInstruct(ACK,conn)
                 /*
                 文件删除交互流程：
@@ -337,11 +465,11 @@ func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客
                 服务端关闭连接
                 */
             case SEND_DB:
-                log("[接收到指令]发送数据库")
+                logger.Debug("发送数据库")
                 acquireGlobalLock()
                 compressDatabase()
                 releaseGlobalLock()
-                sendFile(DB_PATH,conn)
+                sendFile(tmpPath(DB_ZIP),conn)
                 /*
                 发送数据库交互流程：
                 客户端连接服务端
@@ -354,46 +482,29 @@ func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客
                 /*
                 加入集群交互流程：
                 客户端连接服务端
-                客户端发送指令JOIN_CLUSTER+端口号
-                服务端尝试连接，如果连接成功，更新服务器列表，返回ACK，否则返回0
+                客户端发送指令JOIN_CLUSTER+端口号（2字节）+其它地址（8字节长度+逗号分隔的地址列表，可以为空）+对外地址（8字节长度+地址，可以为空）
+                服务端和其它几个成员一起测试连接对外地址（没有声明则为对方IP+端口号），
+                超过半数能连上就加入成员表，返回ACK+对方地址（8字节长度+地址），否则返回ERR+原因（8字节长度+字符串）
+                客户端之后通过GET_MEMBERS获取完整的成员表，并开始gossip
                 客户端关闭连接
                 服务端关闭连接
                 */
-                log("[接收到指令]有服务器加入集群")
-                //读取服务器端口
-                data := make([]byte, 2)
-                conn.Read(data)
-                var server_port uint16
-                binary.Read(bytes.NewBuffer(data), binary.BigEndian, &server_port)
-                server:=strings.Split(conn.RemoteAddr().String(),":")[0]+":"+strconv.Itoa(int(server_port))
-                log("对方IP：",server)
-                time.Sleep(NET_TIMEOUT)//给时间给对方启动服务器
-                test_conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
-                if err != nil {
-                    fmt.Println("测试连接失败")
-                    conn.Write([]byte{ERR})
-                    continue //结束处理
-                }
-                fmt.Println("测试连接成功")
-                test_conn.Close()
-                //更新服务器列表
-                file_datas, _ := ioutil.ReadFile("server_list.txt")
-                if !strings.Contains(string(file_datas),server){
-                    fmt.Println("新增服务器：",server)
-                    file_server_list_strings:=strings.TrimSpace(string(file_datas))+"\r\n"+server
-                    file_server_list, err := os.Create("server_list.txt");checkErr(err)
-                    file_server_list.Write([]byte(file_server_list_strings))
-                    file_server_list.Close()
-                }else{
-                    fmt.Println("服务器已在列表中：",server)
-                }
-                sendInstruct(ACK,conn)//返回ACK
-                conn.Write([]byte(server))
-                syncServerList()//向所有节点同步服务器列表
-                refreshServerList()//刷新服务器列表
+                logger.Info("有服务器加入集群")
+                handleJoinCluster(conn)
+            case VERIFY_ADDR:
+                logger.Debug("测试连接")
+                handleVerifyAddr(conn)
+                /*
+                测试连接交互流程：
+                服务器A连接服务器B
+                A发送指令VERIFY_ADDR+要测试的地址（8字节长度+地址）
+                B尝试连接这个地址，能连上返回ACK，否则返回ERR
+                A关闭连接
+                B关闭连接
+                */
             case GET_SERVER_LIST:
-                log("[接收到指令]请求服务器列表")
-                sendFile("server_list.txt",conn)
+                logger.Debug("请求服务器列表")
+                sendFile(*server_list_file,conn)
                 /*
                 同步服务器列表交互流程：
                 客户端连接服务端
@@ -402,414 +513,236 @@ func clientHandle(conn net.Conn) {//客户端连接处理goroutine，处理客
                 客户端关闭连接
                 服务端关闭连接
                 */
+            case GOSSIP_PING:
+                handleGossipPing(conn)
+                /*
+                gossip探测交互流程：
+                服务器A连接服务器B
+                A发送指令GOSSIP_PING+附带的成员变化（8字节长度+JSON）
+                B应用成员变化，返回ACK+B附带的成员变化（8字节长度+JSON）
+                A关闭连接
+                B关闭连接
+                */
+            case GOSSIP_PING_REQ:
+                handleGossipPingReq(conn)
+                /*
+                间接探测交互流程：
+                服务器A连接服务器B
+                A发送指令GOSSIP_PING_REQ+目标地址（8字节长度+地址）+附带的成员变化
+                B向目标发送GOSSIP_PING，成功则返回ACK+B附带的成员变化，否则返回ERR
+                A关闭连接
+                B关闭连接
+                */
+            case GET_MEMBERS:
+                logger.Debug("请求成员表")
+                sendMembers(memberList(),conn)
+                /*
+                获取成员表交互流程：
+                客户端连接服务端
+                客户端发送指令GET_MEMBERS
+                服务端返回成员表（8字节长度+JSON）
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case DECOMMISSION, DRAIN_STATUS, DRAIN_CANCEL:
+                logger.Info("下线","instruction",instruction_names[instruct])
+                handleDrainCommand(instruct,conn)
+                /*
+                下线交互流程：
+                管理员客户端连接要下线的服务端
+                客户端发送指令DECOMMISSION（开始）、DRAIN_STATUS（查询进度）或DRAIN_CANCEL（取消）
+                DECOMMISSION和DRAIN_CANCEL接着发送管理员密钥（8字节长度+字符串），密钥不正确时服务端返回ERR
+                服务端返回ACK+下线进度（8字节长度+JSON），出错则返回ERR+错误信息（8字节长度+字符串）
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case REBALANCE:
+                logger.Info("重新平衡")
+                go rebalance()
+                sendInstruct(ACK,conn)
+                /*
+                重新平衡交互流程：
+                客户端连接服务端
+                客户端发送指令REBALANCE
+                服务端开始重新平衡（迁出本机多余的文件块），返回ACK
+                客户端关闭连接
+                服务端关闭连接
+                */
             case SERVER_LOAD:
-                log("[接收到指令]查询服务器负载：",global_server_load)
-                conn.Write([]byte{global_server_load})
+                load:=serverLoad()
+                logger.Debug("查询服务器负载","load",load)
+                conn.Write([]byte{load})
+            case DOWNLOAD_RANGE://下载文件的一段
+                data := make([]byte, 16)
+                _,err:=io.ReadFull(conn,data)
+                if err!=nil {break}
+                offset:=binary.BigEndian.Uint64(data[0:8])
+                length:=binary.BigEndian.Uint64(data[8:16])
+                logger.Debug("客户端下载文件的一段","key",key,"offset",offset,"length",length)
+                done:=beginTransfer()
+                sendFileRange(storagePath(key),offset,length,conn)
+                done()
+                /*
+                分段下载交互流程：
+                客户端连接服务端
+                客户端发送指令DOWNLOAD_RANGE+文件key+偏移量（8字节）+长度（8字节）
+                服务端发送实际长度（8字节，超出文件范围的部分不发送，文件不存在则为0）+这一段的内容
+                客户端可以在同一个连接上继续请求下一段
+                客户端关闭连接
+                服务端关闭连接
+                */
+            case FILE_SIZE://查询文件大小
+                logger.Debug("查询文件大小","key",key)
+                info,err:=os.Stat(storagePath(key))
+                if err!=nil {
+                    sendInstruct(ERR,conn)
+                    break
+                }
+                bytes_buf := bytes.NewBuffer(make([]byte, 0))
+                binary.Write(bytes_buf, binary.BigEndian, ACK)
+                binary.Write(bytes_buf, binary.BigEndian, uint64(info.Size()))
+                conn.Write(bytes_buf.Bytes())
+                /*
+                查询文件大小交互流程：
+                客户端连接服务端
+                客户端发送指令FILE_SIZE+文件key
+                服务端返回ACK+文件大小（8字节），文件不存在则返回ERR
+                客户端关闭连接
+                服务端关闭连接
+                */
             case ERR://中断连接
                 break
         }
+        conn.done(instruct,start)
     }
 }
 
 
 func clientShell(){//客户端命令行
     fmt.Println(CLIENT_SHELL_WELCOME_MSG)
+    state:=newLineEditor()
+    defer closeLineEditor(state)
     for{
-        fmt.Printf("GDUT-DSS:%s$ ",username)
-        var command string
-        var parameter [3] string
-        fmt.Scanf("%s %s %s %s", &command, &parameter[0], &parameter[1], &parameter[2])
+        line,err:=state.Prompt(fmt.Sprintf("GDUT-DSS:%s$ ",username))
+        if err==liner.ErrPromptAborted {continue}//Ctrl+C放弃当前输入
+        if err!=nil {return}//输入结束（比如Ctrl+D）
+        args,err:=splitArgs(line)
+        if err!=nil {
+            fmt.Println("[ERROR]",err)
+            continue
+        }
+        if len(args)==0 {continue}
+        state.AppendHistory(line)
+        command,args:=args[0],args[1:]
+        parameter:=func(i int)string{//第i个参数，没有则为空
+            if i<len(args) {return args[i]}
+            return ""
+        }
         switch command {
             case "help"://帮助
                 fmt.Println(CLIENT_SHELL_HELP_MSG)
             case "exit"://退出
-                os.Exit(0)
+                return
             case "login":
-                if parameter[0]!=""{
-                    username=parameter[0]
-                    fmt.Println("用户登录：",username)
-                }else{
+                if parameter(0)==""{
                     fmt.Println("请输入用户名！")
+                    continue
+                }
+                err=client.ValidUser(parameter(0))
+                if err==nil {
+                    username=parameter(0)
+                    fmt.Println("用户登录：",username)
                 }
             case "get"://下载文件
-                /*
-                下载文件流程：
-                先从文件数据库查询文件名对应的文件分块数量和校验码
-                然后根据文件分块所在的服务器，智能选择每个分块的下载服务器
-                所有文件分块下载完成后，合并成一个完整文件
-                */
-                updateServerList()
-                //先从文件数据库读取文件名对应的key和服务器
-                fmt.Println("查找数据库……")
-                if parameter[1]=="" {
+                recursive:=parameter(0)=="-r"
+                if recursive {args=args[1:]}
+                if len(args)!=2 {
                     fmt.Println("请输入文件名！")
-                    fmt.Println("用法：get [username] [filename]")
-                    fmt.Println("例子：get yumi 1.7z")
+                    fmt.Println("用法：get [username] [filename]、get -r [username] [dir]")
+                    fmt.Println("例子：get yumi 1.7z、get yumi \"my file.7z\"、get -r yumi photos")
                     continue
                 }
-                if !isPathExists(dbPath(parameter[0])) {
-                    fmt.Println("数据库不存在！请检查命令或执行update命令更新。")
-                    fmt.Println("用法：get [username] [filename]")
-                    fmt.Println("例子：get yumi 1.7z")
-                    continue
+                err=updateServerList()
+                if err==nil && recursive {
+                    err=getTree(args[0],args[1],"")
+                }else if err==nil {
+                    err=getFile(args[0],args[1],"")
                 }
-                db, err := sql.Open(DB_TYPE, dbPath(parameter[0]));checkErr(err)//连接数据库
-                //从数据库中读取文件名并新建下载任务
-                var key_server_pair [] KeyServerPair
-                //查询得到key_list
-                var key_list [] string
-                rows, err := db.Query(`SELECT key,num FROM FileKey WHERE filename=$1 ORDER BY num`,parameter[1]);checkErr(err)
-                for rows.Next() {
-                    var key string
-                    var num int
-                    if err = rows.Scan(&key,&num); err != nil {
-                        rows.Close()
-                        break
-                    }
-                    log(num,key)
-                    key_list=append(key_list,key)
-                }
-                //查询每个key对应的服务器列表
-                for n,key := range key_list{
-                    key_server_pair=append(key_server_pair,KeyServerPair{Key:key})
-                    rows, err := db.Query(`SELECT server FROM KeyServer WHERE key=$1 ORDER BY server`,key);checkErr(err)
-                    for rows.Next() {
-                        var server string
-                        if err = rows.Scan(&server); err != nil {
-                            rows.Close()
-                            break
-                        }
-                        key_server_pair[n].Server=append(key_server_pair[n].Server,server)
-                    }
-                }
-                err = db.Close();checkErr(err)
-                //提交下载任务
-                //难点：实现智能选择服务器，多线程下载
-                //理想实现：看服务器带宽情况
-                //实际实现：根据服务器连接数进行评分
-                var best_server string
-                for i,key_server := range key_server_pair{//每个key选择最佳服务器进行下载
-                    //选择最佳服务器
-                    best_server_load:=uint8(ERR)//服务器负载
-                    for _,server := range key_server.Server{
-                        server_load:=getServerLoad(server)
-                        if server_load<=best_server_load {
-                            best_server=server
-                            best_server_load=server_load
-                        }
-                    }
-                    if best_server_load==ERR {
-                        fmt.Println("[ERROR]部分文件块所在服务器不在线，文件无法下载。")
-                        os.Exit(1)
-                    }
-                    fmt.Println("提交下载任务",i,key_server.Key,best_server)
-                    download_mission.Add()
-                    go downloadFile(key_server.Key, best_server)
-                }
-                //等待下载完毕
-                fmt.Println("等待下载完成……")
-                download_mission.Wait()
-                //合并文件
-                fmt.Println("合并文件块……")
-                file_full, _ := os.Create("download/"+parameter[1])
-                for _,key := range key_list {
-                    file_piece, err := os.Open("tmp/"+key);checkErr(err)
-                    buf:=make([]byte, getFileSize("tmp/"+key))
-                    file_piece.Read(buf)//全部读取
-                    file_full.Write(buf)
-                    file_piece.Close()
-                    os.Remove("tmp/"+key)
-                }
-                file_full.Close()
-                fmt.Println("文件下载成功")
             case "ls"://查看可下载的文件列表
-                //直接从数据库中读取文件名并打印
                 fmt.Println("")
-                if parameter[0]=="-l" {
-                    dir, err := ioutil.ReadDir("database");checkErr(err)
-                    for _,f := range dir {
-                        if(subString(f.Name(),0,1)=="."){continue}
-                        db, err := sql.Open(DB_TYPE, "database/"+f.Name());checkErr(err)
-                        rows, err := db.Query(`SELECT FileKey.filename,FileKey.num,FileKey.key,KeyServer.server FROM FileKey,KeyServer WHERE FileKey.key=KeyServer.key`);checkErr(err)
-                        for rows.Next() {
-                            var filename,key,server string
-                            var num int
-                            if err = rows.Scan(&filename,&num,&key,&server); err != nil {
-                                rows.Close()
-                                break
-                            }
-                            fmt.Println(filename,num,key,server)
-                        }
-                        err = db.Close();checkErr(err)
-                    }
-                    fmt.Println("")
-                }else{
-                    dir, err := ioutil.ReadDir("database");checkErr(err)
-                    for _,f := range dir {
-                        if(subString(f.Name(),0,1)=="."){continue}
-                        fmt.Println(f.Name(),":")
-                        db, err := sql.Open(DB_TYPE, "database/"+f.Name());checkErr(err)
-                        rows, err := db.Query(`SELECT distinct(filename) FROM FileKey`);checkErr(err)
-                        for rows.Next() {
-                            var filename string
-                            if err = rows.Scan(&filename); err != nil {
-                                rows.Close()
-                                break
-                            }
-                            fmt.Println("    ",filename)
-                        }
-                        fmt.Println("")
-                        err = db.Close();checkErr(err)
-                    }
-                }
-            case "put"://上传文件 TODO：多线程上传
-                if username=="Anonymous" {
-                    fmt.Println("请先登录！")
-                    continue
-                }
-                /*
-                上传文件流程：
-                判断文件大小，如果超过分块数量，则切割成块
-                计算所有分块的hash值并重命名
-                选择服务器并上传文件块
-                将文件信息写入数据库
-                更新数据库到服务器
-                */
-                file_path:=parameter[0]
-                fmt.Println("文件路径：",file_path)
-                _ , filename := filepath.Split(file_path)
-                fmt.Println("文件名：",filename)
-                file_size:=getFileSize(file_path)
-                fmt.Println("文件大小：",file_size)
-                var key_list [] string //key数组
-                if file_size>FILE_BLOCK_SIZE{
-                    file_pieces_num:=int(file_size/FILE_BLOCK_SIZE)+1
-                    fmt.Println("文件超过文件块大小，需要分块。分块数量：",file_pieces_num)
-                    f, err := os.Open(file_path);checkErr(err)
-                    buf_size:=FILE_BLOCK_SIZE
-                    for i:=0;i<file_pieces_num;i++ {
-                        if int(file_size)-FILE_BLOCK_SIZE*i<FILE_BLOCK_SIZE {
-                            buf_size=int(file_size)-FILE_BLOCK_SIZE*i
-                        }
-                        buf:=make([]byte, buf_size)
-                        f.ReadAt(buf,int64(FILE_BLOCK_SIZE*i))//每次读取一个FILE_BLOCK_SIZE
-                        key:=hex.EncodeToString(hashBytes(buf))//计算key
-                        fmt.Println("第",i,"个key：",key)
-                        key_list=append(key_list,key)
-                        //写入文件
-                        file_piece, err := os.Create("tmp/"+key);checkErr(err)
-                        file_piece.Write(buf)
-                        file_piece.Close()
+                err=listFiles(parameter(0)=="-l","")
+            case "put"://上传文件，可以一次上传多个
+                recursive:=parameter(0)=="-r"
+                if recursive {args=args[1:]}
+                if len(args)==0 {fmt.Println("用法：put [filename]...、put -r [dir]...")}
+                for _,file_path:=range args {
+                    if recursive {
+                        err=putTree(username,file_path)
+                    }else{
+                        err=putFile(username,file_path)
                     }
-                    f.Close()
-                    fmt.Println("文件分块完成！")
-                }else{
-                    fmt.Println("文件小于等于文件块大小，无需分块。")
-                    f, err := os.Open(file_path);checkErr(err)
-                    buf:=make([]byte, file_size)
-                    f.Read(buf)//全部读取
-                    key:=hex.EncodeToString(hashBytes(buf))//计算key
-                    fmt.Println("第0个key：",key)
-                    key_list=append(key_list,key)
-                    //写入文件
-                    file_piece, err := os.Create("tmp/"+key);checkErr(err)
-                    file_piece.Write(buf)
-                    file_piece.Close()
-                    f.Close()
+                    if err!=nil {break}
                 }
-                //选择服务器并上传文件块
-                //查询数据库，计算每个服务器的文件数量，从小到大排序，排序相同的按服务器字符串排序
-                //将一个分块发送到两个服务器上，然后重复上面的步骤，查询最佳服务器并继续上传
-                fmt.Println("准备上传文件分块……")
-                for i,key := range key_list {
-                    //选择服务器 TODO：性能待优化
-                    fmt.Println("查找数据库……")
-                    if(!isPathExists(dbPath(username))){
-                      fmt.Println("[INFO]没有数据库，新建中...")
-                      db, err := sql.Open(DB_TYPE, dbPath(username));checkErr(err)
-                      tx, err := db.Begin();checkErr(err)
-                      _, err = tx.Exec(`CREATE TABLE KeyServer (
-                      key string,
-                      server string,
-                      );`);checkErr(err)
-                      _, err = tx.Exec(`CREATE TABLE FileKey (
-                      filename string,
-                      num int,
-                      key string,
-                      );`);checkErr(err)
-                      err = tx.Commit();checkErr(err)
-                      err = db.Close();checkErr(err)
-                      fmt.Println("[INFO]数据库新建完成。")
-                    }
-                    dir, err := ioutil.ReadDir("database");checkErr(err)
-                    servers := map[string]int{} //key为服务器ip，value为服务器上块的数量
-                    for _,f := range dir {
-                        if(subString(f.Name(),0,1)=="."){continue}
-                        log(f.Name())
-                        db, err := sql.Open(DB_TYPE, "database/"+f.Name());checkErr(err)
-                        for _,server := range global_server_list {
-                            var num int
-                            err := db.QueryRow(`SELECT count(*) FROM KeyServer WHERE server=$1`,server).Scan(&num);checkErr(err)
-                            servers[server]+=num
-                            fmt.Println(server,num)
-                        }
-                        err = db.Close();checkErr(err)
-                    }
-                    //将server的key数量进行排序
-                    servers_sorted:=sortMapByValue(servers)
-                    fmt.Println("服务器及其块数量：",servers_sorted)
-                    //fmt.Println("最佳上传服务器：",servers_sorted[0].Key,servers_sorted[0].Value)
-                    //fmt.Println("次佳上传服务器：",servers_sorted[1].Key,servers_sorted[1].Value)
-                    //连接服务器
-                    server_upload:=make([]string,2)
-                    server_upload_point:=0;
-                    for{//上传第一个副本
-                        conn, err := net.DialTimeout("tcp", servers_sorted[server_upload_point].Key, NET_TIMEOUT)
-                        if err != nil {
-                            fmt.Println("服务器连接失败：",servers_sorted[server_upload_point].Key)
-                            if(server_upload_point>=servers_sorted.Len()){
-                                fmt.Println("[ERROR]所有服务器连接失败，没有可上传的服务器！")
-                                os.Exit(1)
-                            }
-                            server_upload_point++
-                        }else{//如果服务器正常，就开始上传。TODO：两个副本同时上传（多线程）
-                            fmt.Println("上传第",i,"个文件分块：",key,servers_sorted[server_upload_point].Key)
-                            upload_mission.Add(1)
-                            uploadFile(key,conn)
-                            server_upload[0]=servers_sorted[server_upload_point].Key
-                            server_upload_point++
-                            break
-                        }
-                    }
-                    for{//上传第二个副本
-                        if(server_upload_point>=servers_sorted.Len()){
-                            fmt.Println("[WARN]只连上一个服务器，该文件分块没有多副本！")
-                            break
-                        }
-                        conn, err := net.DialTimeout("tcp", servers_sorted[server_upload_point].Key, NET_TIMEOUT)
-                        if err != nil {
-                            fmt.Println("服务器连接失败：",servers_sorted[server_upload_point].Key)
-                            if(server_upload_point>=servers_sorted.Len()){
-                                fmt.Println("[WARN]只连上一个服务器，该文件分块没有多副本！")
-                                break
-                            }
-                            server_upload_point++
-                        }else{//如果服务器正常，就开始上传。TODO：两个副本同时上传（多线程）
-                            fmt.Println("上传第",i,"个文件分块：",key,servers_sorted[server_upload_point].Key)
-                            upload_mission.Add(1)
-                            uploadFile(key,conn)
-                            server_upload[1]=servers_sorted[server_upload_point].Key
-                            break
-                        }
-                    }
-                    upload_mission.Wait()
-                    //删除文件
-                    err = os.Remove("tmp/"+key)
-                    if err!=nil {
-                        fmt.Println("[WARN]文件删除失败，可稍后手动删除。",err)
-                    }
-                    //写入数据库
-                    fmt.Println("准备写入数据库……")
-                    //写入数据库
-                    db, err := sql.Open(DB_TYPE, dbPath(username));checkErr(err)//连接数据库
-                    tx, err := db.Begin();checkErr(err)
-                    _, err = tx.Exec(`INSERT INTO FileKey VALUES ($1,$2,$3);`,filename,i,key);checkErr(err)
-                    _, err = tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,key,server_upload[0]);checkErr(err)
-                    if(server_upload[1]!=""){
-                        _, err = tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,key,server_upload[1]);checkErr(err)
-                    }
-                    err = tx.Commit();checkErr(err)
-                    log("插入数据。",)
-                    err = db.Close();checkErr(err)
-                    fmt.Println("数据库更新成功。")
+            case "del"://删除文件，可以一次删除多个
+                if len(args)==0 {fmt.Println("用法：del [filename]...")}
+                for _,filename:=range args {
+                    err=deleteFile(username,filename)
+                    if err!=nil {break}
                 }
-                uploadDatabase()//同步数据库到其它服务器
-                fmt.Println("文件上传完毕！")
-            case "del"://删除文件
-                if username=="Anonymous" {
-                    fmt.Println("请先登录！")
+            case "sync"://双向同步文件夹
+                flags:=flag.NewFlagSet("sync",flag.ContinueOnError)
+                dry_run:=flags.Bool("n",false,"只显示要做的操作")
+                delete_policy:=flags.String("delete","none","删除策略：none、local、remote或both")
+                if flags.Parse(args)!=nil {continue}
+                if flags.NArg()!=2 {
+                    fmt.Println("用法：sync [-n] [-delete none|local|remote|both] [local dir] [remote dir]")
                     continue
                 }
-                /*
-                删除文件流程：
-                将文件信息从数据库中删除
-                更新数据库到服务器
-                通知对应的服务器删除文件块
-                */
-                fmt.Println("准备写入数据库……")
-                //查询key并删除
-                db, err := sql.Open(DB_TYPE, dbPath(username));checkErr(err)//连接数据库
-                rows, err := db.Query(`SELECT key FROM FileKey WHERE filename = $1`,parameter[0]);checkErr(err)
-                var key_list [] string
-                for rows.Next() {
-                    var key string
-                    if err = rows.Scan(&key); err != nil {
-                        rows.Close()
-                        break
-                    }
-                    key_list=append(key_list,key)
-                }
-                tx, err := db.Begin();checkErr(err)
-                //先从KeyServer处删除key
-                for _,key := range key_list {
-                    _, err = tx.Exec(`DELETE FROM KeyServer WHERE key = $1`,key);checkErr(err)//删除文件
-                }
-                //然后从FileKey中删除file
-                _, err = tx.Exec(`DELETE FROM FileKey WHERE filename = $1`,parameter[0]);checkErr(err)//删除文件
-                err = tx.Commit();checkErr(err)
-                err = db.Close();checkErr(err)
-                fmt.Println("数据库更新成功。")
-                //同步数据库到其它服务器
-                uploadDatabase()
-                //通知对应的服务器删除文件块 TODO:待优化，只通知存在的服务器删除
-                log("通知服务器删除文件……")
-                for _,key := range key_list {
-                    bytes_buf := bytes.NewBuffer(make([]byte, 0))
-                    binary.Write(bytes_buf, binary.BigEndian, DELETE_FILE)
-                    binary.Write(bytes_buf, binary.BigEndian, []byte(key))
-                    sendDatasToAllServers(bytes_buf.Bytes())
-                }
-                fmt.Println("文件删除完毕！")
+                err=syncTree(username,flags.Arg(0),flags.Arg(1),*delete_policy,*dry_run)
             case "update":
-                updateServerList()
-                getGlobalDatabase()
+                err=updateDatabase()
             case "status":
-                for _,server:= range global_server_list {
-                    conn, err := net.DialTimeout("tcp", server, NET_TIMEOUT)
-                    if err!=nil {
-                        fmt.Println(server,"无法连接")
-                    }
-                    fmt.Println(server,"在线")
-                    conn.Close()
+                err=printStatus()
+            case "decommission"://服务器下线
+                instruct:=DECOMMISSION
+                server:=parameter(0)
+                switch parameter(0) {
+                    case "status":
+                        instruct=DRAIN_STATUS
+                        server=parameter(1)
+                    case "cancel":
+                        instruct=DRAIN_CANCEL
+                        server=parameter(1)
                 }
+                if server=="" {
+                    fmt.Println("请输入服务器地址！")
+                    fmt.Println("用法：decommission [server]、decommission status [server]、decommission cancel [server]")
+                    fmt.Println("例子：decommission 192.168.1.2:2333")
+                    continue
+                }
+                status,err:=sendDrainCommand(server,instruct)
+                if err!=nil {
+                    fmt.Println("[ERROR]下线命令执行失败：",err)
+                    continue
+                }
+                printDrainStatus(server,status)
+            case "rebalance"://重新平衡
+                requestRebalance()
+            default:
+                fmt.Println("未知命令：",command,"，输入help获取帮助。")
             case "debug"://调试
-                switch parameter[0]{
+                switch parameter(0){
                     case "1":
 
                 }
         }
+        if err!=nil {
+            fmt.Println("[ERROR]",err)
+        }
     }
 }
 
 
-func testConn(){//服务器加入集群时的测试连接函数
-    //打开端口，测试连接
-    tcpAddr, err := net.ResolveTCPAddr("tcp",":"+*port)
-    tcpListener, err := net.ListenTCP("tcp",tcpAddr)
-    if err != nil {
-        fmt.Println("[ERROR]服务器启动错误：",err)
-        panic("服务器启动错误")
-    }
-    fmt.Println("启动连接测试服务器！")
-    //处理服务器测试连接
-    tcpConn, _ := tcpListener.AcceptTCP()
-    fmt.Println("接收到测试连接。")
-    err=tcpConn.Close();checkErr(err)
-    err=tcpListener.Close();checkErr(err)
-    fmt.Println("服务器测试连接成功！")
-}
-
-
 /****************************************************/
 
 //要对golang map按照value进行排序，思路是直接不用map，用struct存放key和value，实现sort接口，就可以调用sort.Sort进行排序了。
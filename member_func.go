@@ -0,0 +1,532 @@
+package main
+
+/*
+本文件包含了集群成员管理相关的函数，使用类似SWIM的gossip协议进行故障检测和成员信息传播
+*/
+
+/*
+成员管理原理（SWIM）：
+每个服务器维护一份成员表，每个成员有地址、状态（存活/可疑/死亡）和化身号（incarnation）。
+每隔GOSSIP_INTERVAL，服务器按轮询顺序选一个成员发送GOSSIP_PING，对方回复ACK。
+如果没有回复，就请GOSSIP_INDIRECT_NUM个其它成员帮忙ping（GOSSIP_PING_REQ），都失败则把它标记为可疑。
+可疑超过SUSPECT_TIMEOUT就标记为死亡，死亡的成员保留DEAD_RETENTION后从成员表中删除。
+成员状态的变化会附带在ping和ack里传播出去（piggyback），每条变化传播若干次。
+被怀疑的服务器收到关于自己的可疑或死亡消息时，会增加自己的化身号并广播存活，以此反驳。
+服务器列表文件server_list.txt只作为启动时的种子列表，由成员表自动更新，只保存存活和可疑的服务器。
+*/
+
+import (
+    "net"
+    "io"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strings"
+    "log/slog"
+    "io/ioutil"
+    "math/rand"
+    "encoding/json"
+    "encoding/binary"
+)
+
+const ( //定义成员状态
+    MEMBER_ALIVE uint8 = 0 //存活
+    MEMBER_SUSPECT uint8 = 1 //可疑，ping不通，等待对方反驳
+    MEMBER_DEAD uint8 = 2 //死亡
+    MEMBER_LEFT uint8 = 3 //已退出集群（下线完成）
+)
+
+const GOSSIP_INTERVAL=time.Second //探测周期
+const GOSSIP_TIMEOUT=time.Millisecond*500 //ping超时时间
+const GOSSIP_INDIRECT_NUM=3 //间接探测时请求的成员数量
+const GOSSIP_MAX_UPDATES=16 //每个消息最多附带的成员变化数量
+const SUSPECT_TIMEOUT=time.Second*5 //可疑状态持续这么久没有反驳就认为死亡
+const DEAD_RETENTION=time.Minute*10 //死亡的成员保留这么久，防止旧消息让它复活
+const MAX_DATA_SIZE=1024*1024*64 //sendData/readData一次最多传输的数据大小
+
+type Member struct {//集群成员
+    Addr string //服务器地址（标识），格式如“127.0.0.1:2333”、“[::1]:2333”
+    Addrs []string //服务器的其它地址，比如IPv6地址或主机名
+    State uint8 //成员状态
+    Incarnation uint64 //化身号，只有成员自己能增加，用于反驳可疑和死亡消息
+    Draining bool //正在下线，不再接收新的文件块
+    Zone string //故障域，同一个文件块的副本不会放在同一个故障域
+    Capacity float64 //容量（GB），作为放置文件块时的权重
+    changed time.Time //状态最后一次变化的时间
+    transmits int //这条变化已经传播的次数
+}
+
+var global_members=map[string]*Member{} //成员表，key为服务器地址
+var global_members_lock sync.Mutex
+var probe_list []string //本轮探测顺序
+var probe_index int
+
+/*
+成员状态名称
+*/
+func memberStateName(state uint8)string{
+    switch state {
+        case MEMBER_ALIVE:
+            return "存活"
+        case MEMBER_SUSPECT:
+            return "可疑"
+        case MEMBER_DEAD:
+            return "死亡"
+        case MEMBER_LEFT:
+            return "已退出"
+    }
+    return "未知"
+}
+
+/*
+把本机加入成员表（服务器启动时调用，此时self_server_addr已确定）
+*/
+func initSelfMember(){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    self,exist:=global_members[self_server_addr]
+    if !exist {
+        self=&Member{Addr:self_server_addr}
+        global_members[self_server_addr]=self
+    }
+    if self.State!=MEMBER_ALIVE || self.Zone!=*zone || self.Capacity!=*capacity || strings.Join(self.Addrs,",")!=strings.Join(self_server_addrs,",") {
+        self.Incarnation++
+        self.State=MEMBER_ALIVE
+    }
+    self.Zone=*zone
+    self.Addrs=self_server_addrs
+    self.Capacity=*capacity
+    self.changed=time.Now()
+    self.transmits=0
+    membersChanged()
+}
+
+/*
+应用一条成员变化，返回是否改变了成员表（调用前需持有global_members_lock）
+*/
+func applyMemberUpdate(u Member)bool{
+    if u.Addr=="" {return false}
+    if self_server_addr!="" && u.Addr==self_server_addr && *enable_server {
+        self:=global_members[self_server_addr]
+        if self==nil {return false}
+        if self.State==MEMBER_ALIVE && u.State!=MEMBER_ALIVE && u.Incarnation>=self.Incarnation {
+            //有人怀疑自己，增加化身号进行反驳
+            self.Incarnation=u.Incarnation+1
+            self.changed=time.Now()
+            self.transmits=0
+            slog.Info("反驳关于本机的消息","state",memberStateName(u.State),"incarnation",self.Incarnation)
+            return true
+        }
+        if u.State==MEMBER_ALIVE && u.Incarnation>self.Incarnation {
+            //重新加入集群时，其它成员可能记得更大的化身号
+            self.Incarnation=u.Incarnation
+            self.changed=time.Now()
+            self.transmits=0
+            return true
+        }
+        return false
+    }
+    m,exist:=global_members[u.Addr]
+    if !exist {
+        if u.State==MEMBER_DEAD || u.State==MEMBER_LEFT {return false}//不认识的成员死了，不需要记录
+        global_members[u.Addr]=&Member{Addr:u.Addr,State:u.State,Incarnation:u.Incarnation,Addrs:u.Addrs,Draining:u.Draining,Zone:u.Zone,Capacity:u.Capacity,changed:time.Now()}
+        slog.Info("新增成员","addr",u.Addr,"state",memberStateName(u.State))
+        scheduleRebalance()//新服务器加入，重新平衡文件块
+        return true
+    }
+    override:=false
+    switch u.State {
+        case MEMBER_ALIVE:
+            override=u.Incarnation>m.Incarnation
+        case MEMBER_SUSPECT:
+            override=(m.State==MEMBER_ALIVE && u.Incarnation>=m.Incarnation) || u.Incarnation>m.Incarnation
+        case MEMBER_DEAD:
+            override=m.State!=MEMBER_DEAD && m.State!=MEMBER_LEFT && u.Incarnation>=m.Incarnation
+        case MEMBER_LEFT:
+            override=m.State!=MEMBER_LEFT && u.Incarnation>=m.Incarnation
+    }
+    if !override {return false}
+    if m.State!=u.State {
+        slog.Info("成员状态变化","addr",u.Addr,"from",memberStateName(m.State),"to",memberStateName(u.State))
+        if u.State==MEMBER_ALIVE && (m.State==MEMBER_DEAD || m.State==MEMBER_LEFT) {
+            scheduleRebalance()//服务器重新加入，重新平衡文件块
+        }
+    }
+    m.State=u.State
+    m.Incarnation=u.Incarnation
+    m.Addrs=u.Addrs
+    m.Draining=u.Draining
+    m.Zone=u.Zone
+    m.Capacity=u.Capacity
+    m.changed=time.Now()
+    m.transmits=0
+    return true
+}
+
+/*
+应用多条成员变化
+*/
+func applyMemberUpdates(updates []Member){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    changed:=false
+    for _,u:=range updates {
+        if applyMemberUpdate(u) {changed=true}
+    }
+    if changed {membersChanged()}
+}
+
+/*
+本机对某个成员做出判断（可疑或死亡），并传播出去
+*/
+func markMember(addr string, state uint8){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    m,exist:=global_members[addr]
+    if !exist {return}
+    if applyMemberUpdate(Member{Addr:addr,State:state,Incarnation:m.Incarnation}) {
+        membersChanged()
+    }
+}
+
+/*
+某个服务器加入集群（JOIN_CLUSTER），如果它以前死过，需要增加化身号让它复活
+*/
+func joinMember(addr string, addrs []string){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    m,exist:=global_members[addr]
+    if !exist {
+        applyMemberUpdate(Member{Addr:addr,Addrs:addrs,State:MEMBER_ALIVE})
+    }else if m.State!=MEMBER_ALIVE {
+        applyMemberUpdate(Member{Addr:addr,Addrs:addrs,State:MEMBER_ALIVE,Incarnation:m.Incarnation+1,Zone:m.Zone,Capacity:m.Capacity})
+    }
+    membersChanged()
+}
+
+/*
+更新本机的状态（下线时使用），增加化身号让新状态覆盖旧状态
+*/
+func updateSelfMember(state uint8, draining bool){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    self,exist:=global_members[self_server_addr]
+    if !exist {return}
+    self.State=state
+    self.Draining=draining
+    self.Incarnation++
+    self.changed=time.Now()
+    self.transmits=0
+    membersChanged()
+}
+
+/*
+判断服务器是否可以存放新的文件块（存活或可疑，并且不在下线中）
+*/
+func isPlaceable(addr string)bool{
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    m,exist:=global_members[addr]
+    if !exist {return true}//不在成员表中（比如旧版本服务器），按原来的方式处理
+    return !m.Draining && m.State!=MEMBER_DEAD && m.State!=MEMBER_LEFT
+}
+
+/*
+取得需要附带传播的成员变化（总是包含本机）
+*/
+func memberUpdatesToGossip()[]Member{
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    limit:=3
+    for n:=len(global_members);n>1;n/=2 {limit+=3}//传播次数约为3*log2(n)
+    var updates []Member
+    if self,exist:=global_members[self_server_addr];exist {
+        updates=append(updates,*self)
+    }
+    for _,m:=range global_members {
+        if len(updates)>=GOSSIP_MAX_UPDATES {break}
+        if m.Addr==self_server_addr || m.transmits>=limit {continue}
+        m.transmits++
+        updates=append(updates,*m)
+    }
+    return updates
+}
+
+/*
+取得成员表的副本，按地址排序
+*/
+func memberList()[]Member{
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    var list []Member
+    for _,m:=range global_members {
+        list=append(list,*m)
+    }
+    sort.Slice(list, func(i, j int)bool{return list[i].Addr<list[j].Addr})
+    return list
+}
+
+/*
+成员表变化后，更新服务器列表，在后台写入服务器列表文件（调用前需持有global_members_lock，写文件时不持有）
+*/
+func membersChanged(){
+    var servers []string
+    for _,m:=range global_members {
+        if m.State!=MEMBER_DEAD && m.State!=MEMBER_LEFT {servers=append(servers,m.Addr)}
+    }
+    sort.Strings(servers)
+    setServerList(servers)
+    go saveServerList()
+}
+
+/*
+取得服务器列表的副本
+*/
+func serverList()[]string{
+    global_server_list_lock.RLock()
+    defer global_server_list_lock.RUnlock()
+    return append([]string{},global_server_list...)
+}
+
+func setServerList(servers []string){
+    global_server_list_lock.Lock()
+    defer global_server_list_lock.Unlock()
+    global_server_list=append([]string{},servers...)
+}
+
+var server_list_file_lock sync.Mutex
+
+/*
+把当前的服务器列表写入服务器列表文件，每次写入的都是最新的列表，多次变化时最后写入的不会是旧的
+*/
+func saveServerList(){
+    server_list_file_lock.Lock()
+    defer server_list_file_lock.Unlock()
+    servers:=serverList()
+    if len(servers)==0 {return}
+    file_server_list_strings:=strings.Join(servers,"\r\n")
+    file_datas, _ := ioutil.ReadFile(*server_list_file)
+    if string(file_datas)==file_server_list_strings {return}
+    err:=ioutil.WriteFile(*server_list_file,[]byte(file_server_list_strings),0644)
+    if err!=nil {
+        slog.Warn("服务器列表文件写入失败","err",err)
+    }
+}
+
+/*
+发送一段数据：8字节长度（uint64）+数据
+*/
+func sendData(datas []byte, conn net.Conn)error{
+    header := make([]byte, 8)
+    binary.BigEndian.PutUint64(header,uint64(len(datas)))
+    return writeAll(conn,append(header,datas...))
+}
+
+/*
+读取一段数据：8字节长度（uint64）+数据
+*/
+func readData(conn net.Conn)([]byte,error){
+    header := make([]byte, 8)
+    _,err:=io.ReadFull(conn,header)
+    if err!=nil {return nil,err}
+    size:=binary.BigEndian.Uint64(header)
+    if size>MAX_DATA_SIZE {
+        return nil,errors.New("数据太大")
+    }
+    datas := make([]byte, size)
+    _,err=io.ReadFull(conn,datas)
+    return datas,err
+}
+
+/*
+发送成员列表
+*/
+func sendMembers(members []Member, conn net.Conn)error{
+    datas,err:=json.Marshal(members)
+    if err!=nil {return err}
+    return sendData(datas,conn)
+}
+
+/*
+读取成员列表
+*/
+func readMembers(conn net.Conn)([]Member,error){
+    datas,err:=readData(conn)
+    if err!=nil {return nil,err}
+    var members []Member
+    err=json.Unmarshal(datas,&members)
+    return members,err
+}
+
+/*
+直接ping一个成员，返回是否收到ACK
+*/
+func pingMember(addr string)bool{
+    conn, err := dialServer(addr, GOSSIP_TIMEOUT)
+    if err != nil {return false}
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(GOSSIP_TIMEOUT))
+    sendInstruct(GOSSIP_PING,conn)
+    if sendMembers(memberUpdatesToGossip(),conn)!=nil {return false}
+    if readInstruct(conn)!=ACK {return false}
+    updates,err:=readMembers(conn)
+    if err!=nil {return false}
+    applyMemberUpdates(updates)
+    return true
+}
+
+/*
+请其它成员帮忙ping一个成员，返回是否有成员ping通
+*/
+func pingMemberIndirect(addr string)bool{
+    var helpers []string
+    for _,m:=range memberList() {
+        if m.Addr==addr || m.Addr==self_server_addr || m.State!=MEMBER_ALIVE {continue}
+        helpers=append(helpers,m.Addr)
+    }
+    rand.Shuffle(len(helpers), func(i, j int){helpers[i],helpers[j]=helpers[j],helpers[i]})
+    if len(helpers)>GOSSIP_INDIRECT_NUM {helpers=helpers[:GOSSIP_INDIRECT_NUM]}
+    result:=make(chan bool,len(helpers))
+    for _,helper:=range helpers {
+        go func(helper string){
+            conn, err := dialServer(helper, GOSSIP_TIMEOUT)
+            if err != nil {
+                result<-false
+                return
+            }
+            defer conn.Close()
+            conn.SetDeadline(time.Now().Add(GOSSIP_TIMEOUT*3))
+            sendInstruct(GOSSIP_PING_REQ,conn)
+            sendData([]byte(addr),conn)
+            sendMembers(memberUpdatesToGossip(),conn)
+            if readInstruct(conn)!=ACK {
+                result<-false
+                return
+            }
+            updates,err:=readMembers(conn)
+            if err==nil {applyMemberUpdates(updates)}
+            result<-true
+        }(helper)
+    }
+    for range helpers {
+        if <-result {return true}
+    }
+    return false
+}
+
+/*
+选择下一个探测目标，每轮打乱一次顺序
+*/
+func nextProbeTarget()string{
+    for tries:=0;tries<2;tries++ {
+        for probe_index<len(probe_list) {
+            addr:=probe_list[probe_index]
+            probe_index++
+            global_members_lock.Lock()
+            m,exist:=global_members[addr]
+            global_members_lock.Unlock()
+            if exist && m.State!=MEMBER_DEAD && m.State!=MEMBER_LEFT {return addr}
+        }
+        probe_list=nil
+        for _,m:=range memberList() {
+            if m.Addr!=self_server_addr && m.State!=MEMBER_DEAD && m.State!=MEMBER_LEFT {probe_list=append(probe_list,m.Addr)}
+        }
+        rand.Shuffle(len(probe_list), func(i, j int){probe_list[i],probe_list[j]=probe_list[j],probe_list[i]})
+        probe_index=0
+    }
+    return ""
+}
+
+/*
+检查可疑成员是否超时，清理死亡太久的成员
+*/
+func checkMemberTimeouts(){
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    changed:=false
+    for addr,m:=range global_members {
+        if m.State==MEMBER_SUSPECT && time.Since(m.changed)>SUSPECT_TIMEOUT {
+            slog.Info("成员状态变化","addr",addr,"from",memberStateName(MEMBER_SUSPECT),"to",memberStateName(MEMBER_DEAD))
+            m.State=MEMBER_DEAD
+            m.changed=time.Now()
+            m.transmits=0
+            changed=true
+        }else if (m.State==MEMBER_DEAD || m.State==MEMBER_LEFT) && time.Since(m.changed)>DEAD_RETENTION {
+            slog.Info("从成员表中删除","addr",addr)
+            delete(global_members,addr)
+            changed=true
+        }
+    }
+    if changed {membersChanged()}
+}
+
+/*
+gossip协程，服务器启动后一直运行
+*/
+func gossipLoop(){
+    for{
+        time.Sleep(GOSSIP_INTERVAL)
+        checkMemberTimeouts()
+        target:=nextProbeTarget()
+        if target=="" {continue}
+        if pingMember(target) {continue}
+        slog.Debug("直接ping失败，尝试间接ping","target",target)
+        if pingMemberIndirect(target) {continue}
+        markMember(target,MEMBER_SUSPECT)
+    }
+}
+
+/*
+从服务器获取成员表。replace为true时用获取到的成员表替换本地的（客户端使用），否则合并（服务器使用）
+*/
+func fetchMembers(server string, replace bool)error{
+    conn, err := dialServer(server, *net_timeout)
+    if err != nil {return err}
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(*net_timeout*10))
+    sendInstruct(GET_MEMBERS,conn)
+    members,err:=readMembers(conn)
+    if err!=nil {return err}
+    if !replace {
+        applyMemberUpdates(members)
+        return nil
+    }
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    global_members=map[string]*Member{}
+    for i:=range members {
+        members[i].changed=time.Now()
+        global_members[members[i].Addr]=&members[i]
+    }
+    membersChanged()
+    return nil
+}
+
+/*
+处理GOSSIP_PING指令
+*/
+func handleGossipPing(conn net.Conn){
+    updates,err:=readMembers(conn)
+    if err!=nil {return}
+    applyMemberUpdates(updates)
+    sendInstruct(ACK,conn)
+    sendMembers(memberUpdatesToGossip(),conn)
+}
+
+/*
+处理GOSSIP_PING_REQ指令
+*/
+func handleGossipPingReq(conn net.Conn){
+    target,err:=readData(conn)
+    if err!=nil {return}
+    updates,err:=readMembers(conn)
+    if err!=nil {return}
+    applyMemberUpdates(updates)
+    if !pingMember(string(target)) {
+        sendInstruct(ERR,conn)
+        return
+    }
+    sendInstruct(ACK,conn)
+    sendMembers(memberUpdatesToGossip(),conn)
+}
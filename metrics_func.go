@@ -0,0 +1,209 @@
+package main
+
+/*
+本文件包含了服务器监控指标相关的函数：-metrics参数指定地址后，服务器在这个地址上提供HTTP接口/metrics（Prometheus格式）
+*/
+
+/*
+指标：
+    dss_requests_total{instruction}                    收到的指令数量
+    dss_request_errors_total{instruction}              出错的指令数量（返回了ERR，或连接读写出错）
+    dss_request_bytes_total{instruction,direction}     处理指令时接收（in）和发送（out）的字节数
+    dss_request_duration_seconds{instruction}          处理指令的耗时
+    dss_connections                                    当前的连接数量
+    dss_connections_total                              接受过的连接数量
+    dss_chunks、dss_chunk_bytes                        本机存放的文件块数量和总大小
+    dss_members{state}                                 成员表中各个状态的服务器数量
+    dss_db_sync_duration_seconds                       接收同步的数据库（SYNC_DB）的耗时，包括接收、检查和解压
+    dss_repair_queue_length                            等待迁移的文件块数量（下线和重新平衡）
+文件块、成员表和迁移队列在每次抓取时统计，不需要额外维护。
+*/
+
+import (
+    "net"
+    "time"
+    "log/slog"
+    "io/ioutil"
+    "net/http"
+    "sync/atomic"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var instruction_names=map[byte]string{ //指令码在指标中的名称
+    DOWNLOAD_FILE:"download_file",
+    SEND_DB:"send_db",
+    SYNC_DB:"sync_db",
+    UPLOAD_FILE:"upload_file",
+    DELETE_FILE:"delete_file",
+    JOIN_CLUSTER:"join_cluster",
+    GET_SERVER_LIST:"get_server_list",
+    SERVER_LOAD:"server_load",
+    DOWNLOAD_RANGE:"download_range",
+    FILE_SIZE:"file_size",
+    GOSSIP_PING:"gossip_ping",
+    GOSSIP_PING_REQ:"gossip_ping_req",
+    GET_MEMBERS:"get_members",
+    DECOMMISSION:"decommission",
+    DRAIN_STATUS:"drain_status",
+    DRAIN_CANCEL:"drain_cancel",
+    REBALANCE:"rebalance",
+    VERIFY_ADDR:"verify_addr",
+    LOCK_ACQUIRE:"lock_acquire",
+    LOCK_RENEW:"lock_renew",
+    LOCK_RELEASE:"lock_release",
+    SEND_USER_DB:"send_user_db",
+    GET_QUOTAS:"get_quotas",
+    SET_QUOTA:"set_quota",
+    SYNC_QUOTAS:"sync_quotas",
+}
+
+var (
+    metric_requests=prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name:"dss_requests_total",
+        Help:"Instructions received, by instruction.",
+    },[]string{"instruction"})
+    metric_errors=prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name:"dss_request_errors_total",
+        Help:"Instructions that answered ERR or failed on the connection, by instruction.",
+    },[]string{"instruction"})
+    metric_bytes=prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name:"dss_request_bytes_total",
+        Help:"Bytes received (in) and sent (out) while handling instructions.",
+    },[]string{"instruction","direction"})
+    metric_duration=prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:"dss_request_duration_seconds",
+        Help:"Time spent handling an instruction.",
+        Buckets:prometheus.ExponentialBuckets(0.001,4,9),//1ms到65s
+    },[]string{"instruction"})
+    metric_connections=prometheus.NewGauge(prometheus.GaugeOpts{
+        Name:"dss_connections",
+        Help:"Open connections.",
+    })
+    metric_connections_total=prometheus.NewCounter(prometheus.CounterOpts{
+        Name:"dss_connections_total",
+        Help:"Accepted connections.",
+    })
+    metric_db_sync=prometheus.NewHistogram(prometheus.HistogramOpts{
+        Name:"dss_db_sync_duration_seconds",
+        Help:"Time spent receiving, checking and unpacking a synced database.",
+        Buckets:prometheus.ExponentialBuckets(0.01,2,12),//10ms到20s
+    })
+)
+
+var member_state_labels=map[uint8]string{ //成员状态在指标中的名称
+    MEMBER_ALIVE:"alive",
+    MEMBER_SUSPECT:"suspect",
+    MEMBER_DEAD:"dead",
+    MEMBER_LEFT:"left",
+}
+
+var rebalance_pending int64 //重新平衡中还没有处理的文件块数量，用atomic读写
+
+/*
+抓取时统计的指标：文件块、成员表和迁移队列
+*/
+type serverCollector struct {
+    chunks *prometheus.Desc
+    chunk_bytes *prometheus.Desc
+    members *prometheus.Desc
+    repair_queue *prometheus.Desc
+}
+
+func newServerCollector()*serverCollector{
+    return &serverCollector{
+        chunks:prometheus.NewDesc("dss_chunks","Chunks stored on this server.",nil,nil),
+        chunk_bytes:prometheus.NewDesc("dss_chunk_bytes","Bytes of chunks stored on this server.",nil,nil),
+        members:prometheus.NewDesc("dss_members","Members in the membership table, by state.",[]string{"state"},nil),
+        repair_queue:prometheus.NewDesc("dss_repair_queue_length","Chunks waiting to be migrated by drain or rebalance.",nil,nil),
+    }
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc){
+    ch<-c.chunks
+    ch<-c.chunk_bytes
+    ch<-c.members
+    ch<-c.repair_queue
+}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric){
+    var count,size int64
+    if dir,err:=ioutil.ReadDir(*storage_dir);err==nil {
+        for _,f:=range dir {
+            if f.IsDir() || !isKey(f.Name()) {continue}
+            count++
+            size+=f.Size()
+        }
+    }
+    ch<-prometheus.MustNewConstMetric(c.chunks,prometheus.GaugeValue,float64(count))
+    ch<-prometheus.MustNewConstMetric(c.chunk_bytes,prometheus.GaugeValue,float64(size))
+    states:=map[uint8]int{}
+    for _,member:=range memberList() {states[member.State]++}
+    for state,name:=range member_state_labels {
+        ch<-prometheus.MustNewConstMetric(c.members,prometheus.GaugeValue,float64(states[state]),name)
+    }
+    queue:=atomic.LoadInt64(&rebalance_pending)
+    if status:=getDrainStatus();status.Running {queue+=int64(status.Total-status.Done-status.Failed)}
+    ch<-prometheus.MustNewConstMetric(c.repair_queue,prometheus.GaugeValue,float64(queue))
+}
+
+/*
+启动/metrics接口，addr为空时不启动
+*/
+func startMetrics(addr string){
+    if addr=="" {return}
+    registry:=prometheus.NewRegistry()
+    registry.MustRegister(metric_requests,metric_errors,metric_bytes,metric_duration,
+        metric_connections,metric_connections_total,metric_db_sync,newServerCollector(),
+        prometheus.NewGoCollector(),prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+    mux:=http.NewServeMux()
+    mux.Handle("/metrics",promhttp.HandlerFor(registry,promhttp.HandlerOpts{}))
+    go func(){
+        slog.Info("监控指标接口","url","http://"+addr+"/metrics")
+        err:=http.ListenAndServe(addr,mux)
+        if err!=nil {slog.Error("监控指标接口启动失败","err",err)}
+    }()
+}
+
+/*
+服务端的连接：统计每条指令读写的字节数和错误，每处理完一条指令调用done记录指标；
+还记录了客户端发来的请求ID（REQUEST_ID指令），用于日志
+*/
+type serverConn struct {
+    net.Conn
+    bytes_in int64
+    bytes_out int64
+    failed bool //读写出错或返回了ERR
+    replied bool //已经发送过数据（只有回复的第一个字节是指令码）
+    request_id string
+}
+
+func (c *serverConn) Read(b []byte)(int,error){
+    n,err:=c.Conn.Read(b)
+    c.bytes_in+=int64(n)
+    if err!=nil {c.failed=true}
+    return n,err
+}
+
+func (c *serverConn) Write(b []byte)(int,error){
+    if !c.replied && len(b)==1 && b[0]==ERR {c.failed=true}
+    c.replied=true
+    n,err:=c.Conn.Write(b)
+    c.bytes_out+=int64(n)
+    if err!=nil {c.failed=true}
+    return n,err
+}
+
+/*
+记录一条指令的指标，然后清零，准备处理下一条指令
+*/
+func (c *serverConn) done(instruct byte, start time.Time){
+    name,ok:=instruction_names[instruct]
+    if !ok {name="unknown"}
+    metric_requests.WithLabelValues(name).Inc()
+    if c.failed {metric_errors.WithLabelValues(name).Inc()}
+    metric_bytes.WithLabelValues(name,"in").Add(float64(c.bytes_in))
+    metric_bytes.WithLabelValues(name,"out").Add(float64(c.bytes_out))
+    metric_duration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+    c.bytes_in,c.bytes_out,c.failed,c.replied=0,0,false,false
+}
@@ -0,0 +1,207 @@
+package main
+
+/*
+本文件包含了服务器之间迁移文件块相关的函数，下线（drain）和重新平衡（rebalance）都会用到
+*/
+
+/*
+迁移一个文件块的步骤：
+1. 源服务器把文件块从storage/发送到目标服务器（UPLOAD_FILE）
+2. 持有用户的集群锁，修改所有引用这个文件块的用户数据库，在KeyServer中把源服务器换成目标服务器
+3. 把修改过的用户数据库带上fencing token同步到所有服务器，然后释放集群锁
+4. 源服务器删除本地的文件块（下线时不删除，由管理员处理）
+数据库同步之前，客户端读到的仍然是源服务器，而源服务器上的文件块此时还在，所以下载不会失败。
+*/
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "errors"
+    "log/slog"
+    "io/ioutil"
+    "database/sql"
+)
+
+/*
+列出所有用户（即database文件夹里的数据库）
+*/
+func listUsers()[]string{
+    var users []string
+    dir, err := ioutil.ReadDir(*database_dir)
+    if err!=nil {return users}
+    for _,f := range dir {
+        if(subString(f.Name(),0,1)=="."){continue}
+        if len(f.Name())<=3 || f.Name()[len(f.Name())-3:]!=".db" {continue}
+        users=append(users,f.Name()[:len(f.Name())-3])
+    }
+    return users
+}
+
+/*
+读取所有用户数据库的KeyServer表，返回 key -> 服务器列表，以及 key -> 引用它的用户列表
+*/
+func scanKeyServers()(map[string][]string,map[string][]string,error){
+    key_servers:=map[string][]string{}
+    key_users:=map[string][]string{}
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    for _,user:=range listUsers() {
+        db, err := sql.Open(DB_TYPE, dbPath(user))
+        if err!=nil {return nil,nil,err}
+        rows, err := db.Query(`SELECT key,server FROM KeyServer`)
+        if err!=nil {
+            db.Close()
+            return nil,nil,err
+        }
+        seen:=map[string]bool{}
+        for rows.Next() {
+            var key,server string
+            if err = rows.Scan(&key,&server); err != nil {
+                rows.Close()
+                break
+            }
+            if !containsString(key_servers[key],server) {
+                key_servers[key]=append(key_servers[key],server)
+            }
+            if !seen[key] {
+                seen[key]=true
+                key_users[key]=append(key_users[key],user)
+            }
+        }
+        db.Close()
+    }
+    return key_servers,key_users,nil
+}
+
+/*
+统计每个服务器上的文件块数量（只统计可以存放文件块的服务器）
+*/
+func countServerBlocks(key_servers map[string][]string)map[string]int{
+    counts:=map[string]int{}
+    for _,server:=range serverList() {
+        if isPlaceable(server) {counts[server]=0}
+    }
+    for _,servers:=range key_servers {
+        for _,server:=range servers {
+            if _,exist:=counts[server];exist {counts[server]++}
+        }
+    }
+    return counts
+}
+
+/*
+服务器把本地的文件块发送给另一个服务器
+*/
+func pushChunk(key string, server string)error{
+    return pushChunkWith(key,server,nil)
+}
+
+/*
+服务器把本地的文件块发送给另一个服务器，wrap不为空时用它包装连接（比如限速）
+*/
+func pushChunkWith(key string, server string, wrap func(conn net.Conn)net.Conn)error{
+    if !isPathExists(storagePath(key)) {
+        return errors.New("本机没有这个文件块")
+    }
+    conn, err := dialServer(server, *net_timeout)
+    if err != nil {return err}
+    defer conn.Close()
+    if wrap!=nil {conn=wrap(conn)}
+    sendInstruct(UPLOAD_FILE,conn)
+    sendString(key,conn)
+    sendFile(storagePath(key),conn)
+    conn.SetReadDeadline(time.Now().Add(*sync_timeout))
+    if readInstruct(conn)!=ACK {
+        return errors.New("目标服务器没有回复ACK")
+    }
+    return nil
+}
+
+/*
+修改用户数据库，把文件块的副本从from换成to（from为空时只新增，to为空时只删除）
+*/
+func replaceChunkServer(user string, key string, from string, to []string)error{
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    db, err := sql.Open(DB_TYPE, dbPath(user))
+    if err!=nil {return err}
+    defer db.Close()
+    tx, err := db.Begin()
+    if err!=nil {return err}
+    for _,server:=range to {
+        var num int
+        err=tx.QueryRow(`SELECT count(*) FROM KeyServer WHERE key=$1 AND server=$2`,key,server).Scan(&num)
+        if err!=nil {
+            tx.Rollback()
+            return err
+        }
+        if num>0 {continue}
+        _, err = tx.Exec(`INSERT INTO KeyServer VALUES ($1,$2);`,key,server)
+        if err!=nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    if from!="" {
+        _, err = tx.Exec(`DELETE FROM KeyServer WHERE key=$1 AND server=$2`,key,from)
+        if err!=nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+/*
+把一个文件块从本机发送到所有目标服务器（不修改数据库，由调用者用applyChunkMoves批量修改）
+*/
+func migrateChunk(key string, targets []string)error{
+    for _,target:=range targets {
+        err:=pushChunk(key,target)
+        if err!=nil {
+            return errors.New("文件块发送到"+target+"失败："+err.Error())
+        }
+    }
+    slog.Debug("文件块发送完成","key",key,"targets",targets)
+    return nil
+}
+
+/*
+把一批迁移写入用户数据库并同步到所有服务器，每个用户的修改都在持有该用户的集群锁时进行。
+add为true时在KeyServer中加入目标服务器，remove为true时删除源服务器，返回失败的文件块
+*/
+func applyChunkMoves(moves []ChunkMove, key_users map[string][]string, add bool, remove bool)map[string]bool{
+    user_moves:=map[string][]ChunkMove{}
+    for _,move:=range moves {
+        for _,user:=range key_users[move.Key] {
+            user_moves[user]=append(user_moves[user],move)
+        }
+    }
+    failed:=map[string]bool{}
+    for user,moves:=range user_moves {
+        err:=updateUserDatabase(user,func()error{
+            for _,move:=range moves {
+                from,to:="",[]string(nil)
+                if remove {from=move.From}
+                if add && move.To!="" {to=[]string{move.To}}
+                err:=replaceChunkServer(user,move.Key,from,to)
+                if err!=nil {return err}
+            }
+            return nil
+        })
+        if err!=nil {
+            slog.Warn("修改数据库失败","user",user,"err",err)
+            for _,move:=range moves {failed[move.Key]=true}
+        }
+    }
+    return failed
+}
+
+/*
+打印迁移进度
+*/
+func printMigrateProgress(name string, done int, total int){
+    if total==0 {return}
+    slog.Info(name+"进度","done",done,"total",total,"percent",fmt.Sprintf("%.2f",float32(done)*100/float32(total)))
+}
@@ -0,0 +1,589 @@
+//go:build linux
+// +build linux
+
+package main
+
+/*
+本文件包含了把集群挂载成文件系统相关的函数（mount命令，使用FUSE，只支持Linux）
+*/
+
+/*
+挂载后的目录结构：
+挂载点/用户名/文件名，文件名中的“/”表示文件夹（和put -r一样），文件夹没有单独的记录，里面有文件就存在；
+mkdir新建的空文件夹只保存在内存中，放入文件后才会写入数据库。
+读取：按需下载读到的文件块，保存在本地缓存文件夹MOUNT_CACHE_DIR中（文件名是key，内容不会变，不需要过期），
+      缓存超过MOUNT_CACHE_SIZE时删除最久没有使用的文件块。
+写入：先写入本地临时文件，close时按put的流程切块上传并写入数据库，没有变化的文件块不会重新上传；
+      打开已有的文件写入（没有O_TRUNC）时先下载原来的内容。
+目录列表：用户的文件列表最多缓存MOUNT_REFRESH_TIME，超过后重新获取数据库，其它客户端上传、删除的文件也能看到。
+重命名：只修改数据库，不重新上传文件块；重命名文件夹会修改其中的所有文件。
+*/
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "syscall"
+    "io/ioutil"
+    "os/signal"
+    "path/filepath"
+    "dss/client"
+    "bazil.org/fuse"
+    fusefs "bazil.org/fuse/fs"
+)
+
+const MOUNT_CACHE_DIR="cache" //文件块缓存文件夹
+const MOUNT_CACHE_SIZE=1024*1024*1024 //文件块缓存的最大大小，单位Byte
+const MOUNT_REFRESH_TIME=2*time.Second //文件列表的缓存时间
+
+type mountFS struct {//挂载的文件系统
+    clients *clientPool
+    listings map[string]mountListing //用户名 -> 文件列表
+    users_time time.Time //上次获取用户列表的时间
+    dirs map[string]bool //mkdir新建的空文件夹：“用户名”或“用户名/文件夹”
+    writers map[string]*mountWriter //“用户名/文件名” -> 正在写入的文件
+    lock sync.Mutex
+    cache_lock sync.Mutex
+}
+
+type mountListing struct {//缓存的文件列表
+    files []client.FileInfo
+    time time.Time
+}
+
+type mountRoot struct {//挂载点，下面是所有用户
+    m *mountFS
+}
+
+type mountDir struct {//用户或文件夹
+    m *mountFS
+    user string
+    prefix string //文件夹的路径加上“/”，用户的根目录为空
+}
+
+type mountFile struct {//文件
+    m *mountFS
+    user string
+    name string
+}
+
+type mountReader struct {//只读打开的文件
+    m *mountFS
+    c *client.Client
+    info client.FileInfo
+    index int //最近读取的文件块序号
+    datas []byte //最近读取的文件块，顺序读取时不需要每次都读缓存文件
+    lock sync.Mutex
+}
+
+type mountWriter struct {//写入打开的文件，内容保存在临时文件中
+    m *mountFS
+    c *client.Client
+    user string
+    name string
+    file *os.File
+    dirty bool //有没有还没上传的修改
+    lock sync.Mutex
+}
+
+/*
+客户端库的错误转换成FUSE的错误码
+*/
+func mountError(err error)error{
+    if err==nil {return nil}
+    if errors.Is(err,client.ErrNotFound) {return fuse.ENOENT}
+    if errors.Is(err,context.Canceled) {return fuse.EINTR}
+    slog.Warn("挂载的文件系统出错","err",err)
+    return fuse.EIO
+}
+
+func (m *mountFS) Root()(fusefs.Node,error){
+    return &mountRoot{m},nil
+}
+
+/*
+用户的文件列表，超过MOUNT_REFRESH_TIME重新获取数据库
+*/
+func (m *mountFS) files(ctx context.Context, user string)([]client.FileInfo,error){
+    m.lock.Lock()
+    listing,exist:=m.listings[user]
+    m.lock.Unlock()
+    if exist && time.Since(listing.time)<MOUNT_REFRESH_TIME {return listing.files,nil}
+    c,err:=m.clients.get(user)
+    if err!=nil {return nil,err}
+    files,err:=c.List(ctx)
+    if err!=nil {return nil,err}
+    m.lock.Lock()
+    m.listings[user]=mountListing{files,time.Now()}
+    m.lock.Unlock()
+    return files,nil
+}
+
+/*
+用户的文件列表已经修改，下次重新获取
+*/
+func (m *mountFS) invalidate(user string){
+    m.lock.Lock()
+    delete(m.listings,user)
+    m.lock.Unlock()
+}
+
+/*
+查找文件
+*/
+func (m *mountFS) stat(ctx context.Context, user string, name string)(client.FileInfo,bool,error){
+    files,err:=m.files(ctx,user)
+    if err!=nil {return client.FileInfo{},false,err}
+    for _,file:=range files {
+        if file.Name==name {return file,true,nil}
+    }
+    return client.FileInfo{},false,nil
+}
+
+/*
+所有用户，包括mkdir新建的
+*/
+func (m *mountFS) users()[]string{
+    m.lock.Lock()
+    stale:=time.Since(m.users_time)>=MOUNT_REFRESH_TIME
+    m.lock.Unlock()
+    var users []string
+    if stale {
+        fetched,err:=fetchUsers()
+        if err==nil {
+            users=fetched
+            m.lock.Lock()
+            m.users_time=time.Now()
+            m.lock.Unlock()
+        }
+    }
+    if users==nil {users=listUsers()}//不需要更新或者获取失败时使用本地的数据库
+    m.lock.Lock()
+    for dir:=range m.dirs {
+        if !strings.Contains(dir,"/") && !containsString(users,dir) {users=append(users,dir)}
+    }
+    m.lock.Unlock()
+    return users
+}
+
+/*
+读取文件块：先找本地缓存，没有再从服务器下载并放入缓存
+*/
+func (m *mountFS) readChunk(ctx context.Context, c *client.Client, chunk client.Chunk)([]byte,error){
+    path:=filepath.Join(MOUNT_CACHE_DIR,chunk.Key)
+    if datas,err:=ioutil.ReadFile(path);err==nil {
+        now:=time.Now()
+        os.Chtimes(path,now,now)//记录最近使用的时间
+        return datas,nil
+    }
+    datas,err:=c.ReadChunk(ctx,chunk)
+    if err!=nil {return nil,err}
+    err=ioutil.WriteFile(path+".tmp",datas,0644)
+    if err==nil {err=os.Rename(path+".tmp",path)}
+    if err==nil {m.trimCache()}
+    return datas,nil
+}
+
+/*
+缓存超过MOUNT_CACHE_SIZE时删除最久没有使用的文件块
+*/
+func (m *mountFS) trimCache(){
+    m.cache_lock.Lock()
+    defer m.cache_lock.Unlock()
+    files,err:=ioutil.ReadDir(MOUNT_CACHE_DIR)
+    if err!=nil {return}
+    var total int64
+    for _,file:=range files {total+=file.Size()}
+    sort.Slice(files,func(i,j int)bool{return files[i].ModTime().Before(files[j].ModTime())})
+    for _,file:=range files {
+        if total<=MOUNT_CACHE_SIZE {break}
+        if os.Remove(filepath.Join(MOUNT_CACHE_DIR,file.Name()))==nil {total-=file.Size()}
+    }
+}
+
+/*
+打开文件写入：内容放在临时文件中，load为true时先下载原来的内容
+*/
+func (m *mountFS) openWriter(ctx context.Context, user string, name string, load bool)(*mountWriter,error){
+    c,err:=m.clients.get(user)
+    if err!=nil {return nil,err}
+    f,err:=ioutil.TempFile(*tmp_dir,"mount-")
+    if err!=nil {return nil,err}
+    w:=&mountWriter{m:m,c:c,user:user,name:name,file:f,dirty:!load}
+    if load {
+        info,exist,err:=m.stat(ctx,user,name)
+        if err==nil && exist {err=c.Download(ctx,info,f)}
+        if err!=nil {
+            w.close()
+            return nil,err
+        }
+    }
+    m.lock.Lock()
+    m.writers[user+"/"+name]=w
+    m.lock.Unlock()
+    return w,nil
+}
+
+/*
+正在写入的文件
+*/
+func (m *mountFS) writer(user string, name string)*mountWriter{
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    return m.writers[user+"/"+name]
+}
+
+func (r *mountRoot) Attr(ctx context.Context, attr *fuse.Attr)error{
+    attr.Mode=os.ModeDir|0755
+    return nil
+}
+
+func (r *mountRoot) Lookup(ctx context.Context, name string)(fusefs.Node,error){
+    if containsString(r.m.users(),name) {return &mountDir{r.m,name,""},nil}
+    return nil,fuse.ENOENT
+}
+
+func (r *mountRoot) ReadDirAll(ctx context.Context)([]fuse.Dirent,error){
+    var entries []fuse.Dirent
+    for _,user:=range r.m.users() {
+        entries=append(entries,fuse.Dirent{Name:user,Type:fuse.DT_Dir})
+    }
+    return entries,nil
+}
+
+/*
+在挂载点下新建文件夹就是新建用户，上传文件后才会有数据库
+*/
+func (r *mountRoot) Mkdir(ctx context.Context, req *fuse.MkdirRequest)(fusefs.Node,error){
+    if client.ValidUser(req.Name)!=nil {return nil,fuse.Errno(syscall.EINVAL)}
+    r.m.lock.Lock()
+    r.m.dirs[req.Name]=true
+    r.m.lock.Unlock()
+    return &mountDir{r.m,req.Name,""},nil
+}
+
+func (d *mountDir) Attr(ctx context.Context, attr *fuse.Attr)error{
+    attr.Mode=os.ModeDir|0755
+    return nil
+}
+
+/*
+文件夹下的文件和子文件夹：名字 -> 是否是文件夹
+*/
+func (d *mountDir) children(ctx context.Context)(map[string]bool,error){
+    files,err:=d.m.files(ctx,d.user)
+    if err!=nil && !errors.Is(err,client.ErrNotFound) {return nil,err}
+    children:=map[string]bool{}
+    add:=func(name string, is_file bool){
+        if !strings.HasPrefix(name,d.prefix) || name==d.prefix {return}
+        rest:=name[len(d.prefix):]
+        if i:=strings.Index(rest,"/");i>=0 {
+            children[rest[:i]]=true
+        }else if _,exist:=children[rest];!exist {
+            children[rest]=!is_file
+        }
+    }
+    for _,file:=range files {add(file.Name,true)}
+    d.m.lock.Lock()
+    for name:=range d.m.writers {
+        if strings.HasPrefix(name,d.user+"/") {add(name[len(d.user)+1:],true)}
+    }
+    for dir:=range d.m.dirs {
+        if strings.HasPrefix(dir,d.user+"/") {add(dir[len(d.user)+1:],false)}
+    }
+    d.m.lock.Unlock()
+    return children,nil
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string)(fusefs.Node,error){
+    children,err:=d.children(ctx)
+    if err!=nil {return nil,mountError(err)}
+    is_dir,exist:=children[name]
+    if !exist {return nil,fuse.ENOENT}
+    if is_dir {return &mountDir{d.m,d.user,d.prefix+name+"/"},nil}
+    return &mountFile{d.m,d.user,d.prefix+name},nil
+}
+
+func (d *mountDir) ReadDirAll(ctx context.Context)([]fuse.Dirent,error){
+    children,err:=d.children(ctx)
+    if err!=nil {return nil,mountError(err)}
+    var entries []fuse.Dirent
+    for name,is_dir:=range children {
+        entry:=fuse.Dirent{Name:name,Type:fuse.DT_File}
+        if is_dir {entry.Type=fuse.DT_Dir}
+        entries=append(entries,entry)
+    }
+    sort.Slice(entries,func(i,j int)bool{return entries[i].Name<entries[j].Name})
+    return entries,nil
+}
+
+func (d *mountDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest)(fusefs.Node,error){
+    path:=d.prefix+req.Name
+    if client.ValidName(path)!=nil {return nil,fuse.Errno(syscall.EINVAL)}
+    d.m.lock.Lock()
+    d.m.dirs[d.user+"/"+path]=true
+    d.m.lock.Unlock()
+    return &mountDir{d.m,d.user,path+"/"},nil
+}
+
+/*
+新建文件：close时上传（即使没有写入内容也会上传一个空文件）
+*/
+func (d *mountDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse)(fusefs.Node,fusefs.Handle,error){
+    name:=d.prefix+req.Name
+    if client.ValidName(name)!=nil {return nil,nil,fuse.Errno(syscall.EINVAL)}
+    w,err:=d.m.openWriter(ctx,d.user,name,false)
+    if err!=nil {return nil,nil,mountError(err)}
+    return &mountFile{d.m,d.user,name},w,nil
+}
+
+/*
+删除文件，或者删除空文件夹
+*/
+func (d *mountDir) Remove(ctx context.Context, req *fuse.RemoveRequest)error{
+    path:=d.prefix+req.Name
+    if req.Dir {
+        children,err:=(&mountDir{d.m,d.user,path+"/"}).children(ctx)
+        if err!=nil {return mountError(err)}
+        if len(children)>0 {return fuse.Errno(syscall.ENOTEMPTY)}
+        d.m.lock.Lock()
+        delete(d.m.dirs,d.user+"/"+path)
+        d.m.lock.Unlock()
+        return nil
+    }
+    c,err:=d.m.clients.get(d.user)
+    if err!=nil {return mountError(err)}
+    err=c.Delete(ctx,path)
+    d.m.invalidate(d.user)
+    return mountError(err)
+}
+
+/*
+重命名文件或文件夹：只修改数据库，一次Commit完成（目标文件已存在时被替换）
+*/
+func (d *mountDir) Rename(ctx context.Context, req *fuse.RenameRequest, new_dir fusefs.Node)error{
+    target,ok:=new_dir.(*mountDir)
+    if !ok || target.user!=d.user {return fuse.Errno(syscall.EXDEV)}//不能移动到其它用户
+    old_path:=d.prefix+req.OldName
+    new_path:=target.prefix+req.NewName
+    if d.m.writer(d.user,old_path)!=nil {return fuse.Errno(syscall.EBUSY)}//还没有上传
+    files,err:=d.m.files(ctx,d.user)
+    if err!=nil {return mountError(err)}
+    var renamed []client.FileInfo
+    var removed []string
+    for _,file:=range files {
+        var name string
+        switch {
+            case file.Name==old_path:
+                name=new_path
+            case strings.HasPrefix(file.Name,old_path+"/"):
+                name=new_path+file.Name[len(old_path):]
+            default:
+                continue
+        }
+        if client.ValidName(name)!=nil {return fuse.Errno(syscall.EINVAL)}
+        removed=append(removed,file.Name)
+        file.Name=name
+        renamed=append(renamed,file)
+    }
+    d.m.lock.Lock()
+    for dir:=range d.m.dirs {
+        key:=d.user+"/"+old_path
+        if dir==key || strings.HasPrefix(dir,key+"/") {
+            delete(d.m.dirs,dir)
+            d.m.dirs[d.user+"/"+new_path+dir[len(key):]]=true
+        }
+    }
+    d.m.lock.Unlock()
+    if len(renamed)==0 {return nil}//空文件夹
+    c,err:=d.m.clients.get(d.user)
+    if err!=nil {return mountError(err)}
+    err=c.Commit(ctx,renamed,removed)
+    d.m.invalidate(d.user)
+    return mountError(err)
+}
+
+func (f *mountFile) Attr(ctx context.Context, attr *fuse.Attr)error{
+    attr.Mode=0644
+    attr.Valid=MOUNT_REFRESH_TIME
+    if w:=f.m.writer(f.user,f.name);w!=nil {
+        stat,err:=w.file.Stat()
+        if err!=nil {return mountError(err)}
+        attr.Size=uint64(stat.Size())
+        attr.Mtime=stat.ModTime()
+        return nil
+    }
+    info,exist,err:=f.m.stat(ctx,f.user,f.name)
+    if err!=nil {return mountError(err)}
+    if !exist {return fuse.ENOENT}
+    if info.Size>0 {attr.Size=uint64(info.Size)}
+    if !info.ModTime.IsZero() {attr.Mtime=info.ModTime}
+    return nil
+}
+
+func (f *mountFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse)(fusefs.Handle,error){
+    if !req.Flags.IsReadOnly() {
+        w,err:=f.m.openWriter(ctx,f.user,f.name,req.Flags&fuse.OpenTruncate==0)
+        return w,mountError(err)
+    }
+    c,err:=f.m.clients.get(f.user)
+    if err!=nil {return nil,mountError(err)}
+    info,exist,err:=f.m.stat(ctx,f.user,f.name)
+    if err!=nil {return nil,mountError(err)}
+    if !exist {return nil,fuse.ENOENT}
+    return &mountReader{m:f.m,c:c,info:info,index:-1},nil
+}
+
+/*
+修改文件大小（truncate），修改时间等其它属性忽略
+*/
+func (f *mountFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse)error{
+    if req.Valid.Size() {
+        if w:=f.m.writer(f.user,f.name);w!=nil {
+            err:=w.truncate(int64(req.Size))
+            if err!=nil {return mountError(err)}
+        }else{//没有打开，修改完直接上传
+            w,err:=f.m.openWriter(ctx,f.user,f.name,req.Size>0)
+            if err!=nil {return mountError(err)}
+            err=w.truncate(int64(req.Size))
+            if rerr:=w.Release(ctx,nil);err==nil {err=rerr}
+            if err!=nil {return mountError(err)}
+        }
+    }
+    return f.Attr(ctx,&resp.Attr)
+}
+
+func (f *mountFile) Fsync(ctx context.Context, req *fuse.FsyncRequest)error{
+    if w:=f.m.writer(f.user,f.name);w!=nil {return w.Flush(ctx,nil)}
+    return nil
+}
+
+/*
+按需读取：读到哪个文件块就下载哪个
+*/
+func (r *mountReader) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse)error{
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    buf:=make([]byte,0,req.Size)
+    offset:=req.Offset
+    for len(buf)<req.Size {
+        i:=int(offset/r.info.ChunkBytes())
+        if i>=len(r.info.Chunks) {break}
+        if i!=r.index {
+            datas,err:=r.m.readChunk(ctx,r.c,r.info.Chunks[i])
+            if err!=nil {return mountError(err)}
+            r.index,r.datas=i,datas
+        }
+        pos:=int(offset-int64(i)*r.info.ChunkBytes())
+        if pos>=len(r.datas) {break}
+        n:=len(r.datas)-pos
+        if n>req.Size-len(buf) {n=req.Size-len(buf)}
+        buf=append(buf,r.datas[pos:pos+n]...)
+        offset+=int64(n)
+    }
+    resp.Data=buf
+    return nil
+}
+
+func (w *mountWriter) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse)error{
+    buf:=make([]byte,req.Size)
+    n,err:=w.file.ReadAt(buf,req.Offset)
+    if err!=nil && n==0 && req.Offset<w.size() {return mountError(err)}
+    resp.Data=buf[:n]
+    return nil
+}
+
+func (w *mountWriter) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse)error{
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    n,err:=w.file.WriteAt(req.Data,req.Offset)
+    resp.Size=n
+    w.dirty=true
+    return mountError(err)
+}
+
+func (w *mountWriter) size()int64{
+    stat,err:=w.file.Stat()
+    if err!=nil {return 0}
+    return stat.Size()
+}
+
+func (w *mountWriter) truncate(size int64)error{
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    w.dirty=true
+    return w.file.Truncate(size)
+}
+
+/*
+close时上传：和put一样切块上传并写入数据库
+*/
+func (w *mountWriter) Flush(ctx context.Context, req *fuse.FlushRequest)error{
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    if !w.dirty {return nil}
+    _,err:=w.file.Seek(0,0)
+    if err!=nil {return mountError(err)}
+    slog.Info("挂载的文件系统上传文件","user",w.user,"name",w.name)
+    err=w.c.PutWithModTime(ctx,w.name,w.file,time.Now())
+    w.m.invalidate(w.user)
+    if err!=nil {return mountError(err)}
+    w.dirty=false
+    return nil
+}
+
+func (w *mountWriter) Release(ctx context.Context, req *fuse.ReleaseRequest)error{
+    err:=w.Flush(ctx,nil)
+    w.m.lock.Lock()
+    if w.m.writers[w.user+"/"+w.name]==w {delete(w.m.writers,w.user+"/"+w.name)}
+    w.m.lock.Unlock()
+    w.close()
+    return err
+}
+
+/*
+删除临时文件
+*/
+func (w *mountWriter) close(){
+    w.file.Close()
+    os.Remove(w.file.Name())
+}
+
+/*
+挂载到dir，直到收到SIGINT或SIGTERM（或者被umount）
+*/
+func mountCluster(dir string)error{
+    err:=os.MkdirAll(MOUNT_CACHE_DIR,0755)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    conn,err:=fuse.Mount(dir,fuse.FSName("dss"),fuse.Subtype("dss"))
+    if err!=nil {return commandError(EXIT_IO,err)}
+    defer conn.Close()
+    m:=&mountFS{
+        clients:newClientPool(),
+        listings:map[string]mountListing{},
+        dirs:map[string]bool{},
+        writers:map[string]*mountWriter{},
+    }
+    signals:=make(chan os.Signal,1)
+    signal.Notify(signals,os.Interrupt,syscall.SIGTERM)
+    defer signal.Stop(signals)
+    go func(){
+        <-signals
+        fmt.Println("正在卸载……")
+        fuse.Unmount(dir)
+    }()
+    fmt.Println("已挂载到：",dir,"（Ctrl+C或umount卸载）")
+    err=fusefs.Serve(conn,m)
+    <-conn.Ready
+    if err==nil {err=conn.MountError}
+    m.clients.close()
+    if err!=nil {return commandError(EXIT_IO,err)}
+    fmt.Println("已卸载：",dir)
+    return nil
+}
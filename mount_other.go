@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+/*
+本文件是非Linux系统上的mount命令，FUSE挂载只支持Linux，见mount_func.go
+*/
+
+import (
+    "errors"
+)
+
+func mountCluster(dir string)error{
+    return commandError(EXIT_USAGE,errors.New("mount命令只支持Linux"))
+}
@@ -0,0 +1,130 @@
+package main
+
+/*
+本文件包含了客户端JSON输出相关的函数
+*/
+
+/*
+JSON输出模式（-json参数）：
+标准输出只输出JSON记录，每行一条（NDJSON），每条记录都有type字段：
+file（文件）、chunk（文件块和所在的服务器）、server（服务器状态）、progress（传输进度）、sync（同步操作）、share（分享链接）、quota（用户的配额和用量）、error（错误）
+其它给人看的信息全部改为输出到标准错误，这样脚本可以直接解析标准输出。
+*/
+
+import (
+    "io"
+    "os"
+    "sync"
+    "encoding/json"
+)
+
+type FileRecord struct {//文件
+    Type string `json:"type"`
+    User string `json:"user"`
+    Name string `json:"name"`
+    Size int64 `json:"size"` //文件大小，旧版本上传的文件没有记录，为-1
+    Mtime int64 `json:"mtime,omitempty"` //文件修改时间（Unix时间戳）
+    Chunks int `json:"chunks"` //文件块数量
+}
+
+type ChunkRecord struct {//文件块和所在的服务器
+    Type string `json:"type"`
+    User string `json:"user"`
+    Name string `json:"name"`
+    Num int `json:"num"`
+    Key string `json:"key"`
+    Servers []string `json:"servers"`
+}
+
+type SyncRecord struct {//同步操作，sync命令执行前输出
+    Type string `json:"type"`
+    Action string `json:"action"` //upload、download、delete-local或delete-remote
+    Path string `json:"path"` //相对路径
+    Conflict bool `json:"conflict,omitempty"` //两边都修改了
+    Reason string `json:"reason"`
+    DryRun bool `json:"dry_run,omitempty"` //-n，没有实际执行
+}
+
+type ServerRecord struct {//服务器状态
+    Type string `json:"type"`
+    Addr string `json:"addr"`
+    Online bool `json:"online"`
+    State string `json:"state"`
+    Incarnation uint64 `json:"incarnation"`
+    Zone string `json:"zone,omitempty"`
+    Capacity float64 `json:"capacity"`
+    Addrs []string `json:"addrs,omitempty"`
+    Draining bool `json:"draining"`
+}
+
+type ProgressRecord struct {//传输进度，每传输完一个文件块输出一条
+    Type string `json:"type"`
+    Op string `json:"op"` //upload或download
+    User string `json:"user"`
+    Name string `json:"name"`
+    Chunk int `json:"chunk"`
+    Key string `json:"key"`
+    Servers []string `json:"servers,omitempty"`
+    Done int `json:"done"` //已完成的文件块数量
+    Total int `json:"total"` //文件块总数
+    Error string `json:"error,omitempty"`
+    RequestID string `json:"request_id,omitempty"` //和服务器日志中的request_id对应
+}
+
+type ShareRecord struct {//分享链接
+    Type string `json:"type"`
+    User string `json:"user"`
+    Name string `json:"name"`
+    Token string `json:"token"`
+    Path string `json:"path"` //网关上的下载路径，前面加上网关的地址就是分享链接
+    Password bool `json:"password"` //是否需要密码
+    Expire int64 `json:"expire,omitempty"` //过期时间（Unix时间戳），不过期时没有
+    MaxDownloads int64 `json:"max_downloads"` //最多下载次数，0表示不限
+    Downloads int64 `json:"downloads"`
+    Created int64 `json:"created"`
+}
+
+type QuotaRecord struct {//用户的配额和用量
+    Type string `json:"type"`
+    User string `json:"user"`
+    Files int64 `json:"files"`
+    Bytes int64 `json:"bytes"` //按配额的计算方式（是否去重）计算
+    MaxFiles int64 `json:"max_files"` //0表示不限
+    MaxBytes int64 `json:"max_bytes"` //0表示不限
+    Dedup bool `json:"dedup"`
+}
+
+type ErrorRecord struct {//错误
+    Type string `json:"type"`
+    Code int `json:"code"` //退出码
+    Message string `json:"message"`
+}
+
+var json_out io.Writer=os.Stdout //JSON记录的输出
+var json_out_lock sync.Mutex
+
+/*
+进入JSON输出模式：JSON记录输出到原来的标准输出，其它信息改为输出到标准错误
+*/
+func enableJSONOutput(){
+    json_out=os.Stdout
+    os.Stdout=os.Stderr
+}
+
+/*
+输出一条JSON记录
+*/
+func emitJSON(record interface{}){
+    json_out_lock.Lock()
+    defer json_out_lock.Unlock()
+    json.NewEncoder(json_out).Encode(record)
+}
+
+/*
+JSON模式下输出传输进度
+*/
+func emitProgress(record ProgressRecord){
+    if !*json_output {return}
+    record.Type="progress"
+    emitJSON(record)
+}
@@ -0,0 +1,51 @@
+package main
+
+/*
+本文件包含了文件块放置（选择存放服务器）相关的函数
+*/
+
+/*
+放置原理（带权重的rendezvous哈希，又叫最高随机权重哈希）：
+对每个可以存放文件块的服务器，用文件块的key和服务器地址算出一个哈希值u（0到1之间），
+得分为 -权重/ln(u)，权重是服务器的容量。按得分从高到低排列，依次选择，跳过已经用过的故障域（zone），
+直到选够REPLICA_NUM个服务器。
+只要成员表相同，客户端和服务器算出的结果就相同，不需要查询数据库；不同的文件块分散到不同的服务器，
+不会所有上传都挤到同一个最空的服务器上。服务器加入或退出时，只有少部分文件块的放置位置会改变。
+故障域是服务器通过-zone参数声明的标签（比如楼栋、宿舍），没有声明的服务器各自算一个故障域。
+*/
+
+import (
+    "dss/client"
+)
+
+/*
+成员转换成客户端库的格式，放置算法在客户端库中（client/member.go），客户端和服务器共用
+*/
+func clientMember(m Member)client.Member{
+    return client.Member{Addr:m.Addr,Addrs:m.Addrs,State:m.State,Incarnation:m.Incarnation,Draining:m.Draining,Zone:m.Zone,Capacity:m.Capacity}
+}
+
+func clientMembers(members []Member)[]client.Member{
+    list:=make([]client.Member,len(members))
+    for i,m:=range members {list[i]=clientMember(m)}
+    return list
+}
+
+/*
+为文件块选择n个服务器，不会有两个服务器在同一个故障域。
+used_zones为已经有副本的故障域，usable不为空时用来过滤服务器（比如连不上的）
+*/
+func placeChunk(key string, n int, used_zones []string, usable func(addr string)bool)[]string{
+    return client.PlaceChunk(key,n,clientMembers(memberList()),used_zones,usable)
+}
+
+/*
+服务器所在的故障域
+*/
+func serverZone(addr string)string{
+    global_members_lock.Lock()
+    defer global_members_lock.Unlock()
+    m,exist:=global_members[addr]
+    if !exist {return "@"+addr}
+    return client.MemberZone(clientMember(*m))
+}
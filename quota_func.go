@@ -0,0 +1,294 @@
+package main
+
+/*
+本文件包含了用户配额相关的函数（quota命令和status中的用量）
+*/
+
+/*
+配额由管理员在客户端用quota命令设置（需要-admin_key和服务器的管理员密钥相同），
+保存在服务器数据库文件夹中的配额表（QUOTAS_FILE，和用户的数据库分开，用户同步数据库不能修改配额）。
+收到SET_QUOTA的服务器持有集群锁client.QUOTA_LOCK，从负责这个锁的服务器获取最新的配额表，修改后带token同步到所有服务器（SYNC_QUOTAS），
+和用户数据库一样，负责这个锁的服务器超过半数接收才算成功。
+服务器接收SYNC_DB时检查配额：用量增加且超出配额时拒绝。客户端在上传文件块前和写入数据库时也检查，超出时退出码为7。
+*/
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "sync"
+    "errors"
+    "context"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "database/sql"
+    "log/slog"
+    "encoding/json"
+    "dss/client"
+)
+
+const QUOTAS_FILE=".quotas.json" //数据库文件夹中的配额表，以“.”开头，压缩数据库时会跳过
+
+type quotaTable struct {//配额表
+    Token uint64 //最后一次修改时QUOTA_LOCK的token
+    Quotas map[string]client.Quota //用户名 -> 配额
+}
+
+var quota_table=quotaTable{Quotas:map[string]client.Quota{}}
+var quota_lock sync.Mutex
+
+/*
+解析容量，支持K、M、G、T后缀（1024进制，可以带B或iB），如10G、512MiB，没有后缀时单位为Byte
+*/
+func parseSize(text string)(int64,error){
+    s:=strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(text)),"B"),"I")
+    unit:=int64(1)
+    if n:=len(s);n>0 {
+        if i:=strings.IndexByte("KMGT",s[n-1]);i>=0 {
+            unit=int64(1)<<(10*uint(i+1))
+            s=s[:n-1]
+        }
+    }
+    value,err:=strconv.ParseFloat(s,64)
+    if err!=nil || value<0 {return 0,errors.New("容量格式错误："+text)}
+    return int64(value*float64(unit)),nil
+}
+
+/*
+把Byte数转换成方便阅读的格式
+*/
+func formatSize(size int64)string{
+    units:=[]string{"B","KB","MB","GB","TB"}
+    value:=float64(size)
+    i:=0
+    for value>=1024 && i<len(units)-1 {
+        value/=1024
+        i++
+    }
+    if i==0 {return fmt.Sprint(size,"B")}
+    return fmt.Sprintf("%.2f%s",value,units[i])
+}
+
+/*
+设置用户的配额，max_bytes和max_files都为0时取消配额
+*/
+func setQuota(user string, max_bytes string, max_files int64, dedup bool)error{
+    bytes,err:=parseSize(max_bytes)
+    if err!=nil {return commandError(EXIT_USAGE,err)}
+    if max_files<0 {return commandError(EXIT_USAGE,errors.New("文件数量不能是负数"))}
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    err=c.SetQuota(context.Background(),client.Quota{MaxBytes:bytes,MaxFiles:max_files,Dedup:dedup})
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    if bytes==0 && max_files==0 {
+        fmt.Println("已取消配额：",user)
+        return nil
+    }
+    return printQuotas([]string{user})
+}
+
+/*
+计算用户的配额和用量（配额从服务器获取，用量使用本地的数据库，clientInit时已经获取过）
+*/
+func userQuotas(users []string)([]QuotaRecord,error){
+    var records []QuotaRecord
+    var quotas map[string]client.Quota
+    for _,user:=range users {
+        c,err:=newClient(user)
+        if err!=nil {return nil,err}
+        if quotas==nil {quotas,err=c.Quotas(context.Background())}
+        var usage client.Usage
+        if err==nil {usage,err=c.CachedUsage(quotas[user].Dedup)}
+        c.Close()
+        if errors.Is(err,client.ErrNotFound) {continue}
+        if err!=nil {return nil,clientError(err,EXIT_NETWORK)}
+        q:=quotas[user]
+        records=append(records,QuotaRecord{"quota",user,usage.Files,usage.Bytes,q.MaxFiles,q.MaxBytes,q.Dedup})
+    }
+    return records,nil
+}
+
+/*
+打印用户的配额和用量
+*/
+func printQuotas(users []string)error{
+    records,err:=userQuotas(users)
+    if err!=nil {return err}
+    for _,record:=range records {
+        if *json_output {
+            emitJSON(record)
+            continue
+        }
+        max_bytes,max_files:="不限","不限"
+        if record.MaxBytes>0 {max_bytes=formatSize(record.MaxBytes)}
+        if record.MaxFiles>0 {max_files=fmt.Sprint(record.MaxFiles)}
+        dedup:=""
+        if record.Dedup {dedup="（去重）"}
+        fmt.Println(record.User,"已用空间：",formatSize(record.Bytes),"/",max_bytes,dedup,"文件数量：",record.Files,"/",max_files)
+    }
+    return nil
+}
+
+/*
+查看用户的配额和用量，user为空时查看所有用户
+*/
+func showQuota(user string)error{
+    users:=listUsers()
+    if user!="" {
+        if !containsString(users,user) {
+            return commandError(EXIT_NOT_FOUND,errors.New("用户数据库不存在："+user))
+        }
+        users=[]string{user}
+    }
+    return printQuotas(users)
+}
+
+/*
+读取配额表，启动时调用
+*/
+func loadQuotas()error{
+    datas,err:=ioutil.ReadFile(databasePath(QUOTAS_FILE))
+    if os.IsNotExist(err) {return nil}
+    if err!=nil {return err}
+    quota_lock.Lock()
+    defer quota_lock.Unlock()
+    err=json.Unmarshal(datas,&quota_table)
+    if quota_table.Quotas==nil {quota_table.Quotas=map[string]client.Quota{}}
+    return err
+}
+
+/*
+检查token并保存配额表，token小于见过的最大token时拒绝
+*/
+func storeQuotas(token uint64, quotas map[string]client.Quota)error{
+    quota_lock.Lock()
+    defer quota_lock.Unlock()
+    err:=checkFencingToken(client.QUOTA_LOCK,token)
+    if err!=nil {return err}
+    datas,_:=json.Marshal(quotaTable{Token:token,Quotas:quotas})
+    tmp_path:=databasePath(QUOTAS_FILE+".tmp")
+    err=ioutil.WriteFile(tmp_path,datas,0644)
+    if err==nil {err=os.Rename(tmp_path,databasePath(QUOTAS_FILE))}
+    if err!=nil {return err}
+    quota_table=quotaTable{Token:token,Quotas:quotas}
+    return nil
+}
+
+/*
+用户的配额
+*/
+func userQuota(user string)client.Quota{
+    quota_lock.Lock()
+    defer quota_lock.Unlock()
+    return quota_table.Quotas[user]
+}
+
+/*
+服务器处理配额相关的指令（GET_QUOTAS、SET_QUOTA、SYNC_QUOTAS）
+*/
+func handleQuotaCommand(instruct byte, conn net.Conn){
+    datas,err:=readData(conn)
+    if err!=nil {return}
+    var request client.QuotaRequest
+    if instruct!=GET_QUOTAS {
+        err=json.Unmarshal(datas,&request)
+        if err!=nil {err=errors.New("请求格式不正确")}
+        if err==nil {err=checkAdminKey(request.AdminKey)}
+    }
+    var reply []byte
+    if err==nil {
+        switch instruct {
+            case GET_QUOTAS:
+                quota_lock.Lock()
+                reply=client.EncodeQuotas(quota_table.Token,quota_table.Quotas)
+                quota_lock.Unlock()
+            case SET_QUOTA:
+                err=setClusterQuota(request.User,request.Quota)
+            case SYNC_QUOTAS:
+                if request.Quotas==nil {request.Quotas=map[string]client.Quota{}}
+                err=storeQuotas(request.Token,request.Quotas)
+        }
+    }
+    logger:=connLogger(conn).With("instruction",instruction_names[instruct])
+    if err!=nil {
+        logger.Warn("拒绝配额请求","user",request.User,"err",err)
+        sendInstruct(ERR,conn)
+        sendData([]byte(err.Error()),conn)
+        return
+    }
+    if instruct==SET_QUOTA {logger.Info("配额已修改","user",request.User,"max_bytes",request.Quota.MaxBytes,"max_files",request.Quota.MaxFiles,"dedup",request.Quota.Dedup)}
+    sendInstruct(ACK,conn)
+    sendData(reply,conn)
+}
+
+/*
+持有配额表的集群锁，从负责这个锁的服务器获取最新的配额表，修改用户的配额，然后带token同步到所有服务器
+*/
+func setClusterQuota(user string, q client.Quota)error{
+    err:=client.ValidUser(user)
+    if err!=nil {return err}
+    if q.MaxBytes<0 || q.MaxFiles<0 {return errors.New("配额不能是负数")}
+    ctx,cancel:=context.WithTimeout(context.Background(),*sync_timeout)
+    defer cancel()
+    lock,err:=cluster_locker.Acquire(ctx,client.QUOTA_LOCK)
+    if err!=nil {return err}
+    defer cluster_locker.Release(lock)
+    _,content,err:=cluster_locker.FetchLatest(ctx,lock,GET_QUOTAS,nil)
+    if err!=nil {return errors.New("获取配额表失败："+err.Error())}
+    quotas,err:=client.DecodeQuotas(content)
+    if err!=nil {return err}
+    if q.Limited() {
+        quotas[user]=q
+    }else{
+        delete(quotas,user)
+    }
+    if lock.Lost() {return errors.New("集群锁已失效，配额没有修改")}
+    err=storeQuotas(lock.Token,quotas)
+    if err!=nil {return err}
+    datas,_:=json.Marshal(client.QuotaRequest{AdminKey:*admin_key,Token:lock.Token,Quotas:quotas})
+    acked:=[]string{self_server_addr}
+    for _,server:=range serverList() {
+        if server==self_server_addr {continue}
+        _,err:=serverRequest(ctx,server,SYNC_QUOTAS,datas)
+        if err!=nil {
+            slog.Warn("同步配额表失败","server",server,"err",err)
+            continue
+        }
+        acked=append(acked,server)
+    }
+    if !lock.Quorum(acked) {return errors.New("负责集群锁的服务器接收配额表的不足半数")}
+    return nil
+}
+
+/*
+检查同步过来的数据库（db）是否超出用户的配额：用量增加且超出配额时拒绝，原因以client.ErrQuota开头，客户端据此返回ErrQuota
+*/
+func checkSyncQuota(db *sql.DB, user string)error{
+    q:=userQuota(user)
+    if !q.Limited() {return nil}
+    files,err:=client.ReadFiles(db,user,"")
+    if err!=nil {return err}
+    after:=client.ComputeUsage(files,q.Dedup)
+    if !q.Exceeded(after) {return nil}
+    before,err:=localUsage(user,q.Dedup)
+    if err!=nil {return err}
+    if q.Allows(before,after) {return nil}
+    return fmt.Errorf("%w：用户%s已用空间%s，文件数量%d",client.ErrQuota,user,formatSize(after.Bytes),after.Files)
+}
+
+/*
+本地数据库中用户的用量，没有数据库时为0
+*/
+func localUsage(user string, dedup bool)(client.Usage,error){
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    if _,err:=os.Stat(dbPath(user));os.IsNotExist(err) {return client.Usage{},nil}
+    db,err:=sql.Open(DB_TYPE,dbPath(user))
+    if err!=nil {return client.Usage{},err}
+    defer db.Close()
+    files,err:=client.ReadFiles(db,user,"")
+    if err!=nil {return client.Usage{},err}
+    return client.ComputeUsage(files,dedup),nil
+}
@@ -0,0 +1,56 @@
+package main
+
+/*
+容量格式的测试
+*/
+
+import (
+    "testing"
+)
+
+func TestParseSize(t *testing.T){
+    tests:=[]struct{
+        text string
+        expect int64
+        ok bool
+    }{
+        {"0",0,true},
+        {"1024",1024,true},
+        {"100B",100,true},
+        {"1K",1<<10,true},
+        {"1kb",1<<10,true},
+        {"512MiB",512<<20,true},
+        {" 10G ",10<<30,true},
+        {"1.5G",3<<29,true},
+        {"2T",2<<40,true},
+        {"",0,false},
+        {"G",0,false},
+        {"-1G",0,false},
+        {"10X",0,false},
+        {"ten",0,false},
+    }
+    for _,test:=range tests {
+        size,err:=parseSize(test.text)
+        if (err==nil)!=test.ok {
+            t.Errorf("%q：错误为%v",test.text,err)
+            continue
+        }
+        if size!=test.expect {t.Errorf("%q：解析为%d，期望%d",test.text,size,test.expect)}
+    }
+}
+
+func TestFormatSize(t *testing.T){
+    tests:=[]struct{
+        size int64
+        expect string
+    }{
+        {0,"0B"},
+        {1023,"1023B"},
+        {1024,"1.00KB"},
+        {3<<29,"1.50GB"},
+        {5<<50,"5120.00TB"},
+    }
+    for _,test:=range tests {
+        if text:=formatSize(test.size);text!=test.expect {t.Errorf("%d：格式化为%s，期望%s",test.size,text,test.expect)}
+    }
+}
@@ -0,0 +1,410 @@
+package main
+
+/*
+本文件包含了重新平衡（rebalance）相关的函数，新服务器加入集群后，把旧服务器上的文件块迁移过去
+*/
+
+/*
+重新平衡原理：
+每个服务器都有所有用户数据库，所以每个服务器都能算出同一份迁移计划：
+统计每个服务器按容量计算的负载（文件块数量/容量），有服务器偏离平均值超过rebalance_threshold时，
+把每个文件块放错位置的副本迁移到放置算法（placement_func.go）为它选出的服务器，迁移后和客户端上传时的放置一致。
+每个文件块由存放它的一个服务器负责迁移（rebalanceMover），从本机发送文件块，替换放错位置的副本（可能在其它服务器上）。
+为了保证读取永远不会指向已经删除的副本，每一批迁移分两步更新数据库：
+1. 文件块发送到目标服务器后，先在KeyServer中加入目标服务器（源服务器保留），同步数据库
+2. 然后从KeyServer中删除源服务器，同步数据库
+每一步对每个用户数据库的修改都持有该用户的集群锁，不会和客户端的上传删除互相覆盖。
+源服务器上的文件块在REBALANCE_DELETE_DELAY之后才删除（源服务器不是本机时发送DELETE_FILE），让拿着旧数据库的客户端也能下载完；
+等待删除的副本保存在REBALANCE_DELETES_FILE中，删除前重启也会继续删除。
+新服务器加入集群后，每个服务器等待-rebalance_delay（期间有其它服务器加入会重新计时）后自动开始重新平衡，-auto_rebalance=false时只能手动触发。
+*/
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "os"
+    "errors"
+    "log/slog"
+    "io/ioutil"
+    "sync/atomic"
+    "encoding/json"
+    "dss/client"
+)
+
+const REBALANCE_DELETE_DELAY=time.Minute*5 //迁移完成后多久删除本地的文件块
+const REBALANCE_BATCH=16 //每批迁移的文件块数量
+const REBALANCE_DELETES_FILE=".rebalance_deletes.json" //数据库文件夹中保存等待删除的副本的文件，以“.”开头，压缩数据库时会跳过
+
+type ChunkMove struct {//迁移计划中的一项
+    Key string
+    From string
+    To string
+}
+
+var rebalance_timer *time.Timer
+var rebalance_timer_lock sync.Mutex
+var rebalance_running sync.Mutex
+
+/*
+安排一次重新平衡（新服务器加入时调用），在-rebalance_delay后执行，重复调用会重新计时；-auto_rebalance=false时不执行
+*/
+func scheduleRebalance(){
+    if !*enable_server || !*auto_rebalance {return}
+    rebalance_timer_lock.Lock()
+    defer rebalance_timer_lock.Unlock()
+    if rebalance_timer!=nil {
+        rebalance_timer.Stop()
+    }
+    slog.Debug("准备重新平衡","delay",*rebalance_delay)
+    rebalance_timer=time.AfterFunc(*rebalance_delay, func(){rebalance()})
+}
+
+/*
+可以存放文件块的成员（不是下线中、死亡、已退出的）
+*/
+func placeableMember(m client.Member)bool{
+    return !m.Draining && m.State!=client.MEMBER_DEAD && m.State!=client.MEMBER_LEFT
+}
+
+/*
+按容量计算的负载（文件块数量/容量）是否都在平均值的threshold范围内
+*/
+func rebalanceBalanced(key_servers map[string][]string, members []client.Member, threshold float64)bool{
+    weights:=map[string]float64{}
+    total_weight:=0.0
+    for _,m:=range members {
+        if !placeableMember(m) {continue}
+        weights[m.Addr]=client.MemberWeight(m)
+        total_weight+=weights[m.Addr]
+    }
+    if len(weights)<2 {return true}
+    counts:=map[string]int{}
+    total:=0
+    for _,servers:=range key_servers {
+        for _,server:=range servers {
+            if _,exist:=weights[server];exist {
+                counts[server]++
+                total++
+            }
+        }
+    }
+    mean:=float64(total)/total_weight
+    for server,weight:=range weights {
+        load:=float64(counts[server])/weight
+        if load>mean*(1+threshold) || load<mean*(1-threshold) {return false}
+    }
+    return true
+}
+
+/*
+计算迁移计划：负载都在平均值的threshold范围内时不迁移，否则把每个文件块放错位置的副本迁移到放置算法为它选出的服务器。
+放置算法和客户端上传时的相同（按容量加权的rendezvous哈希），迁移后的分布和上传时的放置一致，不会互相抵消。
+只处理可以存放文件块的服务器上的副本，下线中的服务器上的副本由下线流程处理；
+可以存放文件块的服务器或故障域不够、放不下所有副本的文件块不迁移
+*/
+func planRebalance(key_servers map[string][]string, members []client.Member, threshold float64)[]ChunkMove{
+    var moves []ChunkMove
+    if rebalanceBalanced(key_servers,members,threshold) {return moves}
+    placeable:=map[string]bool{}
+    for _,m:=range members {placeable[m.Addr]=placeableMember(m)}
+    var keys []string
+    for key:=range key_servers {keys=append(keys,key)}
+    sort.Strings(keys)//排序保证每个服务器算出的计划相同
+    for _,key:=range keys {
+        var holders []string
+        for _,server:=range key_servers[key] {
+            if placeable[server] {holders=append(holders,server)}
+        }
+        targets:=client.PlaceChunk(key,len(holders),members,nil,nil)
+        if len(targets)<len(holders) {continue}
+        var misplaced,missing []string
+        for _,server:=range holders {
+            if !containsString(targets,server) {misplaced=append(misplaced,server)}
+        }
+        for _,server:=range targets {
+            if !containsString(holders,server) {missing=append(missing,server)}
+        }
+        //两者数量相同，迁移后副本所在的服务器就是targets，不会有两个副本在同一个故障域
+        for i:=range misplaced {
+            moves=append(moves,ChunkMove{key,misplaced[i],missing[i]})
+        }
+    }
+    return moves
+}
+
+/*
+负责迁移文件块的服务器：存放副本的可以存放文件块的服务器中，rendezvous得分（不按容量加权，和成员表中的容量无关）最高的一个。
+每个服务器只执行自己负责的文件块的迁移（从本机发送文件块，也可以替换其它服务器上的副本），
+各个服务器的成员表暂时不一致、算出的计划不同时，也不会有两个服务器把同一个文件块的不同副本迁移走只留下一份
+*/
+func rebalanceMover(key string, servers []string, members []client.Member)string{
+    placeable:=map[string]bool{}
+    for _,m:=range members {placeable[m.Addr]=placeableMember(m)}
+    mover,best:="",0.0
+    for _,server:=range servers {
+        if !placeable[server] {continue}
+        score:=client.PlacementScore(key,client.Member{Addr:server})
+        if mover=="" || score>best || (score==best && server<mover) {mover,best=server,score}
+    }
+    return mover
+}
+
+/*
+重新平衡：计算迁移计划，执行从本机迁出的部分
+*/
+func rebalance(){
+    if !rebalance_running.TryLock() {
+        slog.Info("已经在重新平衡中")
+        return
+    }
+    defer rebalance_running.Unlock()
+    if !isPlaceable(self_server_addr) {return}//正在下线的服务器由下线流程处理
+    slog.Info("开始重新平衡……")
+    key_servers,key_users,err:=scanKeyServers()
+    if err!=nil {
+        slog.Error("读取数据库失败","err",err)
+        return
+    }
+    counts:=countServerBlocks(key_servers)
+    slog.Info("服务器及其块数量","counts",sortMapByValue(counts))
+    members:=clientMembers(memberList())
+    var moves []ChunkMove
+    for _,move:=range planRebalance(key_servers,members,*rebalance_threshold) {
+        if rebalanceMover(move.Key,key_servers[move.Key],members)==self_server_addr {moves=append(moves,move)}
+    }
+    slog.Info("本机负责迁移的文件块","count",len(moves))
+    atomic.StoreInt64(&rebalance_pending,int64(len(moves)))
+    defer atomic.StoreInt64(&rebalance_pending,0)
+    done:=0
+    for start:=0;start<len(moves);start+=REBALANCE_BATCH {
+        end:=start+REBALANCE_BATCH
+        if end>len(moves) {end=len(moves)}
+        done+=rebalanceBatch(moves[start:end],key_users)
+        atomic.StoreInt64(&rebalance_pending,int64(len(moves)-end))
+        printMigrateProgress("重新平衡",done,len(moves))
+    }
+    slog.Info("重新平衡完成","moved",done)
+}
+
+/*
+执行一批迁移，返回成功的数量
+*/
+func rebalanceBatch(moves []ChunkMove, key_users map[string][]string)int{
+    //第一步：发送文件块，在数据库中加入目标服务器
+    var pushed []ChunkMove
+    for _,move:=range moves {
+        err:=pushChunkLimited(move.Key,move.To,int64(*rebalance_bandwidth*1024*1024))
+        if err!=nil {
+            slog.Warn("文件块迁移失败","key",move.Key,"to",move.To,"err",err)
+            continue
+        }
+        pushed=append(pushed,move)
+    }
+    failed:=applyChunkMoves(pushed,key_users,true,false)
+    var succeeded []ChunkMove
+    for _,move:=range pushed {
+        if !failed[move.Key] {succeeded=append(succeeded,move)}
+    }
+    //第二步：从数据库中删除源服务器
+    failed=applyChunkMoves(succeeded,key_users,false,true)
+    for key:=range failed {
+        slog.Warn("源服务器没有从数据库中删除，文件块保留在本机","key",key)
+    }
+    var deletable []ChunkMove
+    for _,move:=range succeeded {
+        if !failed[move.Key] {deletable=append(deletable,move)}
+    }
+    //延迟删除源服务器上的文件块
+    addPendingDeletes(deletable)
+    return len(succeeded)
+}
+
+type pendingDelete struct {//等待删除的已迁出的副本
+    Key string
+    Server string //存放这个副本的服务器
+    Due time.Time //删除时间
+}
+
+var pending_deletes []pendingDelete
+var pending_deletes_lock sync.Mutex //读写pending_deletes和保存它的文件时持有
+var pending_deletes_running sync.Mutex //同时只执行一个deletePendingChunks
+
+/*
+记录迁出的副本，保存到文件，REBALANCE_DELETE_DELAY之后删除。保存在文件中，删除前重启也不会留下没人删除的副本
+*/
+func addPendingDeletes(moves []ChunkMove){
+    if len(moves)==0 {return}
+    pending_deletes_lock.Lock()
+    due:=time.Now().Add(REBALANCE_DELETE_DELAY)
+    for _,move:=range moves {pending_deletes=append(pending_deletes,pendingDelete{move.Key,move.From,due})}
+    err:=savePendingDeletes()
+    pending_deletes_lock.Unlock()
+    if err!=nil {slog.Warn("保存等待删除的文件块失败","err",err)}
+    time.AfterFunc(REBALANCE_DELETE_DELAY,deletePendingChunks)
+}
+
+/*
+保存等待删除的副本（调用前需持有pending_deletes_lock）
+*/
+func savePendingDeletes()error{
+    datas,_:=json.Marshal(pending_deletes)
+    tmp_path:=databasePath(REBALANCE_DELETES_FILE+".tmp")
+    err:=ioutil.WriteFile(tmp_path,datas,0644)
+    if err==nil {err=os.Rename(tmp_path,databasePath(REBALANCE_DELETES_FILE))}
+    return err
+}
+
+/*
+读取重启前没有完成的删除，启动时调用
+*/
+func loadPendingDeletes()error{
+    datas,err:=ioutil.ReadFile(databasePath(REBALANCE_DELETES_FILE))
+    if os.IsNotExist(err) {return nil}
+    if err!=nil {return err}
+    pending_deletes_lock.Lock()
+    defer pending_deletes_lock.Unlock()
+    return json.Unmarshal(datas,&pending_deletes)
+}
+
+/*
+在最早的删除时间执行deletePendingChunks（已经到期时马上执行）
+*/
+func schedulePendingDeletes(){
+    pending_deletes_lock.Lock()
+    defer pending_deletes_lock.Unlock()
+    if len(pending_deletes)==0 {return}
+    earliest:=pending_deletes[0].Due
+    for _,d:=range pending_deletes {
+        if d.Due.Before(earliest) {earliest=d.Due}
+    }
+    time.AfterFunc(time.Until(earliest),deletePendingChunks)
+}
+
+/*
+删除到期的副本，源服务器不是本机时发送DELETE_FILE。
+数据库中仍然引用这个服务器时不删除（比如后来又上传了相同的文件块）；
+其它服务器连不上时稍后重试，已经不在服务器列表中的服务器不再处理
+*/
+func deletePendingChunks(){
+    pending_deletes_running.Lock()
+    defer pending_deletes_running.Unlock()
+    now:=time.Now()
+    var due []pendingDelete
+    pending_deletes_lock.Lock()
+    for _,d:=range pending_deletes {
+        if !d.Due.After(now) {due=append(due,d)}
+    }
+    pending_deletes_lock.Unlock()
+    if len(due)==0 {return}
+    key_servers,_,err:=scanKeyServers()
+    if err!=nil {
+        slog.Warn("读取数据库失败，稍后再删除已迁出的文件块","err",err)
+        time.AfterFunc(REBALANCE_DELETE_DELAY,deletePendingChunks)
+        return
+    }
+    var retry []pendingDelete
+    for _,d:=range due {
+        err:=deleteMovedChunk(d.Key,d.Server,key_servers)
+        if err==nil {continue}
+        slog.Warn("删除已迁出的文件块失败","key",d.Key,"server",d.Server,"err",err)
+        if containsString(serverList(),d.Server) {
+            retry=append(retry,pendingDelete{d.Key,d.Server,now.Add(REBALANCE_DELETE_DELAY)})
+        }
+    }
+    pending_deletes_lock.Lock()
+    var rest []pendingDelete
+    for _,d:=range pending_deletes {
+        if d.Due.After(now) {rest=append(rest,d)}
+    }
+    pending_deletes=append(rest,retry...)
+    err=savePendingDeletes()
+    pending_deletes_lock.Unlock()
+    if err!=nil {slog.Warn("保存等待删除的文件块失败","err",err)}
+    schedulePendingDeletes()
+}
+
+/*
+删除一个已经迁出的副本，数据库中仍然引用这个服务器时不删除
+*/
+func deleteMovedChunk(key string, server string, key_servers map[string][]string)error{
+    if containsString(key_servers[key],server) {return nil}
+    if server==self_server_addr {
+        err:=os.Remove(storagePath(key))
+        if os.IsNotExist(err) {err=nil}
+        if err!=nil {return err}
+    }else if err:=deleteRemoteChunk(server,key);err!=nil {
+        return err
+    }
+    slog.Debug("删除已迁出的文件块","key",key,"server",server)
+    return nil
+}
+
+/*
+通知其它服务器删除文件块：DELETE_FILE+key，服务器返回ACK
+*/
+func deleteRemoteChunk(server string, key string)error{
+    conn, err := dialServer(server, *net_timeout)
+    if err != nil {return err}
+    defer conn.Close()
+    sendInstruct(DELETE_FILE,conn)
+    sendString(key,conn)
+    conn.SetReadDeadline(time.Now().Add(*net_timeout*10))
+    if readInstruct(conn)!=ACK {
+        return errors.New("服务器没有回复ACK")
+    }
+    return nil
+}
+
+/*
+限速的连接，写入速度不超过rate字节每秒
+*/
+type limitedConn struct {
+    net.Conn
+    rate int64
+    start time.Time
+    written int64
+}
+
+func (c *limitedConn) Write(b []byte)(int,error){
+    n,err:=c.Conn.Write(b)
+    c.written+=int64(n)
+    expected:=time.Duration(float64(c.written)/float64(c.rate)*float64(time.Second))
+    if elapsed:=time.Since(c.start);elapsed<expected {
+        time.Sleep(expected-elapsed)
+    }
+    return n,err
+}
+
+/*
+限速发送文件块，rate为每秒字节数，0表示不限速
+*/
+func pushChunkLimited(key string, server string, rate int64)error{
+    if rate<=0 {return pushChunk(key,server)}
+    return pushChunkWith(key,server,func(conn net.Conn)net.Conn{
+        return &limitedConn{Conn:conn,rate:rate,start:time.Now()}
+    })
+}
+
+/*
+客户端要求所有服务器重新平衡（rebalance命令）
+*/
+func requestRebalance(){
+    for _,server:=range serverList() {
+        conn, err := dialServer(server, *net_timeout)
+        if err != nil {
+            fmt.Println("服务器连接失败：",server)
+            continue
+        }
+        sendInstruct(REBALANCE,conn)
+        conn.SetReadDeadline(time.Now().Add(*net_timeout*10))
+        if readInstruct(conn)==ACK {
+            fmt.Println("服务器开始重新平衡：",server)
+        }else{
+            fmt.Println("[WARN]服务器拒绝重新平衡：",server)
+        }
+        conn.Close()
+    }
+}
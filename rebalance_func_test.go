@@ -0,0 +1,183 @@
+package main
+
+/*
+重新平衡迁移计划的测试：迁移后和放置算法一致、按容量加权、不违反故障域、成员表不一致时不会丢副本
+*/
+
+import (
+    "fmt"
+    "os"
+    "time"
+    "testing"
+    "io/ioutil"
+    "dss/client"
+)
+
+/*
+生成测试用的成员，服务器地址为s1、s2……
+*/
+func rebalanceMembers(capacities []float64, zones []string)[]client.Member{
+    members:=make([]client.Member,len(capacities))
+    for i,capacity:=range capacities {
+        members[i]=client.Member{Addr:fmt.Sprint("s",i+1),Capacity:capacity}
+        if i<len(zones) {members[i].Zone=zones[i]}
+    }
+    return members
+}
+
+/*
+按members放置n个文件块，每个文件块REPLICA_NUM个副本
+*/
+func placeTestChunks(n int, members []client.Member)map[string][]string{
+    key_servers:=map[string][]string{}
+    for i:=0;i<n;i++ {
+        key:=fmt.Sprintf("chunk-%04d",i)
+        key_servers[key]=client.PlaceChunk(key,REPLICA_NUM,members,nil,nil)
+    }
+    return key_servers
+}
+
+/*
+执行迁移：加入目标服务器，删除源服务器
+*/
+func applyTestMoves(key_servers map[string][]string, moves []ChunkMove){
+    for _,move:=range moves {
+        var servers []string
+        for _,server:=range key_servers[move.Key] {
+            if server!=move.From {servers=append(servers,server)}
+        }
+        if !containsString(servers,move.To) {servers=append(servers,move.To)}
+        key_servers[move.Key]=servers
+    }
+}
+
+func TestPlanRebalance(t *testing.T){
+    tests:=[]struct{
+        name string
+        before []client.Member //放置文件块时的成员表
+        after []client.Member //重新平衡时的成员表
+        moves bool //是否需要迁移
+    }{
+        {"加入一个服务器",rebalanceMembers([]float64{100,100,100},nil),rebalanceMembers([]float64{100,100,100,100},nil),true},
+        {"加入大容量服务器",rebalanceMembers([]float64{100,100,100},nil),rebalanceMembers([]float64{100,100,100,300},nil),true},
+        {"有故障域",rebalanceMembers([]float64{100,100,100},[]string{"a","b","c"}),rebalanceMembers([]float64{100,100,100,100,100,100},[]string{"a","b","c","a","b","c"}),true},
+        {"已经按容量放置",rebalanceMembers([]float64{100,400},nil),rebalanceMembers([]float64{100,400},nil),false},//大容量服务器上的文件块多，不应该迁走
+        {"只有一个服务器",rebalanceMembers([]float64{100},nil),rebalanceMembers([]float64{100},nil),false},
+    }
+    for _,test:=range tests {
+        t.Run(test.name, func(t *testing.T){
+            key_servers:=placeTestChunks(2000,test.before)
+            moves:=planRebalance(key_servers,test.after,0.1)
+            if (len(moves)>0)!=test.moves {t.Fatalf("迁移了%d个文件块",len(moves))}
+            if fmt.Sprint(moves)!=fmt.Sprint(planRebalance(key_servers,test.after,0.1)) {t.Fatal("两次计算的迁移计划不同")}
+            for _,move:=range moves {
+                servers:=key_servers[move.Key]
+                if !containsString(servers,move.From) || containsString(servers,move.To) {t.Fatalf("迁移%v不正确，文件块在%v",move,servers)}
+            }
+            applyTestMoves(key_servers,moves)
+            zone_of:=map[string]string{}
+            for _,m:=range test.after {zone_of[m.Addr]=client.MemberZone(m)}
+            replicas:=REPLICA_NUM
+            if len(test.before)<replicas {replicas=len(test.before)}
+            for key,servers:=range key_servers {
+                if len(servers)!=replicas {t.Fatalf("%s：迁移后有%d个副本",key,len(servers))}
+                if len(servers)>1 && zone_of[servers[0]]==zone_of[servers[1]] {t.Fatalf("%s：%v在同一个故障域",key,servers)}
+                if !test.moves {continue}
+                //迁移后和客户端上传时的放置一致
+                targets:=client.PlaceChunk(key,REPLICA_NUM,test.after,nil,nil)
+                for _,server:=range servers {
+                    if !containsString(targets,server) {t.Fatalf("%s：迁移后在%v，放置算法选出的是%v",key,servers,targets)}
+                }
+            }
+            //副本数量有限时负载不一定和容量成正比（一个服务器最多存一个副本），但再次计算不会再迁移
+            if again:=planRebalance(key_servers,test.after,0.1);len(again)>0 {t.Errorf("迁移后再次计算还要迁移%d个文件块",len(again))}
+        })
+    }
+}
+
+func TestPlanRebalanceDraining(t *testing.T){
+    before:=rebalanceMembers([]float64{100,100,100},nil)
+    key_servers:=placeTestChunks(500,before)
+    after:=rebalanceMembers([]float64{100,100,100,100,100},nil)
+    after[0].Draining=true
+    for _,move:=range planRebalance(key_servers,after,0.1) {
+        if move.From=="s1" || move.To=="s1" {t.Fatalf("迁移了下线中的服务器上的副本：%v",move)}
+        if rebalanceMover(move.Key,key_servers[move.Key],after)=="s1" {t.Fatalf("%s：下线中的服务器负责迁移",move.Key)}
+    }
+}
+
+/*
+各个服务器的成员表不一致（对s3的容量看法不同）时，每个服务器按自己的成员表计算计划，只执行自己负责的迁移：
+每个文件块只有一个服务器迁移，副本数量不会减少
+*/
+func TestRebalanceDivergentViews(t *testing.T){
+    before:=rebalanceMembers([]float64{100,100,100},nil)
+    key_servers:=placeTestChunks(1000,before)
+    views:=map[string][]client.Member{
+        "s1":rebalanceMembers([]float64{100,100,100,100},nil),
+        "s2":rebalanceMembers([]float64{100,100,300,100},nil),
+        "s3":rebalanceMembers([]float64{100,100,100,300},nil),
+        "s4":rebalanceMembers([]float64{100,100,100,100},nil),
+    }
+    var executed []ChunkMove
+    movers:=map[string]string{}
+    for server,members:=range views {
+        for _,move:=range planRebalance(key_servers,members,0.1) {
+            if rebalanceMover(move.Key,key_servers[move.Key],members)!=server {continue}
+            if mover,exist:=movers[move.Key];exist && mover!=server {t.Fatalf("%s：%s和%s都迁移了",move.Key,mover,server)}
+            movers[move.Key]=server
+            executed=append(executed,move)
+        }
+    }
+    if len(executed)==0 {t.Fatal("没有迁移")}
+    applyTestMoves(key_servers,executed)
+    for key,servers:=range key_servers {
+        if len(servers)!=REPLICA_NUM {t.Fatalf("%s：迁移后只有%v",key,servers)}
+    }
+}
+
+func TestRebalanceBalanced(t *testing.T){
+    key_servers:=map[string][]string{}
+    for i:=0;i<100;i++ {key_servers[fmt.Sprint("a",i)]=[]string{"s1"}}
+    for i:=0;i<300;i++ {key_servers[fmt.Sprint("b",i)]=[]string{"s2"}}
+    tests:=[]struct{
+        name string
+        members []client.Member
+        expect bool
+    }{
+        {"按容量平衡",rebalanceMembers([]float64{100,300},nil),true},
+        {"容量相同",rebalanceMembers([]float64{100,100},nil),false},
+        {"新服务器为空",rebalanceMembers([]float64{100,300,100},nil),false},
+        {"没有声明容量",rebalanceMembers([]float64{0,300},nil),true},//按DEFAULT_CAPACITY计算
+    }
+    for _,test:=range tests {
+        if balanced:=rebalanceBalanced(key_servers,test.members,0.1);balanced!=test.expect {t.Errorf("%s：返回%v",test.name,balanced)}
+    }
+}
+
+/*
+迁出的副本等待删除时重启：重启后读取保存的记录，到期后删除本机的副本；连不上且已经不在服务器列表中的服务器不再处理
+*/
+func TestPendingDeletesAfterRestart(t *testing.T){
+    saved_database,saved_storage,saved_self:=*database_dir,*storage_dir,self_server_addr
+    *database_dir,*storage_dir,self_server_addr=t.TempDir(),t.TempDir(),"s1"
+    defer func(){
+        *database_dir,*storage_dir,self_server_addr=saved_database,saved_storage,saved_self
+        pending_deletes=nil
+    }()
+    const key="0123456789abcdef0123456789abcdef01234567"
+    if err:=ioutil.WriteFile(storagePath(key),[]byte("chunk"),0644);err!=nil {t.Fatal(err)}
+    addPendingDeletes([]ChunkMove{{key,"s1","s2"},{key,"s9","s3"}})
+    //重启
+    pending_deletes=nil
+    if err:=loadPendingDeletes();err!=nil {t.Fatal(err)}
+    if len(pending_deletes)!=2 || pending_deletes[0].Key!=key || pending_deletes[0].Server!="s1" {t.Fatalf("重启后读取到%v",pending_deletes)}
+    deletePendingChunks()//还没有到期
+    if _,err:=os.Stat(storagePath(key));err!=nil {t.Fatal("没有到期就删除了文件块")}
+    for i:=range pending_deletes {pending_deletes[i].Due=time.Now().Add(-time.Second)}
+    deletePendingChunks()
+    if _,err:=os.Stat(storagePath(key));!os.IsNotExist(err) {t.Error("到期后没有删除文件块")}
+    pending_deletes=nil
+    if err:=loadPendingDeletes();err!=nil {t.Fatal(err)}
+    if len(pending_deletes)!=0 {t.Errorf("删除后还有记录：%v",pending_deletes)}
+}
@@ -0,0 +1,310 @@
+package main
+
+/*
+本文件包含了S3网关的认证相关的函数：AWS签名V4（SigV4）
+*/
+
+/*
+Access Key为用户名，Secret Key为gateway_tokens.txt中该用户的令牌（一个用户有多个令牌时任意一个都可以）。
+支持三种签名方式：
+    Authorization请求头，请求体的sha256写在X-Amz-Content-Sha256中（或者UNSIGNED-PAYLOAD不签名请求体）
+    预签名URL（X-Amz-Signature等参数在URL中），可以把链接发给没有密钥的人，过期时间最长7天
+    aws-chunked流式上传（STREAMING-AWS4-HMAC-SHA256-PAYLOAD），每个数据块单独签名，
+        以及STREAMING-UNSIGNED-PAYLOAD-TRAILER（数据块不签名，校验和放在末尾，忽略）
+请求体的sha256或数据块签名在读完请求体时检查，不正确时读取出错，上传的文件不会写入数据库。
+*/
+
+import (
+    "io"
+    "hash"
+    "time"
+    "bufio"
+    "bytes"
+    "sort"
+    "strconv"
+    "strings"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+const S3_MAX_SKEW=15*time.Minute //请求时间和本机时间允许的误差
+const S3_MAX_PRESIGN_EXPIRES=7*24*3600 //预签名URL的最长有效期，单位秒
+const S3_TIME_FORMAT="20060102T150405Z" //X-Amz-Date的格式
+const S3_UNSIGNED_PAYLOAD="UNSIGNED-PAYLOAD"
+const S3_STREAMING_PAYLOAD="STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+const S3_STREAMING_UNSIGNED_TRAILER="STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+const S3_EMPTY_SHA256="e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" //空字符串的sha256
+
+type s3Auth struct {//认证通过的请求
+    user string
+    amz_date string
+    scope string //日期/区域/服务/aws4_request
+    signing_key []byte
+    signature string //请求的签名，流式上传时第一个数据块的签名以它为基础
+}
+
+/*
+按AWS的规则进行URL编码：除了字母、数字和-._~以外都编码，encode_slash为false时保留/
+*/
+func awsURIEncode(s string, encode_slash bool)string{
+    var buf strings.Builder
+    for i:=0;i<len(s);i++ {
+        b:=s[i]
+        if ('A'<=b && b<='Z') || ('a'<=b && b<='z') || ('0'<=b && b<='9') || b=='-' || b=='.' || b=='_' || b=='~' || (b=='/' && !encode_slash) {
+            buf.WriteByte(b)
+            continue
+        }
+        buf.WriteString("%"+strings.ToUpper(hex.EncodeToString([]byte{b})))
+    }
+    return buf.String()
+}
+
+func hmacSHA256(key []byte, data string)[]byte{
+    mac:=hmac.New(sha256.New,key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte)string{
+    sum:=sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+/*
+计算签名密钥：scope为 日期/区域/服务/aws4_request
+*/
+func s3SigningKey(secret string, scope string)[]byte{
+    key:=[]byte("AWS4"+secret)
+    for _,part:=range strings.Split(scope,"/") {key=hmacSHA256(key,part)}
+    return key
+}
+
+/*
+规范请求：方法、路径、参数、签名的请求头、请求体的hash
+*/
+func s3CanonicalRequest(r *http.Request, signed_headers []string, payload_hash string)string{
+    //参数按名字和值排序，预签名URL的签名本身不参与签名
+    query:=r.URL.Query()
+    var params []string
+    for name,values:=range query {
+        if name=="X-Amz-Signature" {continue}
+        for _,value:=range values {params=append(params,awsURIEncode(name,true)+"="+awsURIEncode(value,true))}
+    }
+    sort.Strings(params)
+    var headers strings.Builder
+    for _,name:=range signed_headers {
+        var value string
+        switch name {
+            case "host":
+                value=r.Host
+            case "content-length":
+                value=strconv.FormatInt(r.ContentLength,10)
+                if v:=r.Header.Get(name);v!="" {value=v}
+            case "transfer-encoding":
+                value=strings.Join(r.TransferEncoding,",")
+            default:
+                value=strings.Join(r.Header.Values(name),",")
+        }
+        headers.WriteString(name+":"+strings.Join(strings.Fields(value)," ")+"\n")
+    }
+    return strings.Join([]string{
+        r.Method,
+        awsURIEncode(r.URL.Path,false),
+        strings.Join(params,"&"),
+        headers.String(),
+        strings.Join(signed_headers,";"),
+        payload_hash,
+    },"\n")
+}
+
+/*
+认证请求，通过时返回认证信息；请求体需要校验时替换r.Body
+*/
+func (g *s3Gateway) authenticate(r *http.Request)(*s3Auth,error){
+    var credential,signed_headers,signature,amz_date,payload_hash string
+    query:=r.URL.Query()
+    header:=r.Header.Get("Authorization")
+    presigned:=false
+    switch {
+        case strings.HasPrefix(header,"AWS4-HMAC-SHA256 "):
+            for _,field:=range strings.Split(header[len("AWS4-HMAC-SHA256 "):],",") {
+                name,value,_:=strings.Cut(strings.TrimSpace(field),"=")
+                switch name {
+                    case "Credential":
+                        credential=value
+                    case "SignedHeaders":
+                        signed_headers=value
+                    case "Signature":
+                        signature=value
+                }
+            }
+            amz_date=r.Header.Get("X-Amz-Date")
+            payload_hash=r.Header.Get("X-Amz-Content-Sha256")
+            if payload_hash=="" {return nil,s3Errorf(http.StatusBadRequest,"InvalidRequest","缺少X-Amz-Content-Sha256")}
+        case query.Get("X-Amz-Algorithm")=="AWS4-HMAC-SHA256":
+            presigned=true
+            credential=query.Get("X-Amz-Credential")
+            signed_headers=query.Get("X-Amz-SignedHeaders")
+            signature=query.Get("X-Amz-Signature")
+            amz_date=query.Get("X-Amz-Date")
+            payload_hash=S3_UNSIGNED_PAYLOAD
+        case header=="" && query.Get("X-Amz-Algorithm")=="":
+            return nil,s3Errorf(http.StatusForbidden,"AccessDenied","需要认证")
+        default:
+            return nil,s3Errorf(http.StatusBadRequest,"InvalidRequest","只支持AWS4-HMAC-SHA256签名")
+    }
+    //Credential为 AccessKey/日期/区域/服务/aws4_request
+    parts:=strings.Split(credential,"/")
+    if len(parts)!=5 || parts[4]!="aws4_request" || signature=="" || signed_headers=="" {
+        return nil,s3Errorf(http.StatusBadRequest,"AuthorizationHeaderMalformed","认证信息格式不正确")
+    }
+    user:=parts[0]
+    scope:=strings.Join(parts[1:],"/")
+    t,err:=time.Parse(S3_TIME_FORMAT,amz_date)
+    if err!=nil || parts[1]!=amz_date[:8] {
+        return nil,s3Errorf(http.StatusBadRequest,"AuthorizationHeaderMalformed","X-Amz-Date不正确")
+    }
+    if presigned {
+        expires,err:=strconv.Atoi(query.Get("X-Amz-Expires"))
+        if err!=nil || expires<0 || expires>S3_MAX_PRESIGN_EXPIRES {
+            return nil,s3Errorf(http.StatusBadRequest,"AuthorizationQueryParametersError","X-Amz-Expires不正确")
+        }
+        if time.Now().After(t.Add(time.Duration(expires)*time.Second)) || time.Until(t)>S3_MAX_SKEW {
+            return nil,s3Errorf(http.StatusForbidden,"AccessDenied","链接已过期")
+        }
+    }else if d:=time.Since(t);d>S3_MAX_SKEW || d< -S3_MAX_SKEW {
+        return nil,s3Errorf(http.StatusForbidden,"RequestTimeTooSkewed","请求时间和服务器时间相差太多")
+    }
+    canonical:=s3CanonicalRequest(r,strings.Split(signed_headers,";"),payload_hash)
+    string_to_sign:="AWS4-HMAC-SHA256\n"+amz_date+"\n"+scope+"\n"+sha256Hex([]byte(canonical))
+    var auth *s3Auth
+    for _,secret:=range g.secrets[user] {
+        key:=s3SigningKey(secret,scope)
+        expected:=hex.EncodeToString(hmacSHA256(key,string_to_sign))
+        if hmac.Equal([]byte(expected),[]byte(signature)) {
+            auth=&s3Auth{user,amz_date,scope,key,signature}
+            break
+        }
+    }
+    if auth==nil {
+        if len(g.secrets[user])==0 {return nil,s3Errorf(http.StatusForbidden,"InvalidAccessKeyId","Access Key不存在："+user)}
+        return nil,s3Errorf(http.StatusForbidden,"SignatureDoesNotMatch","签名不正确")
+    }
+    //请求体的校验
+    switch payload_hash {
+        case S3_UNSIGNED_PAYLOAD:
+        case S3_STREAMING_PAYLOAD:
+            r.Body=&s3ChunkedReader{body:r.Body,reader:bufio.NewReader(r.Body),auth:auth,prev_sig:auth.signature}
+        case S3_STREAMING_UNSIGNED_TRAILER:
+            r.Body=&s3ChunkedReader{body:r.Body,reader:bufio.NewReader(r.Body)}
+        default:
+            if _,err:=hex.DecodeString(payload_hash);err!=nil || len(payload_hash)!=64 {
+                return nil,s3Errorf(http.StatusNotImplemented,"NotImplemented","不支持的X-Amz-Content-Sha256："+payload_hash)
+            }
+            r.Body=&s3HashReader{body:r.Body,hash:sha256.New(),expected:payload_hash}
+    }
+    return auth,nil
+}
+
+type s3HashReader struct {//读完时检查请求体的sha256
+    body io.ReadCloser
+    hash hash.Hash
+    expected string
+}
+
+func (r *s3HashReader) Read(p []byte)(int,error){
+    n,err:=r.body.Read(p)
+    r.hash.Write(p[:n])
+    if err==io.EOF && hex.EncodeToString(r.hash.Sum(nil))!=r.expected {
+        return n,s3Errorf(http.StatusBadRequest,"XAmzContentSHA256Mismatch","请求体的sha256不正确")
+    }
+    return n,err
+}
+
+func (r *s3HashReader) Close()error{
+    return r.body.Close()
+}
+
+/*
+aws-chunked格式的请求体：每个数据块为 “十六进制长度;chunk-signature=签名\r\n数据\r\n”，
+最后是长度为0的数据块，后面可能有校验和等trailer，以空行结束
+*/
+type s3ChunkedReader struct {
+    body io.ReadCloser
+    reader *bufio.Reader
+    auth *s3Auth //为nil时数据块没有签名
+    prev_sig string //上一个数据块的签名
+    chunk_sig string //当前数据块的签名
+    remain int64 //当前数据块还没读的长度
+    hash hash.Hash //当前数据块的sha256
+    done bool
+}
+
+var errS3BadChunk=s3Errorf(http.StatusBadRequest,"IncompleteBody","aws-chunked数据格式不正确")
+
+func (r *s3ChunkedReader) Read(p []byte)(int,error){
+    if r.done {return 0,io.EOF}
+    if r.remain==0 {
+        err:=r.nextChunk()
+        if err!=nil {return 0,err}
+        if r.done {return 0,io.EOF}
+    }
+    if int64(len(p))>r.remain {p=p[:r.remain]}
+    n,err:=r.reader.Read(p)
+    r.hash.Write(p[:n])
+    r.remain-=int64(n)
+    if err==io.EOF {err=io.ErrUnexpectedEOF}
+    if err==nil && r.remain==0 {err=r.endChunk()}
+    return n,err
+}
+
+/*
+读取数据块的头部
+*/
+func (r *s3ChunkedReader) nextChunk()error{
+    line,err:=r.reader.ReadString('\n')
+    if err!=nil {return errS3BadChunk}
+    size_text,ext,_:=strings.Cut(strings.TrimRight(line,"\r\n"),";")
+    size,err:=strconv.ParseInt(size_text,16,64)
+    if err!=nil || size<0 {return errS3BadChunk}
+    r.chunk_sig=strings.TrimPrefix(ext,"chunk-signature=")
+    r.remain=size
+    r.hash=sha256.New()
+    if size>0 {return nil}
+    //最后一个数据块：检查签名，跳过trailer
+    err=r.verifyChunk()
+    if err!=nil {return err}
+    for{
+        line,err:=r.reader.ReadString('\n')
+        if err!=nil {return errS3BadChunk}
+        if strings.TrimRight(line,"\r\n")=="" {break}
+    }
+    r.done=true
+    return nil
+}
+
+/*
+数据块结束：跳过\r\n，检查签名
+*/
+func (r *s3ChunkedReader) endChunk()error{
+    crlf:=make([]byte,2)
+    if _,err:=io.ReadFull(r.reader,crlf);err!=nil || !bytes.Equal(crlf,[]byte("\r\n")) {return errS3BadChunk}
+    return r.verifyChunk()
+}
+
+func (r *s3ChunkedReader) verifyChunk()error{
+    if r.auth==nil {return nil}
+    string_to_sign:="AWS4-HMAC-SHA256-PAYLOAD\n"+r.auth.amz_date+"\n"+r.auth.scope+"\n"+r.prev_sig+"\n"+S3_EMPTY_SHA256+"\n"+hex.EncodeToString(r.hash.Sum(nil))
+    expected:=hex.EncodeToString(hmacSHA256(r.auth.signing_key,string_to_sign))
+    if !hmac.Equal([]byte(expected),[]byte(r.chunk_sig)) {
+        return s3Errorf(http.StatusForbidden,"SignatureDoesNotMatch","数据块签名不正确")
+    }
+    r.prev_sig=expected
+    return nil
+}
+
+func (r *s3ChunkedReader) Close()error{
+    return r.body.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+/*
+SigV4签名的测试，使用AWS公布的签名测试用例（aws-sig-v4-test-suite）
+*/
+
+import (
+    "testing"
+    "net/http"
+    "encoding/hex"
+)
+
+func TestS3Signature(t *testing.T){
+    const secret="wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+    const scope="20150830/us-east-1/service/aws4_request"
+    const amz_date="20150830T123600Z"
+    tests:=[]struct{
+        name string
+        method string
+        url string
+        canonical string //规范请求
+        signature string
+    }{
+        {"get-vanilla","GET","/",
+            "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n"+S3_EMPTY_SHA256,
+            "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+        {"get-vanilla-query-order-key-case","GET","/?Param2=value2&Param1=value1",
+            "GET\n/\nParam1=value1&Param2=value2\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n"+S3_EMPTY_SHA256,
+            "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+        {"post-vanilla","POST","/",
+            "POST\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n"+S3_EMPTY_SHA256,
+            "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+    }
+    key:=s3SigningKey(secret,scope)
+    for _,test:=range tests {
+        r,err:=http.NewRequest(test.method,"http://example.amazonaws.com"+test.url,nil)
+        if err!=nil {t.Fatal(err)}
+        r.Header.Set("X-Amz-Date",amz_date)
+        canonical:=s3CanonicalRequest(r,[]string{"host","x-amz-date"},S3_EMPTY_SHA256)
+        if canonical!=test.canonical {
+            t.Errorf("%s：规范请求为\n%s\n期望\n%s",test.name,canonical,test.canonical)
+            continue
+        }
+        string_to_sign:="AWS4-HMAC-SHA256\n"+amz_date+"\n"+scope+"\n"+sha256Hex([]byte(canonical))
+        if signature:=hex.EncodeToString(hmacSHA256(key,string_to_sign));signature!=test.signature {
+            t.Errorf("%s：签名为%s，期望%s",test.name,signature,test.signature)
+        }
+    }
+}
+
+func TestAWSURIEncode(t *testing.T){
+    tests:=[]struct{
+        s string
+        encode_slash bool
+        expect string
+    }{
+        {"abcXYZ019-._~",true,"abcXYZ019-._~"},
+        {"/a b/c",false,"/a%20b/c"},
+        {"/a b/c",true,"%2Fa%20b%2Fc"},
+        {"a+b=c&d",true,"a%2Bb%3Dc%26d"},
+        {"中",true,"%E4%B8%AD"},
+    }
+    for _,test:=range tests {
+        if encoded:=awsURIEncode(test.s,test.encode_slash);encoded!=test.expect {t.Errorf("%q：编码为%s，期望%s",test.s,encoded,test.expect)}
+    }
+}
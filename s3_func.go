@@ -0,0 +1,704 @@
+package main
+
+/*
+本文件包含了S3兼容网关相关的函数（gateway -s3）：AWS SDK、aws-cli、mc等S3工具可以直接使用存储系统
+*/
+
+/*
+对应关系：bucket就是用户名，object key就是文件名（key中的“/”表示文件夹，和put -r一样），只支持路径风格的URL（http://网关/bucket/key）。
+所有用户都可以读取所有bucket中的对象（有意如此：和HTTP网关、命令行一样，存储系统中所有用户的文件对所有用户可见），
+只能修改自己的bucket；没有完成的分块上传（ListMultipartUploads、ListParts）还不是对象，只有bucket的主人可以查看。认证见s3_auth_func.go。
+支持的操作：
+    ListBuckets、HeadBucket、GetBucketLocation、CreateBucket（只能是自己的，bucket不需要创建，上传文件后就存在）、DeleteBucket（空bucket）
+    ListObjectsV2、ListObjects、GetObject（支持Range）、HeadObject、PutObject、DeleteObject、DeleteObjects
+    分块上传：CreateMultipartUpload、UploadPart、CompleteMultipartUpload、AbortMultipartUpload、ListParts、ListMultipartUploads
+分块上传的每个part先保存在网关本地（S3_MULTIPART_DIR），网关重启后可以继续上传；
+Complete时把所有part按顺序拼起来，按put的流程切成文件块上传并写入数据库（服务器上已有的文件块不会重新上传），然后删除本地的part。
+part的边界一般和文件块（分块大小由-block_size指定）对不齐，不能在收到时直接切块上传，所以网关要限制本地保存的part：
+每个part最大S3_MAX_PART_SIZE；用户有空间配额时，这个bucket所有没有完成的上传加上已用空间不能超出配额；
+超过S3_MULTIPART_EXPIRE没有上传新的part的分块上传会被定期删除。
+ETag：S3工具会把没有“-”的ETag当成MD5校验，而数据库中只有文件块的sha1，
+所以对象的ETag为“文件块key的hash-文件块数量”；part的ETag为part内容的MD5。
+*/
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "sort"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "net/http"
+    "io/ioutil"
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/rand"
+    "encoding/xml"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/base64"
+    "path/filepath"
+    "log/slog"
+    "dss/client"
+)
+
+const S3_MULTIPART_DIR="s3-multipart" //分块上传的part保存的文件夹（在tmp文件夹中），每次上传一个子文件夹
+const S3_MULTIPART_EXPIRE=24*time.Hour //超过这个时间没有上传新的part的分块上传会被删除
+const S3_MULTIPART_CLEAN_INTERVAL=time.Hour //检查过期的分块上传的间隔
+const S3_MAX_PART_SIZE=5*1024*1024*1024 //part最大5GiB，和S3一致
+const S3_MAX_KEYS=1000 //ListObjects一次最多返回的数量
+const S3_MAX_PART_NUMBER=10000
+const S3_XMLNS="http://s3.amazonaws.com/doc/2006-03-01/"
+const S3_TIME_LAYOUT="2006-01-02T15:04:05.000Z" //XML中的时间格式
+
+type s3Gateway struct {
+    secrets map[string][]string //用户名 -> 令牌（Secret Key）
+    clients *clientPool
+}
+
+type s3Error struct {//S3格式的错误
+    Status int
+    Code string
+    Message string
+}
+
+func (e *s3Error) Error()string{
+    return e.Code+"："+e.Message
+}
+
+func s3Errorf(status int, code string, message string)*s3Error{
+    return &s3Error{status,code,message}
+}
+
+type s3Upload struct {//分块上传的信息，保存在上传文件夹的meta.json
+    Bucket string
+    Key string
+    Initiated time.Time
+}
+
+type s3Object struct {
+    Key string
+    LastModified string
+    ETag string
+    Size int64
+    StorageClass string
+}
+
+type s3Part struct {
+    PartNumber int
+    LastModified string `xml:",omitempty"`
+    ETag string
+    Size int64 `xml:",omitempty"`
+}
+
+/*
+新建S3网关，所有令牌都可以作为对应用户的Secret Key；定期删除过期的分块上传
+*/
+func newS3Gateway(tokens map[string]string, clients *clientPool)*s3Gateway{
+    g:=&s3Gateway{secrets:map[string][]string{},clients:clients}
+    for token,user:=range tokens {g.secrets[user]=append(g.secrets[user],token)}
+    go func(){
+        for{
+            expireS3Uploads()
+            time.Sleep(S3_MULTIPART_CLEAN_INTERVAL)
+        }
+    }()
+    return g
+}
+
+/*
+删除超过S3_MULTIPART_EXPIRE没有上传新的part的分块上传（上传part时文件夹的修改时间会更新）
+*/
+func expireS3Uploads(){
+    dirs,_:=ioutil.ReadDir(tmpPath(S3_MULTIPART_DIR))
+    for _,dir:=range dirs {
+        if time.Since(dir.ModTime())<=S3_MULTIPART_EXPIRE {continue}
+        err:=os.RemoveAll(filepath.Join(*tmp_dir,S3_MULTIPART_DIR,dir.Name()))
+        if err!=nil {
+            slog.Warn("删除过期的分块上传失败","upload_id",dir.Name(),"err",err)
+            continue
+        }
+        slog.Info("删除过期的分块上传","upload_id",dir.Name())
+    }
+}
+
+/*
+输出XML，根元素加上S3的命名空间
+*/
+func writeXML(w http.ResponseWriter, status int, v interface{}){
+    var buf bytes.Buffer
+    buf.WriteString(xml.Header)
+    xml.NewEncoder(&buf).Encode(v)
+    w.Header().Set("Content-Type","application/xml")
+    w.WriteHeader(status)
+    w.Write(buf.Bytes())
+}
+
+/*
+输出S3格式的错误，不是s3Error的错误按退出码转换
+*/
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error){
+    var s3_err *s3Error
+    if !errors.As(err,&s3_err) {
+        switch exitCode(clientError(err,EXIT_ERROR)) {
+            case EXIT_NOT_FOUND:
+                s3_err=s3Errorf(http.StatusNotFound,"NoSuchKey",err.Error())
+            case EXIT_NETWORK:
+                s3_err=s3Errorf(http.StatusServiceUnavailable,"ServiceUnavailable",err.Error())
+            case EXIT_SYNC:
+                s3_err=s3Errorf(http.StatusConflict,"OperationAborted",err.Error())
+            case EXIT_QUOTA:
+                s3_err=s3Errorf(http.StatusForbidden,"QuotaExceeded",err.Error())
+            default:
+                s3_err=s3Errorf(http.StatusInternalServerError,"InternalError",err.Error())
+        }
+    }
+    if r.Method==http.MethodHead {//HEAD请求不能有响应体
+        w.WriteHeader(s3_err.Status)
+        return
+    }
+    writeXML(w,s3_err.Status,struct{
+        XMLName xml.Name `xml:"Error"`
+        Code string
+        Message string
+        Resource string
+    }{Code:s3_err.Code,Message:s3_err.Message,Resource:r.URL.Path})
+}
+
+/*
+对象的ETag：文件块key的hash加上文件块数量，带“-”表示不是MD5
+*/
+func s3ETag(info client.FileInfo)string{
+    hash:=sha1.New()
+    for _,chunk:=range info.Chunks {hash.Write([]byte(chunk.Key))}
+    return fmt.Sprintf(`"%s-%d"`,hex.EncodeToString(hash.Sum(nil))[:32],len(info.Chunks))
+}
+
+func s3Time(t time.Time)string{
+    return t.UTC().Format(S3_TIME_LAYOUT)
+}
+
+func (g *s3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request){
+    r=withHTTPRequestID(w,r)
+    start:=time.Now()
+    auth,err:=g.authenticate(r)
+    if err!=nil {
+        writeS3Error(w,r,err)
+        httpLogger("s3",r).Warn("认证失败","err",err)
+        return
+    }
+    err=g.serve(w,r,auth)
+    if err!=nil {writeS3Error(w,r,err)}
+    logger:=httpLogger("s3",r).With("user",auth.user,"duration",time.Since(start))
+    if err!=nil {logger.Warn("请求失败","err",err)}else{logger.Info("请求完成")}
+}
+
+/*
+按路径和参数分发请求，出错时返回错误（还没有输出任何内容）
+*/
+func (g *s3Gateway) serve(w http.ResponseWriter, r *http.Request, auth *s3Auth)error{
+    bucket,key,_:=strings.Cut(strings.TrimPrefix(r.URL.Path,"/"),"/")
+    query:=r.URL.Query()
+    if bucket=="" {
+        if r.Method!=http.MethodGet {return s3Errorf(http.StatusMethodNotAllowed,"MethodNotAllowed","不支持的请求方法")}
+        return g.listBuckets(w,r,auth)
+    }
+    if client.ValidUser(bucket)!=nil {return s3Errorf(http.StatusBadRequest,"InvalidBucketName","bucket名字不正确："+bucket)}
+    if r.Method!=http.MethodGet && r.Method!=http.MethodHead && bucket!=auth.user {
+        return s3Errorf(http.StatusForbidden,"AccessDenied","只能修改自己的bucket")
+    }
+    _,has_upload_id:=query["uploadId"]
+    if (query.Has("uploads") || has_upload_id) && bucket!=auth.user {
+        return s3Errorf(http.StatusForbidden,"AccessDenied","只能查看自己的bucket中没有完成的分块上传")
+    }
+    c,err:=g.clients.get(bucket)
+    if err!=nil {return err}
+    if key=="" {//bucket的操作
+        switch {
+            case r.Method==http.MethodGet && query.Has("location"):
+                writeXML(w,http.StatusOK,struct{
+                    XMLName xml.Name `xml:"LocationConstraint"`
+                    Xmlns string `xml:"xmlns,attr"`
+                }{Xmlns:S3_XMLNS})
+                return nil
+            case r.Method==http.MethodGet && query.Has("uploads"):
+                return g.listUploads(w,r,bucket)
+            case r.Method==http.MethodGet:
+                return g.listObjects(w,r,c,bucket)
+            case r.Method==http.MethodHead || r.Method==http.MethodPut:
+                w.WriteHeader(http.StatusOK)
+                return nil
+            case r.Method==http.MethodDelete:
+                files,err:=c.List(r.Context())
+                if err!=nil {return err}
+                if len(files)>0 {return s3Errorf(http.StatusConflict,"BucketNotEmpty","bucket不是空的")}
+                w.WriteHeader(http.StatusNoContent)
+                return nil
+            case r.Method==http.MethodPost && query.Has("delete"):
+                return g.deleteObjects(w,r,c)
+        }
+        return s3Errorf(http.StatusNotImplemented,"NotImplemented","不支持的操作")
+    }
+    if err:=client.ValidName(key);err!=nil {return s3Errorf(http.StatusBadRequest,"InvalidArgument",err.Error())}
+    switch {
+        case r.Method==http.MethodGet && has_upload_id:
+            return g.listParts(w,r,bucket,key)
+        case r.Method==http.MethodGet || r.Method==http.MethodHead:
+            return g.getObject(w,r,c,key)
+        case r.Method==http.MethodPut && r.Header.Get("X-Amz-Copy-Source")!="":
+            return s3Errorf(http.StatusNotImplemented,"NotImplemented","不支持复制对象")
+        case r.Method==http.MethodPut && has_upload_id:
+            return g.uploadPart(w,r,c,bucket,key)
+        case r.Method==http.MethodPut:
+            return g.putObject(w,r,c,key)
+        case r.Method==http.MethodPost && query.Has("uploads"):
+            return g.createUpload(w,r,bucket,key)
+        case r.Method==http.MethodPost && has_upload_id:
+            return g.completeUpload(w,r,c,bucket,key)
+        case r.Method==http.MethodDelete && has_upload_id:
+            dir,err:=g.uploadDir(r,bucket,key)
+            if err!=nil {return err}
+            os.RemoveAll(dir)
+            w.WriteHeader(http.StatusNoContent)
+            return nil
+        case r.Method==http.MethodDelete:
+            err:=c.Delete(r.Context(),key)
+            if err!=nil && !errors.Is(err,client.ErrNotFound) {return err}//删除不存在的对象也算成功
+            w.WriteHeader(http.StatusNoContent)
+            return nil
+    }
+    return s3Errorf(http.StatusNotImplemented,"NotImplemented","不支持的操作")
+}
+
+/*
+所有用户就是所有bucket
+*/
+func (g *s3Gateway) listBuckets(w http.ResponseWriter, r *http.Request, auth *s3Auth)error{
+    users,err:=fetchUsers()
+    if err!=nil {return err}
+    type bucket struct {
+        Name string
+        CreationDate string
+    }
+    var buckets []bucket
+    for _,user:=range users {buckets=append(buckets,bucket{user,s3Time(time.Unix(0,0))})}
+    writeXML(w,http.StatusOK,struct{
+        XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Owner struct{ID string;DisplayName string}
+        Buckets []bucket `xml:"Buckets>Bucket"`
+    }{Xmlns:S3_XMLNS,Owner:struct{ID string;DisplayName string}{auth.user,auth.user},Buckets:buckets})
+    return nil
+}
+
+/*
+ListObjectsV2（list-type=2）和ListObjects：按key排序，delimiter把下一级“文件夹”合并成CommonPrefixes
+*/
+func (g *s3Gateway) listObjects(w http.ResponseWriter, r *http.Request, c *client.Client, bucket string)error{
+    query:=r.URL.Query()
+    v2:=query.Get("list-type")=="2"
+    prefix,delimiter:=query.Get("prefix"),query.Get("delimiter")
+    max_keys:=S3_MAX_KEYS
+    if text:=query.Get("max-keys");text!="" {
+        n,err:=strconv.Atoi(text)
+        if err!=nil || n<0 {return s3Errorf(http.StatusBadRequest,"InvalidArgument","max-keys不正确")}
+        if n<max_keys {max_keys=n}
+    }
+    marker:=query.Get("marker")
+    if v2 {
+        marker=query.Get("start-after")
+        if token:=query.Get("continuation-token");token!="" {
+            datas,err:=base64.StdEncoding.DecodeString(token)
+            if err!=nil {return s3Errorf(http.StatusBadRequest,"InvalidArgument","continuation-token不正确")}
+            marker=string(datas)
+        }
+    }
+    files,err:=c.List(r.Context())
+    if err!=nil {return err}
+    sort.Slice(files,func(i,j int)bool{return files[i].Name<files[j].Name})
+    encode:=func(s string)string{return s}
+    if query.Get("encoding-type")=="url" {encode=func(s string)string{return awsURIEncode(s,false)}}
+    var contents []s3Object
+    var common_prefixes []string
+    last:=""
+    truncated:=false
+    for _,file:=range files {
+        if file.Name<=marker || !strings.HasPrefix(file.Name,prefix) {continue}
+        entry,is_prefix:=file.Name,false
+        if delimiter!="" {
+            if i:=strings.Index(file.Name[len(prefix):],delimiter);i>=0 {
+                entry,is_prefix=file.Name[:len(prefix)+i+len(delimiter)],true
+                if entry==last || entry<=marker {continue}//这个“文件夹”已经返回过了
+            }
+        }
+        if len(contents)+len(common_prefixes)>=max_keys {
+            truncated=true
+            break
+        }
+        last=entry
+        if is_prefix {
+            common_prefixes=append(common_prefixes,encode(entry))
+            continue
+        }
+        size:=file.Size
+        if size<0 {size=0}//旧版本上传的文件没有记录大小
+        contents=append(contents,s3Object{encode(file.Name),s3Time(file.ModTime),s3ETag(file),size,"STANDARD"})
+    }
+    type prefix_entry struct{Prefix string}
+    var prefixes []prefix_entry
+    for _,p:=range common_prefixes {prefixes=append(prefixes,prefix_entry{p})}
+    result:=struct{
+        XMLName xml.Name `xml:"ListBucketResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Name string
+        Prefix string
+        Delimiter string `xml:",omitempty"`
+        EncodingType string `xml:",omitempty"`
+        MaxKeys int
+        IsTruncated bool
+        Marker *string `xml:",omitempty"`
+        NextMarker string `xml:",omitempty"`
+        StartAfter string `xml:",omitempty"`
+        ContinuationToken string `xml:",omitempty"`
+        NextContinuationToken string `xml:",omitempty"`
+        KeyCount *int `xml:",omitempty"`
+        Contents []s3Object
+        CommonPrefixes []prefix_entry
+    }{
+        Xmlns:S3_XMLNS,Name:bucket,Prefix:encode(prefix),Delimiter:encode(delimiter),EncodingType:query.Get("encoding-type"),
+        MaxKeys:max_keys,IsTruncated:truncated,Contents:contents,CommonPrefixes:prefixes,
+    }
+    if v2 {
+        key_count:=len(contents)+len(common_prefixes)
+        result.KeyCount=&key_count
+        result.StartAfter=encode(query.Get("start-after"))
+        result.ContinuationToken=query.Get("continuation-token")
+        if truncated {result.NextContinuationToken=base64.StdEncoding.EncodeToString([]byte(last))}
+    }else{
+        v1_marker:=encode(query.Get("marker"))
+        result.Marker=&v1_marker
+        if truncated {result.NextMarker=encode(last)}
+    }
+    writeXML(w,http.StatusOK,result)
+    return nil
+}
+
+/*
+GetObject和HeadObject：支持Range，边下载文件块边输出
+*/
+func (g *s3Gateway) getObject(w http.ResponseWriter, r *http.Request, c *client.Client, key string)error{
+    info,err:=c.Stat(r.Context(),key)
+    if errors.Is(err,client.ErrNotFound) {return s3Errorf(http.StatusNotFound,"NoSuchKey","对象不存在："+key)}
+    if err!=nil {return err}
+    w.Header().Set("ETag",s3ETag(info))
+    reader:=c.NewReader(r.Context(),info)
+    if info.Size<0 {//旧版本上传的文件没有记录大小，不支持Range
+        w.Header().Set("Content-Type","application/octet-stream")
+        if r.Method==http.MethodGet {io.Copy(w,reader)}
+        return nil
+    }
+    http.ServeContent(w,r,key,info.ModTime,reader)
+    return nil
+}
+
+/*
+检查Content-MD5请求头，md5为实际内容的MD5
+*/
+func checkContentMD5(r *http.Request, md5_sum []byte)error{
+    header:=r.Header.Get("Content-Md5")
+    if header=="" {return nil}
+    expected,err:=base64.StdEncoding.DecodeString(header)
+    if err!=nil {return s3Errorf(http.StatusBadRequest,"InvalidDigest","Content-MD5不正确")}
+    if !bytes.Equal(expected,md5_sum) {return s3Errorf(http.StatusBadRequest,"BadDigest","内容的MD5和Content-MD5不一致")}
+    return nil
+}
+
+/*
+PutObject：由网关切块上传，请求体和MD5都校验通过后才写入数据库
+*/
+func (g *s3Gateway) putObject(w http.ResponseWriter, r *http.Request, c *client.Client, key string)error{
+    hash:=md5.New()
+    info,err:=c.Upload(r.Context(),key,io.TeeReader(r.Body,hash),time.Now())
+    if err!=nil {return err}
+    err=checkContentMD5(r,hash.Sum(nil))
+    if err!=nil {return err}
+    err=c.Commit(r.Context(),[]client.FileInfo{info},nil)
+    if err!=nil {return err}
+    w.Header().Set("ETag",s3ETag(info))
+    w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+/*
+DeleteObjects：一次删除多个对象，只同步一次数据库，不存在的对象也算删除成功
+*/
+func (g *s3Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, c *client.Client)error{
+    var request struct{
+        Quiet bool
+        Objects []struct{Key string} `xml:"Object"`
+    }
+    if err:=xml.NewDecoder(r.Body).Decode(&request);err!=nil {
+        return s3Errorf(http.StatusBadRequest,"MalformedXML",err.Error())
+    }
+    files,err:=c.List(r.Context())
+    if err!=nil {return err}
+    exist:=map[string]bool{}
+    for _,file:=range files {exist[file.Name]=true}
+    var removed []string
+    for _,object:=range request.Objects {
+        if exist[object.Key] {
+            removed=append(removed,object.Key)
+            exist[object.Key]=false//重复的key只删除一次
+        }
+    }
+    err=c.Commit(r.Context(),nil,removed)
+    type deleted struct{Key string}
+    type delete_error struct{Key string;Code string;Message string}
+    var result struct{
+        XMLName xml.Name `xml:"DeleteResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Deleted []deleted
+        Error []delete_error
+    }
+    result.Xmlns=S3_XMLNS
+    for _,object:=range request.Objects {
+        switch {
+            case err!=nil:
+                result.Error=append(result.Error,delete_error{object.Key,"InternalError",err.Error()})
+            case !request.Quiet:
+                result.Deleted=append(result.Deleted,deleted{object.Key})
+        }
+    }
+    writeXML(w,http.StatusOK,result)
+    return nil
+}
+
+/*
+分块上传的文件夹，检查uploadId是否属于这个bucket和key
+*/
+func (g *s3Gateway) uploadDir(r *http.Request, bucket string, key string)(string,error){
+    upload_id:=r.URL.Query().Get("uploadId")
+    no_such_upload:=s3Errorf(http.StatusNotFound,"NoSuchUpload","分块上传不存在："+upload_id)
+    if _,err:=hex.DecodeString(upload_id);err!=nil || upload_id=="" {return "",no_such_upload}
+    dir:=filepath.Join(*tmp_dir,S3_MULTIPART_DIR,upload_id)
+    datas,err:=ioutil.ReadFile(filepath.Join(dir,"meta.json"))
+    if err!=nil {return "",no_such_upload}
+    var upload s3Upload
+    if json.Unmarshal(datas,&upload)!=nil || upload.Bucket!=bucket || upload.Key!=key {return "",no_such_upload}
+    return dir,nil
+}
+
+/*
+CreateMultipartUpload：新建上传文件夹
+*/
+func (g *s3Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket string, key string)error{
+    id:=make([]byte,16)
+    if _,err:=rand.Read(id);err!=nil {return err}
+    upload_id:=hex.EncodeToString(id)
+    dir:=filepath.Join(*tmp_dir,S3_MULTIPART_DIR,upload_id)
+    err:=os.MkdirAll(dir,0755)
+    if err!=nil {return err}
+    datas,err:=json.Marshal(s3Upload{bucket,key,time.Now()})
+    if err==nil {err=ioutil.WriteFile(filepath.Join(dir,"meta.json"),datas,0644)}
+    if err!=nil {
+        os.RemoveAll(dir)
+        return err
+    }
+    writeXML(w,http.StatusOK,struct{
+        XMLName xml.Name `xml:"InitiateMultipartUploadResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Bucket string
+        Key string
+        UploadId string
+    }{Xmlns:S3_XMLNS,Bucket:bucket,Key:key,UploadId:upload_id})
+    return nil
+}
+
+/*
+part的文件名，后面加上.md5为保存MD5的文件
+*/
+func s3PartPath(dir string, number int)string{
+    return filepath.Join(dir,fmt.Sprintf("%05d",number))
+}
+
+/*
+UploadPart：part保存到上传文件夹，同一个编号重新上传时替换。
+part超过S3_MAX_PART_SIZE或者会超出用户的空间配额时拒绝，不会把整个请求体写到本地
+*/
+func (g *s3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, c *client.Client, bucket string, key string)error{
+    number,err:=strconv.Atoi(r.URL.Query().Get("partNumber"))
+    if err!=nil || number<1 || number>S3_MAX_PART_NUMBER {return s3Errorf(http.StatusBadRequest,"InvalidArgument","partNumber不正确")}
+    dir,err:=g.uploadDir(r,bucket,key)
+    if err!=nil {return err}
+    path:=s3PartPath(dir,number)
+    limit:=int64(S3_MAX_PART_SIZE)
+    remaining,limited,err:=s3QuotaRemaining(r,c,bucket,path)
+    if err!=nil {return err}
+    if limited && remaining<limit {limit=remaining}
+    too_large:=func()error{
+        if limited && limit==remaining {return fmt.Errorf("%w：分块上传的part加起来超出配额",client.ErrQuota)}
+        return s3Errorf(http.StatusBadRequest,"EntityTooLarge",fmt.Sprintf("part不能超过%s",formatSize(S3_MAX_PART_SIZE)))
+    }
+    if limit<0 || r.ContentLength>limit {return too_large()}
+    f,err:=ioutil.TempFile(dir,"part-")
+    if err!=nil {return err}
+    defer os.Remove(f.Name())
+    hash:=md5.New()
+    n,err:=io.Copy(io.MultiWriter(f,hash),io.LimitReader(r.Body,limit+1))
+    if cerr:=f.Close();err==nil {err=cerr}
+    if err!=nil {return err}
+    if n>limit {return too_large()}
+    md5_sum:=hash.Sum(nil)
+    err=checkContentMD5(r,md5_sum)
+    if err!=nil {return err}
+    etag:=`"`+hex.EncodeToString(md5_sum)+`"`
+    err=ioutil.WriteFile(path+".md5",[]byte(etag),0644)
+    if err==nil {err=os.Rename(f.Name(),path)}
+    if err!=nil {return err}
+    w.Header().Set("ETag",etag)
+    w.WriteHeader(http.StatusOK)
+    return nil
+}
+
+/*
+用户还能用于分块上传的空间：空间配额减去已用空间（网关本地的数据库）和这个bucket所有没有完成的上传的part（不包括要替换的part_path），
+没有空间配额时limited为false。完成上传时写入数据库还会按最新的数据库检查一次
+*/
+func s3QuotaRemaining(r *http.Request, c *client.Client, bucket string, part_path string)(int64,bool,error){
+    quotas,err:=c.Quotas(r.Context())
+    if err!=nil {return 0,false,err}
+    q:=quotas[bucket]
+    if q.MaxBytes<=0 {return 0,false,nil}
+    usage,err:=c.CachedUsage(q.Dedup)
+    if err!=nil && !errors.Is(err,client.ErrNotFound) {return 0,false,err}
+    remaining:=q.MaxBytes-usage.Bytes
+    dirs,_:=ioutil.ReadDir(tmpPath(S3_MULTIPART_DIR))
+    for _,d:=range dirs {
+        dir:=filepath.Join(*tmp_dir,S3_MULTIPART_DIR,d.Name())
+        datas,err:=ioutil.ReadFile(filepath.Join(dir,"meta.json"))
+        if err!=nil {continue}
+        var meta s3Upload
+        if json.Unmarshal(datas,&meta)!=nil || meta.Bucket!=bucket {continue}
+        parts,err:=s3ListParts(dir)
+        if err!=nil {continue}
+        for _,part:=range parts {
+            if s3PartPath(dir,part.PartNumber)!=part_path {remaining-=part.Size}
+        }
+    }
+    return remaining,true,nil
+}
+
+/*
+上传文件夹中已有的part，按编号排序
+*/
+func s3ListParts(dir string)([]s3Part,error){
+    files,err:=ioutil.ReadDir(dir)
+    if err!=nil {return nil,err}
+    var parts []s3Part
+    for _,file:=range files {
+        number,err:=strconv.Atoi(file.Name())
+        if err!=nil {continue}//meta.json、.md5和正在上传的临时文件
+        etag,err:=ioutil.ReadFile(filepath.Join(dir,file.Name()+".md5"))
+        if err!=nil {continue}
+        parts=append(parts,s3Part{number,s3Time(file.ModTime()),string(etag),file.Size()})
+    }
+    sort.Slice(parts,func(i,j int)bool{return parts[i].PartNumber<parts[j].PartNumber})
+    return parts,nil
+}
+
+/*
+CompleteMultipartUpload：检查part列表，把part按顺序拼起来上传，写入数据库后删除上传文件夹
+*/
+func (g *s3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, c *client.Client, bucket string, key string)error{
+    dir,err:=g.uploadDir(r,bucket,key)
+    if err!=nil {return err}
+    var request struct{
+        Parts []s3Part `xml:"Part"`
+    }
+    if err:=xml.NewDecoder(r.Body).Decode(&request);err!=nil || len(request.Parts)==0 {
+        return s3Errorf(http.StatusBadRequest,"MalformedXML","part列表不正确")
+    }
+    uploaded,err:=s3ListParts(dir)
+    if err!=nil {return err}
+    etags:=map[int]string{}
+    for _,part:=range uploaded {etags[part.PartNumber]=part.ETag}
+    var readers []io.Reader
+    for i,part:=range request.Parts {
+        if i>0 && part.PartNumber<=request.Parts[i-1].PartNumber {
+            return s3Errorf(http.StatusBadRequest,"InvalidPartOrder","part必须按编号从小到大排列")
+        }
+        if etags[part.PartNumber]!=`"`+strings.Trim(part.ETag,`"`)+`"` {
+            return s3Errorf(http.StatusBadRequest,"InvalidPart",fmt.Sprintf("第%d个part不存在或者ETag不一致",part.PartNumber))
+        }
+        f,err:=os.Open(s3PartPath(dir,part.PartNumber))
+        if err!=nil {return err}
+        defer f.Close()
+        readers=append(readers,f)
+    }
+    info,err:=c.Upload(r.Context(),key,io.MultiReader(readers...),time.Now())
+    if err!=nil {return err}
+    err=c.Commit(r.Context(),[]client.FileInfo{info},nil)
+    if err!=nil {return err}
+    os.RemoveAll(dir)
+    writeXML(w,http.StatusOK,struct{
+        XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Location string
+        Bucket string
+        Key string
+        ETag string
+    }{Xmlns:S3_XMLNS,Location:"/"+bucket+"/"+key,Bucket:bucket,Key:key,ETag:s3ETag(info)})
+    return nil
+}
+
+/*
+ListParts：返回已上传的所有part，不分页
+*/
+func (g *s3Gateway) listParts(w http.ResponseWriter, r *http.Request, bucket string, key string)error{
+    dir,err:=g.uploadDir(r,bucket,key)
+    if err!=nil {return err}
+    parts,err:=s3ListParts(dir)
+    if err!=nil {return err}
+    writeXML(w,http.StatusOK,struct{
+        XMLName xml.Name `xml:"ListPartsResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Bucket string
+        Key string
+        UploadId string
+        MaxParts int
+        IsTruncated bool
+        Parts []s3Part `xml:"Part"`
+    }{Xmlns:S3_XMLNS,Bucket:bucket,Key:key,UploadId:r.URL.Query().Get("uploadId"),MaxParts:S3_MAX_PART_NUMBER,Parts:parts})
+    return nil
+}
+
+/*
+ListMultipartUploads：这个bucket所有没有完成的分块上传，不分页
+*/
+func (g *s3Gateway) listUploads(w http.ResponseWriter, r *http.Request, bucket string)error{
+    prefix:=r.URL.Query().Get("prefix")
+    type upload struct{Key string;UploadId string;Initiated string}
+    var uploads []upload
+    dirs,_:=ioutil.ReadDir(tmpPath(S3_MULTIPART_DIR))
+    for _,dir:=range dirs {
+        datas,err:=ioutil.ReadFile(filepath.Join(*tmp_dir,S3_MULTIPART_DIR,dir.Name(),"meta.json"))
+        if err!=nil {continue}
+        var meta s3Upload
+        if json.Unmarshal(datas,&meta)!=nil || meta.Bucket!=bucket || !strings.HasPrefix(meta.Key,prefix) {continue}
+        uploads=append(uploads,upload{meta.Key,dir.Name(),s3Time(meta.Initiated)})
+    }
+    sort.Slice(uploads,func(i,j int)bool{return uploads[i].Key<uploads[j].Key})
+    writeXML(w,http.StatusOK,struct{
+        XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+        Xmlns string `xml:"xmlns,attr"`
+        Bucket string
+        Prefix string
+        MaxUploads int
+        IsTruncated bool
+        Uploads []upload `xml:"Upload"`
+    }{Xmlns:S3_XMLNS,Bucket:bucket,Prefix:prefix,MaxUploads:S3_MAX_KEYS,Uploads:uploads})
+    return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+/*
+S3网关的权限测试：没有完成的分块上传只有bucket的主人可以查看
+*/
+
+import (
+    "errors"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+func TestS3MultipartOwner(t *testing.T){
+    saved_database,saved_tmp,saved_servers:=*database_dir,*tmp_dir,serverList()
+    *database_dir,*tmp_dir=t.TempDir(),t.TempDir()
+    setServerList([]string{"127.0.0.1:1"})
+    defer func(){
+        *database_dir,*tmp_dir=saved_database,saved_tmp
+        setServerList(saved_servers)
+    }()
+    g:=&s3Gateway{clients:newClientPool()}
+    defer g.clients.close()
+    tests:=[]struct{
+        name string
+        url string
+        status int //0表示成功
+    }{
+        {"别人的ListMultipartUploads","/bob?uploads",http.StatusForbidden},
+        {"别人的ListParts","/bob/a.txt?uploadId=0123",http.StatusForbidden},
+        {"自己的ListMultipartUploads","/alice?uploads",0},
+    }
+    for _,test:=range tests {
+        r:=httptest.NewRequest(http.MethodGet,test.url,nil)
+        w:=httptest.NewRecorder()
+        err:=g.serve(w,r,&s3Auth{user:"alice"})
+        var s3_err *s3Error
+        switch {
+            case test.status==0 && err!=nil:
+                t.Errorf("%s：%v",test.name,err)
+            case test.status!=0 && (!errors.As(err,&s3_err) || s3_err.Status!=test.status):
+                t.Errorf("%s：返回%v，期望状态码%d",test.name,err,test.status)
+        }
+    }
+}
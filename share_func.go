@@ -0,0 +1,253 @@
+package main
+
+/*
+本文件包含了分享链接相关的函数（share、unshare命令和网关的分享接口）
+*/
+
+/*
+分享链接：文件的所有者创建分享（随机令牌），可以设置密码、过期时间和最多下载次数，
+分享保存在所有者的数据库中，同步到所有服务器，任何一个网关都能下载：
+    GET    /share/用户名/令牌                   下载分享的文件（不需要认证），支持Range；有密码时浏览器会显示输入密码的页面
+    POST   /share/用户名/令牌                   输入密码的页面提交（表单字段password），返回文件
+    GET    /api/shares                          当前用户的分享列表
+    POST   /api/shares                          新建分享，请求体 {"name":"文件名","password":"","expire":过期秒数,"max_downloads":次数}
+    DELETE /api/shares/令牌                     取消分享
+脚本和下载工具可以用X-Share-Password请求头传递密码（支持断点续传），密码不会出现在URL和访问日志中。
+每个GET和POST在发送前记录要发送的字节数（需要申请所有者的集群锁并同步数据库），按字节数计算下载次数，
+所以断点续传、后缀范围和多个范围的请求都会计入；HEAD不计入。
+*/
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "context"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "html/template"
+    "encoding/json"
+    "dss/client"
+)
+
+var share_password_page=template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="zh-CN"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Name}} - dss分享</title></head>
+<body style="font-family:sans-serif;max-width:420px;margin:80px auto">
+<h2>{{.Name}}</h2>
+{{if .Wrong}}<p style="color:#cf222e">密码错误</p>{{end}}
+<form method="post"><input type="password" name="password" placeholder="请输入分享密码" autofocus> <button type="submit">下载</button></form>
+</body></html>
+`))
+
+/*
+分享链接在网关上的路径
+*/
+func sharePath(user string, token string)string{
+    return "/share/"+url.PathEscape(user)+"/"+token
+}
+
+func shareRecord(s client.Share)ShareRecord{
+    record:=ShareRecord{"share",s.User,s.Name,s.Token,sharePath(s.User,s.Token),s.HasPassword(),0,s.MaxDownloads,s.Downloads,s.Created.Unix()}
+    if !s.Expire.IsZero() {record.Expire=s.Expire.Unix()}
+    return record
+}
+
+/*
+打印一个分享
+*/
+func printShare(s client.Share){
+    if *json_output {
+        emitJSON(shareRecord(s))
+        return
+    }
+    expire:="不过期"
+    if !s.Expire.IsZero() {expire=s.Expire.Format("2006-01-02 15:04:05")}
+    max:="不限"
+    if s.MaxDownloads>0 {max=fmt.Sprint(s.MaxDownloads)}
+    fmt.Println(s.Token,s.Name,"链接：",sharePath(s.User,s.Token),"密码：",s.HasPassword(),"过期时间：",expire,"已下载：",s.Downloads,"/",max)
+}
+
+/*
+分享文件：expire为0时不过期，max_downloads为0时不限下载次数
+*/
+func shareFile(user string, filename string, password string, expire time.Duration, max_downloads int64)error{
+    if expire<0 || max_downloads<0 {return commandError(EXIT_USAGE,errors.New("过期时间和下载次数不能是负数"))}
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    var expire_time time.Time
+    if expire>0 {expire_time=time.Now().Add(expire)}
+    s,err:=c.CreateShare(context.Background(),filename,password,expire_time,max_downloads)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    printShare(s)
+    if !*json_output {fmt.Println("分享成功，在链接前面加上网关的地址（如http://gateway:8080）发给别人即可下载")}
+    return nil
+}
+
+/*
+列出用户的所有分享
+*/
+func listShares(user string)error{
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    shares,err:=c.Shares(context.Background())
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    for _,s:=range shares {printShare(s)}
+    return nil
+}
+
+/*
+取消分享
+*/
+func revokeShare(user string, token string)error{
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    err=c.RevokeShare(context.Background(),token)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    fmt.Println("已取消分享：",token)
+    return nil
+}
+
+/*
+下载分享的文件：先只读检查分享（不存在的用户和令牌不会申请集群锁），GET和POST再记录这次要发送的字节数
+*/
+func (g *gateway) serveShare(w http.ResponseWriter, r *http.Request){
+    start:=time.Now()
+    parts:=strings.Split(strings.TrimPrefix(r.URL.Path,"/share/"),"/")
+    if len(parts)!=2 || client.ValidUser(parts[0])!=nil || parts[1]=="" {
+        writeHTTPError(w,http.StatusNotFound,errors.New("分享不存在"))
+        return
+    }
+    user,token:=parts[0],parts[1]
+    if r.Method!=http.MethodGet && r.Method!=http.MethodHead && r.Method!=http.MethodPost {
+        writeHTTPError(w,http.StatusMethodNotAllowed,errors.New("只支持GET、HEAD和POST"))
+        return
+    }
+    password:=r.Header.Get("X-Share-Password")
+    if r.Method==http.MethodPost {password=r.PostFormValue("password")}
+    c,err:=g.clients.get(user)
+    var s client.Share
+    var info client.FileInfo
+    if err==nil {s,info,err=c.StatShare(r.Context(),token,password)}
+    if err==nil && r.Method!=http.MethodHead {
+        s,info,err=c.UseShare(r.Context(),token,password,shareRequestBytes(r,info))
+    }
+    switch {
+        case errors.Is(err,client.ErrSharePassword):
+            w.Header().Set("Content-Type","text/html; charset=utf-8")
+            w.WriteHeader(http.StatusUnauthorized)
+            share_password_page.Execute(w,map[string]interface{}{"Name":user+"分享的文件","Wrong":password!=""})
+        case errors.Is(err,client.ErrShareExpired):
+            writeHTTPError(w,http.StatusGone,err)
+        case errors.Is(err,client.ErrNotFound):
+            writeHTTPError(w,http.StatusNotFound,errors.New("分享不存在"))
+        case err!=nil:
+            writeHTTPError(w,0,err)
+        default:
+            filename:=info.Name[strings.LastIndex(info.Name,"/")+1:]
+            w.Header().Set("Content-Disposition","attachment; filename*=UTF-8''"+url.PathEscape(filename))
+            g.serveReader(w,r,c,info)
+    }
+    logger:=httpLogger("http",r).With("share",s.Name,"duration",time.Since(start))
+    if err!=nil {logger.Warn("分享下载失败","err",err)}else{logger.Info("分享下载完成")}
+}
+
+/*
+计算一次请求会发送的字节数，和http.ServeContent处理Range的方式一致：
+没有Range、Range格式错误、If-Range和文件修改时间不一致或者文件没有记录大小时发送整个文件；
+多个范围相加（重叠部分重复计算），加起来超过文件大小时ServeContent会发送整个文件
+*/
+func shareRequestBytes(r *http.Request, info client.FileInfo)int64{
+    size:=client.ComputeUsage([]client.FileInfo{info},false).Bytes
+    header:=r.Header.Get("Range")
+    if header=="" || info.Size<0 || !strings.HasPrefix(header,"bytes=") {return size}
+    if if_range:=r.Header.Get("If-Range");if_range!="" {
+        t,err:=http.ParseTime(if_range)
+        if err!=nil || info.ModTime.IsZero() || t.Unix()!=info.ModTime.Unix() {return size}
+    }
+    var total int64
+    ranges:=0
+    for _,spec:=range strings.Split(strings.TrimPrefix(header,"bytes="),",") {
+        spec=strings.TrimSpace(spec)
+        if spec=="" {continue}
+        ranges++
+        i:=strings.IndexByte(spec,'-')
+        if i<0 {return size}
+        start_text,end_text:=strings.TrimSpace(spec[:i]),strings.TrimSpace(spec[i+1:])
+        if start_text=="" {//后缀范围：最后n个字节
+            n,err:=strconv.ParseInt(end_text,10,64)
+            if err!=nil || n<0 {return size}
+            if n>size {n=size}
+            total+=n
+            continue
+        }
+        begin,err:=strconv.ParseInt(start_text,10,64)
+        if err!=nil || begin<0 {return size}
+        end:=size-1
+        if end_text!="" {
+            end,err=strconv.ParseInt(end_text,10,64)
+            if err!=nil || begin>end {return size}
+            if end>=size {end=size-1}
+        }
+        if begin>=size {continue}//不满足的范围，不发送
+        total+=end-begin+1
+    }
+    if ranges==0 || total>size {return size}
+    return total
+}
+
+/*
+分享管理：只能管理自己的分享
+*/
+func (g *gateway) serveShares(w http.ResponseWriter, r *http.Request, user string){
+    c,err:=g.clients.get(user)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    token:=strings.TrimPrefix(strings.TrimPrefix(r.URL.Path,"/api/shares"),"/")
+    switch {
+        case token=="" && r.Method==http.MethodGet:
+            shares,err:=c.Shares(r.Context())
+            if err!=nil && !errors.Is(err,client.ErrNotFound) {
+                writeHTTPError(w,0,err)
+                return
+            }
+            records:=[]ShareRecord{}
+            for _,s:=range shares {records=append(records,shareRecord(s))}
+            writeJSON(w,http.StatusOK,records)
+        case token=="" && r.Method==http.MethodPost:
+            var request struct {
+                Name string `json:"name"`
+                Password string `json:"password"`
+                Expire int64 `json:"expire"` //多少秒后过期，0表示不过期
+                MaxDownloads int64 `json:"max_downloads"`
+            }
+            err:=json.NewDecoder(r.Body).Decode(&request)
+            if err==nil && (request.Expire<0 || request.MaxDownloads<0) {err=errors.New("过期时间和下载次数不能是负数")}
+            if err!=nil {
+                writeHTTPError(w,http.StatusBadRequest,err)
+                return
+            }
+            var expire time.Time
+            if request.Expire>0 {expire=time.Now().Add(time.Duration(request.Expire)*time.Second)}
+            s,err:=c.CreateShare(r.Context(),request.Name,request.Password,expire,request.MaxDownloads)
+            if err!=nil {
+                writeHTTPError(w,0,err)
+                return
+            }
+            writeJSON(w,http.StatusCreated,shareRecord(s))
+        case token!="" && r.Method==http.MethodDelete:
+            err:=c.RevokeShare(r.Context(),token)
+            if err!=nil {
+                writeHTTPError(w,0,err)
+                return
+            }
+            w.WriteHeader(http.StatusNoContent)
+        default:
+            writeHTTPError(w,http.StatusMethodNotAllowed,errors.New("不支持的请求方法："+r.Method))
+    }
+}
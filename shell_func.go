@@ -0,0 +1,201 @@
+package main
+
+/*
+本文件包含了交互式命令行的行编辑相关的函数：参数解析（引号和转义）、命令历史、Tab补全
+*/
+
+/*
+参数解析规则（和常见的shell一致）：
+空白分隔参数；单引号内的内容原样保留；双引号内可以用\"和\\转义；引号外可以用\转义任何字符（比如空格）。
+例如：put "my file.txt"、get yumi 'a b.7z'、del 中文\ 文件.txt
+*/
+
+import (
+    "os"
+    "sort"
+    "errors"
+    "strings"
+    "unicode"
+    "path/filepath"
+    "github.com/peterh/liner"
+)
+
+const SHELL_COMMANDS="help ls login get put del sync update status decommission rebalance exit" //可以补全的命令
+
+type shellArg struct {//解析出来的参数
+    Value string //去掉引号和转义后的内容
+    Start int //在命令行中的起始位置
+    End int //在命令行中的结束位置
+}
+
+/*
+把命令行拆成参数，partial为true时允许引号没有结束（补全时用）
+*/
+func parseArgs(line string, partial bool)([]shellArg,error){
+    var args []shellArg
+    var current []rune
+    var quote rune //当前所在的引号，0表示不在引号内
+    in_arg:=false
+    escaped:=false
+    for i,r:=range line {
+        if !in_arg {
+            if unicode.IsSpace(r) {continue}
+            in_arg=true
+            args=append(args,shellArg{Start:i})
+        }
+        switch {
+            case escaped:
+                current=append(current,r)
+                escaped=false
+            case r=='\\' && quote!='\'':
+                escaped=true
+            case quote!=0 && r==quote:
+                quote=0
+            case quote!=0:
+                current=append(current,r)
+            case r=='"' || r=='\'':
+                quote=r
+            case unicode.IsSpace(r):
+                args[len(args)-1].Value=string(current)
+                args[len(args)-1].End=i
+                current=current[:0]
+                in_arg=false
+            default:
+                current=append(current,r)
+        }
+    }
+    if !partial && (quote!=0 || escaped) {
+        return nil,errors.New("引号或转义没有结束")
+    }
+    if in_arg {
+        args[len(args)-1].Value=string(current)
+        args[len(args)-1].End=len(line)
+    }
+    return args,nil
+}
+
+/*
+把命令行拆成参数
+*/
+func splitArgs(line string)([]string,error){
+    parsed,err:=parseArgs(line,false)
+    if err!=nil {return nil,err}
+    var args []string
+    for _,arg:=range parsed {args=append(args,arg.Value)}
+    return args,nil
+}
+
+/*
+给参数加上引号，使它解析后还是原来的内容（补全时用）
+*/
+func quoteArg(s string)string{
+    if s!="" && !strings.ContainsAny(s," \t\"'\\") {return s}
+    return "'"+strings.Replace(s,"'",`'\''`,-1)+"'"
+}
+
+/*
+新建行编辑器，读取命令历史，设置Tab补全
+*/
+func newLineEditor()*liner.State{
+    state:=liner.NewLiner()
+    state.SetCtrlCAborts(true)
+    state.SetTabCompletionStyle(liner.TabPrints)
+    state.SetWordCompleter(completeLine)
+    if *history_file=="" {return state}
+    if f,err:=os.Open(*history_file);err==nil {
+        state.ReadHistory(f)
+        f.Close()
+    }
+    return state
+}
+
+/*
+保存命令历史并恢复终端
+*/
+func closeLineEditor(state *liner.State){
+    if *history_file!="" {
+        if f,err:=os.Create(*history_file);err==nil {
+            state.WriteHistory(f)
+            f.Close()
+        }
+    }
+    state.Close()
+}
+
+/*
+Tab补全：第一个参数补全命令，其它参数按命令补全用户名、本用户的文件名（来自本地数据库）或本地文件路径
+*/
+func completeLine(line string, pos int)(head string, completions []string, tail string){
+    args,_:=parseArgs(line[:pos],true)
+    word:=""
+    start:=pos
+    if len(args)>0 && args[len(args)-1].End==pos {//光标在最后一个参数上
+        word=args[len(args)-1].Value
+        start=args[len(args)-1].Start
+        args=args[:len(args)-1]
+    }
+    var candidates []string
+    if len(args)==0 {
+        candidates=strings.Fields(SHELL_COMMANDS)
+    }else{
+        switch args[0].Value {
+            case "login":
+                if len(args)==1 {candidates=listUsers()}
+            case "get":
+                if len(args)>1 && args[1].Value=="-r" {args=args[1:]}
+                if len(args)==1 {candidates=append(listUsers(),"-r")}
+                if len(args)==2 {candidates=remoteFileNames(args[1].Value)}
+            case "del":
+                candidates=remoteFileNames(username)
+            case "put":
+                candidates=localFileNames(word)
+                if len(args)==1 {candidates=append(candidates,"-r")}
+            case "sync":
+                candidates=append(localFileNames(word),"-n","-delete")
+            case "ls":
+                if len(args)==1 {candidates=[]string{"-l"}}
+            case "decommission":
+                if len(args)==1 {candidates=append([]string{"status","cancel"},serverList()...)}
+                if len(args)==2 {candidates=serverList()}
+        }
+    }
+    for _,candidate:=range candidates {
+        if strings.HasPrefix(candidate,word) {completions=append(completions,quoteArg(candidate))}
+    }
+    sort.Strings(completions)
+    return line[:start],completions,line[pos:]
+}
+
+/*
+用户的文件名，来自本地数据库
+*/
+func remoteFileNames(user string)[]string{
+    if !isPathExists(dbPath(user)) {return nil}
+    acquireGlobalLock()
+    defer releaseGlobalLock()
+    files,err:=queryFiles(user)
+    if err!=nil {return nil}
+    var names []string
+    for _,file:=range files {names=append(names,file.Name)}
+    return names
+}
+
+/*
+本地文件路径，文件夹后面加上路径分隔符
+*/
+func localFileNames(prefix string)[]string{
+    matches,_:=filepath.Glob(escapeGlob(prefix)+"*")
+    for i,match:=range matches {
+        if info,err:=os.Stat(match);err==nil && info.IsDir() {matches[i]=match+string(filepath.Separator)}
+    }
+    return matches
+}
+
+/*
+转义glob的特殊字符，文件名中的*、?、[不会被当成通配符
+*/
+func escapeGlob(s string)string{
+    if filepath.Separator=='\\' {return s}//Windows的路径分隔符就是反斜杠，不支持转义
+    replacer:=strings.NewReplacer(`*`,`\*`,`?`,`\?`,`[`,`\[`,`\`,`\\`)
+    return replacer.Replace(s)
+}
@@ -0,0 +1,51 @@
+package main
+
+/*
+命令行参数解析的测试
+*/
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestSplitArgs(t *testing.T){
+    tests:=[]struct{
+        line string
+        expect []string //为nil时应该解析出错
+    }{
+        {``,[]string{}},
+        {`   `,[]string{}},
+        {`ls`,[]string{"ls"}},
+        {`  get   yumi  a.7z  `,[]string{"get","yumi","a.7z"}},
+        {`put "my file.txt"`,[]string{"put","my file.txt"}},
+        {`get yumi 'a b.7z'`,[]string{"get","yumi","a b.7z"}},
+        {`del 中文\ 文件.txt`,[]string{"del","中文 文件.txt"}},
+        {`put "a \"b\" \\c"`,[]string{"put",`a "b" \c`}},
+        {`put 'a\b'`,[]string{"put",`a\b`}},//单引号内不转义
+        {`put a"b c"d`,[]string{"put","ab cd"}},//引号可以在参数中间
+        {`put "" x`,[]string{"put","","x"}},
+        {`put "abc`,nil},
+        {`put 'abc`,nil},
+        {`put abc\`,nil},
+    }
+    for _,test:=range tests {
+        args,err:=splitArgs(test.line)
+        if test.expect==nil {
+            if err==nil {t.Errorf("%q：应该出错，解析为%q",test.line,args)}
+            continue
+        }
+        if err!=nil {
+            t.Errorf("%q：%v",test.line,err)
+            continue
+        }
+        if fmt.Sprintf("%q",args)!=fmt.Sprintf("%q",test.expect) {t.Errorf("%q：解析为%q，期望%q",test.line,args,test.expect)}
+    }
+}
+
+func TestQuoteArg(t *testing.T){
+    for _,arg:=range []string{"a.txt","","my file.txt","it's",`a"b`,`a\b`,"中文\t文件"} {
+        args,err:=splitArgs("get "+quoteArg(arg))
+        if err!=nil || len(args)!=2 || args[1]!=arg {t.Errorf("%q：加引号后解析为%q，%v",arg,args,err)}
+    }
+}
@@ -0,0 +1,378 @@
+package main
+
+/*
+本文件包含了双向同步文件夹相关的函数（sync命令）
+*/
+
+/*
+同步原理：
+本地文件夹对应服务器上以“远程文件夹/”开头的文件（和put -r、get -r一样，文件名中带相对路径）。
+每次同步成功后，在本地文件夹的SYNC_STATE_FILE中记录每个文件的大小、修改时间和文件块key，
+下次同步时和记录比较，就能知道是哪一边修改、新建或删除了文件：
+    本地大小和修改时间都没变的，认为没有修改（不需要重新计算hash）；变了的重新计算文件块key，key没变也认为没有修改
+    服务器上的文件直接比较文件块key
+    两边都有：内容相同则跳过；只有一边修改了就从这边传到另一边；两边都修改了（冲突）以修改时间新的为准，
+              本地被覆盖时先把本地文件改名为“文件名.conflict”保留
+    只有一边有：上次同步过（记录中有），说明另一边删除了，按删除策略删除这一边，不允许删除时重新传过去；
+                上次没有同步过，说明是新文件，传到另一边
+删除策略（-delete）：none不删除任何文件（默认），local允许删除本地文件，remote允许删除服务器上的文件，both都允许。
+上传时服务器上已有的文件块不会重新上传，下载时本地旧文件中已有的文件块直接复制，不会重新下载；
+所有上传和服务器上的删除最后一次性写入数据库，只同步一次。-n只输出要做的操作，不实际执行。
+*/
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "errors"
+    "context"
+    "strings"
+    "io/fs"
+    "path/filepath"
+    "encoding/json"
+    "io/ioutil"
+    "dss/client"
+)
+
+const SYNC_STATE_FILE=".dss-sync.json" //同步记录文件，放在本地文件夹中，不会被同步
+
+const ( //同步操作
+    SYNC_UPLOAD = "upload" //上传到服务器
+    SYNC_DOWNLOAD = "download" //下载到本地
+    SYNC_DELETE_LOCAL = "delete-local" //删除本地文件
+    SYNC_DELETE_REMOTE = "delete-remote" //删除服务器上的文件
+)
+
+type SyncState struct {//同步记录
+    User string
+    Remote string
+    Files map[string]SyncFileState //相对路径（用/分隔） -> 上次同步时的状态
+}
+
+type SyncFileState struct {//上次同步时文件的状态
+    Size int64
+    Mtime int64 //本地文件的修改时间（UnixNano）
+    Keys []string //文件块key
+}
+
+type syncAction struct {//一个同步操作
+    Action string
+    Path string //相对路径（用/分隔）
+    Conflict bool //两边都修改了
+    Reason string //给人看的原因
+    remote client.FileInfo //服务器上的文件（下载时用）
+}
+
+/*
+判断删除策略是否允许删除某一边（side为local或remote）的文件
+*/
+func syncAllowDelete(policy string, side string)bool{
+    return policy=="both" || policy==side
+}
+
+/*
+判断两个key列表是否相同
+*/
+func sameKeys(a []string, b []string)bool{
+    if len(a)!=len(b) {return false}
+    for i:=range a {
+        if a[i]!=b[i] {return false}
+    }
+    return true
+}
+
+/*
+读取同步记录，不存在或者不是这个用户、远程文件夹的记录时返回空记录
+*/
+func readSyncState(local string, user string, remote string)SyncState{
+    state:=SyncState{User:user,Remote:remote,Files:map[string]SyncFileState{}}
+    datas,err:=ioutil.ReadFile(filepath.Join(local,SYNC_STATE_FILE))
+    if err!=nil {return state}
+    var saved SyncState
+    if json.Unmarshal(datas,&saved)!=nil || saved.User!=user || saved.Remote!=remote || saved.Files==nil {
+        return state
+    }
+    return saved
+}
+
+/*
+保存同步记录（先写临时文件再改名）
+*/
+func writeSyncState(local string, state SyncState)error{
+    datas,err:=json.MarshalIndent(state,"","  ")
+    if err!=nil {return err}
+    path:=filepath.Join(local,SYNC_STATE_FILE)
+    err=ioutil.WriteFile(path+".tmp",datas,0644)
+    if err!=nil {return err}
+    return os.Rename(path+".tmp",path)
+}
+
+/*
+按分块大小block_size计算本地文件的文件块key
+*/
+func localChunkKeys(path string, block_size int64)([]string,error){
+    f,err:=os.Open(path)
+    if err!=nil {return nil,err}
+    defer f.Close()
+    return client.ChunkKeys(f,block_size)
+}
+
+/*
+同步、监视时跳过的本地文件：同步记录、上传队列和下载中的临时文件
+*/
+func skipLocalFile(name string)bool{
+    for _,file:=range []string{SYNC_STATE_FILE,WATCH_QUEUE_FILE} {
+        if name==file || name==file+".tmp" {return true}
+    }
+    return strings.HasSuffix(name,".dss-part")
+}
+
+/*
+扫描本地文件夹，返回 相对路径 -> 文件信息（跳过skipLocalFile的文件和非普通文件）
+*/
+func scanLocalTree(local string)(map[string]os.FileInfo,error){
+    files:=map[string]os.FileInfo{}
+    err:=filepath.WalkDir(local,func(path string, d fs.DirEntry, err error)error{
+        if err!=nil {return err}
+        if !d.Type().IsRegular() {return nil}
+        if skipLocalFile(d.Name()) {return nil}
+        rel,err:=filepath.Rel(local,path)
+        if err!=nil {return err}
+        info,err:=d.Info()
+        if err!=nil {return err}
+        files[filepath.ToSlash(rel)]=info
+        return nil
+    })
+    return files,err
+}
+
+/*
+比较两边和同步记录，计算要做的操作。keys返回本地文件的文件块key（计算过的）
+*/
+func planSync(local string, local_files map[string]os.FileInfo, remote_files map[string]client.FileInfo, state SyncState, policy string)([]syncAction,map[string][]string,error){
+    var actions []syncAction
+    keys:=map[string][]string{}
+    paths:=map[string]bool{}
+    for path:=range local_files {paths[path]=true}
+    for path:=range remote_files {paths[path]=true}
+    var sorted []string
+    for path:=range paths {sorted=append(sorted,path)}
+    sort.Strings(sorted)
+    for _,path:=range sorted {
+        info,local_exist:=local_files[path]
+        remote,remote_exist:=remote_files[path]
+        last,synced:=state.Files[path]
+        var remote_keys []string
+        for _,chunk:=range remote.Chunks {remote_keys=append(remote_keys,chunk.Key)}
+        //本地文件的key：大小和修改时间没变的直接用记录中的
+        if local_exist {
+            if synced && info.Size()==last.Size && info.ModTime().UnixNano()==last.Mtime {
+                keys[path]=last.Keys
+            }else{
+                size:=block_size //服务器上有这个文件时按它的分块大小计算，才能比较
+                if remote_exist {size=remote.ChunkBytes()}
+                k,err:=localChunkKeys(filepath.Join(local,filepath.FromSlash(path)),size)
+                if err!=nil {return nil,nil,err}
+                keys[path]=k
+            }
+        }
+        local_changed:=!synced || !sameKeys(keys[path],last.Keys)
+        remote_changed:=!synced || !sameKeys(remote_keys,last.Keys)
+        switch {
+            case local_exist && remote_exist:
+                switch {
+                    case sameKeys(keys[path],remote_keys):
+                        //内容相同
+                    case local_changed && !remote_changed:
+                        actions=append(actions,syncAction{Action:SYNC_UPLOAD,Path:path,Reason:"本地修改"})
+                    case remote_changed && !local_changed:
+                        actions=append(actions,syncAction{Action:SYNC_DOWNLOAD,Path:path,Reason:"服务器修改",remote:remote})
+                    case info.ModTime().After(remote.ModTime)://两边都修改了，以新的为准
+                        actions=append(actions,syncAction{Action:SYNC_UPLOAD,Path:path,Conflict:true,Reason:"两边都修改了，本地较新"})
+                    default:
+                        actions=append(actions,syncAction{Action:SYNC_DOWNLOAD,Path:path,Conflict:true,Reason:"两边都修改了，服务器较新",remote:remote})
+                }
+            case local_exist:
+                if synced && !local_changed && syncAllowDelete(policy,"local") {
+                    actions=append(actions,syncAction{Action:SYNC_DELETE_LOCAL,Path:path,Reason:"服务器上已删除"})
+                }else if synced && !local_changed {
+                    actions=append(actions,syncAction{Action:SYNC_UPLOAD,Path:path,Reason:"服务器上已删除，删除策略不允许删除本地文件"})
+                }else{
+                    actions=append(actions,syncAction{Action:SYNC_UPLOAD,Path:path,Reason:"本地新文件"})
+                }
+            case remote_exist:
+                if synced && !remote_changed && syncAllowDelete(policy,"remote") {
+                    actions=append(actions,syncAction{Action:SYNC_DELETE_REMOTE,Path:path,Reason:"本地已删除"})
+                }else if synced && !remote_changed {
+                    actions=append(actions,syncAction{Action:SYNC_DOWNLOAD,Path:path,Reason:"本地已删除，删除策略不允许删除服务器上的文件",remote:remote})
+                }else{
+                    actions=append(actions,syncAction{Action:SYNC_DOWNLOAD,Path:path,Reason:"服务器新文件",remote:remote})
+                }
+        }
+    }
+    return actions,keys,nil
+}
+
+/*
+下载服务器上的文件，本地旧文件中key相同的文件块直接复制，先写临时文件，完成后改名
+*/
+func syncDownload(ctx context.Context, c *client.Client, file client.FileInfo, path string, old_keys []string, conflict bool)error{
+    tmp:=path+".dss-part"
+    err:=os.MkdirAll(filepath.Dir(path),0755)
+    if err!=nil {return err}
+    f,err:=os.Create(tmp)
+    if err!=nil {return err}
+    old,_:=os.Open(path)
+    offsets:=map[string]int64{} //key -> 在本地旧文件中的位置
+    size:=file.ChunkBytes() //old_keys是按服务器上的文件的分块大小计算的
+    for i,key:=range old_keys {offsets[key]=int64(i)*size}
+    err=c.DownloadMissing(ctx,file,f,func(i int, key string)bool{
+        offset,exist:=offsets[key]
+        if old==nil || !exist {return false}
+        _,err:=io.Copy(io.NewOffsetWriter(f,int64(i)*size),io.NewSectionReader(old,offset,size))
+        return err==nil
+    })
+    if old!=nil {old.Close()}
+    if cerr:=f.Close();err==nil {err=cerr}
+    if err==nil && conflict {err=os.Rename(path,path+".conflict")}//保留被覆盖的本地文件
+    if err==nil {err=os.Rename(tmp,path)}
+    if err!=nil {
+        os.Remove(tmp)
+        return err
+    }
+    if !file.ModTime.IsZero() {os.Chtimes(path,file.ModTime,file.ModTime)}
+    return nil
+}
+
+/*
+双向同步本地文件夹和服务器上的文件夹
+*/
+func syncTree(user string, local string, remote_dir string, policy string, dry_run bool)error{
+    if user=="" || user=="Anonymous" {
+        return commandError(EXIT_USAGE,errors.New("请先登录"))
+    }
+    switch policy {
+        case "none","local","remote","both":
+        default:
+            return commandError(EXIT_USAGE,errors.New("删除策略只能是none、local、remote或both："+policy))
+    }
+    remote_dir=strings.Trim(remote_dir,"/")
+    if remote_dir=="" {return commandError(EXIT_USAGE,errors.New("请指定服务器上的文件夹"))}
+    prefix:=remote_dir+"/"
+    if info,err:=os.Stat(local);err!=nil || !info.IsDir() {
+        return commandError(EXIT_NOT_FOUND,errors.New("本地文件夹不存在："+local))
+    }
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    ctx:=context.Background()
+    //取得两边的文件列表
+    all_files,err:=c.List(ctx)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    remote_files:=map[string]client.FileInfo{}
+    for _,file:=range all_files {
+        if !strings.HasPrefix(file.Name,prefix) {continue}
+        path:=file.Name[len(prefix):]
+        if !filepath.IsLocal(filepath.FromSlash(path)) {
+            fmt.Println("[WARN]文件名不安全，跳过：",file.Name)
+            continue
+        }
+        remote_files[path]=file
+    }
+    local_files,err:=scanLocalTree(local)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    state:=readSyncState(local,user,remote_dir)
+    actions,keys,err:=planSync(local,local_files,remote_files,state,policy)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    for _,action:=range actions {
+        if *json_output {
+            emitJSON(SyncRecord{"sync",action.Action,action.Path,action.Conflict,action.Reason,dry_run})
+            continue
+        }
+        fmt.Println(action.Action,action.Path,"（"+action.Reason+"）")
+    }
+    if dry_run {
+        fmt.Println("共",len(actions),"个操作（-n：没有实际执行）")
+        return nil
+    }
+    //执行：上传和下载并行，服务器上的删除最后和上传一起写入数据库
+    var uploaded []client.FileInfo
+    var removed []string
+    var lock sync.Mutex
+    done:=map[string]bool{} //成功的操作
+    op_err:=parallelDo(TREE_PARALLEL,len(actions),func(i int)error{
+        action:=actions[i]
+        path:=filepath.Join(local,filepath.FromSlash(action.Path))
+        var err error
+        switch action.Action {
+            case SYNC_UPLOAD:
+                var f *os.File
+                f,err=os.Open(path)
+                if err!=nil {return commandError(EXIT_IO,err)}
+                defer f.Close()
+                var file client.FileInfo
+                file,err=c.Upload(ctx,prefix+action.Path,f,local_files[action.Path].ModTime())
+                if err==nil {
+                    lock.Lock()
+                    uploaded=append(uploaded,file)
+                    lock.Unlock()
+                }
+            case SYNC_DOWNLOAD:
+                err=syncDownload(ctx,c,action.remote,path,keys[action.Path],action.Conflict)
+            case SYNC_DELETE_LOCAL:
+                err=os.Remove(path)
+            case SYNC_DELETE_REMOTE:
+                lock.Lock()
+                removed=append(removed,prefix+action.Path)
+                lock.Unlock()
+                return nil
+        }
+        if err!=nil {
+            fmt.Println("[ERROR]",action.Action,action.Path,err)
+            return clientError(err,EXIT_NETWORK)
+        }
+        lock.Lock()
+        done[action.Path]=true
+        lock.Unlock()
+        return nil
+    })
+    commit_err:=c.Commit(ctx,uploaded,removed)
+    if commit_err==nil {
+        for _,file:=range uploaded {done[file.Name[len(prefix):]]=true}
+        for _,name:=range removed {done[name[len(prefix):]]=true}
+    }else{
+        fmt.Println("[ERROR]数据库更新失败：",commit_err)
+        for _,file:=range uploaded {delete(done,file.Name[len(prefix):])}
+    }
+    //更新同步记录：成功的操作和本来就相同的文件记录当前状态，失败的保留上次的记录，下次重试
+    acted:=map[string]string{}
+    for _,action:=range actions {acted[action.Path]=action.Action}
+    new_state:=SyncState{User:user,Remote:remote_dir,Files:map[string]SyncFileState{}}
+    for path:=range local_files {
+        if _,exist:=acted[path];!exist {
+            new_state.Files[path]=SyncFileState{local_files[path].Size(),local_files[path].ModTime().UnixNano(),keys[path]}
+        }
+    }
+    for path,action:=range acted {
+        if !done[path] {
+            if last,exist:=state.Files[path];exist {new_state.Files[path]=last}
+            continue
+        }
+        if action==SYNC_DELETE_LOCAL || action==SYNC_DELETE_REMOTE {continue}
+        info,err:=os.Stat(filepath.Join(local,filepath.FromSlash(path)))
+        if err!=nil {continue}
+        file_keys:=keys[path]
+        if action==SYNC_DOWNLOAD {
+            file_keys=nil
+            for _,chunk:=range remote_files[path].Chunks {file_keys=append(file_keys,chunk.Key)}
+        }
+        new_state.Files[path]=SyncFileState{info.Size(),info.ModTime().UnixNano(),file_keys}
+    }
+    err=writeSyncState(local,new_state)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    fmt.Println("同步完毕：",len(done),"个操作成功，",len(actions)-len(done),"个失败")
+    if commit_err!=nil {return clientError(commit_err,EXIT_SYNC)}
+    return op_err
+}
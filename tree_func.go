@@ -0,0 +1,209 @@
+package main
+
+/*
+本文件包含了递归上传、下载文件夹相关的函数（put -r、get -r）
+*/
+
+/*
+文件夹在服务器上没有单独的记录，文件名中带上相对路径（用/分隔）就表示了文件夹结构：
+put -r photos 会把 photos/2019/1.jpg 上传为文件名 “photos/2019/1.jpg”，
+get -r yumi photos 会下载所有以 “photos/” 开头的文件，保存到 download/photos/2019/1.jpg（下载文件夹由-download_dir指定）。
+文件块的key相同的文件（服务器上已有的、本地已经下载过的）会跳过。
+上传时所有文件的文件块都传完之后才一次性写入数据库，只需要申请一次集群锁、同步一次数据库。
+*/
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "io/fs"
+    "path/filepath"
+    "dss/client"
+)
+
+const TREE_PARALLEL=4 //递归上传下载时同时传输的文件数量
+
+/*
+用n个协程并行执行f(0)到f(count-1)，某个任务出错时其它任务继续执行，返回第一个错误
+*/
+func parallelDo(n int, count int, f func(i int)error)error{
+    var first_err error
+    var lock sync.Mutex
+    var wg sync.WaitGroup
+    jobs:=make(chan int)
+    for w:=0;w<n;w++ {
+        wg.Add(1)
+        go func(){
+            defer wg.Done()
+            for i:=range jobs {
+                err:=f(i)
+                if err==nil {continue}
+                lock.Lock()
+                if first_err==nil {first_err=err}
+                lock.Unlock()
+            }
+        }()
+    }
+    for i:=0;i<count;i++ {jobs<-i}
+    close(jobs)
+    wg.Wait()
+    return first_err
+}
+
+/*
+递归上传文件夹：
+遍历文件夹下的所有普通文件，文件名为“文件夹名/相对路径”，
+服务器上已有同名文件且文件块相同的跳过，其它文件并行上传文件块，
+最后把上传成功的文件一次性写入数据库（有文件上传失败时也会写入成功的部分）
+*/
+func putTree(user string, dir string)error{
+    if user=="" || user=="Anonymous" {
+        return commandError(EXIT_USAGE,errors.New("请先登录"))
+    }
+    info,err:=os.Stat(dir)
+    if err!=nil {return commandError(EXIT_NOT_FOUND,err)}
+    if !info.IsDir() {return putFile(user,dir)}
+    dir=filepath.Clean(dir)
+    base:=filepath.Base(dir)
+    if base=="." || base==".." || base==string(filepath.Separator) {
+        abs,err:=filepath.Abs(dir)
+        if err!=nil {return commandError(EXIT_IO,err)}
+        base=filepath.Base(abs)
+    }
+    //遍历文件夹
+    var paths,names []string
+    err=filepath.WalkDir(dir,func(path string, d fs.DirEntry, err error)error{
+        if err!=nil {return err}
+        if !d.Type().IsRegular() {return nil}//跳过文件夹、符号链接等
+        rel,err:=filepath.Rel(dir,path)
+        if err!=nil {return err}
+        paths=append(paths,path)
+        names=append(names,base+"/"+filepath.ToSlash(rel))
+        return nil
+    })
+    if err!=nil {return commandError(EXIT_IO,err)}
+    fmt.Println("文件夹：",dir,"文件数量：",len(paths))
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    ctx:=context.Background()
+    remote_files,err:=c.List(ctx)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    remote:=map[string]client.FileInfo{}
+    for _,file:=range remote_files {remote[file.Name]=file}
+    //并行上传文件块
+    var uploaded []client.FileInfo
+    var lock sync.Mutex
+    skipped:=0
+    upload_err:=parallelDo(TREE_PARALLEL,len(paths),func(i int)error{
+        f,err:=os.Open(paths[i])
+        if err!=nil {return commandError(EXIT_IO,err)}
+        defer f.Close()
+        stat,err:=f.Stat()
+        if err!=nil {return commandError(EXIT_IO,err)}
+        if file,exist:=remote[names[i]];exist {
+            keys,err:=client.ChunkKeys(f,file.ChunkBytes())
+            if err!=nil {return commandError(EXIT_IO,err)}
+            if file.SameChunks(keys) {
+                slog.Info("文件没有变化，跳过","name",names[i])
+                lock.Lock()
+                skipped++
+                lock.Unlock()
+                return nil
+            }
+            _,err=f.Seek(0,0)
+            if err!=nil {return commandError(EXIT_IO,err)}
+        }
+        fmt.Println("上传文件：",names[i])
+        file,err:=c.Upload(ctx,names[i],f,stat.ModTime())
+        if err!=nil {
+            fmt.Println("[ERROR]文件上传失败：",names[i],err)
+            return clientError(err,EXIT_NETWORK)
+        }
+        lock.Lock()
+        uploaded=append(uploaded,file)
+        lock.Unlock()
+        return nil
+    })
+    //一次性写入数据库
+    if len(uploaded)>0 {
+        fmt.Println("准备写入数据库……")
+        err=c.Commit(ctx,uploaded,nil)
+        if err!=nil {return clientError(err,EXIT_SYNC)}
+        fmt.Println("数据库更新成功。")
+    }
+    fmt.Println("上传完毕：上传",len(uploaded),"个文件，跳过",skipped,"个没有变化的文件，失败",len(paths)-len(uploaded)-skipped,"个文件")
+    return upload_err
+}
+
+/*
+递归下载文件夹：
+下载用户所有以“remote_dir/”开头的文件，按相对路径保存到output文件夹（默认为-download_dir），
+本地已有且文件块相同的文件跳过，文件先下载到临时文件，完成后再改名，不会破坏本地已有的文件
+*/
+func getTree(user string, remote_dir string, output string)error{
+    prefix:=strings.Trim(remote_dir,"/")+"/"
+    if prefix=="/" {prefix=""}//空文件夹名表示所有文件
+    if output=="" {output=*download_dir}
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    ctx:=context.Background()
+    all_files,err:=c.List(ctx)
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    var files []client.FileInfo
+    for _,file:=range all_files {
+        if strings.HasPrefix(file.Name,prefix) {files=append(files,file)}
+    }
+    if len(files)==0 {
+        return commandError(EXIT_NOT_FOUND,errors.New("文件夹不存在或为空："+remote_dir))
+    }
+    fmt.Println("文件夹：",remote_dir,"文件数量：",len(files))
+    var lock sync.Mutex
+    downloaded,skipped:=0,0
+    download_err:=parallelDo(TREE_PARALLEL,len(files),func(i int)error{
+        file:=files[i]
+        rel:=filepath.FromSlash(file.Name)
+        if !filepath.IsLocal(rel) {//文件名不能跳出输出文件夹
+            fmt.Println("[ERROR]文件名不安全，跳过：",file.Name)
+            return commandError(EXIT_ERROR,errors.New("文件名不安全："+file.Name))
+        }
+        local:=filepath.Join(output,rel)
+        if f,err:=os.Open(local);err==nil {
+            keys,err:=client.ChunkKeys(f,file.ChunkBytes())
+            f.Close()
+            if err==nil && file.SameChunks(keys) {
+                slog.Info("文件没有变化，跳过","path",local)
+                lock.Lock()
+                skipped++
+                lock.Unlock()
+                return nil
+            }
+        }
+        err:=os.MkdirAll(filepath.Dir(local),0755)
+        if err!=nil {return commandError(EXIT_IO,err)}
+        fmt.Println("下载文件：",file.Name)
+        tmp:=local+".dss-part"
+        f,err:=os.Create(tmp)
+        if err!=nil {return commandError(EXIT_IO,err)}
+        err=c.Download(ctx,file,f)
+        if cerr:=f.Close();err==nil {err=cerr}
+        if err==nil {err=os.Rename(tmp,local)}
+        if err!=nil {
+            os.Remove(tmp)
+            fmt.Println("[ERROR]文件下载失败：",file.Name,err)
+            return clientError(err,EXIT_NETWORK)
+        }
+        if !file.ModTime.IsZero() {os.Chtimes(local,file.ModTime,file.ModTime)}
+        lock.Lock()
+        downloaded++
+        lock.Unlock()
+        return nil
+    })
+    fmt.Println("下载完毕：下载",downloaded,"个文件，跳过",skipped,"个没有变化的文件，失败",len(files)-downloaded-skipped,"个文件")
+    return download_err
+}
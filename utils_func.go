@@ -55,15 +55,6 @@ func hashBytes(b []byte) []byte {
     return h.Sum(nil) //长度20Byte
 }
 
-/*
-当verbose参数为true时，打印日志
-*/
-func log(v ... interface{}){
-    if *verbose {
-        fmt.Println(v...)
-    }
-}
-
 /*
 判断目录或文件是否存在
 */
@@ -106,3 +97,13 @@ func RemoveDuplicatesAndEmpty(a []string) (ret []string){
     }
     return
 }
+
+/*
+判断字符串数组是否包含某个字符串
+*/
+func containsString(list []string, s string)bool{
+    for _,item:=range list {
+        if item==s {return true}
+    }
+    return false
+}
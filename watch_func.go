@@ -0,0 +1,321 @@
+package main
+
+/*
+本文件包含了监视文件夹、自动上传相关的函数（watch命令）
+*/
+
+/*
+监视原理：
+用inotify（fsnotify）监视本地文件夹和所有子文件夹，新建的子文件夹会自动加入监视。
+文件新建或修改后加入上传队列，每秒检查一次队列中文件的大小和修改时间，
+超过WATCH_STABLE_TIME没有变化才认为文件已经写完（稳定），开始上传，避免上传写了一半的文件。
+上传时服务器上已有的文件块不会重新上传；一批文件上传完之后一次性写入数据库，只同步一次。
+上传失败的文件按指数退避重试（WATCH_RETRY_MIN、2倍、4倍……最多WATCH_RETRY_MAX）。
+上传队列保存在本地文件夹的WATCH_QUEUE_FILE中，程序重启后继续上传；
+启动时还会扫描整个文件夹，把服务器上没有或者内容不同的文件加入队列（停止期间新建、修改的文件也会上传）。
+本地删除的文件不会删除服务器上的文件（需要双向同步请使用sync命令）。
+*/
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "syscall"
+    "io/fs"
+    "io/ioutil"
+    "os/signal"
+    "path/filepath"
+    "encoding/json"
+    "dss/client"
+    "github.com/fsnotify/fsnotify"
+)
+
+const WATCH_QUEUE_FILE=".dss-watch.json" //上传队列文件，放在本地文件夹中，不会被上传
+const WATCH_STABLE_TIME=5*time.Second //文件多久没有变化才上传
+const WATCH_CHECK_INTERVAL=time.Second //检查队列的间隔
+const WATCH_RETRY_MIN=5*time.Second //上传失败后第一次重试的等待时间
+const WATCH_RETRY_MAX=10*time.Minute //上传失败后重试的最长等待时间
+
+type WatchQueue struct {//上传队列
+    User string
+    Remote string
+    Files map[string]*WatchItem //相对路径（用/分隔） -> 等待上传的文件
+}
+
+type WatchItem struct {//等待上传的文件
+    Size int64 //最后一次检查时的大小
+    Mtime int64 //最后一次检查时的修改时间（UnixNano）
+    Changed int64 //最后一次发现变化的时间（UnixNano）
+    Attempts int //失败次数
+    NextTry int64 //下次重试的时间（UnixNano），0表示不需要等待
+    LastError string `json:",omitempty"` //最后一次失败的原因
+}
+
+type watchResult struct {//一批文件的上传结果
+    Changed map[string]int64 //开始上传时文件的Changed
+    Errors map[string]error //上传失败的文件，nil表示成功
+}
+
+/*
+读取上传队列，不存在或者不是这个用户、远程文件夹的队列时返回空队列
+*/
+func readWatchQueue(local string, user string, remote string)*WatchQueue{
+    queue:=&WatchQueue{User:user,Remote:remote,Files:map[string]*WatchItem{}}
+    datas,err:=ioutil.ReadFile(filepath.Join(local,WATCH_QUEUE_FILE))
+    if err!=nil {return queue}
+    var saved WatchQueue
+    if json.Unmarshal(datas,&saved)!=nil || saved.User!=user || saved.Remote!=remote || saved.Files==nil {
+        return queue
+    }
+    return &saved
+}
+
+/*
+保存上传队列（先写临时文件再改名）
+*/
+func writeWatchQueue(local string, queue *WatchQueue){
+    datas,err:=json.MarshalIndent(queue,"","  ")
+    if err!=nil {return}
+    path:=filepath.Join(local,WATCH_QUEUE_FILE)
+    err=ioutil.WriteFile(path+".tmp",datas,0644)
+    if err==nil {err=os.Rename(path+".tmp",path)}
+    if err!=nil {fmt.Println("[WARNING]保存上传队列失败：",err)}
+}
+
+/*
+失败n次后的重试等待时间
+*/
+func watchBackoff(attempts int)time.Duration{
+    wait:=WATCH_RETRY_MIN
+    for i:=1;i<attempts && wait<WATCH_RETRY_MAX;i++ {wait*=2}
+    if wait>WATCH_RETRY_MAX {wait=WATCH_RETRY_MAX}
+    return wait
+}
+
+/*
+把文件夹和所有子文件夹加入监视
+*/
+func watchTree(watcher *fsnotify.Watcher, dir string)error{
+    return filepath.WalkDir(dir,func(path string, d fs.DirEntry, err error)error{
+        if err!=nil {return err}
+        if !d.IsDir() {return nil}
+        return watcher.Add(path)
+    })
+}
+
+/*
+文件加入上传队列（已经在队列中的重新开始计算稳定时间）
+*/
+func enqueueWatchFile(queue *WatchQueue, rel string, info os.FileInfo){
+    item,exist:=queue.Files[rel]
+    if !exist {
+        item=&WatchItem{}
+        queue.Files[rel]=item
+        slog.Info("加入上传队列","path",rel)
+    }
+    item.Size=info.Size()
+    item.Mtime=info.ModTime().UnixNano()
+    item.Changed=time.Now().UnixNano()
+}
+
+/*
+扫描文件夹，把服务器上没有或者内容不同的文件加入上传队列
+*/
+func scanWatchTree(c *client.Client, local string, dir string, remote string, queue *WatchQueue)error{
+    remote_files,err:=c.List(context.Background())
+    if err!=nil {return clientError(err,EXIT_NETWORK)}
+    uploaded:=map[string]client.FileInfo{}
+    for _,file:=range remote_files {uploaded[file.Name]=file}
+    return filepath.WalkDir(dir,func(path string, d fs.DirEntry, err error)error{
+        if err!=nil {return err}
+        if !d.Type().IsRegular() || skipLocalFile(d.Name()) {return nil}
+        rel,err:=filepath.Rel(local,path)
+        if err!=nil {return err}
+        rel=filepath.ToSlash(rel)
+        info,err:=d.Info()
+        if err!=nil {return nil}//扫描过程中被删除了
+        if file,exist:=uploaded[remote+"/"+rel];exist {
+            if file.Size==info.Size() && file.ModTime.Unix()==info.ModTime().Unix() {return nil}
+            keys,err:=localChunkKeys(path,file.ChunkBytes())
+            if err==nil && file.SameChunks(keys) {return nil}
+        }
+        enqueueWatchFile(queue,rel,info)
+        return nil
+    })
+}
+
+/*
+上传一批文件，所有文件块上传完之后一次性写入数据库。
+files为相对路径 -> 开始上传时的文件状态，上传过程中文件变化了的不写入数据库，留在队列中等下次上传
+*/
+func uploadWatchFiles(ctx context.Context, c *client.Client, local string, remote string, files map[string]WatchItem)map[string]error{
+    var rels []string
+    for rel:=range files {rels=append(rels,rel)}
+    errs:=map[string]error{}
+    var uploaded []client.FileInfo
+    var lock sync.Mutex
+    parallelDo(TREE_PARALLEL,len(rels),func(i int)error{
+        rel:=rels[i]
+        item:=files[rel]
+        name:=remote+"/"+rel
+        err:=func()error{
+            f,err:=os.Open(filepath.Join(local,filepath.FromSlash(rel)))
+            if err!=nil {return err}
+            defer f.Close()
+            fmt.Println("上传文件：",name)
+            file,err:=c.Upload(ctx,name,f,time.Unix(0,item.Mtime))
+            if err!=nil {return err}
+            stat,err:=f.Stat()
+            if err!=nil {return err}
+            if stat.Size()!=item.Size || stat.ModTime().UnixNano()!=item.Mtime {
+                return errors.New("上传过程中文件被修改了")
+            }
+            lock.Lock()
+            uploaded=append(uploaded,file)
+            lock.Unlock()
+            return nil
+        }()
+        lock.Lock()
+        errs[rel]=err
+        lock.Unlock()
+        return err
+    })
+    if len(uploaded)==0 {return errs}
+    err:=c.Commit(ctx,uploaded,nil)
+    for _,file:=range uploaded {
+        rel:=strings.TrimPrefix(file.Name,remote+"/")
+        errs[rel]=err
+        if err==nil {fmt.Println("上传完毕：",file.Name)}
+    }
+    return errs
+}
+
+/*
+监视本地文件夹，自动上传新建和修改的文件，直到收到SIGINT或SIGTERM。
+remote_dir为服务器上的文件夹名，为空时使用本地文件夹的名字
+*/
+func watchFolder(user string, local string, remote_dir string)error{
+    if user=="" || user=="Anonymous" {
+        return commandError(EXIT_USAGE,errors.New("请先登录"))
+    }
+    info,err:=os.Stat(local)
+    if err!=nil {return commandError(EXIT_NOT_FOUND,err)}
+    if !info.IsDir() {return commandError(EXIT_USAGE,errors.New("不是文件夹："+local))}
+    local,err=filepath.Abs(local)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    remote:=strings.Trim(remote_dir,"/")
+    if remote=="" {remote=filepath.Base(local)}
+    c,err:=newClient(user)
+    if err!=nil {return err}
+    defer c.Close()
+    watcher,err:=fsnotify.NewWatcher()
+    if err!=nil {return commandError(EXIT_IO,err)}
+    defer watcher.Close()
+    //先开始监视再扫描，扫描期间新建、修改的文件不会漏掉
+    err=watchTree(watcher,local)
+    if err!=nil {return commandError(EXIT_IO,err)}
+    queue:=readWatchQueue(local,user,remote)
+    if len(queue.Files)>0 {fmt.Println("继续上传队列中的",len(queue.Files),"个文件")}
+    err=scanWatchTree(c,local,local,remote,queue)
+    if err!=nil {return err}
+    writeWatchQueue(local,queue)
+    fmt.Println("正在监视文件夹：",local,"上传到：",remote+"/","（Ctrl+C退出）")
+    ctx,stop:=signal.NotifyContext(context.Background(),os.Interrupt,syscall.SIGTERM)
+    defer stop()
+    ticker:=time.NewTicker(WATCH_CHECK_INTERVAL)
+    defer ticker.Stop()
+    results:=make(chan watchResult,1)
+    uploading:=false
+    rescan:=false
+    for {
+        select {
+            case <-ctx.Done():
+                if uploading {
+                    fmt.Println("等待正在上传的文件结束……")
+                    <-results
+                }
+                writeWatchQueue(local,queue)
+                fmt.Println("已停止监视，队列中还有",len(queue.Files),"个文件等待上传")
+                return nil
+            case event,ok:=<-watcher.Events:
+                if !ok {return nil}
+                if skipLocalFile(filepath.Base(event.Name)) || !event.Has(fsnotify.Create|fsnotify.Write) {continue}
+                info,err:=os.Lstat(event.Name)
+                if err!=nil {continue}
+                if info.IsDir() {
+                    //新建的文件夹加入监视，里面已有的文件（比如移动进来的文件夹）也要上传
+                    if watchTree(watcher,event.Name)!=nil {rescan=true}
+                    err=scanWatchTree(c,local,event.Name,remote,queue)
+                    if err!=nil {rescan=true}
+                    continue
+                }
+                if !info.Mode().IsRegular() {continue}
+                rel,err:=filepath.Rel(local,event.Name)
+                if err!=nil {continue}
+                enqueueWatchFile(queue,filepath.ToSlash(rel),info)
+            case err,ok:=<-watcher.Errors:
+                if !ok {return nil}
+                fmt.Println("[WARNING]监视出错：",err)
+                if errors.Is(err,fsnotify.ErrEventOverflow) {rescan=true}//事件太多丢失了，重新扫描整个文件夹
+            case result:=<-results:
+                uploading=false
+                now:=time.Now()
+                for rel,err:=range result.Errors {
+                    item,exist:=queue.Files[rel]
+                    if !exist {continue}
+                    if err==nil {
+                        if item.Changed==result.Changed[rel] {delete(queue.Files,rel)}//上传期间没有再修改
+                        continue
+                    }
+                    if ctx.Err()!=nil {continue}//退出导致的失败不算
+                    item.Attempts++
+                    item.LastError=err.Error()
+                    wait:=watchBackoff(item.Attempts)
+                    item.NextTry=now.Add(wait).UnixNano()
+                    fmt.Println("[ERROR]文件上传失败：",remote+"/"+rel,err,"，",wait,"后重试")
+                }
+                writeWatchQueue(local,queue)
+            case <-ticker.C:
+                if rescan && !uploading {
+                    rescan=false
+                    watchTree(watcher,local)
+                    err=scanWatchTree(c,local,local,remote,queue)
+                    if err!=nil {
+                        rescan=true
+                        fmt.Println("[WARNING]扫描文件夹失败：",err)
+                    }
+                }
+                //检查队列中的文件是否稳定
+                now:=time.Now()
+                ready:=map[string]WatchItem{}
+                for rel,item:=range queue.Files {
+                    info,err:=os.Stat(filepath.Join(local,filepath.FromSlash(rel)))
+                    if err!=nil || !info.Mode().IsRegular() {//已经被删除了
+                        delete(queue.Files,rel)
+                        continue
+                    }
+                    if info.Size()!=item.Size || info.ModTime().UnixNano()!=item.Mtime {
+                        item.Size=info.Size()
+                        item.Mtime=info.ModTime().UnixNano()
+                        item.Changed=now.UnixNano()
+                        continue
+                    }
+                    if now.Sub(time.Unix(0,item.Changed))<WATCH_STABLE_TIME || now.UnixNano()<item.NextTry {continue}
+                    ready[rel]=*item
+                }
+                if uploading || len(ready)==0 {continue}
+                uploading=true
+                writeWatchQueue(local,queue)
+                go func(){
+                    changed:=map[string]int64{}
+                    for rel,item:=range ready {changed[rel]=item.Changed}
+                    results<-watchResult{changed,uploadWatchFiles(ctx,c,local,remote,ready)}
+                }()
+        }
+    }
+}
@@ -0,0 +1,567 @@
+package main
+
+/*
+本文件包含了WebDAV网关相关的函数（gateway -webdav）：Windows资源管理器、macOS Finder、Nautilus等文件管理器可以直接挂载集群
+*/
+
+/*
+目录结构和mount一样：/用户名/文件名，文件名中的“/”表示文件夹，文件夹没有单独的记录，里面有文件就存在；
+MKCOL新建的空文件夹只保存在网关的内存中，放入文件后才会写入数据库。
+认证和HTTP网关相同（HTTP Basic，用户名+令牌作为密码），所有用户都可以读取所有用户的文件，只能修改自己的文件。
+GET：按需下载读到的文件块，支持Range。
+PUT：内容先写入本地临时文件，写完后按put的流程切块上传并写入数据库，没有变化的文件块不会重新上传。
+MOVE：只修改数据库，不重新上传文件块；移动文件夹会修改其中的所有文件。
+LOCK/UNLOCK：锁保存在网关的内存中，Office等需要锁的编辑器可以直接打开编辑，网关重启后锁失效。
+文件列表最多缓存WEBDAV_REFRESH_TIME，PROPFIND一个文件夹时不需要每个文件都获取一次数据库。
+*/
+
+import (
+    "io"
+    "os"
+    "mime"
+    "path"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "log/slog"
+    "syscall"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "dss/client"
+    "golang.org/x/net/webdav"
+)
+
+const WEBDAV_REFRESH_TIME=2*time.Second //文件列表的缓存时间
+
+type davGateway struct {
+    *gateway //认证和客户端
+    locks webdav.LockSystem
+    listings map[string]davListing //用户名 -> 文件列表
+    users []string //用户列表
+    users_time time.Time //上次获取用户列表的时间
+    dirs map[string]bool //MKCOL新建的空文件夹：“用户名”或“用户名/文件夹”
+    lock sync.Mutex
+}
+
+type davListing struct {//缓存的文件列表
+    files []client.FileInfo
+    time time.Time
+}
+
+type davFS struct {//一个请求看到的文件系统，user是认证的用户
+    g *davGateway
+    user string
+}
+
+type davFileInfo struct {//文件或文件夹的信息
+    name string
+    dir bool
+    info client.FileInfo
+}
+
+type davDir struct {//打开的文件夹
+    ctx context.Context
+    fs *davFS
+    info davFileInfo
+    user string
+    prefix string //文件夹的路径加上“/”，用户的根目录为空
+    entries []os.FileInfo //Readdir分批读取时还没有返回的
+    read bool //是否已经读取过文件夹的内容
+}
+
+type davReader struct {//只读打开的文件
+    *client.Reader
+    info davFileInfo
+}
+
+type davWriter struct {//写入打开的文件，内容保存在临时文件中，Close时上传
+    ctx context.Context
+    c *client.Client
+    g *davGateway
+    user string
+    name string
+    file *os.File
+    dirty bool //有没有还没上传的修改
+}
+
+/*
+把请求的路径分成用户名和文件名（文件夹的路径）
+*/
+func splitDavPath(name string)(string,string){
+    name=strings.Trim(path.Clean("/"+name),"/")
+    if i:=strings.Index(name,"/");i>=0 {return name[:i],name[i+1:]}
+    return name,""
+}
+
+func newDavGateway(g *gateway)*davGateway{
+    return &davGateway{
+        gateway:g,
+        locks:webdav.NewMemLS(),
+        listings:map[string]davListing{},
+        dirs:map[string]bool{},
+    }
+}
+
+/*
+只读的请求方法，其它方法只能修改自己的文件
+*/
+func davReadOnly(method string)bool{
+    switch method {
+        case http.MethodGet,http.MethodHead,http.MethodOptions,"PROPFIND":
+            return true
+    }
+    return false
+}
+
+func (g *davGateway) ServeHTTP(w http.ResponseWriter, r *http.Request){
+    r=withHTTPRequestID(w,r)
+    start:=time.Now()
+    user,ok:=g.authenticate(r)
+    if !ok {
+        w.Header().Set("WWW-Authenticate",`Basic realm="dss"`)
+        http.Error(w,"需要认证",http.StatusUnauthorized)
+        httpLogger("webdav",r).Warn("认证失败")
+        return
+    }
+    //COPY只检查目标，MOVE检查来源和目标，其它修改的请求检查请求的路径
+    var targets []string
+    if !davReadOnly(r.Method) && r.Method!="COPY" {targets=append(targets,r.URL.Path)}
+    if r.Method=="COPY" || r.Method=="MOVE" {
+        if u,err:=url.Parse(r.Header.Get("Destination"));err==nil {targets=append(targets,u.Path)}
+    }
+    for _,target:=range targets {
+        if target_user,_:=splitDavPath(target);target_user!=user {
+            http.Error(w,"只能修改自己的文件",http.StatusForbidden)
+            httpLogger("webdav",r).Warn("没有权限","user",user)
+            return
+        }
+    }
+    handler:=&webdav.Handler{
+        FileSystem:&davFS{g,user},
+        LockSystem:g.locks,
+        Logger:func(r *http.Request, err error){
+            logger:=httpLogger("webdav",r).With("user",user,"duration",time.Since(start))
+            if err!=nil {logger.Warn("请求失败","err",err)}else{logger.Info("请求完成")}
+        },
+    }
+    handler.ServeHTTP(w,r)
+}
+
+/*
+用户的文件列表，超过WEBDAV_REFRESH_TIME重新获取数据库，用户还没有数据库时为空
+*/
+func (g *davGateway) files(ctx context.Context, user string)([]client.FileInfo,error){
+    g.lock.Lock()
+    listing,exist:=g.listings[user]
+    g.lock.Unlock()
+    if exist && time.Since(listing.time)<WEBDAV_REFRESH_TIME {return listing.files,nil}
+    c,err:=g.clients.get(user)
+    if err!=nil {return nil,err}
+    files,err:=c.List(ctx)
+    if err!=nil && !errors.Is(err,client.ErrNotFound) {return nil,err}
+    g.lock.Lock()
+    g.listings[user]=davListing{files,time.Now()}
+    g.lock.Unlock()
+    return files,nil
+}
+
+/*
+用户的文件列表已经修改，下次重新获取
+*/
+func (g *davGateway) invalidate(user string){
+    g.lock.Lock()
+    delete(g.listings,user)
+    g.lock.Unlock()
+}
+
+/*
+所有用户，包括MKCOL新建的，超过WEBDAV_REFRESH_TIME重新获取
+*/
+func (g *davGateway) allUsers()[]string{
+    g.lock.Lock()
+    users,stale:=g.users,time.Since(g.users_time)>=WEBDAV_REFRESH_TIME
+    g.lock.Unlock()
+    if stale {
+        fetched,err:=fetchUsers()
+        if err!=nil {fetched=listUsers()}//获取失败时使用本地的数据库
+        users=fetched
+        g.lock.Lock()
+        g.users,g.users_time=users,time.Now()
+        g.lock.Unlock()
+    }
+    users=append([]string{},users...)
+    g.lock.Lock()
+    for dir:=range g.dirs {
+        if !strings.Contains(dir,"/") && !containsString(users,dir) {users=append(users,dir)}
+    }
+    g.lock.Unlock()
+    sort.Strings(users)
+    return users
+}
+
+/*
+查找文件或文件夹，不存在时返回os.ErrNotExist
+*/
+func (fs *davFS) stat(ctx context.Context, name string)(davFileInfo,error){
+    user,p:=splitDavPath(name)
+    if user=="" {return davFileInfo{name:"/",dir:true},nil}
+    if client.ValidUser(user)!=nil {return davFileInfo{},os.ErrNotExist}
+    if p=="" {
+        if containsString(fs.g.allUsers(),user) {return davFileInfo{name:user,dir:true},nil}
+        return davFileInfo{},os.ErrNotExist
+    }
+    files,err:=fs.g.files(ctx,user)
+    if err!=nil {return davFileInfo{},err}
+    is_dir:=false
+    for _,file:=range files {
+        if file.Name==p {return davFileInfo{name:path.Base(p),info:file},nil}
+        if strings.HasPrefix(file.Name,p+"/") {is_dir=true}
+    }
+    fs.g.lock.Lock()
+    if fs.g.dirs[user+"/"+p] {is_dir=true}
+    fs.g.lock.Unlock()
+    if is_dir {return davFileInfo{name:path.Base(p),dir:true},nil}
+    return davFileInfo{},os.ErrNotExist
+}
+
+/*
+只能修改自己的文件
+*/
+func (fs *davFS) writable(user string)error{
+    if user=="" || user!=fs.user {return os.ErrPermission}
+    return nil
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string)(os.FileInfo,error){
+    info,err:=fs.stat(ctx,name)
+    if err!=nil {return nil,err}
+    return info,nil
+}
+
+/*
+在根目录下新建文件夹就是新建用户，上传文件后才会有数据库
+*/
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode)error{
+    user,p:=splitDavPath(name)
+    if err:=fs.writable(user);err!=nil {return err}
+    if _,err:=fs.stat(ctx,name);err==nil {return os.ErrExist}
+    key:=user
+    if p!="" {
+        if client.ValidName(p)!=nil {return os.ErrInvalid}
+        parent,err:=fs.stat(ctx,path.Dir("/"+user+"/"+p))
+        if err!=nil {return err}
+        if !parent.dir {return os.ErrNotExist}
+        key=user+"/"+p
+    }
+    fs.g.lock.Lock()
+    fs.g.dirs[key]=true
+    fs.g.lock.Unlock()
+    return nil
+}
+
+/*
+打开文件：写入时先写到临时文件，Close时上传；读取时按需下载
+*/
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode)(webdav.File,error){
+    user,p:=splitDavPath(name)
+    info,err:=fs.stat(ctx,name)
+    exist:=err==nil
+    if err!=nil && !errors.Is(err,os.ErrNotExist) {return nil,err}
+    if exist && info.dir {
+        if flag&(os.O_CREATE|os.O_TRUNC)!=0 {return nil,&os.PathError{Op:"open",Path:name,Err:syscall.EISDIR}}
+        prefix:=""
+        if p!="" {prefix=p+"/"}
+        return &davDir{ctx:ctx,fs:fs,info:info,user:user,prefix:prefix},nil
+    }
+    if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC)!=0 {
+        if err:=fs.writable(user);err!=nil {return nil,err}
+        if !exist && flag&os.O_CREATE==0 {return nil,os.ErrNotExist}
+        if client.ValidName(p)!=nil {return nil,os.ErrInvalid}
+        return fs.openWriter(ctx,user,p,info,exist && flag&os.O_TRUNC==0)
+    }
+    if !exist {return nil,os.ErrNotExist}
+    c,err:=fs.g.clients.get(user)
+    if err!=nil {return nil,err}
+    return &davReader{c.NewReader(ctx,info.info),info},nil
+}
+
+/*
+打开文件写入：内容放在临时文件中，load为true时先下载原来的内容
+*/
+func (fs *davFS) openWriter(ctx context.Context, user string, name string, info davFileInfo, load bool)(*davWriter,error){
+    c,err:=fs.g.clients.get(user)
+    if err!=nil {return nil,err}
+    f,err:=ioutil.TempFile(*tmp_dir,"webdav-")
+    if err!=nil {return nil,err}
+    w:=&davWriter{ctx:ctx,c:c,g:fs.g,user:user,name:name,file:f,dirty:!load}
+    if load {
+        err=c.Download(ctx,info.info,f)
+        if err!=nil {
+            w.remove()
+            return nil,err
+        }
+    }
+    return w,nil
+}
+
+/*
+删除文件，或者删除文件夹和其中的所有文件（一次Commit完成）
+*/
+func (fs *davFS) RemoveAll(ctx context.Context, name string)error{
+    user,p:=splitDavPath(name)
+    if err:=fs.writable(user);err!=nil {return err}
+    files,err:=fs.g.files(ctx,user)
+    if err!=nil {return err}
+    var removed []string
+    for _,file:=range files {
+        if p=="" || file.Name==p || strings.HasPrefix(file.Name,p+"/") {removed=append(removed,file.Name)}
+    }
+    key:=user
+    if p!="" {key=user+"/"+p}
+    fs.g.lock.Lock()
+    for dir:=range fs.g.dirs {
+        if dir==key || strings.HasPrefix(dir,key+"/") {delete(fs.g.dirs,dir)}
+    }
+    fs.g.lock.Unlock()
+    if len(removed)==0 {return nil}
+    c,err:=fs.g.clients.get(user)
+    if err!=nil {return err}
+    err=c.Commit(ctx,nil,removed)
+    fs.g.invalidate(user)
+    return err
+}
+
+/*
+移动文件或文件夹：只修改数据库，一次Commit完成，不能移动到其它用户
+*/
+func (fs *davFS) Rename(ctx context.Context, old_name string, new_name string)error{
+    user,old_path:=splitDavPath(old_name)
+    new_user,new_path:=splitDavPath(new_name)
+    if err:=fs.writable(user);err!=nil {return err}
+    if new_user!=user || old_path=="" || new_path=="" {return os.ErrPermission}
+    if new_path==old_path || strings.HasPrefix(new_path,old_path+"/") {return os.ErrInvalid}
+    files,err:=fs.g.files(ctx,user)
+    if err!=nil {return err}
+    var renamed []client.FileInfo
+    var removed []string
+    for _,file:=range files {
+        var name string
+        switch {
+            case file.Name==old_path:
+                name=new_path
+            case strings.HasPrefix(file.Name,old_path+"/"):
+                name=new_path+file.Name[len(old_path):]
+            default:
+                continue
+        }
+        if client.ValidName(name)!=nil {return os.ErrInvalid}
+        removed=append(removed,file.Name)
+        file.Name=name
+        renamed=append(renamed,file)
+    }
+    fs.g.lock.Lock()
+    key:=user+"/"+old_path
+    for dir:=range fs.g.dirs {
+        if dir==key || strings.HasPrefix(dir,key+"/") {
+            delete(fs.g.dirs,dir)
+            fs.g.dirs[user+"/"+new_path+dir[len(key):]]=true
+        }
+    }
+    fs.g.lock.Unlock()
+    if len(renamed)==0 {return nil}//空文件夹
+    c,err:=fs.g.clients.get(user)
+    if err!=nil {return err}
+    err=c.Commit(ctx,renamed,removed)
+    fs.g.invalidate(user)
+    return err
+}
+
+func (info davFileInfo) Name()string{
+    return info.name
+}
+
+/*
+旧版本上传的文件没有记录大小，显示为0
+*/
+func (info davFileInfo) Size()int64{
+    if info.dir || info.info.Size<0 {return 0}
+    return info.info.Size
+}
+
+func (info davFileInfo) Mode()os.FileMode{
+    if info.dir {return os.ModeDir|0755}
+    return 0644
+}
+
+func (info davFileInfo) ModTime()time.Time{
+    return info.info.ModTime
+}
+
+func (info davFileInfo) IsDir()bool{
+    return info.dir
+}
+
+func (info davFileInfo) Sys()interface{}{
+    return nil
+}
+
+/*
+按扩展名判断文件类型，不需要像默认的实现一样下载文件内容
+*/
+func (info davFileInfo) ContentType(ctx context.Context)(string,error){
+    if content_type:=mime.TypeByExtension(path.Ext(info.name));content_type!="" {return content_type,nil}
+    return "application/octet-stream",nil
+}
+
+/*
+ETag和S3网关一样按文件块的key计算，内容不变时不会变化
+*/
+func (info davFileInfo) ETag(ctx context.Context)(string,error){
+    if len(info.info.Chunks)==0 {return "",webdav.ErrNotImplemented}
+    return s3ETag(info.info),nil
+}
+
+/*
+文件夹下的文件和子文件夹，count大于0时每次最多返回count个，读完后返回io.EOF
+*/
+func (d *davDir) Readdir(count int)([]os.FileInfo,error){
+    if !d.read {
+        entries,err:=d.list()
+        if err!=nil {return nil,err}
+        d.entries,d.read=entries,true
+    }
+    if count<=0 {
+        entries:=d.entries
+        d.entries=nil
+        return entries,nil
+    }
+    if len(d.entries)==0 {return nil,io.EOF}
+    if count>len(d.entries) {count=len(d.entries)}
+    entries:=d.entries[:count]
+    d.entries=d.entries[count:]
+    return entries,nil
+}
+
+/*
+列出文件夹的内容：根目录下是所有用户
+*/
+func (d *davDir) list()([]os.FileInfo,error){
+    var entries []os.FileInfo
+    if d.user=="" {
+        for _,user:=range d.fs.g.allUsers() {entries=append(entries,davFileInfo{name:user,dir:true})}
+        return entries,nil
+    }
+    files,err:=d.fs.g.files(d.ctx,d.user)
+    if err!=nil {return nil,err}
+    seen:=map[string]bool{}
+    add:=func(name string, info *client.FileInfo){
+        if !strings.HasPrefix(name,d.prefix) || name==d.prefix {return}
+        rest:=name[len(d.prefix):]
+        if i:=strings.Index(rest,"/");i>=0 {
+            rest,info=rest[:i],nil
+        }
+        if seen[rest] {return}
+        seen[rest]=true
+        if info==nil {
+            entries=append(entries,davFileInfo{name:rest,dir:true})
+        }else{
+            entries=append(entries,davFileInfo{name:rest,info:*info})
+        }
+    }
+    for i:=range files {add(files[i].Name,&files[i])}
+    d.fs.g.lock.Lock()
+    for dir:=range d.fs.g.dirs {
+        if strings.HasPrefix(dir,d.user+"/") {add(dir[len(d.user)+1:],nil)}
+    }
+    d.fs.g.lock.Unlock()
+    sort.Slice(entries,func(i,j int)bool{return entries[i].Name()<entries[j].Name()})
+    return entries,nil
+}
+
+func (d *davDir) Stat()(os.FileInfo,error){
+    return d.info,nil
+}
+
+func (d *davDir) Read(p []byte)(int,error){
+    return 0,&os.PathError{Op:"read",Path:d.info.name,Err:syscall.EISDIR}
+}
+
+func (d *davDir) Write(p []byte)(int,error){
+    return 0,&os.PathError{Op:"write",Path:d.info.name,Err:syscall.EISDIR}
+}
+
+func (d *davDir) Seek(offset int64, whence int)(int64,error){
+    return 0,&os.PathError{Op:"seek",Path:d.info.name,Err:syscall.EISDIR}
+}
+
+func (d *davDir) Close()error{
+    return nil
+}
+
+func (r *davReader) Readdir(count int)([]os.FileInfo,error){
+    return nil,&os.PathError{Op:"readdir",Path:r.info.name,Err:syscall.ENOTDIR}
+}
+
+func (r *davReader) Stat()(os.FileInfo,error){
+    return r.info,nil
+}
+
+func (r *davReader) Write(p []byte)(int,error){
+    return 0,os.ErrPermission
+}
+
+func (r *davReader) Close()error{
+    return nil
+}
+
+func (w *davWriter) Read(p []byte)(int,error){
+    return w.file.Read(p)
+}
+
+func (w *davWriter) Seek(offset int64, whence int)(int64,error){
+    return w.file.Seek(offset,whence)
+}
+
+func (w *davWriter) Write(p []byte)(int,error){
+    w.dirty=true
+    return w.file.Write(p)
+}
+
+func (w *davWriter) Readdir(count int)([]os.FileInfo,error){
+    return nil,&os.PathError{Op:"readdir",Path:w.name,Err:syscall.ENOTDIR}
+}
+
+/*
+正在写入的文件：大小和修改时间取临时文件的，还没有文件块
+*/
+func (w *davWriter) Stat()(os.FileInfo,error){
+    stat,err:=w.file.Stat()
+    if err!=nil {return nil,err}
+    return davFileInfo{name:path.Base(w.name),info:client.FileInfo{User:w.user,Name:w.name,Size:stat.Size(),ModTime:stat.ModTime()}},nil
+}
+
+/*
+Close时上传：和put一样切块上传并写入数据库，然后删除临时文件
+*/
+func (w *davWriter) Close()error{
+    defer w.remove()
+    if !w.dirty {return nil}
+    _,err:=w.file.Seek(0,io.SeekStart)
+    if err!=nil {return err}
+    slog.Info("WebDAV上传文件","user",w.user,"name",w.name,"request_id",client.RequestID(w.ctx))
+    err=w.c.PutWithModTime(w.ctx,w.name,w.file,time.Now())
+    w.g.invalidate(w.user)
+    return err
+}
+
+/*
+删除临时文件
+*/
+func (w *davWriter) remove(){
+    w.file.Close()
+    os.Remove(w.file.Name())
+}
@@ -0,0 +1,390 @@
+// dss网页界面：通过HTTP网关的接口浏览、上传、下载、分享文件和查看服务器状态
+// 认证使用浏览器的HTTP Basic登录框，登录后浏览器会自动在请求中带上用户名和令牌
+"use strict";
+
+const state = {
+    me: "", // 当前登录的用户
+    replicas: 2, // 每个文件块的副本数量
+    user: "", // 正在浏览的用户
+    dir: "", // 正在浏览的文件夹，以“/”结尾，根目录为空
+    files: [], // 正在浏览的用户的所有文件
+};
+
+const $ = (selector) => document.querySelector(selector);
+
+// 文件名中每一段分别URL编码，“/”保留
+function encodePath(path) {
+    return path.split("/").map(encodeURIComponent).join("/");
+}
+
+function fileURL(user, name) {
+    return "/api/files/" + encodeURIComponent(user) + "/" + encodePath(name);
+}
+
+async function api(path, options) {
+    const resp = await fetch(path, options);
+    if (!resp.ok) {
+        let message = resp.status + " " + resp.statusText;
+        try {
+            message = (await resp.json()).error || message;
+        } catch (e) {}
+        const err = new Error(message);
+        err.status = resp.status;
+        throw err;
+    }
+    return resp.status === 204 ? null : resp.json();
+}
+
+function showError(err) {
+    const el = $("#error");
+    el.textContent = err ? "错误：" + err.message : "";
+    el.hidden = !err;
+}
+
+function formatSize(size) {
+    if (size < 0) return "未知";
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let i = 0;
+    while (size >= 1024 && i < units.length - 1) {
+        size /= 1024;
+        i++;
+    }
+    return (i === 0 ? size : size.toFixed(1)) + " " + units[i];
+}
+
+function formatTime(mtime) {
+    return mtime ? new Date(mtime * 1000).toLocaleString() : "";
+}
+
+function element(tag, props, ...children) {
+    const el = document.createElement(tag);
+    Object.assign(el, props);
+    for (const child of children) el.append(child);
+    return el;
+}
+
+function link(text, onclick, className) {
+    return element("a", {textContent: text, className: className || "", onclick: (e) => {
+        e.preventDefault();
+        onclick();
+    }});
+}
+
+// 用户列表
+async function loadUsers() {
+    const users = await api("/api/users");
+    if (!users.includes(state.me)) users.push(state.me); // 还没有上传过文件的用户也能上传
+    users.sort();
+    const list = $("#users");
+    list.replaceChildren();
+    for (const user of users) {
+        list.append(element("li", {
+            textContent: user,
+            className: user === state.user ? "active" : "",
+            onclick: () => openUser(user),
+        }));
+    }
+}
+
+async function openUser(user) {
+    state.user = user;
+    state.dir = "";
+    for (const li of $("#users").children) li.className = li.textContent === user ? "active" : "";
+    await loadFiles();
+}
+
+async function loadFiles() {
+    try {
+        state.files = await api("/api/files/" + encodeURIComponent(state.user) + "/");
+        showError(null);
+    } catch (err) {
+        state.files = [];
+        if (err.status !== 404) showError(err); // 404是还没有数据库的用户
+    }
+    renderFiles();
+}
+
+// 当前文件夹下的子文件夹和文件
+function currentEntries() {
+    const dirs = new Set();
+    const files = [];
+    for (const file of state.files) {
+        if (!file.name.startsWith(state.dir)) continue;
+        const rest = file.name.slice(state.dir.length);
+        const i = rest.indexOf("/");
+        if (i >= 0) dirs.add(rest.slice(0, i));
+        else files.push(file);
+    }
+    return {dirs: [...dirs].sort(), files: files.sort((a, b) => a.name.localeCompare(b.name))};
+}
+
+function renderBreadcrumb() {
+    const crumb = $("#breadcrumb");
+    crumb.replaceChildren(link(state.user, () => openDir("")));
+    let path = "";
+    for (const part of state.dir.split("/").filter(Boolean)) {
+        path += part + "/";
+        const target = path;
+        crumb.append(" / ", link(part, () => openDir(target)));
+    }
+}
+
+function openDir(dir) {
+    state.dir = dir;
+    renderFiles();
+}
+
+function renderFiles() {
+    renderBreadcrumb();
+    const writable = state.user === state.me;
+    $("#upload-button").hidden = !writable;
+    $("#drop-hint").hidden = !writable;
+    const tbody = $("#files tbody");
+    tbody.replaceChildren();
+    const {dirs, files} = currentEntries();
+    for (const dir of dirs) {
+        tbody.append(element("tr", {},
+            element("td", {className: "name"}, "📁 ", link(dir, () => openDir(state.dir + dir + "/"))),
+            element("td"), element("td"), element("td"), element("td")));
+    }
+    for (const file of files) {
+        const row = element("tr", {},
+            element("td", {className: "name"}, file.name.slice(state.dir.length)),
+            element("td", {textContent: formatSize(file.size)}),
+            element("td", {textContent: formatTime(file.mtime)}),
+            element("td", {textContent: file.chunks}),
+            element("td", {className: "actions"}));
+        const actions = row.lastChild;
+        actions.append(element("a", {textContent: "下载", href: fileURL(file.user, file.name), download: file.name.split("/").pop()}));
+        actions.append(link("文件块", () => toggleChunks(row, file)));
+        if (writable) actions.append(link("分享", () => createShare(file)));
+        if (writable) actions.append(link("删除", () => deleteFile(file), "danger"));
+        tbody.append(row);
+    }
+    $("#empty").hidden = dirs.length + files.length > 0;
+}
+
+// 展开文件块：每个文件块所在的服务器和副本是否健康
+async function toggleChunks(row, file) {
+    if (row.nextSibling && row.nextSibling.className === "chunks") {
+        row.nextSibling.remove();
+        return;
+    }
+    const cell = element("td", {colSpan: 5, textContent: "加载中……"});
+    row.after(element("tr", {className: "chunks"}, cell));
+    try {
+        const chunks = await api("/api/chunks/" + encodeURIComponent(file.user) + "/" + encodePath(file.name));
+        const table = element("table");
+        table.append(element("tr", {},
+            element("th", {textContent: "序号"}), element("th", {textContent: "key"}), element("th", {textContent: "所在的服务器"})));
+        for (const chunk of chunks) {
+            let health = "ok";
+            let title = "副本完整";
+            if (chunk.alive === 0) {
+                health = "lost";
+                title = "没有存活的副本";
+            } else if (chunk.alive < state.replicas) {
+                health = "degraded";
+                title = "存活的副本不足" + state.replicas + "个";
+            }
+            table.append(element("tr", {},
+                element("td", {}, element("span", {className: "health " + health, title: title}), String(chunk.num)),
+                element("td", {className: "key", textContent: chunk.key}),
+                element("td", {textContent: chunk.servers.join(", ") + "（存活" + chunk.alive + "个）"})));
+        }
+        cell.replaceChildren(chunks.length ? table : "没有文件块");
+    } catch (err) {
+        cell.textContent = "错误：" + err.message;
+    }
+}
+
+async function deleteFile(file) {
+    if (!confirm("删除 " + file.name + "？")) return;
+    try {
+        await api(fileURL(file.user, file.name), {method: "DELETE"});
+        await loadFiles();
+    } catch (err) {
+        showError(err);
+    }
+}
+
+// 分享链接的完整地址
+function shareURL(share) {
+    return location.origin + share.path;
+}
+
+async function createShare(file) {
+    const hours = prompt("分享 " + file.name + "\n有效期（小时，0表示不过期）：", "72");
+    if (hours === null) return;
+    const max = prompt("最多下载次数（0表示不限）：", "0");
+    if (max === null) return;
+    const password = prompt("密码（为空表示不需要密码）：", "");
+    if (password === null) return;
+    try {
+        const share = await api("/api/shares", {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({name: file.name, password: password, expire: Math.round(Number(hours) * 3600), max_downloads: Number(max)}),
+        });
+        prompt("分享成功，复制下面的链接发给别人：", shareURL(share));
+    } catch (err) {
+        showError(err);
+    }
+}
+
+// 当前用户的分享列表
+async function loadShares() {
+    try {
+        const shares = await api("/api/shares");
+        const tbody = $("#shares tbody");
+        tbody.replaceChildren();
+        const now = Date.now() / 1000;
+        for (const share of shares) {
+            const expired = (share.expire && share.expire < now) || (share.max_downloads > 0 && share.downloads >= share.max_downloads);
+            tbody.append(element("tr", {className: expired ? "expired" : ""},
+                element("td", {className: "name", textContent: share.name}),
+                element("td", {}, element("a", {href: shareURL(share), textContent: share.token.slice(0, 8) + "…", target: "_blank"})),
+                element("td", {textContent: share.password ? "有" : "无"}),
+                element("td", {textContent: share.expire ? formatTime(share.expire) : "不过期"}),
+                element("td", {textContent: share.downloads + " / " + (share.max_downloads || "不限")}),
+                element("td", {className: "actions"}, link("取消分享", () => revokeShare(share), "danger"))));
+        }
+        $("#shares-empty").hidden = shares.length > 0;
+        showError(null);
+    } catch (err) {
+        showError(err);
+    }
+}
+
+async function revokeShare(share) {
+    if (!confirm("取消 " + share.name + " 的分享？链接将无法下载。")) return;
+    try {
+        await api("/api/shares/" + encodeURIComponent(share.token), {method: "DELETE"});
+        await loadShares();
+    } catch (err) {
+        showError(err);
+    }
+}
+
+// 上传文件到当前文件夹，显示每个文件的上传进度（浏览器到网关），网关切块上传完后才会返回
+function uploadFile(file) {
+    const user = state.user;
+    const name = state.dir + file.name;
+    const progress = element("progress", {max: 1, value: 0});
+    const status = element("span", {textContent: "0%"});
+    const item = element("li", {}, element("span", {textContent: name}), progress, status);
+    $("#uploads").append(item);
+    return new Promise((resolve) => {
+        const xhr = new XMLHttpRequest();
+        xhr.open("PUT", fileURL(user, name));
+        xhr.setRequestHeader("Last-Modified", new Date(file.lastModified).toUTCString());
+        xhr.upload.onprogress = (e) => {
+            if (!e.lengthComputable) return;
+            progress.value = e.loaded / e.total;
+            status.textContent = e.loaded < e.total ? Math.floor(e.loaded / e.total * 100) + "%" : "正在写入集群……";
+        };
+        xhr.onload = () => {
+            if (xhr.status === 201) {
+                item.remove();
+            } else {
+                let message = xhr.status + " " + xhr.statusText;
+                try {
+                    message = JSON.parse(xhr.responseText).error || message;
+                } catch (e) {}
+                status.textContent = "失败：" + message;
+                status.className = "failed";
+            }
+            resolve();
+        };
+        xhr.onerror = () => {
+            status.textContent = "失败：网络错误";
+            status.className = "failed";
+            resolve();
+        };
+        xhr.send(file);
+    });
+}
+
+async function uploadFiles(files) {
+    if (state.user !== state.me) return;
+    await Promise.all([...files].map(uploadFile));
+    await loadFiles();
+    await loadUsers();
+}
+
+function setupUpload() {
+    $("#upload-input").onchange = (e) => {
+        uploadFiles(e.target.files);
+        e.target.value = "";
+    };
+    const zone = $("#dropzone");
+    zone.ondragover = (e) => {
+        if (state.user !== state.me) return;
+        e.preventDefault();
+        zone.classList.add("dragover");
+    };
+    zone.ondragleave = () => zone.classList.remove("dragover");
+    zone.ondrop = (e) => {
+        e.preventDefault();
+        zone.classList.remove("dragover");
+        uploadFiles(e.dataTransfer.files);
+    };
+}
+
+// 服务器状态，显示时每5秒刷新一次
+let servers_timer = null;
+
+async function loadServers() {
+    try {
+        const servers = await api("/api/status");
+        const tbody = $("#servers tbody");
+        tbody.replaceChildren();
+        for (const server of servers) {
+            tbody.append(element("tr", {},
+                element("td", {textContent: server.addr}),
+                element("td", {textContent: server.online ? "在线" : "无法连接", className: server.online ? "online" : "offline"}),
+                element("td", {textContent: server.state + (server.draining ? "（正在下线）" : "")}),
+                element("td", {textContent: server.zone || ""}),
+                element("td", {textContent: server.capacity}),
+                element("td", {textContent: server.incarnation}),
+                element("td", {textContent: (server.addrs || []).join(", ")})));
+        }
+        $("#servers-updated").textContent = "更新时间：" + new Date().toLocaleTimeString();
+        showError(null);
+    } catch (err) {
+        showError(err);
+    }
+}
+
+function route() {
+    const view = ["#shares", "#servers"].includes(location.hash) ? location.hash.slice(1) : "files";
+    for (const name of ["files", "shares", "servers"]) {
+        $("#" + name + "-view").hidden = name !== view;
+        $("#tab-" + name).className = name === view ? "active" : "";
+    }
+    clearInterval(servers_timer);
+    if (view === "shares") loadShares();
+    if (view === "servers") {
+        loadServers();
+        servers_timer = setInterval(loadServers, 5000);
+    }
+}
+
+async function main() {
+    try {
+        const me = await api("/api/me");
+        state.me = me.user;
+        state.replicas = me.replicas;
+        $("#me").textContent = "当前用户：" + me.user;
+        setupUpload();
+        window.onhashchange = route;
+        route();
+        state.user = me.user;
+        await loadUsers();
+        await loadFiles();
+    } catch (err) {
+        showError(err);
+    }
+}
+
+main();
@@ -0,0 +1,105 @@
+package main
+
+/*
+本文件包含了网页界面相关的函数：HTTP网关的根路径是内置的单页网页界面，
+可以浏览用户和文件、查看文件块所在的服务器和副本是否健康、拖放上传（显示进度）、下载、分享，以及查看服务器状态
+*/
+
+/*
+网页文件在webui文件夹中，编译时用embed打包进程序，部署时仍然只需要一个dss文件。
+网页界面使用和HTTP网关相同的认证（浏览器弹出登录框，用户名+令牌），除了下面的接口，文件操作使用HTTP网关的/api/files/：
+    GET /api/me                      当前登录的用户和每个文件块的副本数量
+    GET /api/status                  服务器状态（和status -json的server记录相同）
+    GET /api/chunks/用户名/文件名     文件的文件块、所在的服务器和其中存活的数量
+*/
+
+import (
+    "embed"
+    "io/fs"
+    "errors"
+    "strings"
+    "net/http"
+    "dss/client"
+)
+
+//go:embed webui
+var webui_files embed.FS
+
+type chunkStatus struct {//文件块和副本的状态
+    Num int `json:"num"`
+    Key string `json:"key"`
+    Servers []string `json:"servers"`
+    Alive int `json:"alive"` //所在的服务器中状态为存活的数量
+}
+
+/*
+网页界面的静态文件
+*/
+func (g *gateway) serveUI(w http.ResponseWriter, r *http.Request){
+    if r.Method!=http.MethodGet && r.Method!=http.MethodHead {
+        writeHTTPError(w,http.StatusMethodNotAllowed,errors.New("只支持GET"))
+        return
+    }
+    root,err:=fs.Sub(webui_files,"webui")
+    checkErr(err)
+    http.FileServer(http.FS(root)).ServeHTTP(w,r)
+}
+
+/*
+当前登录的用户
+*/
+func (g *gateway) serveMe(w http.ResponseWriter, r *http.Request, user string){
+    writeJSON(w,http.StatusOK,map[string]interface{}{"user":user,"replicas":REPLICA_NUM})
+}
+
+/*
+服务器状态
+*/
+func (g *gateway) serveStatus(w http.ResponseWriter, r *http.Request){
+    records,err:=serverStatus()
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    writeJSON(w,http.StatusOK,records)
+}
+
+/*
+文件的文件块和副本状态：按成员表判断文件块所在的服务器是否存活
+*/
+func (g *gateway) serveChunks(w http.ResponseWriter, r *http.Request){
+    path:=strings.TrimPrefix(r.URL.Path,"/api/chunks/")
+    i:=strings.Index(path,"/")
+    if i<0 {
+        writeHTTPError(w,http.StatusBadRequest,errors.New("需要用户名和文件名"))
+        return
+    }
+    user,name:=path[:i],path[i+1:]
+    if err:=client.ValidUser(user);err!=nil {
+        writeHTTPError(w,http.StatusBadRequest,err)
+        return
+    }
+    c,err:=g.clients.get(user)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    info,err:=c.Stat(r.Context(),name)
+    if err!=nil {
+        writeHTTPError(w,0,err)
+        return
+    }
+    alive:=map[string]bool{}
+    for _,member:=range memberList() {
+        if member.State==MEMBER_ALIVE {alive[member.Addr]=true}
+    }
+    chunks:=[]chunkStatus{}
+    for i,chunk:=range info.Chunks {
+        status:=chunkStatus{Num:i,Key:chunk.Key,Servers:chunk.Servers}
+        for _,server:=range chunk.Servers {
+            if alive[server] {status.Alive++}
+        }
+        chunks=append(chunks,status)
+    }
+    writeJSON(w,http.StatusOK,chunks)
+}